@@ -0,0 +1,233 @@
+// Package account serves the registration, the login and the logout.
+package account
+
+import (
+	"net/http"
+	"server/apierror"
+	"server/app"
+	"server/metrics"
+	"server/model"
+	"server/openapi"
+	"server/utils"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// How long the emailed code and the register_token cookie proving it was entered stay valid
+const otpTTL = 15 * time.Minute
+
+type handler struct {
+	*app.App
+}
+
+type emailRequest struct {
+	Email string `json:"email" form:"email" binding:"required,email"`
+}
+
+type otpRequest struct {
+	Email string `json:"email" form:"email" binding:"required,email"`
+	OTP   string `json:"otp" form:"otp" binding:"required" doc:"Code emailed by POST /v1/auth/otp"`
+}
+
+type registerRequest struct {
+	Username string `json:"username" form:"username" binding:"required"`
+	Email    string `json:"email" form:"email" binding:"required,email" doc:"Email verified by POST /v1/auth/otp/verify"`
+	Password string `json:"password" form:"password" binding:"required"`
+}
+
+type loginRequest struct {
+	Email    string `json:"email" form:"email" binding:"required"`
+	Password string `json:"password" form:"password" binding:"required"`
+}
+
+type pingResponse struct {
+	Message string `json:"message" doc:"pong, invalid token or no token"`
+}
+
+type loginResponse struct {
+	Message   string `json:"message"`
+	UserID    string `json:"userId"`
+	UserEmail string `json:"userEmail"`
+	UserName  string `json:"userName"`
+}
+
+// Register serves the routes under /v1/auth on v1 and the older routes on r.
+func Register(r gin.IRouter, v1 *openapi.Router, a *app.App) {
+	h := handler{a}
+	authLimit := a.Limit(a.AuthRule())
+	v1 = v1.Tag("auth")
+	v1.GET("/ping", openapi.Operation{
+		Summary:  "Tell whether the jwt_token cookie is valid",
+		Response: pingResponse{},
+	}, h.ping)
+	v1.POST("/auth/otp", openapi.Operation{
+		Summary:  "Email a code proving the email belongs to the user, the first step of the registration",
+		Body:     emailRequest{},
+		Response: openapi.Fields{},
+		Errors:   []*apierror.Error{apierror.EmailTaken, apierror.RateLimited, apierror.UpstreamFailed},
+	}, authLimit, h.registerEmail)
+	v1.POST("/auth/otp/verify", openapi.Operation{
+		Summary:     "Check the emailed code",
+		Description: "Sets the register_token cookie POST /v1/auth/register needs.",
+		Body:        otpRequest{},
+		Response:    openapi.Fields{},
+		Errors:      []*apierror.Error{apierror.OTPIncorrect, apierror.OTPExpired, apierror.AlreadyLoggedIn, apierror.RateLimited},
+	}, authLimit, a.RequireGuest, h.verifyOTP)
+	v1.POST("/auth/register", openapi.Operation{
+		Summary:     "Create the account of a verified email and log in",
+		Description: "Needs the register_token cookie of POST /v1/auth/otp/verify, sets the jwt_token cookie.",
+		Body:        registerRequest{},
+		Response:    openapi.Fields{},
+		Errors:      []*apierror.Error{apierror.EmailNotVerified, apierror.AlreadyLoggedIn},
+	}, a.RequireGuest, h.register)
+	v1.POST("/auth/login", openapi.Operation{
+		Summary:     "Log in",
+		Description: "Sets the jwt_token cookie the other routes need.",
+		Body:        loginRequest{},
+		Response:    loginResponse{},
+		Errors:      []*apierror.Error{apierror.InvalidCredentials, apierror.AlreadyLoggedIn, apierror.RateLimited},
+	}, authLimit, a.RequireGuest, h.login)
+	v1.POST("/auth/logout", openapi.Operation{
+		Summary:  "Log out, the jwt_token cookie is deleted",
+		Response: openapi.Fields{},
+	}, h.logout)
+
+	r.GET("/ping", app.Deprecated("/v1/ping"), h.ping)
+	r.POST("/registerEmail", app.Deprecated("/v1/auth/otp"), authLimit, h.registerEmail)
+	r.POST("/verify_register_OTP", app.Deprecated("/v1/auth/otp/verify"), authLimit, a.RequireGuest, h.verifyOTP)
+	r.POST("/register", app.Deprecated("/v1/auth/register"), a.RequireGuest, h.register)
+	r.POST("/login", app.Deprecated("/v1/auth/login"), authLimit, a.RequireGuest, h.login)
+	r.GET("/logout", app.Deprecated("/v1/auth/logout"), h.logout)
+}
+
+// setCookie sets an http-only cookie readable by the frontend served from another site, a negative maxAge deletes it.
+func setCookie(c *gin.Context, name, value string, maxAge time.Duration) {
+	cookie := &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Expires:  time.Now().Add(maxAge),
+		Path:     "/",
+		Domain:   "",
+		MaxAge:   int(maxAge.Seconds()),
+		Secure:   true,
+		HttpOnly: true,
+		SameSite: http.SameSiteNoneMode,
+	}
+	if maxAge < 0 {
+		cookie.MaxAge = -1
+	}
+	http.SetCookie(c.Writer, cookie)
+}
+
+func (h handler) ping(c *gin.Context) {
+	if token, err := c.Request.Cookie("jwt_token"); err != nil {
+		c.JSON(http.StatusOK, gin.H{"message": "no token"})
+		return
+	} else {
+		if _, er := h.Tokens.VerifyJWT(token.Value); er != nil {
+			c.JSON(http.StatusOK, gin.H{"message": "invalid token"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"message": "pong"})
+	}
+}
+
+// registerEmail emails a code to the address, which the user then enters on verifyOTP.
+func (h handler) registerEmail(c *gin.Context) {
+	var request emailRequest
+	if !app.Bind(c, &request) {
+		return
+	}
+	taken, err := h.Users.EmailTaken(request.Email)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+	if taken {
+		c.Error(apierror.EmailTaken)
+		return
+	}
+	otp := utils.GenerateOTP()
+	if err := h.Mailer.SendOTP(request.Email, otp); err != nil {
+		c.Error(apierror.UpstreamFailed.Because(err))
+		return
+	}
+	metrics.OTPEmailsSent.Inc()
+	if err := h.Sessions.SaveOTP(request.Email, otp, otpTTL); err != nil {
+		c.Error(err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "success"})
+}
+
+func (h handler) verifyOTP(c *gin.Context) {
+	var request otpRequest
+	if !app.Bind(c, &request) {
+		return
+	}
+	if err := h.Sessions.VerifyOTP(request.Email, request.OTP); err != nil {
+		c.Error(err)
+		return
+	}
+	token, err := h.Sessions.IssueRegisterToken(request.Email)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+	setCookie(c, "register_token", token, otpTTL)
+	c.JSON(http.StatusOK, gin.H{"message": "success"})
+}
+
+func (h handler) register(c *gin.Context) {
+	var request registerRequest
+	if !app.Bind(c, &request) {
+		return
+	}
+	if cookie, err := c.Request.Cookie("register_token"); err != nil {
+		c.Error(apierror.EmailNotVerified)
+		return
+	} else {
+		if !h.Sessions.ConsumeRegisterToken(request.Email, cookie.Value) {
+			c.Error(apierror.EmailNotVerified)
+			return
+		}
+	}
+	setCookie(c, "register_token", "", -time.Hour)
+	user := model.User{Username: request.Username, Email: request.Email, Password: request.Password}
+	if err := h.Users.CreateUser(&user); err != nil {
+		c.Error(err)
+		return
+	}
+	if token, er := h.Tokens.GenerateJWT(user.ID.Hex()); er != nil {
+		c.Error(er)
+		return
+	} else {
+		setCookie(c, "jwt_token", token, h.Config.Auth.TokenTTL)
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "success"})
+}
+
+func (h handler) login(c *gin.Context) {
+	var request loginRequest
+	if !app.Bind(c, &request) {
+		return
+	}
+	if userId, userName, err := h.Users.Login(request.Email, request.Password); err != nil {
+		c.Error(err)
+		return
+	} else {
+		if token, er := h.Tokens.GenerateJWT(userId); er != nil {
+			c.Error(er)
+			return
+		} else {
+			setCookie(c, "jwt_token", token, h.Config.Auth.TokenTTL)
+		}
+		c.JSON(http.StatusOK, loginResponse{Message: "success", UserID: userId, UserEmail: request.Email, UserName: userName})
+	}
+}
+
+func (h handler) logout(c *gin.Context) {
+	setCookie(c, "jwt_token", "", -time.Second)
+	c.JSON(http.StatusOK, gin.H{"message": "success"})
+}
@@ -0,0 +1,421 @@
+// Package conversation serves the conversations of a user, asking the model in them and the websocket streaming the answers.
+package conversation
+
+import (
+	"net/http"
+	"server/apierror"
+	"server/app"
+	"server/model"
+	"server/openapi"
+	ws "server/websocket"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+type handler struct {
+	*app.App
+}
+
+type listQuery struct {
+	Mode string `form:"mode" binding:"omitempty,oneof=1 2"`
+	// Dates are RFC 3339 timestamps or plain days, a plain to day includes the whole day
+	From     string   `form:"from" doc:"RFC 3339 timestamp or day such as 2024-03-08"`
+	To       string   `form:"to" doc:"RFC 3339 timestamp or day, a day includes the whole day"`
+	Folder   string   `form:"folder" doc:"Folder id, or none for the conversations in no folder"`
+	Tags     []string `form:"tag" doc:"Repeat to require several tags"`
+	Pinned   *bool    `form:"pinned"`
+	Archived *bool    `form:"archived"`
+	Cursor   string   `form:"cursor" doc:"next_cursor of the previous page"`
+	Limit    int      `form:"limit" binding:"omitempty,min=1"`
+}
+
+type askNewRequest struct {
+	Message string `json:"message" form:"message" binding:"required"`
+	Mode    string `json:"mode" form:"mode" binding:"omitempty,oneof=1 2" doc:"1 by default"`
+	Cid     string `json:"cid" form:"cid" doc:"Id of the question on the client, saved with the message"`
+}
+
+// legacyAskNewRequest is askNewRequest as the clients written before /v1 send it, they may send any mode
+type legacyAskNewRequest struct {
+	Message string `json:"message" form:"message" binding:"required"`
+	Mode    string `json:"mode" form:"mode"`
+	Cid     string `json:"cid" form:"cid"`
+}
+
+type askRequest struct {
+	Message string `json:"message" form:"message" binding:"required"`
+	Cid     string `json:"cid" form:"cid" doc:"Id of the question on the client, saved with the message"`
+}
+
+type updateRequest struct {
+	Title    *string `json:"title" form:"title"`
+	Mode     *string `json:"mode" form:"mode" binding:"omitempty,oneof=1 2"`
+	Pinned   *bool   `json:"pinned" form:"pinned"`
+	Archived *bool   `json:"archived" form:"archived"`
+}
+
+// Register serves the conversations and their messages under /v1/conversations on v1 and the older routes on r.
+func Register(r gin.IRouter, v1 *openapi.Router, a *app.App) {
+	h := handler{a}
+	askLimit := a.Limit(a.AskRule())
+	asks := []*apierror.Error{apierror.ServerRestarting, apierror.RateLimited}
+
+	v1 = v1.Tag("conversations")
+	v1.GET("/conversations/:id/ws", openapi.Operation{
+		Summary: "Stream the answers of the conversation over a websocket",
+		Description: "Needs the jwt_token cookie. Every token of an answer is sent as a text message, then the topic line " +
+			"on the first answer of a conversation, then \"end of response\". An answer whose generation failed and is tried " +
+			"again is preceded by \"restart of response\": the previous answer, apology included, is to be dropped.",
+		Status: http.StatusSwitchingProtocols,
+		Errors: []*apierror.Error{apierror.Unauthenticated, apierror.TokenExpired, apierror.InvalidToken, apierror.ConversationNotFound},
+	}, h.websocket)
+	user := v1.User(a.RequireUser)
+	user.GET("/conversations", openapi.Operation{
+		Summary:  "List the conversations, newest first",
+		Query:    listQuery{},
+		Response: openapi.Fields{"conversations": []model.ConversationSummary{}, "next_cursor": "", "total": int64(0)},
+	}, h.list)
+	user.POST("/conversations", openapi.Operation{
+		Summary:     "Start a conversation with a question",
+		Description: "Returns before the answer is generated, it is streamed on the websocket of the conversation.",
+		Body:        askNewRequest{},
+		Response:    openapi.Fields{"id": ""},
+		Errors:      asks,
+	}, a.AcceptAsks, askLimit, h.askNew)
+	user.GET("/conversations/trash", openapi.Operation{
+		Summary:  "List the deleted conversations",
+		Response: openapi.Fields{"conversations": []model.ConversationSummary{}},
+	}, h.trash)
+	user.GET("/conversations/:id", openapi.Operation{
+		Summary:  "Get a conversation with the messages of its active branch",
+		Response: openapi.Fields{"conversation": model.Conversation{}},
+		Errors:   []*apierror.Error{apierror.ConversationNotFound},
+	}, h.get)
+	user.PATCH("/conversations/:id", openapi.Operation{
+		Summary:  "Change the title, the mode, the pin or the archiving of a conversation",
+		Body:     updateRequest{},
+		Response: openapi.Fields{"conversation": model.Conversation{}},
+		Errors:   []*apierror.Error{apierror.ConversationNotFound},
+	}, h.update)
+	user.DELETE("/conversations/:id", openapi.Operation{
+		Summary:  "Move a conversation to the trash",
+		Response: openapi.Fields{},
+		Errors:   []*apierror.Error{apierror.ConversationNotFound},
+	}, h.delete)
+	user.POST("/conversations/:id/restore", openapi.Operation{
+		Summary:  "Restore a conversation from the trash",
+		Response: openapi.Fields{},
+		Errors:   []*apierror.Error{apierror.NotInTrash},
+	}, h.restore)
+	user.POST("/conversations/:id/regenerate", openapi.Operation{
+		Summary:  "Answer the last question again, the new answer is another version of the previous one",
+		Response: openapi.Fields{},
+		Errors:   append([]*apierror.Error{apierror.ConversationNotFound, apierror.AnswerInProgress}, asks...),
+	}, a.AcceptAsks, askLimit, h.regenerate)
+	registerMessages(user, h, askLimit, asks)
+
+	r.GET("/ws/:id", app.Deprecated("/v1/conversations/:id/ws"), h.websocket)
+	r.GET("/test/:userid", h.testOwner)
+	r.GET("/test/conversations", testConversations)
+
+	old := r.Group("", a.RequireUser)
+	old.GET("/conversations/:id", app.Deprecated("/v1/conversations"), h.listPage)
+	old.GET("/conversations", app.Deprecated("/v1/conversations"), h.listAll)
+	old.GET("/conversations/trash", app.Deprecated("/v1/conversations/trash"), h.trash)
+	old.GET("/conversation/:id", app.Deprecated("/v1/conversations/:id"), h.get)
+	old.PATCH("/conversation/:id", app.Deprecated("/v1/conversations/:id"), h.update)
+	old.DELETE("/conversation/:id", app.Deprecated("/v1/conversations/:id"), h.delete)
+	old.POST("/conversation/:id/restore", app.Deprecated("/v1/conversations/:id/restore"), h.restore)
+	r.POST("/conversation/new", app.Deprecated("/v1/conversations"), a.AcceptAsks, askLimit, a.RequireUser, h.legacyAskNew)
+	r.POST("/conversation/:id", app.Deprecated("/v1/conversations/:id/messages"), a.AcceptAsks, askLimit, a.RequireUser, h.ask)
+	r.POST("/conversation/:id/regenerate", app.Deprecated("/v1/conversations/:id/regenerate"), a.AcceptAsks, askLimit, a.RequireUser, h.regenerate)
+
+	old.GET("/conversation/:id/messages", app.Deprecated("/v1/conversations/:id/messages"), h.messages)
+	old.GET("/conversation/:id/messages/:messageId", app.Deprecated("/v1/conversations/:id/messages/:messageId"), h.message)
+	old.DELETE("/conversation/:id/messages/:messageId", app.Deprecated("/v1/conversations/:id/messages/:messageId"), h.deleteMessage)
+	old.POST("/conversation/:id/messages/:messageId/pin", app.Deprecated("/v1/conversations/:id/messages/:messageId/pin"), h.pinMessage)
+	old.POST("/conversation/:id/messages/:messageId/copy", app.Deprecated("/v1/conversations/:id/messages/:messageId/copy"), h.copyMessage)
+	r.POST("/conversation/:id/messages/:messageId/edit", app.Deprecated("/v1/conversations/:id/messages/:messageId/edit"), a.AcceptAsks, askLimit, a.RequireUser, h.editMessage)
+	old.GET("/conversation/:id/messages/:messageId/branches", app.Deprecated("/v1/conversations/:id/messages/:messageId/branches"), h.branches)
+	old.POST("/conversation/:id/messages/:messageId/switch", app.Deprecated("/v1/conversations/:id/messages/:messageId/switch"), h.switchBranch)
+	old.POST("/conversation/:id/messages/:messageId/select", app.Deprecated("/v1/conversations/:id/messages/:messageId/select"), h.selectVersion)
+}
+
+func (h handler) websocket(c *gin.Context) {
+	ws.HandleWebSocket(c, h.Tokens, h.Conversations.CheckOwner)
+}
+
+func (h handler) testOwner(c *gin.Context) {
+	id := "670aa7a22065dc72cb99f733"
+	userid := c.Param("userid")
+	objectId1, _ := primitive.ObjectIDFromHex(id)
+	objectId2, _ := primitive.ObjectIDFromHex(userid)
+	if err := h.Conversations.CheckOwner(objectId1, objectId2); err != nil {
+		c.Error(err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "success"})
+}
+
+func testConversations(c *gin.Context) {
+	type Test struct {
+		ID          string    `json:"id"`
+		Title       string    `json:"title"`
+		LastMessage string    `json:"lastMessage"`
+		UpdatedAt   time.Time `json:"updatedAt"`
+		Unread      bool      `json:"unread"`
+	}
+	conversation1 := Test{
+		ID:          "1",
+		Title:       "First Conversation",
+		LastMessage: "Last message in the conversation",
+		UpdatedAt:   time.Date(2024, 3, 8, 12, 0, 0, 0, time.UTC),
+		Unread:      false,
+	}
+	conversation2 := Test{
+		ID:          "2",
+		Title:       "Second Conversation",
+		LastMessage: "Last message in the conversation",
+		UpdatedAt:   time.Date(2024, 3, 9, 12, 0, 0, 0, time.UTC),
+		Unread:      true,
+	}
+	conversation3 := Test{
+		ID:          "3",
+		Title:       "Thirsd Conversation",
+		LastMessage: "Last message in the conversation3",
+		UpdatedAt:   time.Date(2024, 3, 9, 18, 0, 0, 0, time.UTC),
+		Unread:      false,
+	}
+	test := []Test{conversation1, conversation2, conversation3}
+
+	c.JSON(http.StatusOK, gin.H{"list": test})
+}
+
+// listPage is the page-numbered list kept for older clients, :id is the page number starting at 1.
+func (h handler) listPage(c *gin.Context) {
+	page, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil || page <= 0 {
+		c.Error(apierror.Invalid("bad page"))
+		return
+	}
+	var query listQuery
+	if !app.Bind(c, &query) {
+		return
+	}
+	filter, err := conversationFilter(query)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+	if conversations, err := h.Conversations.ListPage(app.UserID(c), page, filter); err != nil {
+		c.Error(err)
+	} else {
+		c.JSON(http.StatusOK, gin.H{"message": "success", "conversations": conversations})
+	}
+}
+
+// listAll is the whole list kept for the clients written before pagination, they do not read next_cursor and
+// would lose the conversations past the first page.
+func (h handler) listAll(c *gin.Context) {
+	var query listQuery
+	if !app.Bind(c, &query) {
+		return
+	}
+	filter, err := conversationFilter(query)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+	if conversations, err := h.Conversations.ListAll(app.UserID(c), filter); err != nil {
+		c.Error(err)
+	} else {
+		c.JSON(http.StatusOK, gin.H{"message": "success", "conversations": conversations})
+	}
+}
+
+func (h handler) list(c *gin.Context) {
+	var query listQuery
+	if !app.Bind(c, &query) {
+		return
+	}
+	filter, err := conversationFilter(query)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+	if page, err := h.Conversations.List(app.UserID(c), filter, query.Cursor, query.Limit); err != nil {
+		c.Error(err)
+	} else {
+		c.JSON(http.StatusOK, gin.H{
+			"message":       "success",
+			"conversations": page.Conversations,
+			"next_cursor":   page.NextCursor,
+			"total":         page.Total,
+		})
+	}
+}
+
+func (h handler) get(c *gin.Context) {
+	conversationID, ok := app.ParamID(c, "id", "conversation")
+	if !ok {
+		return
+	}
+	if conversation, err := h.Conversations.Get(conversationID, app.UserID(c)); err != nil {
+		c.Error(err)
+	} else {
+		c.JSON(http.StatusOK, gin.H{"message": "success", "conversation": conversation})
+	}
+}
+
+// askNew starts a conversation with a question, the answer is streamed on the websocket of the returned conversation.
+func (h handler) askNew(c *gin.Context) {
+	var request askNewRequest
+	if !app.Bind(c, &request) {
+		return
+	}
+	if request.Mode == "" {
+		request.Mode = "1"
+	}
+	h.startConversation(c, request)
+}
+
+// legacyAskNew is askNew for the clients written before /v1, which always got mode 1 for a mode other than 1 or 2.
+func (h handler) legacyAskNew(c *gin.Context) {
+	var request legacyAskNewRequest
+	if !app.Bind(c, &request) {
+		return
+	}
+	if request.Mode != "1" && request.Mode != "2" {
+		request.Mode = "1"
+	}
+	h.startConversation(c, askNewRequest(request))
+}
+
+func (h handler) startConversation(c *gin.Context, request askNewRequest) {
+	if id, err := h.Conversations.AskNew(c.Request.Context(), app.UserID(c), request.Message, request.Mode, request.Cid); err != nil {
+		c.Error(err)
+	} else {
+		// cid is the name the clients written before /v1 read the id under
+		c.JSON(http.StatusOK, gin.H{"message": "success", "id": id.Hex(), "cid": id.Hex()})
+	}
+}
+
+func (h handler) ask(c *gin.Context) {
+	conversationID, ok := app.ParamID(c, "id", "conversation")
+	if !ok {
+		return
+	}
+	var request askRequest
+	if !app.Bind(c, &request) {
+		return
+	}
+	if err := h.Conversations.Ask(c.Request.Context(), conversationID, app.UserID(c), request.Message, request.Cid); err != nil {
+		c.Error(err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "success"})
+}
+
+func (h handler) update(c *gin.Context) {
+	conversationID, ok := app.ParamID(c, "id", "conversation")
+	if !ok {
+		return
+	}
+	var request updateRequest
+	if !app.Bind(c, &request) {
+		return
+	}
+	changes := model.ConversationUpdate{Title: request.Title, Mode: request.Mode, Pinned: request.Pinned, Archived: request.Archived}
+	if conversation, err := h.Conversations.Update(conversationID, app.UserID(c), changes); err != nil {
+		c.Error(err)
+	} else {
+		c.JSON(http.StatusOK, gin.H{"message": "success", "conversation": conversation})
+	}
+}
+
+// delete moves the conversation to the trash, it can be restored until the trash is purged.
+func (h handler) delete(c *gin.Context) {
+	conversationID, ok := app.ParamID(c, "id", "conversation")
+	if !ok {
+		return
+	}
+	if err := h.Conversations.Delete(conversationID, app.UserID(c)); err != nil {
+		c.Error(err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "success"})
+}
+
+func (h handler) restore(c *gin.Context) {
+	conversationID, ok := app.ParamID(c, "id", "conversation")
+	if !ok {
+		return
+	}
+	if err := h.Conversations.Restore(conversationID, app.UserID(c)); err != nil {
+		c.Error(err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "success"})
+}
+
+func (h handler) trash(c *gin.Context) {
+	if conversations, err := h.Conversations.Trash(app.UserID(c)); err != nil {
+		c.Error(err)
+	} else {
+		c.JSON(http.StatusOK, gin.H{"message": "success", "conversations": conversations})
+	}
+}
+
+func (h handler) regenerate(c *gin.Context) {
+	conversationID, ok := app.ParamID(c, "id", "conversation")
+	if !ok {
+		return
+	}
+	if err := h.Messages.Regenerate(c.Request.Context(), conversationID, app.UserID(c)); err != nil {
+		c.Error(err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "success"})
+}
+
+// conversationFilter turns the query of the conversation list into a filter.
+func conversationFilter(query listQuery) (model.ConversationFilter, error) {
+	filter := model.ConversationFilter{Mode: query.Mode, Tags: query.Tags, Pinned: query.Pinned, Archived: query.Archived}
+	parseDate := func(value string, endOfDay bool) (time.Time, error) {
+		if t, err := time.Parse(time.RFC3339, value); err == nil {
+			return t, nil
+		}
+		t, err := time.Parse(time.DateOnly, value)
+		if err != nil {
+			return t, apierror.Invalid("invalid date " + value)
+		}
+		if endOfDay {
+			t = t.Add(24*time.Hour - time.Millisecond)
+		}
+		return t, nil
+	}
+	var err error
+	if query.From != "" {
+		if filter.From, err = parseDate(query.From, false); err != nil {
+			return filter, err
+		}
+	}
+	if query.To != "" {
+		if filter.To, err = parseDate(query.To, true); err != nil {
+			return filter, err
+		}
+	}
+	switch query.Folder {
+	case "":
+	case "none":
+		filter.Unfiled = true
+	default:
+		if filter.FolderID, err = primitive.ObjectIDFromHex(query.Folder); err != nil {
+			return filter, apierror.Invalid("invalid folder id")
+		}
+	}
+	return filter, nil
+}
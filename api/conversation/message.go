@@ -0,0 +1,263 @@
+package conversation
+
+import (
+	"net/http"
+	"server/apierror"
+	"server/app"
+	"server/model"
+	"server/openapi"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+type messagesQuery struct {
+	After  string `form:"after" doc:"Only the messages after this message id, to catch up with new messages"`
+	Cursor string `form:"cursor" doc:"next_cursor of the previous page, which is the oldest message already loaded"`
+	// before is the name of cursor for older clients
+	Before string `form:"before"`
+	Limit  int    `form:"limit" binding:"omitempty,min=1"`
+}
+
+type pinRequest struct {
+	Pinned *bool `json:"pinned" form:"pinned" doc:"true by default"`
+}
+
+type copyRequest struct {
+	Target string `json:"target" form:"target" binding:"required" doc:"Id of the conversation the message is copied to"`
+}
+
+type selectRequest struct {
+	Index *int `json:"index" form:"index" binding:"required,min=0"`
+}
+
+func registerMessages(user *openapi.Router, h handler, askLimit gin.HandlerFunc, asks []*apierror.Error) {
+	notFound := []*apierror.Error{apierror.ConversationNotFound, apierror.MessageNotFound}
+	user.GET("/conversations/:id/messages", openapi.Operation{
+		Summary:  "Page through the active branch, newest messages first",
+		Query:    messagesQuery{},
+		Response: openapi.Fields{"messages": []model.Message{}, "next_cursor": "", "has_newer": false},
+		Errors:   notFound,
+	}, h.messages)
+	user.POST("/conversations/:id/messages", openapi.Operation{
+		Summary:     "Ask a question in the conversation",
+		Description: "Returns before the answer is generated, it is streamed on the websocket of the conversation.",
+		Body:        askRequest{},
+		Response:    openapi.Fields{},
+		Errors:      append([]*apierror.Error{apierror.ConversationNotFound}, asks...),
+	}, h.App.AcceptAsks, askLimit, h.ask)
+	user.GET("/conversations/:id/messages/:messageId", openapi.Operation{
+		Summary:  "Get a message",
+		Response: openapi.Fields{"data": model.Message{}},
+		Errors:   notFound,
+	}, h.message)
+	user.DELETE("/conversations/:id/messages/:messageId", openapi.Operation{
+		Summary:  "Delete a message",
+		Response: openapi.Fields{},
+		Errors:   notFound,
+	}, h.deleteMessage)
+	user.PUT("/conversations/:id/messages/:messageId/pin", openapi.Operation{
+		Summary:  "Pin or unpin a message",
+		Body:     pinRequest{},
+		Response: openapi.Fields{},
+		Errors:   notFound,
+	}, h.pinMessage)
+	user.POST("/conversations/:id/messages/:messageId/copy", openapi.Operation{
+		Summary:  "Copy a message to another conversation",
+		Body:     copyRequest{},
+		Response: openapi.Fields{"data": model.Message{}},
+		Errors:   notFound,
+	}, h.copyMessage)
+	user.POST("/conversations/:id/messages/:messageId/edit", openapi.Operation{
+		Summary:     "Ask an edited question on a new branch starting at the edited message",
+		Description: "The answer is streamed on the websocket of the conversation.",
+		Body:        askRequest{},
+		Response:    openapi.Fields{},
+		Errors:      append(notFound, asks...),
+	}, h.App.AcceptAsks, askLimit, h.editMessage)
+	user.GET("/conversations/:id/messages/:messageId/branches", openapi.Operation{
+		Summary:  "List the branches starting at a message, selected is the index of the active one",
+		Response: openapi.Fields{"branches": []model.Message{}, "selected": 0},
+		Errors:   notFound,
+	}, h.branches)
+	user.POST("/conversations/:id/messages/:messageId/switch", openapi.Operation{
+		Summary:  "Make the branch of the message the active one",
+		Response: openapi.Fields{"conversation": model.Conversation{}},
+		Errors:   notFound,
+	}, h.switchBranch)
+	user.POST("/conversations/:id/messages/:messageId/select", openapi.Operation{
+		Summary:  "Show another version of an answer",
+		Body:     selectRequest{},
+		Response: openapi.Fields{"data": model.Message{}},
+		Errors:   append(notFound, apierror.VersionNotFound),
+	}, h.selectVersion)
+}
+
+// messageParams reads the :id and :messageId path parameters of the per-message routes.
+func messageParams(c *gin.Context) (conversationID, messageID primitive.ObjectID, ok bool) {
+	if conversationID, ok = app.ParamID(c, "id", "conversation"); !ok {
+		return
+	}
+	messageID, ok = app.ParamID(c, "messageId", "message")
+	return
+}
+
+// messages returns a page of the active branch, see MessageStore.Messages.
+func (h handler) messages(c *gin.Context) {
+	conversationID, ok := app.ParamID(c, "id", "conversation")
+	if !ok {
+		return
+	}
+	var query messagesQuery
+	if !app.Bind(c, &query) {
+		return
+	}
+	if query.Cursor == "" {
+		query.Cursor = query.Before
+	}
+	var after, before primitive.ObjectID
+	var err error
+	if query.After != "" {
+		if after, err = primitive.ObjectIDFromHex(query.After); err != nil {
+			c.Error(apierror.Invalid("invalid message id"))
+			return
+		}
+	}
+	if query.Cursor != "" {
+		if before, err = primitive.ObjectIDFromHex(query.Cursor); err != nil {
+			c.Error(apierror.Invalid("invalid message id"))
+			return
+		}
+	}
+	if page, err := h.Messages.Messages(conversationID, app.UserID(c), after, before, query.Limit); err != nil {
+		c.Error(err)
+	} else {
+		c.JSON(http.StatusOK, gin.H{"message": "success", "messages": page.Messages, "next_cursor": page.NextCursor, "has_newer": page.HasNewer})
+	}
+}
+
+func (h handler) message(c *gin.Context) {
+	conversationID, messageID, ok := messageParams(c)
+	if !ok {
+		return
+	}
+	if message, err := h.Messages.Message(conversationID, app.UserID(c), messageID); err != nil {
+		c.Error(err)
+	} else {
+		c.JSON(http.StatusOK, gin.H{"message": "success", "data": message})
+	}
+}
+
+func (h handler) deleteMessage(c *gin.Context) {
+	conversationID, messageID, ok := messageParams(c)
+	if !ok {
+		return
+	}
+	if err := h.Messages.DeleteMessage(conversationID, app.UserID(c), messageID); err != nil {
+		c.Error(err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "success"})
+}
+
+func (h handler) pinMessage(c *gin.Context) {
+	conversationID, messageID, ok := messageParams(c)
+	if !ok {
+		return
+	}
+	var request pinRequest
+	if !app.Bind(c, &request) {
+		return
+	}
+	pinned := request.Pinned == nil || *request.Pinned
+	if err := h.Messages.PinMessage(conversationID, app.UserID(c), messageID, pinned); err != nil {
+		c.Error(err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "success"})
+}
+
+func (h handler) copyMessage(c *gin.Context) {
+	conversationID, messageID, ok := messageParams(c)
+	if !ok {
+		return
+	}
+	var request copyRequest
+	if !app.Bind(c, &request) {
+		return
+	}
+	targetID, err := primitive.ObjectIDFromHex(request.Target)
+	if err != nil {
+		c.Error(apierror.Invalid("invalid target conversation id"))
+		return
+	}
+	if message, err := h.Messages.CopyMessage(conversationID, app.UserID(c), messageID, targetID); err != nil {
+		c.Error(err)
+	} else {
+		c.JSON(http.StatusOK, gin.H{"message": "success", "data": message})
+	}
+}
+
+// editMessage asks an edited question on a new branch starting at the edited message.
+func (h handler) editMessage(c *gin.Context) {
+	conversationID, messageID, ok := messageParams(c)
+	if !ok {
+		return
+	}
+	var request askRequest
+	if !app.Bind(c, &request) {
+		return
+	}
+	if err := h.Messages.EditMessage(c.Request.Context(), conversationID, app.UserID(c), messageID, request.Message, request.Cid); err != nil {
+		c.Error(err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "success"})
+}
+
+func (h handler) branches(c *gin.Context) {
+	conversationID, messageID, ok := messageParams(c)
+	if !ok {
+		return
+	}
+	branches, selected, err := h.Messages.Branches(conversationID, app.UserID(c), messageID)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "success", "branches": branches, "selected": selected})
+}
+
+// switchBranch makes the branch of the message the active one and returns the conversation as it now shows.
+func (h handler) switchBranch(c *gin.Context) {
+	conversationID, messageID, ok := messageParams(c)
+	if !ok {
+		return
+	}
+	userID := app.UserID(c)
+	if err := h.Messages.SwitchBranch(conversationID, userID, messageID); err != nil {
+		c.Error(err)
+		return
+	}
+	if conversation, err := h.Conversations.Get(conversationID, userID); err != nil {
+		c.Error(err)
+	} else {
+		c.JSON(http.StatusOK, gin.H{"message": "success", "conversation": conversation})
+	}
+}
+
+func (h handler) selectVersion(c *gin.Context) {
+	conversationID, messageID, ok := messageParams(c)
+	if !ok {
+		return
+	}
+	var request selectRequest
+	if !app.Bind(c, &request) {
+		return
+	}
+	if message, err := h.Messages.SelectVersion(conversationID, app.UserID(c), messageID, *request.Index); err != nil {
+		c.Error(err)
+	} else {
+		c.JSON(http.StatusOK, gin.H{"message": "success", "data": message})
+	}
+}
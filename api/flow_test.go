@@ -0,0 +1,226 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"os"
+	"server/app"
+	"server/auth"
+	"server/chatbotAPI/chatbotapitest"
+	"server/config"
+	"server/model"
+	"server/model/modeltest"
+	"server/utils"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// mailbox keeps the codes the server would have emailed.
+type mailbox struct {
+	mu   sync.Mutex
+	otps map[string]string
+}
+
+func (m *mailbox) SendOTP(to, otp string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.otps[to] = otp
+	return nil
+}
+
+func (m *mailbox) otp(to string) string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.otps[to]
+}
+
+// flow is a user of the server in memory, talking to it over TLS since the cookies are Secure.
+type flow struct {
+	t      *testing.T
+	server *httptest.Server
+	client *http.Client
+}
+
+func (f *flow) postJSON(path, body string) map[string]interface{} {
+	f.t.Helper()
+	resp, err := f.client.Post(f.server.URL+path, "application/json", strings.NewReader(body))
+	if err != nil {
+		f.t.Fatal(err)
+	}
+	return f.decode(path, resp)
+}
+
+func (f *flow) get(path string) map[string]interface{} {
+	f.t.Helper()
+	resp, err := f.client.Get(f.server.URL + path)
+	if err != nil {
+		f.t.Fatal(err)
+	}
+	return f.decode(path, resp)
+}
+
+func (f *flow) decode(path string, resp *http.Response) map[string]interface{} {
+	f.t.Helper()
+	defer resp.Body.Close()
+	var body map[string]interface{}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		f.t.Fatalf("%s: %v", path, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		f.t.Fatalf("%s answered %d: %v", path, resp.StatusCode, body)
+	}
+	return body
+}
+
+// stream reads the websocket of a conversation until the end of the answer.
+func (f *flow) stream(conn *websocket.Conn) []string {
+	f.t.Helper()
+	var tokens []string
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	for {
+		_, message, err := conn.ReadMessage()
+		if err != nil {
+			f.t.Fatalf("reading the answer after %q: %v", tokens, err)
+		}
+		if string(message) == "end of response" {
+			return tokens
+		}
+		tokens = append(tokens, string(message))
+	}
+}
+
+func (f *flow) dial(conversationID string) *websocket.Conn {
+	f.t.Helper()
+	dialer := websocket.Dialer{
+		TLSClientConfig: f.client.Transport.(*http.Transport).TLSClientConfig,
+		Jar:             f.client.Jar,
+	}
+	conn, _, err := dialer.Dial("wss"+strings.TrimPrefix(f.server.URL, "https")+"/ws/"+conversationID, nil)
+	if err != nil {
+		f.t.Fatal(err)
+	}
+	f.t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// conversationStore is every conversation store of app, which the stores of model and modeltest implement.
+type conversationStore interface {
+	app.ConversationStore
+	app.MessageStore
+	app.FolderStore
+	app.ShareStore
+	app.TransferStore
+	app.SearchStore
+}
+
+// stores returns the fakes of modeltest, or the MongoDB stores when DB_URL points to a server the tests may write to,
+// so the flow also goes through the queries of package model. They write to the chatbot-test database.
+func stores(t *testing.T, cfg *config.Config) (app.UserStore, conversationStore) {
+	url := os.Getenv("DB_URL")
+	if url == "" {
+		return modeltest.NewUsers(), modeltest.NewConversations(cfg)
+	}
+	cfg.Mongo.URL, cfg.Mongo.Database = url, "chatbot-test"
+	client := utils.ConnectDB(cfg.Mongo)
+	t.Cleanup(func() { client.Disconnect(context.Background()) })
+	db := model.NewDB(client, cfg)
+	if err := model.EnsureIndexes(db); err != nil {
+		t.Fatal(err)
+	}
+	return model.NewMongoUsers(db), model.NewMongoConversations(db)
+}
+
+func TestRegisterLoginAskAndStream(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	modelAPI := chatbotapitest.NewServer(chatbotapitest.Echo)
+	defer modelAPI.Close()
+	cfg := config.Default()
+	cfg.Auth.JWTSecret = "test secret"
+	cfg.ModelAPI.URL = modelAPI.URL
+
+	mail := &mailbox{otps: make(map[string]string)}
+	users, conversations := stores(t, cfg)
+	a := &app.App{
+		Config:        cfg,
+		Users:         users,
+		Conversations: conversations,
+		Messages:      conversations,
+		Folders:       conversations,
+		Shares:        conversations,
+		Transfers:     conversations,
+		Search:        conversations,
+		Sessions:      modeltest.NewSessions("test key"),
+		Mailer:        mail,
+		Tokens:        auth.NewTokens(cfg.Auth),
+	}
+	server := httptest.NewTLSServer(NewRouter(a))
+	defer server.Close()
+	client := server.Client()
+	client.Jar, _ = cookiejar.New(nil)
+	f := &flow{t: t, server: server, client: client}
+
+	// A database may keep the users of earlier runs
+	email := primitive.NewObjectID().Hex() + "@example.com"
+	f.postJSON("/v1/auth/otp", `{"email":"`+email+`"}`)
+	if mail.otp(email) == "" {
+		t.Fatal("no code was emailed")
+	}
+	f.postJSON("/v1/auth/otp/verify", `{"email":"`+email+`","otp":"`+mail.otp(email)+`"}`)
+	f.postJSON("/v1/auth/register", `{"username":"Ada","email":"`+email+`","password":"secret"}`)
+	f.postJSON("/v1/auth/logout", `{}`)
+	login := f.postJSON("/v1/auth/login", `{"email":"`+email+`","password":"secret"}`)
+	if login["userName"] != "Ada" {
+		t.Fatalf("unexpected login %v", login)
+	}
+
+	asked := f.postJSON("/v1/conversations", `{"message":"Xin chào","mode":"1","cid":"first"}`)
+	conversationID, _ := asked["id"].(string)
+	if conversationID == "" {
+		t.Fatalf("no conversation id in %v", asked)
+	}
+	conn := f.dial(conversationID)
+	tokens := f.stream(conn)
+	want := []string{"You asked:\n", "Xin chào\n", chatbotapitest.TopicPrefix + "Echo\n"}
+	if strings.Join(tokens, "|") != strings.Join(want, "|") {
+		t.Fatalf("streamed %q, want %q", tokens, want)
+	}
+
+	f.postJSON("/v1/conversations/"+conversationID+"/messages", `{"message":"Tiếp tục","cid":"second"}`)
+	if tokens := f.stream(conn); strings.Join(tokens, "") != "You asked:\nTiếp tục\n" {
+		t.Fatalf("second answer streamed %q", tokens)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := model.WaitForAnswers(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	var conversation struct {
+		Topic    string          `json:"topic"`
+		Messages []model.Message `json:"messages"`
+	}
+	raw, _ := json.Marshal(f.get("/v1/conversations/" + conversationID)["conversation"])
+	json.Unmarshal(raw, &conversation)
+	if conversation.Topic != "Echo" {
+		t.Errorf("topic is %q", conversation.Topic)
+	}
+	if len(conversation.Messages) != 4 {
+		t.Fatalf("expected 4 messages, got %+v", conversation.Messages)
+	}
+	if conversation.Messages[0].Status != model.StatusComplete || conversation.Messages[1].Content != "You asked:\nXin chào\n" {
+		t.Errorf("first exchange saved as %+v", conversation.Messages[:2])
+	}
+	requests := modelAPI.Requests()
+	if len(requests) != 2 || requests[0].IsFirst != "true" || requests[1].IsFirst != "false" || requests[1].ConversationID != conversationID {
+		t.Errorf("the model API was asked %+v", requests)
+	}
+}
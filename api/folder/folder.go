@@ -0,0 +1,181 @@
+// Package folder serves the folders and the tags organizing the conversations of a user.
+package folder
+
+import (
+	"net/http"
+	"server/apierror"
+	"server/app"
+	"server/model"
+	"server/openapi"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+type handler struct {
+	*app.App
+}
+
+type folderRequest struct {
+	Name string `json:"name" form:"name" binding:"required"`
+}
+
+type moveRequest struct {
+	Folder string `json:"folder" form:"folder" doc:"Folder id, empty to take the conversation out of its folder"`
+}
+
+type tagsRequest struct {
+	// tag is repeated in the forms of older clients
+	Tags []string `json:"tags" form:"tag"`
+}
+
+// Register serves the folders and the tags on v1 and the older routes on r.
+func Register(r gin.IRouter, v1 *openapi.Router, a *app.App) {
+	h := handler{a}
+	user := v1.Tag("folders").User(a.RequireUser)
+	user.GET("/folders", openapi.Operation{
+		Summary:  "List the folders, unfiled is the number of conversations in no folder",
+		Response: openapi.Fields{"folders": []model.Folder{}, "unfiled": int64(0)},
+	}, h.list)
+	user.POST("/folders", openapi.Operation{
+		Summary:  "Create a folder",
+		Body:     folderRequest{},
+		Response: openapi.Fields{"folder": model.Folder{}},
+		Errors:   []*apierror.Error{apierror.FolderExists},
+	}, h.create)
+	user.PATCH("/folders/:id", openapi.Operation{
+		Summary:  "Rename a folder",
+		Body:     folderRequest{},
+		Response: openapi.Fields{},
+		Errors:   []*apierror.Error{apierror.FolderNotFound, apierror.FolderExists},
+	}, h.rename)
+	user.DELETE("/folders/:id", openapi.Operation{
+		Summary:  "Delete a folder, its conversations are kept in no folder",
+		Response: openapi.Fields{},
+		Errors:   []*apierror.Error{apierror.FolderNotFound},
+	}, h.delete)
+	user.PUT("/conversations/:id/folder", openapi.Operation{
+		Summary:  "Move a conversation to a folder",
+		Body:     moveRequest{},
+		Response: openapi.Fields{},
+		Errors:   []*apierror.Error{apierror.ConversationNotFound, apierror.FolderNotFound},
+	}, h.move)
+	user.PUT("/conversations/:id/tags", openapi.Operation{
+		Summary:  "Replace the tags of a conversation",
+		Body:     tagsRequest{},
+		Response: openapi.Fields{"tags": []string{}},
+		Errors:   []*apierror.Error{apierror.ConversationNotFound},
+	}, h.setTags)
+	user.GET("/tags", openapi.Operation{
+		Summary:  "List the tags with the number of conversations having each",
+		Response: openapi.Fields{"tags": []model.TagCount{}},
+	}, h.tags)
+
+	old := r.Group("", a.RequireUser)
+	old.GET("/folders", app.Deprecated("/v1/folders"), h.list)
+	old.POST("/folders", app.Deprecated("/v1/folders"), h.create)
+	old.PATCH("/folders/:id", app.Deprecated("/v1/folders/:id"), h.rename)
+	old.DELETE("/folders/:id", app.Deprecated("/v1/folders/:id"), h.delete)
+	old.POST("/conversation/:id/folder", app.Deprecated("/v1/conversations/:id/folder"), h.move)
+	old.PUT("/conversation/:id/tags", app.Deprecated("/v1/conversations/:id/tags"), h.setTags)
+	old.GET("/tags", app.Deprecated("/v1/tags"), h.tags)
+}
+
+func (h handler) list(c *gin.Context) {
+	if list, err := h.Folders.Folders(app.UserID(c)); err != nil {
+		c.Error(err)
+	} else {
+		c.JSON(http.StatusOK, gin.H{"message": "success", "folders": list.Folders, "unfiled": list.Unfiled})
+	}
+}
+
+func (h handler) create(c *gin.Context) {
+	var request folderRequest
+	if !app.Bind(c, &request) {
+		return
+	}
+	if folder, err := h.Folders.CreateFolder(app.UserID(c), request.Name); err != nil {
+		c.Error(err)
+	} else {
+		c.JSON(http.StatusOK, gin.H{"message": "success", "folder": folder})
+	}
+}
+
+func (h handler) rename(c *gin.Context) {
+	folderID, ok := app.ParamID(c, "id", "folder")
+	if !ok {
+		return
+	}
+	var request folderRequest
+	if !app.Bind(c, &request) {
+		return
+	}
+	if err := h.Folders.RenameFolder(folderID, app.UserID(c), request.Name); err != nil {
+		c.Error(err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "success"})
+}
+
+// delete removes the folder, its conversations become unfiled.
+func (h handler) delete(c *gin.Context) {
+	folderID, ok := app.ParamID(c, "id", "folder")
+	if !ok {
+		return
+	}
+	if err := h.Folders.DeleteFolder(folderID, app.UserID(c)); err != nil {
+		c.Error(err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "success"})
+}
+
+func (h handler) move(c *gin.Context) {
+	conversationID, ok := app.ParamID(c, "id", "conversation")
+	if !ok {
+		return
+	}
+	var request moveRequest
+	if !app.Bind(c, &request) {
+		return
+	}
+	// An empty folder takes the conversation out of its folder
+	var folderID primitive.ObjectID
+	if request.Folder != "" {
+		var err error
+		if folderID, err = primitive.ObjectIDFromHex(request.Folder); err != nil {
+			c.Error(apierror.Invalid("invalid folder id"))
+			return
+		}
+	}
+	if err := h.Folders.Move(conversationID, app.UserID(c), folderID); err != nil {
+		c.Error(err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "success"})
+}
+
+// setTags replaces the tags of the conversation.
+func (h handler) setTags(c *gin.Context) {
+	conversationID, ok := app.ParamID(c, "id", "conversation")
+	if !ok {
+		return
+	}
+	var request tagsRequest
+	if !app.Bind(c, &request) {
+		return
+	}
+	if tags, err := h.Folders.SetTags(conversationID, app.UserID(c), request.Tags); err != nil {
+		c.Error(err)
+	} else {
+		c.JSON(http.StatusOK, gin.H{"message": "success", "tags": tags})
+	}
+}
+
+func (h handler) tags(c *gin.Context) {
+	if tags, err := h.Folders.Tags(app.UserID(c)); err != nil {
+		c.Error(err)
+	} else {
+		c.JSON(http.StatusOK, gin.H{"message": "success", "tags": tags})
+	}
+}
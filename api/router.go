@@ -0,0 +1,69 @@
+// Package api builds the HTTP router of the server, the routes themselves are registered by the packages under api.
+package api
+
+import (
+	"server/api/account"
+	"server/api/conversation"
+	"server/api/folder"
+	"server/api/search"
+	"server/api/share"
+	"server/api/tools"
+	"server/api/transfer"
+	"server/apierror"
+	"server/app"
+	"server/logging"
+	"server/metrics"
+	"server/openapi"
+	"server/tracing"
+	"server/websocket"
+	"time"
+
+	"github.com/gin-contrib/cors"
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/contrib/instrumentation/github.com/gin-gonic/gin/otelgin"
+)
+
+// NewRouter serves every route of a. It does not touch MongoDB or Redis itself, so an App on fakes can be served by httptest.
+func NewRouter(a *app.App) *gin.Engine {
+	router := gin.New()
+	// Gin believes X-Forwarded-For from anyone by default, which would let clients pick the IP they are limited by.
+	// config.Validate has already checked the proxies
+	if err := router.SetTrustedProxies(a.Config.Server.TrustedProxies); err != nil {
+		panic(err)
+	}
+	// A span for each request, named after its route. The stores and the model API continue the trace from c.Request.Context()
+	router.Use(otelgin.Middleware(tracing.ServiceName))
+	// Inside the span so that the request line has the trace_id, and around Recovery so that it logs the panics too
+	router.Use(logging.Middleware(), logging.Recovery())
+	// Before the error middleware so that it sees the status of the answers written by the middlewares below
+	router.Use(metrics.Middleware())
+	// Handlers fail with c.Error, the middleware answers with the error code of the catalog, see apierror/ERRORS.md
+	router.Use(apierror.Middleware(app.Translate))
+	router.Use(cors.New(cors.Config{
+		AllowOrigins:     a.Config.Server.CORSOrigins,
+		AllowMethods:     []string{"GET", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"},
+		AllowHeaders:     []string{"Origin", "Content-Type", "Accept", "Authorization", "X-Requested-With", "ngrok-skip-browser-warning", logging.RequestIDHeader},
+		ExposeHeaders:    []string{"Content-Length", "Content-Disposition", "Set-Cookie", "RateLimit-Limit", "RateLimit-Remaining", "RateLimit-Reset", "RateLimit-Policy", "Retry-After", "Deprecation", "Link", logging.RequestIDHeader},
+		AllowCredentials: true,
+		MaxAge:           12 * time.Hour,
+	}))
+	router.Use(a.Limit(a.GlobalRule()))
+
+	metrics.CountWebsockets(websocket.Count)
+	router.GET("/metrics", metrics.Handler(a.Config.Metrics.Token))
+
+	// Every route is served under /v1 and documented in /v1/openapi.json. The routes of the clients written before /v1
+	// stay at the root as deprecated aliases.
+	spec := openapi.New("Chatbot server", "1")
+	v1 := openapi.NewRouter(router.Group("/v1"), spec)
+	router.GET("/v1/openapi.json", spec.Handler())
+
+	account.Register(router, v1, a)
+	conversation.Register(router, v1, a)
+	folder.Register(router, v1, a)
+	share.Register(router, v1, a)
+	transfer.Register(router, v1, a)
+	search.Register(router, v1, a)
+	tools.Register(router, v1, a)
+	return router
+}
@@ -0,0 +1,349 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"server/app"
+	"server/auth"
+	"server/config"
+	"server/model"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// The fakes embed the interfaces they stand for, calling a method a test did not expect panics on the nil interface.
+type fakeUsers struct {
+	app.UserStore
+	id primitive.ObjectID
+}
+
+func (f fakeUsers) Login(email, password string) (string, string, error) {
+	if email != "ada@example.com" || password != "secret" {
+		return "", "", model.ErrInvalidCredentials
+	}
+	return f.id.Hex(), "Ada", nil
+}
+
+type fakeConversations struct {
+	app.ConversationStore
+	listedFor primitive.ObjectID
+	asked     string
+	mode      string
+}
+
+func (f *fakeConversations) List(userID primitive.ObjectID, filter model.ConversationFilter, cursor string, limit int) (*model.ConversationPage, error) {
+	f.listedFor = userID
+	return &model.ConversationPage{Conversations: []model.ConversationSummary{{Topic: "Hello"}}, Total: 1}, nil
+}
+
+func (f *fakeConversations) ListAll(userID primitive.ObjectID, filter model.ConversationFilter) (*[]model.ConversationSummary, error) {
+	f.listedFor = userID
+	conversations := make([]model.ConversationSummary, 30)
+	return &conversations, nil
+}
+
+func (f *fakeConversations) AskNew(ctx context.Context, userID primitive.ObjectID, content, mode, cid string) (primitive.ObjectID, error) {
+	f.asked, f.mode = content, mode
+	return primitive.NewObjectID(), nil
+}
+
+func (f *fakeConversations) Ask(ctx context.Context, conversationID, userID primitive.ObjectID, content, cid string) error {
+	f.asked = content
+	return nil
+}
+
+type fakeSessions struct {
+	app.SessionStore
+}
+
+func (fakeSessions) IsBlacklisted(userID string) bool { return false }
+
+func newTestApp(t *testing.T) (*app.App, *fakeConversations, primitive.ObjectID) {
+	gin.SetMode(gin.TestMode)
+	cfg := config.Default()
+	cfg.Auth.JWTSecret = "test secret"
+	userID := primitive.NewObjectID()
+	conversations := &fakeConversations{}
+	return &app.App{
+		Config:        cfg,
+		Users:         fakeUsers{id: userID},
+		Conversations: conversations,
+		Sessions:      fakeSessions{},
+		Tokens:        auth.NewTokens(cfg.Auth),
+	}, conversations, userID
+}
+
+func loggedIn(t *testing.T, tokens *auth.Tokens, req *http.Request, userID primitive.ObjectID) *http.Request {
+	token, err := tokens.GenerateJWT(userID.Hex())
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.AddCookie(&http.Cookie{Name: "jwt_token", Value: token})
+	return req
+}
+
+func TestLoginSetsTheTokenCookie(t *testing.T) {
+	a, _, userID := newTestApp(t)
+	router := NewRouter(a)
+
+	req := httptest.NewRequest(http.MethodPost, "/login", strings.NewReader(`{"email":"ada@example.com","password":"secret"}`))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("login answered %d: %s", w.Code, w.Body)
+	}
+	var token string
+	for _, cookie := range w.Result().Cookies() {
+		if cookie.Name == "jwt_token" {
+			token = cookie.Value
+		}
+	}
+	claims, err := a.Tokens.VerifyJWT(token)
+	if err != nil || claims.UserID != userID.Hex() {
+		t.Fatalf("unexpected token %q: %v", token, err)
+	}
+}
+
+func TestConversationsNeedAUser(t *testing.T) {
+	a, conversations, userID := newTestApp(t)
+	router := NewRouter(a)
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/conversations", nil))
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401 without a token, got %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, loggedIn(t, a.Tokens, httptest.NewRequest(http.MethodGet, "/v1/conversations", nil), userID))
+	if w.Code != http.StatusOK {
+		t.Fatalf("list answered %d: %s", w.Code, w.Body)
+	}
+	if conversations.listedFor != userID {
+		t.Errorf("listed the conversations of %s instead of %s", conversations.listedFor.Hex(), userID.Hex())
+	}
+	var body struct {
+		Total int64 `json:"total"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&body); err != nil || body.Total != 1 {
+		t.Errorf("unexpected body %s: %v", w.Body, err)
+	}
+}
+
+func TestAsksAreRefusedWhileDraining(t *testing.T) {
+	a, conversations, userID := newTestApp(t)
+	router := NewRouter(a)
+	ask := func() *httptest.ResponseRecorder {
+		form := url.Values{"message": {"Xin chào"}}
+		req := httptest.NewRequest(http.MethodPost, "/conversation/"+primitive.NewObjectID().Hex(), strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, loggedIn(t, a.Tokens, req, userID))
+		return w
+	}
+
+	if w := ask(); w.Code != http.StatusOK || conversations.asked != "Xin chào" {
+		t.Fatalf("ask answered %d: %s", w.Code, w.Body)
+	}
+	a.Drain()
+	if w := ask(); w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") == "" {
+		t.Fatalf("expected 503 with Retry-After while draining, got %d", w.Code)
+	}
+}
+
+func TestErrorsHaveCodes(t *testing.T) {
+	a, _, userID := newTestApp(t)
+	router := NewRouter(a)
+	answer := func(req *http.Request) (int, string) {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		var body struct {
+			Code string `json:"code"`
+		}
+		if err := json.NewDecoder(w.Body).Decode(&body); err != nil {
+			t.Fatalf("%s %s answered %s: %v", req.Method, req.URL, w.Body, err)
+		}
+		return w.Code, body.Code
+	}
+	login := func() *http.Request {
+		req := httptest.NewRequest(http.MethodPost, "/login", strings.NewReader(`{"email":"ada@example.com","password":"wrong"}`))
+		req.Header.Set("Content-Type", "application/json")
+		return req
+	}
+	garbage := httptest.NewRequest(http.MethodGet, "/conversations", nil)
+	garbage.AddCookie(&http.Cookie{Name: "jwt_token", Value: "garbage"})
+	expiring := auth.NewTokens(config.Auth{JWTSecret: a.Config.Auth.JWTSecret, TokenTTL: -time.Minute})
+	expired := loggedIn(t, expiring, httptest.NewRequest(http.MethodGet, "/conversations", nil), userID)
+
+	for _, tc := range []struct {
+		req    *http.Request
+		status int
+		code   string
+	}{
+		{login(), http.StatusUnauthorized, "invalid_credentials"},
+		{loggedIn(t, a.Tokens, login(), userID), http.StatusConflict, "already_logged_in"},
+		{httptest.NewRequest(http.MethodGet, "/conversations", nil), http.StatusUnauthorized, "unauthenticated"},
+		{garbage, http.StatusUnauthorized, "invalid_token"},
+		{expired, http.StatusUnauthorized, "token_expired"},
+		{loggedIn(t, a.Tokens, httptest.NewRequest(http.MethodGet, "/conversation/nope", nil), userID), http.StatusBadRequest, "invalid_request"},
+	} {
+		if status, code := answer(tc.req); status != tc.status || code != tc.code {
+			t.Errorf("%s %s answered %d %q, want %d %q", tc.req.Method, tc.req.URL, status, code, tc.status, tc.code)
+		}
+	}
+}
+
+func TestEveryV1RouteIsDocumented(t *testing.T) {
+	a, _, _ := newTestApp(t)
+	router := NewRouter(a)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/v1/openapi.json", nil))
+	var document struct {
+		OpenAPI string                                `json:"openapi"`
+		Paths   map[string]map[string]json.RawMessage `json:"paths"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&document); err != nil || document.OpenAPI == "" {
+		t.Fatalf("unexpected document %s: %v", w.Body, err)
+	}
+	param := regexp.MustCompile(`:(\w+)`)
+	for _, route := range router.Routes() {
+		if !strings.HasPrefix(route.Path, "/v1/") || route.Path == "/v1/openapi.json" {
+			continue
+		}
+		path := param.ReplaceAllString(route.Path, "{$1}")
+		if _, ok := document.Paths[path][strings.ToLower(route.Method)]; !ok {
+			t.Errorf("%s %s is not documented", route.Method, route.Path)
+		}
+	}
+}
+
+func TestV1BodiesAreValidated(t *testing.T) {
+	a, conversations, userID := newTestApp(t)
+	router := NewRouter(a)
+	ask := func(body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/v1/conversations/"+primitive.NewObjectID().Hex()+"/messages", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, loggedIn(t, a.Tokens, req, userID))
+		return w
+	}
+
+	w := ask(`{"cid":"1"}`)
+	var body struct {
+		Code    string `json:"code"`
+		Details struct {
+			Fields map[string]string `json:"fields"`
+		} `json:"details"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != http.StatusBadRequest || body.Code != "invalid_request" || body.Details.Fields["message"] != "required" {
+		t.Fatalf("asking without message answered %d %+v", w.Code, body)
+	}
+	if w := ask(`{"message":"Xin chào"}`); w.Code != http.StatusOK || conversations.asked != "Xin chào" {
+		t.Fatalf("ask answered %d: %s", w.Code, w.Body)
+	}
+}
+
+func TestOldRoutesAreDeprecatedAliases(t *testing.T) {
+	a, conversations, userID := newTestApp(t)
+	router := NewRouter(a)
+	conversationID := primitive.NewObjectID().Hex()
+	form := url.Values{"message": {"Xin chào"}}
+	req := httptest.NewRequest(http.MethodPost, "/conversation/"+conversationID, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, loggedIn(t, a.Tokens, req, userID))
+	if w.Code != http.StatusOK || conversations.asked != "Xin chào" {
+		t.Fatalf("the old ask route answered %d: %s", w.Code, w.Body)
+	}
+	if w.Header().Get("Deprecation") != "true" || w.Header().Get("Link") != "</v1/conversations/"+conversationID+`/messages>; rel="successor-version"` {
+		t.Errorf("unexpected headers %v", w.Header())
+	}
+}
+
+func TestOldAskNewAcceptsAnyMode(t *testing.T) {
+	a, conversations, userID := newTestApp(t)
+	router := NewRouter(a)
+	askNew := func(path, mode string) int {
+		form := url.Values{"message": {"Xin chào"}, "mode": {mode}}
+		req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, loggedIn(t, a.Tokens, req, userID))
+		return w.Code
+	}
+	for _, tc := range []struct{ mode, want string }{{"2", "2"}, {"3", "1"}, {"chat", "1"}, {"", "1"}} {
+		conversations.mode = ""
+		if status := askNew("/conversation/new", tc.mode); status != http.StatusOK || conversations.mode != tc.want {
+			t.Errorf("the old route answered %d for mode %q and asked with mode %q, want %q", status, tc.mode, conversations.mode, tc.want)
+		}
+	}
+	if status := askNew("/v1/conversations", "3"); status != http.StatusBadRequest {
+		t.Errorf("/v1/conversations answered %d for mode 3, want 400", status)
+	}
+}
+
+func TestMetricsCountTheRoutes(t *testing.T) {
+	a, _, userID := newTestApp(t)
+	router := NewRouter(a)
+
+	router.ServeHTTP(httptest.NewRecorder(), loggedIn(t, a.Tokens, httptest.NewRequest(http.MethodGet, "/v1/conversations", nil), userID))
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("/metrics answered %d: %s", w.Code, w.Body)
+	}
+	if !strings.Contains(w.Body.String(), `chatbot_http_requests_total{method="GET",route="/v1/conversations",status="200"}`) {
+		t.Errorf("the request to /v1/conversations is not counted:\n%s", w.Body)
+	}
+}
+
+func TestForwardedForNeedsATrustedProxy(t *testing.T) {
+	a, _, _ := newTestApp(t)
+	clientIP := func() string {
+		router := NewRouter(a)
+		router.GET("/ip", func(c *gin.Context) { c.String(http.StatusOK, c.ClientIP()) })
+		req := httptest.NewRequest(http.MethodGet, "/ip", nil)
+		req.RemoteAddr = "10.0.0.2:1234"
+		req.Header.Set("X-Forwarded-For", "1.2.3.4")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w.Body.String()
+	}
+
+	if ip := clientIP(); ip != "10.0.0.2" {
+		t.Errorf("without trusted proxies the client picked its IP %q", ip)
+	}
+	a.Config.Server.TrustedProxies = []string{"10.0.0.0/8"}
+	if ip := clientIP(); ip != "1.2.3.4" {
+		t.Errorf("behind a trusted proxy the IP should be the forwarded one, got %q", ip)
+	}
+}
+
+func TestOldListHasEveryConversation(t *testing.T) {
+	a, _, userID := newTestApp(t)
+	router := NewRouter(a)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, loggedIn(t, a.Tokens, httptest.NewRequest(http.MethodGet, "/conversations", nil), userID))
+	var body struct {
+		Conversations []model.ConversationSummary `json:"conversations"`
+		NextCursor    *string                     `json:"next_cursor"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&body); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("the old list answered %d: %v", w.Code, err)
+	}
+	if len(body.Conversations) != 30 || body.NextCursor != nil {
+		t.Errorf("the old list should have every conversation and no cursor, got %d and %v", len(body.Conversations), body.NextCursor)
+	}
+}
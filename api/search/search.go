@@ -0,0 +1,66 @@
+// Package search serves the full-text and the semantic search over the conversations of a user.
+package search
+
+import (
+	"net/http"
+	"server/apierror"
+	"server/app"
+	"server/model"
+	"server/openapi"
+
+	"github.com/gin-gonic/gin"
+)
+
+type handler struct {
+	*app.App
+}
+
+type searchQuery struct {
+	Q     string `form:"q" binding:"required"`
+	Limit int    `form:"limit" binding:"omitempty,min=1"`
+}
+
+// Register serves the search on v1 and the older routes on r.
+func Register(r gin.IRouter, v1 *openapi.Router, a *app.App) {
+	h := handler{a}
+	user := v1.Tag("search").User(a.RequireUser)
+	user.GET("/search", openapi.Operation{
+		Summary:  "Search the words of the question in the titles and the messages, best matches first",
+		Query:    searchQuery{},
+		Response: openapi.Fields{"results": []model.SearchResult{}},
+	}, h.search)
+	user.GET("/search/semantic", openapi.Operation{
+		Summary:  "Search the messages closest in meaning to the question",
+		Query:    searchQuery{},
+		Response: openapi.Fields{"results": []model.SemanticResult{}},
+		Errors:   []*apierror.Error{apierror.SemanticSearchDisabled},
+	}, h.semantic)
+
+	old := r.Group("", a.RequireUser)
+	old.GET("/search", app.Deprecated("/v1/search"), h.search)
+	old.GET("/search/semantic", app.Deprecated("/v1/search/semantic"), h.semantic)
+}
+
+func (h handler) search(c *gin.Context) {
+	var query searchQuery
+	if !app.Bind(c, &query) {
+		return
+	}
+	if results, err := h.Search.Search(app.UserID(c), query.Q, query.Limit); err != nil {
+		c.Error(err)
+	} else {
+		c.JSON(http.StatusOK, gin.H{"message": "success", "results": results})
+	}
+}
+
+func (h handler) semantic(c *gin.Context) {
+	var query searchQuery
+	if !app.Bind(c, &query) {
+		return
+	}
+	if results, err := h.Search.SemanticSearch(app.UserID(c), query.Q, query.Limit); err != nil {
+		c.Error(err)
+	} else {
+		c.JSON(http.StatusOK, gin.H{"message": "success", "results": results})
+	}
+}
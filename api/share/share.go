@@ -0,0 +1,147 @@
+// Package share serves the read-only links to a snapshot of a conversation.
+package share
+
+import (
+	"net/http"
+	"server/apierror"
+	"server/app"
+	"server/model"
+	"server/openapi"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+type handler struct {
+	*app.App
+}
+
+type shareRequest struct {
+	ExpiresIn string `json:"expires_in" form:"expires_in" doc:"Duration such as 24h, the link works until it is revoked without it"`
+}
+
+type shareResponse struct {
+	Message   string     `json:"message"`
+	Token     string     `json:"token"`
+	Path      string     `json:"path"`
+	ExpiresAt *time.Time `json:"expires_at"`
+}
+
+type sharedConversation struct {
+	Message   string                `json:"message"`
+	Topic     string                `json:"topic"`
+	Mode      string                `json:"mode"`
+	Messages  []model.SharedMessage `json:"messages"`
+	CreatedAt time.Time             `json:"created_at"`
+	ExpiresAt *time.Time            `json:"expires_at"`
+}
+
+// Register serves the share links on v1 and the older routes on r.
+func Register(r gin.IRouter, v1 *openapi.Router, a *app.App) {
+	h := handler{a}
+	v1 = v1.Tag("shares")
+	// Public: anyone with the link can read the shared conversation, no jwt_token is needed
+	v1.GET("/shares/:token", openapi.Operation{
+		Summary:  "Read a shared conversation, no login is needed",
+		Response: sharedConversation{},
+		Errors:   []*apierror.Error{apierror.ShareNotFound},
+	}, h.get)
+	user := v1.User(a.RequireUser)
+	user.POST("/conversations/:id/shares", openapi.Operation{
+		Summary:  "Share a snapshot of the conversation as it is now",
+		Body:     shareRequest{},
+		Response: shareResponse{},
+		Errors:   []*apierror.Error{apierror.ConversationNotFound},
+	}, h.create)
+	user.GET("/conversations/:id/shares", openapi.Operation{
+		Summary:  "List the links sharing the conversation",
+		Response: openapi.Fields{"shares": []model.Share{}},
+		Errors:   []*apierror.Error{apierror.ConversationNotFound},
+	}, h.list)
+	user.DELETE("/shares/:token", openapi.Operation{
+		Summary:  "Revoke a link",
+		Response: openapi.Fields{},
+		Errors:   []*apierror.Error{apierror.ShareNotFound},
+	}, h.revoke)
+	user.POST("/shares/:token/fork", openapi.Operation{
+		Summary:  "Copy a shared conversation into the conversations of the user",
+		Response: openapi.Fields{"id": ""},
+		Errors:   []*apierror.Error{apierror.ShareNotFound},
+	}, h.fork)
+
+	r.GET("/share/:token", app.Deprecated("/v1/shares/:token"), h.get)
+	old := r.Group("", a.RequireUser)
+	old.POST("/conversation/:id/share", app.Deprecated("/v1/conversations/:id/shares"), h.create)
+	old.GET("/conversation/:id/shares", app.Deprecated("/v1/conversations/:id/shares"), h.list)
+	old.DELETE("/share/:token", app.Deprecated("/v1/shares/:token"), h.revoke)
+	old.POST("/share/:token/fork", app.Deprecated("/v1/shares/:token/fork"), h.fork)
+}
+
+func (h handler) create(c *gin.Context) {
+	conversationID, ok := app.ParamID(c, "id", "conversation")
+	if !ok {
+		return
+	}
+	var request shareRequest
+	if !app.Bind(c, &request) {
+		return
+	}
+	var expiresIn time.Duration
+	if request.ExpiresIn != "" {
+		var err error
+		if expiresIn, err = time.ParseDuration(request.ExpiresIn); err != nil || expiresIn <= 0 {
+			c.Error(apierror.Invalid("invalid expires_in"))
+			return
+		}
+	}
+	if share, err := h.Shares.Share(conversationID, app.UserID(c), expiresIn); err != nil {
+		c.Error(err)
+	} else {
+		c.JSON(http.StatusOK, shareResponse{Message: "success", Token: share.Token, Path: "/v1/shares/" + share.Token, ExpiresAt: share.ExpiresAt})
+	}
+}
+
+func (h handler) list(c *gin.Context) {
+	conversationID, ok := app.ParamID(c, "id", "conversation")
+	if !ok {
+		return
+	}
+	if shares, err := h.Shares.Shares(conversationID, app.UserID(c)); err != nil {
+		c.Error(err)
+	} else {
+		c.JSON(http.StatusOK, gin.H{"message": "success", "shares": shares})
+	}
+}
+
+func (h handler) get(c *gin.Context) {
+	share, err := h.Shares.GetShare(c.Param("token"))
+	if err != nil {
+		c.Error(err)
+		return
+	}
+	c.JSON(http.StatusOK, sharedConversation{
+		Message:   "success",
+		Topic:     share.Topic,
+		Mode:      share.Mode,
+		Messages:  share.Messages,
+		CreatedAt: share.CreatedAt,
+		ExpiresAt: share.ExpiresAt,
+	})
+}
+
+func (h handler) revoke(c *gin.Context) {
+	if err := h.Shares.RevokeShare(c.Param("token"), app.UserID(c)); err != nil {
+		c.Error(err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "success"})
+}
+
+// fork copies the shared conversation into the conversations of the caller, who can then go on asking in it.
+func (h handler) fork(c *gin.Context) {
+	if conversation, err := h.Shares.ForkShare(c.Param("token"), app.UserID(c)); err != nil {
+		c.Error(err)
+	} else {
+		c.JSON(http.StatusOK, gin.H{"message": "success", "id": conversation.ID.Hex()})
+	}
+}
@@ -0,0 +1,69 @@
+// Package tools serves the helpers of the frontend backed by third-party APIs: topics from Gemini and upload keys from Pinata.
+package tools
+
+import (
+	"net/http"
+	"server/apierror"
+	"server/app"
+	"server/cloud"
+	geminiapi "server/geminiAPI"
+	"server/openapi"
+
+	"github.com/gin-gonic/gin"
+)
+
+type handler struct {
+	*app.App
+}
+
+type topicRequest struct {
+	Question string `json:"question" form:"question" binding:"required"`
+}
+
+type uploadKey struct {
+	JWT string `json:"jwt"`
+}
+
+// Register serves the helpers on v1 and the older routes on r.
+func Register(r gin.IRouter, v1 *openapi.Router, a *app.App) {
+	h := handler{a}
+	topicLimit := a.Limit(a.TopicRule())
+	v1 = v1.Tag("tools")
+	v1.User(a.RequireUser).POST("/uploads/key", openapi.Operation{
+		Summary:  "Get a single-use Pinata key to upload a file with",
+		Response: uploadKey{},
+		Errors:   []*apierror.Error{apierror.UpstreamFailed},
+	}, h.signedJWT)
+	v1.POST("/topics", openapi.Operation{
+		Summary:  "Name the topic of a question",
+		Body:     topicRequest{},
+		Response: openapi.Fields{"topic": ""},
+		Errors:   []*apierror.Error{apierror.RateLimited, apierror.UpstreamFailed},
+	}, topicLimit, h.topic)
+
+	r.GET("/api/get-signed-jwt", app.Deprecated("/v1/uploads/key"), a.RequireUser, h.signedJWT)
+	r.POST("/getTopic", app.Deprecated("/v1/topics"), topicLimit, h.topic)
+}
+
+// signedJWT returns a single-use Pinata key the frontend uploads files with.
+func (h handler) signedJWT(c *gin.Context) {
+	if jwt, err := cloud.GetSignedJWT(h.Config.Pinata.JWT, app.UserID(c).Hex()); err != nil {
+		c.Error(apierror.UpstreamFailed.Because(err))
+		return
+	} else {
+		c.JSON(http.StatusOK, uploadKey{JWT: jwt})
+	}
+}
+
+func (h handler) topic(c *gin.Context) {
+	var request topicRequest
+	if !app.Bind(c, &request) {
+		return
+	}
+	if topic, err := geminiapi.GetTopic(c.Request.Context(), h.Config.Gemini.APIKey, request.Question, false); err != nil {
+		c.Error(apierror.UpstreamFailed.Because(err))
+		return
+	} else {
+		c.JSON(http.StatusOK, gin.H{"message": "success", "topic": topic})
+	}
+}
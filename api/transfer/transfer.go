@@ -0,0 +1,156 @@
+// Package transfer serves the export of conversations to files and the import of conversations from other services.
+package transfer
+
+import (
+	"errors"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"server/apierror"
+	"server/app"
+	"server/model"
+	"server/openapi"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Largest file accepted by the import
+const maxImportSize = 50 << 20
+
+type handler struct {
+	*app.App
+}
+
+type exportQuery struct {
+	Format string `form:"format" binding:"omitempty,oneof=md html json txt" doc:"md by default"`
+}
+
+type exportRequest struct {
+	// id is repeated in the forms of older clients
+	IDs    []string `json:"ids" form:"id" binding:"required,min=1"`
+	Format string   `json:"format" form:"format" binding:"omitempty,oneof=md html json txt" doc:"md by default"`
+}
+
+// importForm documents the upload of importFile, which reads the file itself to tell a file too large apart.
+type importForm struct {
+	File   *multipart.FileHeader `form:"file" binding:"required"`
+	Format string                `form:"format" binding:"omitempty,oneof=chatgpt jsonl" doc:"Guessed from the file without it"`
+}
+
+// Register serves the export and the import on v1 and the older routes on r.
+func Register(r gin.IRouter, v1 *openapi.Router, a *app.App) {
+	h := handler{a}
+	user := v1.Tag("transfer").User(a.RequireUser)
+	user.GET("/conversations/:id/export", openapi.Operation{
+		Summary:  "Download the active branch of a conversation as a file",
+		Query:    exportQuery{},
+		Download: "application/octet-stream",
+		Errors:   []*apierror.Error{apierror.ConversationNotFound},
+	}, h.export)
+	user.POST("/conversations/export", openapi.Operation{
+		Summary:  "Download several conversations as a ZIP with one file per conversation",
+		Body:     exportRequest{},
+		Download: "application/zip",
+		Errors:   []*apierror.Error{apierror.ConversationNotFound},
+	}, h.exportMany)
+	user.POST("/conversations/import", openapi.Operation{
+		Summary:     "Import the conversations of a ChatGPT export or of a JSON Lines file",
+		Description: "Each conversation is imported on its own, results tells which ones failed and why.",
+		Body:        importForm{},
+		Multipart:   true,
+		Response:    openapi.Fields{"imported": 0, "failed": 0, "results": []model.ImportResult{}},
+		Errors:      []*apierror.Error{apierror.PayloadTooLarge},
+	}, h.importFile)
+
+	old := r.Group("", a.RequireUser)
+	old.GET("/conversation/:id/export", app.Deprecated("/v1/conversations/:id/export"), h.export)
+	old.POST("/conversations/export", app.Deprecated("/v1/conversations/export"), h.exportMany)
+	old.POST("/conversations/import", app.Deprecated("/v1/conversations/import"), h.importFile)
+}
+
+func (h handler) export(c *gin.Context) {
+	conversationID, ok := app.ParamID(c, "id", "conversation")
+	if !ok {
+		return
+	}
+	var query exportQuery
+	if !app.Bind(c, &query) {
+		return
+	}
+	if query.Format == "" {
+		query.Format = "md"
+	}
+	export, err := h.Transfers.Export(conversationID, app.UserID(c), query.Format)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+	c.Header("Content-Disposition", `attachment; filename="`+export.Filename+`"`)
+	c.Data(http.StatusOK, export.ContentType, export.Data)
+}
+
+// exportMany exports the conversations as a ZIP with one file per conversation.
+func (h handler) exportMany(c *gin.Context) {
+	var request exportRequest
+	if !app.Bind(c, &request) {
+		return
+	}
+	if request.Format == "" {
+		request.Format = "md"
+	}
+	var conversationIDs []primitive.ObjectID
+	for _, id := range request.IDs {
+		conversationID, err := primitive.ObjectIDFromHex(id)
+		if err != nil {
+			c.Error(apierror.Invalid("invalid conversation id " + id))
+			return
+		}
+		conversationIDs = append(conversationIDs, conversationID)
+	}
+	export, err := h.Transfers.ExportMany(conversationIDs, app.UserID(c), request.Format)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+	c.Header("Content-Disposition", `attachment; filename="`+export.Filename+`"`)
+	c.Data(http.StatusOK, export.ContentType, export.Data)
+}
+
+// importFile imports the conversations of the uploaded file, see model.ImportConversations for the formats.
+func (h handler) importFile(c *gin.Context) {
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxImportSize)
+	header, err := c.FormFile("file")
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			c.Error(apierror.PayloadTooLarge.WithMessage("the file is larger than 50 MB").WithDetail("max_bytes", maxImportSize))
+		} else {
+			c.Error(apierror.Invalid("a file of at most 50 MB is required"))
+		}
+		return
+	}
+	file, err := header.Open()
+	if err != nil {
+		c.Error(err)
+		return
+	}
+	defer file.Close()
+	data, err := io.ReadAll(file)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+	results, err := h.Transfers.Import(app.UserID(c), c.PostForm("format"), data)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+	imported := 0
+	for _, result := range results {
+		if result.Error == "" {
+			imported++
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "success", "imported": imported, "failed": len(results) - imported, "results": results})
+}
@@ -0,0 +1,112 @@
+// Package apierror is how the server reports errors to its clients. Every error answer has the same body:
+//
+//	{"code": "conversation_not_found", "error": "conversation not found or does not belong to the user", "details": {...}}
+//
+// Clients branch on code, which never changes once released; error is an English message for humans and logs, and
+// details is only set by the codes documented with it. The codes are listed in ERRORS.md.
+//
+// Handlers report an error with c.Error(err) and return, Middleware renders it.
+package apierror
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Error is an error with what the client needs to handle it.
+type Error struct {
+	// HTTP status of the answer
+	Status  int                    `json:"-"`
+	Code    string                 `json:"code"`
+	Message string                 `json:"error"`
+	Details map[string]interface{} `json:"details,omitempty"`
+
+	// What went wrong on the server side, it is logged but never sent
+	cause error
+}
+
+func New(status int, code, message string) *Error {
+	return &Error{Status: status, Code: code, Message: message}
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+// WithMessage returns a copy of e with another message, the code and the status stay.
+func (e *Error) WithMessage(message string) *Error {
+	copied := *e
+	copied.Message = message
+	return &copied
+}
+
+// WithDetail returns a copy of e with the detail key set to value.
+func (e *Error) WithDetail(key string, value interface{}) *Error {
+	copied := *e
+	copied.Details = make(map[string]interface{}, len(e.Details)+1)
+	for k, v := range e.Details {
+		copied.Details[k] = v
+	}
+	copied.Details[key] = value
+	return &copied
+}
+
+// Because returns a copy of e caused by err. The client gets e, err is logged.
+func (e *Error) Because(err error) *Error {
+	copied := *e
+	copied.cause = err
+	return &copied
+}
+
+func (e *Error) Unwrap() error {
+	return e.cause
+}
+
+// Invalid is InvalidRequest with message telling what is wrong in the request.
+func Invalid(message string) *Error {
+	return InvalidRequest.WithMessage(message)
+}
+
+// Abort stops the chain of handlers and makes Middleware answer with err.
+func Abort(c *gin.Context, err error) {
+	c.Error(err)
+	c.Abort()
+}
+
+// Middleware answers with the last error added to the context by the handlers, when they have not answered
+// themselves. translate turns the errors of the stores into catalog errors, it returns nil for the ones it does not
+// know, which are answered as Internal and logged since the client cannot do anything about them.
+func Middleware(translate func(error) *Error) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Next()
+		if len(c.Errors) == 0 || c.Writer.Written() {
+			return
+		}
+		err := c.Errors.Last().Err
+		e := From(err, translate)
+		if e.Status >= http.StatusInternalServerError {
+			if e.cause != nil {
+				err = e.cause
+			}
+			slog.ErrorContext(c.Request.Context(), "request failed", "error_code", e.Code, "error", err)
+		}
+		c.JSON(e.Status, e)
+	}
+}
+
+// From returns err as a catalog error: err itself when it is one, else its translation, else Internal.
+func From(err error, translate func(error) *Error) *Error {
+	var e *Error
+	if errors.As(err, &e) {
+		return e
+	}
+	if translate != nil {
+		if e = translate(err); e != nil {
+			return e
+		}
+	}
+	return Internal
+}
@@ -0,0 +1,87 @@
+package apierror
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestCatalogIsDocumented(t *testing.T) {
+	doc, err := os.ReadFile("ERRORS.md")
+	if err != nil {
+		t.Fatal(err)
+	}
+	seen := make(map[string]bool)
+	for _, e := range Catalog {
+		if seen[e.Code] {
+			t.Errorf("code %s is used twice", e.Code)
+		}
+		seen[e.Code] = true
+		if e.Status < 400 || e.Message == "" {
+			t.Errorf("%s has status %d and message %q", e.Code, e.Status, e.Message)
+		}
+		if !strings.Contains(string(doc), "| `"+e.Code+"` |") {
+			t.Errorf("%s is missing from ERRORS.md", e.Code)
+		}
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	errMissing := errors.New("missing")
+	router := gin.New()
+	router.Use(Middleware(func(err error) *Error {
+		if errors.Is(err, errMissing) {
+			return NotFound
+		}
+		return nil
+	}))
+	router.GET("/invalid", func(c *gin.Context) { c.Error(Invalid("bad page")) })
+	router.GET("/missing", func(c *gin.Context) { c.Error(errMissing) })
+	router.GET("/broken", func(c *gin.Context) { c.Error(errors.New("connection refused")) })
+	router.GET("/upstream", func(c *gin.Context) { c.Error(UpstreamFailed.Because(errors.New("gemini is down"))) })
+	router.GET("/answered", func(c *gin.Context) {
+		c.Error(errMissing)
+		c.JSON(http.StatusOK, gin.H{"message": "success"})
+	})
+
+	for path, want := range map[string]struct {
+		status        int
+		code, message string
+	}{
+		"/invalid":  {http.StatusBadRequest, "invalid_request", "bad page"},
+		"/missing":  {http.StatusNotFound, "not_found", NotFound.Message},
+		"/broken":   {http.StatusInternalServerError, "internal", Internal.Message},
+		"/upstream": {http.StatusBadGateway, "upstream_failed", UpstreamFailed.Message},
+		"/answered": {http.StatusOK, "", ""},
+	} {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		var body struct {
+			Code    string `json:"code"`
+			Message string `json:"error"`
+		}
+		if err := json.NewDecoder(w.Body).Decode(&body); err != nil {
+			t.Fatalf("%s: %v", path, err)
+		}
+		if w.Code != want.status || body.Code != want.code || body.Message != want.message {
+			t.Errorf("%s answered %d %+v, want %+v", path, w.Code, body, want)
+		}
+	}
+}
+
+func TestWithDetailCopies(t *testing.T) {
+	limited := RateLimited.WithDetail("retry_after", 30)
+	if RateLimited.Details != nil {
+		t.Fatal("WithDetail changed the catalog error")
+	}
+	if limited.Code != RateLimited.Code || limited.Details["retry_after"] != 30 {
+		t.Errorf("unexpected error %+v", limited)
+	}
+}
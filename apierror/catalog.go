@@ -0,0 +1,44 @@
+package apierror
+
+import "net/http"
+
+// The catalog. A new code needs its line in ERRORS.md, the test of the package checks it is there.
+var (
+	InvalidRequest = New(http.StatusBadRequest, "invalid_request", "invalid request")
+	NotFound       = New(http.StatusNotFound, "not_found", "not found")
+
+	Unauthenticated    = New(http.StatusUnauthorized, "unauthenticated", "not authenticated")
+	TokenExpired       = New(http.StatusUnauthorized, "token_expired", "token expired")
+	InvalidToken       = New(http.StatusUnauthorized, "invalid_token", "token is not valid")
+	TokenRevoked       = New(http.StatusUnauthorized, "token_revoked", "token has been revoked")
+	InvalidCredentials = New(http.StatusUnauthorized, "invalid_credentials", "email or password is incorrect")
+	AlreadyLoggedIn    = New(http.StatusConflict, "already_logged_in", "already logged in")
+	EmailNotVerified   = New(http.StatusForbidden, "email_not_verified", "please verify your email first")
+	EmailTaken         = New(http.StatusConflict, "email_taken", "email has been registered")
+	OTPIncorrect       = New(http.StatusBadRequest, "otp_incorrect", "otp is incorrect")
+	OTPExpired         = New(http.StatusBadRequest, "otp_expired", "otp has been expired")
+
+	ConversationNotFound = New(http.StatusNotFound, "conversation_not_found", "conversation not found or does not belong to the user")
+	NotInTrash           = New(http.StatusNotFound, "not_in_trash", "conversation not found in the trash")
+	MessageNotFound      = New(http.StatusNotFound, "message_not_found", "message not found")
+	VersionNotFound      = New(http.StatusNotFound, "version_not_found", "version not found")
+	AnswerInProgress     = New(http.StatusConflict, "answer_in_progress", "the answer is still being generated, try again once it is done")
+	FolderNotFound       = New(http.StatusNotFound, "folder_not_found", "folder not found")
+	FolderExists         = New(http.StatusConflict, "folder_exists", "a folder with this name already exists")
+	ShareNotFound        = New(http.StatusNotFound, "share_not_found", "shared conversation not found")
+
+	SemanticSearchDisabled = New(http.StatusNotImplemented, "semantic_search_disabled", "semantic search is not enabled")
+	PayloadTooLarge        = New(http.StatusRequestEntityTooLarge, "payload_too_large", "request is too large")
+	RateLimited            = New(http.StatusTooManyRequests, "rate_limited", "too many requests, please try again later")
+	ServerRestarting       = New(http.StatusServiceUnavailable, "server_restarting", "server is restarting, try again in a moment")
+	UpstreamFailed         = New(http.StatusBadGateway, "upstream_failed", "a service the server depends on failed, please try again")
+	Internal               = New(http.StatusInternalServerError, "internal", "something went wrong, please try again")
+)
+
+// Catalog lists every error above.
+var Catalog = []*Error{
+	InvalidRequest, NotFound,
+	Unauthenticated, TokenExpired, InvalidToken, TokenRevoked, InvalidCredentials, AlreadyLoggedIn, EmailNotVerified, EmailTaken, OTPIncorrect, OTPExpired,
+	ConversationNotFound, NotInTrash, MessageNotFound, VersionNotFound, AnswerInProgress, FolderNotFound, FolderExists, ShareNotFound,
+	SemanticSearchDisabled, PayloadTooLarge, RateLimited, ServerRestarting, UpstreamFailed, Internal,
+}
@@ -0,0 +1,238 @@
+// Package app holds what the HTTP handlers depend on. Storage is reached through the store interfaces below, one per
+// group of routes, so an App can be built on MongoDB and Redis in main or on fakes in tests.
+package app
+
+import (
+	"context"
+	"server/apierror"
+	"server/auth"
+	"server/config"
+	"server/logging"
+	"server/model"
+	"server/ratelimit"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+type UserStore interface {
+	EmailTaken(email string) (bool, error)
+	// CreateUser hashes the password of user and sets its ID
+	CreateUser(user *model.User) error
+	// Login returns the id and the name of the user owning email when password matches
+	Login(email, password string) (string, string, error)
+}
+
+// ConversationStore keeps the conversations of the users, the stores after it their messages, folders, shares, files
+// and search. model.MongoConversations implements them all. Every method taking a userID fails when the conversation
+// does not belong to that user.
+type ConversationStore interface {
+	CheckOwner(conversationID, userID primitive.ObjectID) error
+	List(userID primitive.ObjectID, filter model.ConversationFilter, cursor string, limit int) (*model.ConversationPage, error)
+	// ListPage is the page-numbered list of older clients
+	ListPage(userID primitive.ObjectID, page int64, filter model.ConversationFilter) (*[]model.ConversationSummary, error)
+	// ListAll is the whole list of the clients written before pages
+	ListAll(userID primitive.ObjectID, filter model.ConversationFilter) (*[]model.ConversationSummary, error)
+	Get(conversationID, userID primitive.ObjectID) (*model.Conversation, error)
+	// AskNew and Ask save the question and return before the answer is generated, it is streamed over the websocket.
+	// The methods asking the model take the context of the request for its trace only: the question is saved and
+	// answered even when the request is canceled.
+	AskNew(ctx context.Context, userID primitive.ObjectID, content, mode, cid string) (primitive.ObjectID, error)
+	Ask(ctx context.Context, conversationID, userID primitive.ObjectID, content, cid string) error
+	Update(conversationID, userID primitive.ObjectID, changes model.ConversationUpdate) (*model.Conversation, error)
+	Delete(conversationID, userID primitive.ObjectID) error
+	Restore(conversationID, userID primitive.ObjectID) error
+	Trash(userID primitive.ObjectID) ([]model.ConversationSummary, error)
+}
+
+// MessageStore keeps the messages of the conversations, their branches and the versions of the answers.
+type MessageStore interface {
+	Messages(conversationID, userID, after, before primitive.ObjectID, limit int) (*model.MessagePage, error)
+	Message(conversationID, userID, messageID primitive.ObjectID) (*model.Message, error)
+	DeleteMessage(conversationID, userID, messageID primitive.ObjectID) error
+	PinMessage(conversationID, userID, messageID primitive.ObjectID, pinned bool) error
+	CopyMessage(conversationID, userID, messageID, targetID primitive.ObjectID) (*model.Message, error)
+	EditMessage(ctx context.Context, conversationID, userID, messageID primitive.ObjectID, content, cid string) error
+	Branches(conversationID, userID, messageID primitive.ObjectID) ([]model.Message, int, error)
+	SwitchBranch(conversationID, userID, messageID primitive.ObjectID) error
+	Regenerate(ctx context.Context, conversationID, userID primitive.ObjectID) error
+	SelectVersion(conversationID, userID, messageID primitive.ObjectID, index int) (*model.Message, error)
+}
+
+// FolderStore files the conversations in folders and tags them.
+type FolderStore interface {
+	Folders(userID primitive.ObjectID) (*model.FolderList, error)
+	CreateFolder(userID primitive.ObjectID, name string) (*model.Folder, error)
+	RenameFolder(folderID, userID primitive.ObjectID, name string) error
+	DeleteFolder(folderID, userID primitive.ObjectID) error
+	// Move puts the conversation in the folder, a zero folderID takes it out of its folder
+	Move(conversationID, userID, folderID primitive.ObjectID) error
+	SetTags(conversationID, userID primitive.ObjectID, tags []string) ([]string, error)
+	Tags(userID primitive.ObjectID) ([]model.TagCount, error)
+}
+
+// ShareStore keeps the read-only links to a copy of a conversation.
+type ShareStore interface {
+	Share(conversationID, userID primitive.ObjectID, expiresIn time.Duration) (*model.Share, error)
+	Shares(conversationID, userID primitive.ObjectID) ([]model.Share, error)
+	// GetShare needs no user, anyone with the token can read the share
+	GetShare(token string) (*model.Share, error)
+	RevokeShare(token string, userID primitive.ObjectID) error
+	ForkShare(token string, userID primitive.ObjectID) (*model.Conversation, error)
+}
+
+// TransferStore moves conversations in and out of the server as files.
+type TransferStore interface {
+	Export(conversationID, userID primitive.ObjectID, format string) (*model.Export, error)
+	ExportMany(conversationIDs []primitive.ObjectID, userID primitive.ObjectID, format string) (*model.Export, error)
+	Import(userID primitive.ObjectID, format string, data []byte) ([]model.ImportResult, error)
+}
+
+// SearchStore finds the messages of a user by their words or by their meaning.
+type SearchStore interface {
+	Search(userID primitive.ObjectID, query string, limit int) ([]model.SearchResult, error)
+	SemanticSearch(userID primitive.ObjectID, query string, limit int) ([]model.SemanticResult, error)
+}
+
+// SessionStore keeps the short-lived state of the registration and the users whose tokens are refused.
+type SessionStore interface {
+	SaveOTP(email, otp string, ttl time.Duration) error
+	// VerifyOTP consumes the code, it fails when the code is wrong or expired
+	VerifyOTP(email, otp string) error
+	IssueRegisterToken(email string) (string, error)
+	// ConsumeRegisterToken tells whether token was issued for email, a token can only be used once
+	ConsumeRegisterToken(email, token string) bool
+	IsBlacklisted(userID string) bool
+}
+
+type Mailer interface {
+	SendOTP(to, otp string) error
+}
+
+type App struct {
+	Config        *config.Config
+	Users         UserStore
+	Conversations ConversationStore
+	Messages      MessageStore
+	Folders       FolderStore
+	Shares        ShareStore
+	Transfers     TransferStore
+	Search        SearchStore
+	Sessions      SessionStore
+	Mailer        Mailer
+	// Signs and verifies the jwt_token cookies of the sessions
+	Tokens *auth.Tokens
+	// Nil turns rate limiting off
+	Limiter *ratelimit.Limiter
+
+	// Set on shutdown, the routes asking the model then answer 503 so clients retry on the next instance
+	draining atomic.Bool
+}
+
+const userIDKey = "userID"
+
+// Limit applies rule to the routes it is added to.
+func (a *App) Limit(rule ratelimit.Rule) gin.HandlerFunc {
+	if a.Limiter == nil {
+		return func(c *gin.Context) { c.Next() }
+	}
+	return a.Limiter.Limit(rule)
+}
+
+// Budgets of the rate limiter, set in the rate_limit section of the configuration. The routes calling the model or
+// Gemini and the ones sending emails are stricter than the global budget.
+func (a *App) GlobalRule() ratelimit.Rule { return a.rule("global", a.Config.RateLimit.Global) }
+func (a *App) AskRule() ratelimit.Rule    { return a.rule("ask", a.Config.RateLimit.Ask) }
+func (a *App) TopicRule() ratelimit.Rule  { return a.rule("topic", a.Config.RateLimit.Topic) }
+func (a *App) AuthRule() ratelimit.Rule   { return a.rule("auth", a.Config.RateLimit.Auth) }
+
+func (a *App) rule(name string, cfg config.RateLimitRule) ratelimit.Rule {
+	rule := ratelimit.Rule{Name: name, Limit: cfg.Limit, Window: cfg.Window, Key: ratelimit.ByUser(a.Tokens)}
+	switch cfg.Key {
+	case "ip":
+		rule.Key = ratelimit.ByIP
+	case "api_key":
+		rule.Key = ratelimit.ByAPIKey(a.Config.RateLimit.APIKeys, a.Tokens)
+	}
+	return rule
+}
+
+// Drain makes AcceptAsks refuse new questions.
+func (a *App) Drain() {
+	a.draining.Store(true)
+}
+
+// AcceptAsks guards the routes asking the model, which are refused once the server is shutting down.
+func (a *App) AcceptAsks(c *gin.Context) {
+	if a.draining.Load() {
+		c.Header("Retry-After", "5")
+		apierror.Abort(c, apierror.ServerRestarting)
+		return
+	}
+	c.Next()
+}
+
+// RequireUser lets through the requests carrying a valid jwt_token cookie of a user that is not blacklisted,
+// the handlers then get the user with UserID.
+func (a *App) RequireUser(c *gin.Context) {
+	cookie, err := c.Request.Cookie("jwt_token")
+	if err != nil {
+		apierror.Abort(c, apierror.Unauthenticated)
+		return
+	}
+	claims, err := a.Tokens.VerifyJWT(cookie.Value)
+	if auth.IsExpired(err) {
+		apierror.Abort(c, apierror.TokenExpired)
+		return
+	}
+	if err != nil {
+		apierror.Abort(c, apierror.InvalidToken)
+		return
+	}
+	if a.Sessions.IsBlacklisted(claims.UserID) {
+		apierror.Abort(c, apierror.TokenRevoked)
+		return
+	}
+	userID, err := primitive.ObjectIDFromHex(claims.UserID)
+	if err != nil {
+		apierror.Abort(c, apierror.InvalidToken)
+		return
+	}
+	c.Set(userIDKey, userID)
+	logging.Add(c.Request.Context(), "user_id", claims.UserID)
+	c.Next()
+}
+
+// RequireGuest keeps the routes of the registration and the login for the requests without a usable token.
+func (a *App) RequireGuest(c *gin.Context) {
+	cookie, err := c.Request.Cookie("jwt_token")
+	if err != nil {
+		c.Next()
+		return
+	}
+	claims, err := a.Tokens.VerifyJWT(cookie.Value)
+	if err != nil || a.Sessions.IsBlacklisted(claims.UserID) {
+		c.Next()
+		return
+	}
+	apierror.Abort(c, apierror.AlreadyLoggedIn)
+}
+
+// UserID returns the user let through by RequireUser.
+func UserID(c *gin.Context) primitive.ObjectID {
+	return c.MustGet(userIDKey).(primitive.ObjectID)
+}
+
+// ParamID reads the object id in the path parameter name. When it is not one it fails the request with
+// invalid_request "invalid <what> id" and returns false.
+func ParamID(c *gin.Context, name, what string) (primitive.ObjectID, bool) {
+	id, err := primitive.ObjectIDFromHex(c.Param(name))
+	if err != nil {
+		c.Error(apierror.Invalid("invalid " + what + " id"))
+		return id, false
+	}
+	logging.Add(c.Request.Context(), what+"_id", id.Hex())
+	return id, true
+}
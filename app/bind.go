@@ -0,0 +1,87 @@
+package app
+
+import (
+	"errors"
+	"reflect"
+	"regexp"
+	"server/apierror"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+	"github.com/go-playground/validator/v10"
+)
+
+func init() {
+	// Name the fields in the validation errors as the clients send them
+	if v, ok := binding.Validator.Engine().(*validator.Validate); ok {
+		v.RegisterTagNameFunc(func(field reflect.StructField) string {
+			for _, key := range []string{"json", "form"} {
+				if name, _, _ := strings.Cut(field.Tag.Get(key), ","); name != "" && name != "-" {
+					return name
+				}
+			}
+			return field.Name
+		})
+	}
+}
+
+// Bind reads the request into obj and checks the binding tags of its fields. The body is read as JSON or as a form
+// depending on its Content-Type, so the routes kept for older clients sending forms bind the same structs. A request
+// without body binds the query. When it fails the request fails with invalid_request and Bind returns false.
+func Bind(c *gin.Context, obj interface{}) bool {
+	var err error
+	if c.Request.ContentLength == 0 {
+		err = c.ShouldBindWith(obj, binding.Form)
+	} else {
+		err = c.ShouldBind(obj)
+	}
+	if err != nil {
+		c.Error(bindError(err))
+		return false
+	}
+	return true
+}
+
+func bindError(err error) *apierror.Error {
+	var fields validator.ValidationErrors
+	if !errors.As(err, &fields) {
+		return apierror.Invalid("invalid request: " + err.Error())
+	}
+	invalid := make(map[string]string, len(fields))
+	for _, field := range fields {
+		invalid[field.Field()] = field.Tag()
+	}
+	first := fields[0]
+	var message string
+	switch first.Tag() {
+	case "required":
+		message = first.Field() + " is required"
+	case "email":
+		message = first.Field() + " must be an email address"
+	case "oneof":
+		message = first.Field() + " must be one of " + strings.Join(strings.Fields(first.Param()), ", ")
+	case "min", "gte":
+		message = first.Field() + " must be at least " + first.Param()
+	case "max", "lte":
+		message = first.Field() + " must be at most " + first.Param()
+	default:
+		message = first.Field() + " is invalid"
+	}
+	return apierror.Invalid(message).WithDetail("fields", invalid)
+}
+
+var routeParam = regexp.MustCompile(`:(\w+)`)
+
+// Deprecated marks the routes kept for the clients written before /v1. The answers tell those clients the route
+// is deprecated and link its successor, whose :params are filled from the request.
+func Deprecated(successor string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		link := routeParam.ReplaceAllStringFunc(successor, func(param string) string {
+			return c.Param(param[1:])
+		})
+		c.Header("Deprecation", "true")
+		c.Header("Link", "<"+link+`>; rel="successor-version"`)
+		c.Next()
+	}
+}
@@ -0,0 +1,39 @@
+package app
+
+import (
+	"errors"
+	"server/apierror"
+	"server/model"
+
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+var modelErrors = map[error]*apierror.Error{
+	model.ErrConversationNotFound:   apierror.ConversationNotFound,
+	model.ErrNotInTrash:             apierror.NotInTrash,
+	model.ErrMessageNotFound:        apierror.MessageNotFound,
+	model.ErrVersionNotFound:        apierror.VersionNotFound,
+	model.ErrAnswerInProgress:       apierror.AnswerInProgress,
+	model.ErrFolderNotFound:         apierror.FolderNotFound,
+	model.ErrFolderExists:           apierror.FolderExists,
+	model.ErrShareNotFound:          apierror.ShareNotFound,
+	model.ErrInvalidCredentials:     apierror.InvalidCredentials,
+	model.ErrOTPIncorrect:           apierror.OTPIncorrect,
+	model.ErrOTPExpired:             apierror.OTPExpired,
+	model.ErrSemanticSearchDisabled: apierror.SemanticSearchDisabled,
+	mongo.ErrNoDocuments:            apierror.NotFound,
+}
+
+// Translate returns the catalog error of an error of the stores, or nil when it is not one the client can act on.
+func Translate(err error) *apierror.Error {
+	var input *model.InvalidInput
+	if errors.As(err, &input) {
+		return apierror.Invalid(input.Message)
+	}
+	for modelErr, apiErr := range modelErrors {
+		if errors.Is(err, modelErr) {
+			return apiErr
+		}
+	}
+	return nil
+}
@@ -3,11 +3,23 @@ package auth
 import (
 	"errors"
 	"github.com/golang-jwt/jwt/v5"
-	"os"
+	"server/config"
 	"time"
 )
 
-var secretKey = []byte(os.Getenv("JWT_SECRET"))
+// Tokens signs and verifies the tokens of the sessions with the key of the settings.
+type Tokens struct {
+	secretKey []byte
+	tokenTTL  time.Duration
+}
+
+var errNotConfigured = errors.New("jwt secret is not configured")
+
+// NewTokens uses the key signing the tokens and how long they stay valid of cfg. Without a key tokens can neither
+// be signed nor verified.
+func NewTokens(cfg config.Auth) *Tokens {
+	return &Tokens{secretKey: []byte(cfg.JWTSecret), tokenTTL: cfg.TokenTTL}
+}
 
 // CustomClaims extends jwt.RegisteredClaims to include custom fields
 type CustomClaims struct {
@@ -16,24 +28,30 @@ type CustomClaims struct {
 }
 
 // GenerateJWT creates a new JWT token
-func GenerateJWT(userID string) (string, error) {
+func (t *Tokens) GenerateJWT(userID string) (string, error) {
+	if len(t.secretKey) == 0 {
+		return "", errNotConfigured
+	}
 	claims := CustomClaims{
 		UserID: userID,
 		RegisteredClaims: jwt.RegisteredClaims{
-			ExpiresAt: jwt.NewNumericDate(time.Now().Add(24 * time.Hour)),
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(t.tokenTTL)),
 			IssuedAt:  jwt.NewNumericDate(time.Now()),
 			NotBefore: jwt.NewNumericDate(time.Now()),
 		},
 	}
 
 	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	return token.SignedString(secretKey)
+	return token.SignedString(t.secretKey)
 }
 
 // VerifyJWT checks if the provided token is valid
-func VerifyJWT(tokenString string) (*CustomClaims, error) {
+func (t *Tokens) VerifyJWT(tokenString string) (*CustomClaims, error) {
+	if len(t.secretKey) == 0 {
+		return nil, errNotConfigured
+	}
 	token, err := jwt.ParseWithClaims(tokenString, &CustomClaims{}, func(token *jwt.Token) (interface{}, error) {
-		return secretKey, nil
+		return t.secretKey, nil
 	})
 
 	if err != nil {
@@ -47,6 +65,11 @@ func VerifyJWT(tokenString string) (*CustomClaims, error) {
 	return nil, errors.New("invalid token")
 }
 
+// IsExpired tells whether VerifyJWT failed only because the token expired, such a user just has to log in again.
+func IsExpired(err error) bool {
+	return errors.Is(err, jwt.ErrTokenExpired)
+}
+
 // DecodeJWT decodes the JWT without verifying the signature
 func DecodeJWT(tokenString string) (*CustomClaims, error) {
 	token, _, err := new(jwt.Parser).ParseUnverified(tokenString, &CustomClaims{})
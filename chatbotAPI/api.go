@@ -2,15 +2,31 @@ package chatbotapi
 
 import (
 	"bufio"
+	"context"
 	"encoding/json"
 	"fmt"
+	"log/slog"
 	"net/http"
-	"time"
-	"os"
+	"server/config"
+	"server/metrics"
+	"server/tracing"
 	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
-var test = os.Getenv("MODEL_API_URL")
-func GetStreamingResponseFromModelAPIDemo() <-chan string {
+
+// Client asks the model API of its settings.
+type Client struct {
+	settings config.ModelAPI
+}
+
+func New(cfg config.ModelAPI) *Client {
+	return &Client{settings: cfg}
+}
+
+func (c *Client) GetStreamingResponseFromModelAPIDemo() <-chan string {
 	tokenChan := make(chan string)
 
 	go func() {
@@ -26,9 +42,9 @@ func GetStreamingResponseFromModelAPIDemo() <-chan string {
 		// }
 
 		// Create a new request
-		req, err := http.NewRequest("GET", os.Getenv("MODEL_API_URL_DEMO"), strings.NewReader("abc"))
+		req, err := http.NewRequest("GET", c.settings.DemoURL, strings.NewReader("abc"))
 		if err != nil {
-			fmt.Println("Error creating request:", err)
+			slog.Error("failed to create the demo request", "error", err)
 			return
 		}
 
@@ -40,14 +56,14 @@ func GetStreamingResponseFromModelAPIDemo() <-chan string {
 		client := &http.Client{}
 		resp, err := client.Do(req)
 		if err != nil {
-			fmt.Println("Error sending request:", err)
+			slog.Error("failed to send the demo request", "error", err)
 			return
 		}
 		defer resp.Body.Close()
 
 		// Check the response status
 		if resp.StatusCode != http.StatusOK {
-			fmt.Println("Unexpected status code:", resp.StatusCode)
+			slog.Error("unexpected status from the demo model", "status", resp.StatusCode)
 			return
 		}
 
@@ -59,34 +75,82 @@ func GetStreamingResponseFromModelAPIDemo() <-chan string {
 		}
 
 		if err := scanner.Err(); err != nil {
-			fmt.Println("Error reading response:", err)
+			slog.Error("failed to read the demo response", "error", err)
 		}
 	}()
 
 	return tokenChan
 }
-func GetStreamingResponseFromModelAPI(message,mode string, id string, isFirst bool,cid string) <-chan string {
+// HistoryMessage is one turn of the conversation, sent when the answer has to be generated from another branch
+// than the one the model API keeps for this conversation_id.
+type HistoryMessage struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
+}
+
+func (c *Client) GetStreamingResponseFromModelAPI(message,mode string, id string, isFirst bool,cid string) <-chan string {
+	return c.GetStreamingResponseFromModelAPIWithHistory(message, mode, id, isFirst, cid, nil)
+}
+func (c *Client) GetStreamingResponseFromModelAPIWithHistory(message,mode string, id string, isFirst bool,cid string, history []HistoryMessage) <-chan string {
+	return c.OpenStream(context.Background(), message, mode, id, isFirst, cid, history).Tokens
+}
+
+// Stream is a response of the model API being read. When something goes wrong an apology is still sent as the last token
+// so the user sees it, Err tells the caller about it once Tokens is closed.
+type Stream struct {
+	Tokens <-chan string
+	err    error
+}
+
+// Err returns why the response was cut short, nil when the model API answered completely. It is only valid once Tokens is closed.
+func (s *Stream) Err() error {
+	return s.err
+}
+
+// OpenStream asks the model API and streams its answer. The request is traced as a child of the span in ctx and passes
+// the trace on to the model API in the traceparent header. Cancelling ctx stops it like the timeout of the settings does,
+// but without an apology: whoever cancelled it is not waiting for the answer anymore.
+func (c *Client) OpenStream(ctx context.Context, message, mode string, id string, isFirst bool, cid string, history []HistoryMessage) *Stream {
 	if mode != "1" && mode != "2" {
 		mode = "1"
 	}
 	// Create a channel to send tokens
 	tokenChan := make(chan string)
+	stream := &Stream{Tokens: tokenChan}
+	ctx, span := tracing.Start(ctx, "model API stream", trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(
+		attribute.String("chatbot.mode", mode),
+		attribute.String("chatbot.conversation_id", id),
+	))
 
 	go func() {
 		// Close the channel when the function returns
 		defer close(tokenChan)
+		defer span.End()
+		defer func() {
+			if stream.err != nil {
+				tracing.Fail(span, stream.err)
+				slog.WarnContext(ctx, "model API stream failed", "mode", mode, "error", stream.err)
+			}
+		}()
 
 		// Prepare the request body
-		reqBody := map[string]string{"query": message, "conversation_id": id, "is_first": fmt.Sprintf("%t", isFirst),"mode":mode,"cid":cid}
+		reqBody := map[string]interface{}{"query": message, "conversation_id": id, "is_first": fmt.Sprintf("%t", isFirst),"mode":mode,"cid":cid}
+		if history != nil {
+			reqBody["history"] = history
+		}
 		jsonBody, err := json.Marshal(reqBody)
 		if err != nil {
+			metrics.ModelErrors.WithLabelValues(metrics.ModelErrorRequest).Inc()
+			stream.err = err
 			tokenChan <- "Sorry, something went wrong while processing your request"
 			return
 		}
 
 		// Create a new request
-		req, err := http.NewRequest("POST", os.Getenv("MODEL_API_URL"), strings.NewReader(string(jsonBody)))
+		req, err := http.NewRequestWithContext(ctx, "POST", c.settings.URL, strings.NewReader(string(jsonBody)))
 		if err != nil {
+			metrics.ModelErrors.WithLabelValues(metrics.ModelErrorRequest).Inc()
+			stream.err = err
 			tokenChan <- "Sorry, there was an error connecting to the service"
 			return
 		}
@@ -94,35 +158,51 @@ func GetStreamingResponseFromModelAPI(message,mode string, id string, isFirst bo
 		// Set headers
 		req.Header.Set("Content-Type", "application/json")
 		req.Header.Set("ngrok-skip-browser-warning", "hello")
+		tracing.InjectHeaders(ctx, req.Header)
 
 		// Send the request
 		client := &http.Client{
-			Timeout: 60 * time.Second,
+			Timeout: c.settings.Timeout,
 		}
+		start := time.Now()
 		resp, err := client.Do(req)
 		if err != nil {
-			fmt.Println("Error sending request:", err)
+			stream.err = err
+			if ctx.Err() != nil {
+				return
+			}
 			if strings.Contains(err.Error(), "timeout") {
+				metrics.ModelErrors.WithLabelValues(metrics.ModelErrorTimeout).Inc()
 				tokenChan <- "Sorry, the request timed out. Please try again"
 			} else {
+				metrics.ModelErrors.WithLabelValues(metrics.ModelErrorNetwork).Inc()
 				tokenChan <- "Sorry, there was a network error. Please check your connection"
 			}
 			return
 		}
 		defer resp.Body.Close()
+		span.SetAttributes(attribute.Int("http.response.status_code", resp.StatusCode))
 
 		// Check the response status
 		if resp.StatusCode != http.StatusOK {
-			fmt.Println("Unexpected status code:", resp.StatusCode)
+			metrics.ModelErrors.WithLabelValues(metrics.ModelErrorStatus).Inc()
+			stream.err = fmt.Errorf("model API answered with status %d", resp.StatusCode)
 			tokenChan <- fmt.Sprintf("Sorry, received unexpected response (Status: %d)", resp.StatusCode)
 			return
 		}
 
 		// Read the response body line by line
 		scanner := bufio.NewScanner(resp.Body)
+		tokens := 0
 		for scanner.Scan() {
 			token := scanner.Text()
 			if token != "" {
+				if tokens == 0 {
+					metrics.ModelFirstToken.WithLabelValues(mode).Observe(time.Since(start).Seconds())
+					span.AddEvent("first token")
+				}
+				tokens++
+				metrics.ModelTokens.Inc()
 				tokenChan <- token + "\n"
 			}
 			
@@ -130,11 +210,18 @@ func GetStreamingResponseFromModelAPI(message,mode string, id string, isFirst bo
 			time.Sleep(100 * time.Millisecond)
 		}
 
+		span.SetAttributes(attribute.Int("chatbot.tokens", tokens))
 		if err := scanner.Err(); err != nil {
-			fmt.Println("Error reading response:", err)
+			stream.err = err
+			if ctx.Err() != nil {
+				return
+			}
+			metrics.ModelErrors.WithLabelValues(metrics.ModelErrorRead).Inc()
 			tokenChan <- "Sorry, there was an error reading the response"
+			return
 		}
+		metrics.ModelGeneration.WithLabelValues(mode).Observe(time.Since(start).Seconds())
 	}()
 
-	return tokenChan
+	return stream
 }
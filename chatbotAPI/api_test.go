@@ -1,65 +1,148 @@
 package chatbotapi_test
 
 import (
-	"fmt"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
 	"server/chatbotAPI"
+	"server/chatbotAPI/chatbotapitest"
+	"server/config"
+	"strings"
 	"testing"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace/noop"
 )
 
 func TestGetStreamingResponseFromModelAPI(t *testing.T) {
-	for token := range chatbotapi.GetStreamingResponseFromModelAPI("Nước bọt giúp tiêu hóa như thế nào?","1", "123",true,"test") {
-		fmt.Print(token)
+	model := chatbotapitest.NewServer(chatbotapitest.Echo)
+	defer model.Close()
+	client := chatbotapi.New(config.ModelAPI{URL: model.URL, Timeout: 5 * time.Second})
+
+	var tokens []string
+	for token := range client.GetStreamingResponseFromModelAPI("Nước bọt giúp tiêu hóa như thế nào?", "1", "123", true, "test") {
+		tokens = append(tokens, token)
+	}
+	want := []string{"You asked:\n", "Nước bọt giúp tiêu hóa như thế nào?\n", chatbotapitest.TopicPrefix + "Echo\n"}
+	if len(tokens) != len(want) {
+		t.Fatalf("got tokens %q, want %q", tokens, want)
+	}
+	for i := range want {
+		if tokens[i] != want[i] {
+			t.Errorf("token %d is %q, want %q", i, tokens[i], want[i])
+		}
+	}
+	requests := model.Requests()
+	if len(requests) != 1 || requests[0].ConversationID != "123" || requests[0].IsFirst != "true" || requests[0].Cid != "test" {
+		t.Errorf("unexpected requests %+v", requests)
 	}
-	fmt.Println("Channel is closed, all data received!!")
 }
 
-// func TestCurl(t *testing.T){
-// 	response, err := http.Get("https://9e5c-34-87-53-195.ngrok-free.app/ping")
-// 	if err != nil {
-// 		fmt.Println("Error:", err)
-// 		return
-// 	}
-// 	defer response.Body.Close()
+func TestStreamReportsErrorStatus(t *testing.T) {
+	model := chatbotapitest.NewServer(func(chatbotapitest.Request) chatbotapitest.Reply {
+		return chatbotapitest.Reply{Status: http.StatusServiceUnavailable}
+	})
+	defer model.Close()
+	client := chatbotapi.New(config.ModelAPI{URL: model.URL, Timeout: 5 * time.Second})
 
-// 	// Read the response body
-// 	body, err := io.ReadAll(response.Body) // Use io.ReadAll() instead of ioutil.ReadAll()
-// 	if err != nil {
-// 		fmt.Println("Error:", err)
-// 		return
-// 	}
+	stream := client.OpenStream(context.Background(), "Xin chào", "1", "123", false, "", nil)
+	var tokens []string
+	for token := range stream.Tokens {
+		tokens = append(tokens, token)
+	}
+	if stream.Err() == nil {
+		t.Fatal("expected an error for status 503")
+	}
+	if len(tokens) != 1 {
+		t.Errorf("expected the apology only, got %q", tokens)
+	}
+}
 
-// 	// Print the response
-// 	fmt.Println(string(body))
-// }
-// func TestPost(t *testing.T){
-// 	data := map[string]string{
-// 		"title":  "foo",
-// 		"body":   "bar",
-// 		"userId": "1",
-// 	}
+func TestStreamReportsCutAnswers(t *testing.T) {
+	model := chatbotapitest.NewServer(func(chatbotapitest.Request) chatbotapitest.Reply {
+		return chatbotapitest.Reply{Tokens: []string{"Một", "hai", "ba"}, FailAfter: 2}
+	})
+	defer model.Close()
+	client := chatbotapi.New(config.ModelAPI{URL: model.URL, Timeout: 5 * time.Second})
 
-// 	// Convert data to JSON format
-// 	jsonData, err := json.Marshal(data)
-// 	if err != nil {
-// 		fmt.Println("Error:", err)
-// 		return
-// 	}
+	stream := client.OpenStream(context.Background(), "Đếm đến ba", "1", "123", false, "", nil)
+	var tokens []string
+	for token := range stream.Tokens {
+		tokens = append(tokens, token)
+	}
+	if stream.Err() == nil {
+		t.Fatal("expected an error for an answer cut short")
+	}
+	if len(tokens) != 3 || tokens[0] != "Một\n" || tokens[1] != "hai\n" {
+		t.Errorf("expected two tokens and the apology, got %q", tokens)
+	}
+}
 
-// 	// Send a POST request
-// 	response, err := http.Post("https://7efb-34-87-53-195.ngrok-free.app/submit", "application/json", bytes.NewBuffer(jsonData))
-// 	if err != nil {
-// 		fmt.Println("Error:", err)
-// 		return
-// 	}
-// 	defer response.Body.Close()
+func TestStreamPropagatesTheTrace(t *testing.T) {
+	traceparent := make(chan string, 1)
+	model := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		traceparent <- r.Header.Get("traceparent")
+		w.Write([]byte("Xin chào\n"))
+	}))
+	defer model.Close()
+	client := chatbotapi.New(config.ModelAPI{URL: model.URL, Timeout: 5 * time.Second})
 
-// 	// Read the response body
-// 	body, err := io.ReadAll(response.Body) // Use io.ReadAll() instead of ioutil.ReadAll()
-// 	if err != nil {
-// 		fmt.Println("Error:", err)
-// 		return
-// 	}
+	spans := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(spans))
+	otel.SetTracerProvider(provider)
+	defer otel.SetTracerProvider(noop.NewTracerProvider())
+	ctx, request := provider.Tracer("test").Start(context.Background(), "request")
+	stream := client.OpenStream(ctx, "Xin chào", "1", "123", false, "", nil)
+	for range stream.Tokens {
+	}
+	request.End()
+
+	traceID := request.SpanContext().TraceID().String()
+	if header := <-traceparent; !strings.Contains(header, traceID) {
+		t.Errorf("traceparent %q is not in the trace %s", header, traceID)
+	}
+	ended := spans.Ended()
+	if len(ended) != 2 || ended[0].Name() != "model API stream" || ended[0].Parent().SpanID() != request.SpanContext().SpanID() {
+		t.Fatalf("expected the model API span under the request, got %v", ended)
+	}
+}
+
+func TestStreamStopsWhenCancelled(t *testing.T) {
+	model := chatbotapitest.NewServer(func(chatbotapitest.Request) chatbotapitest.Reply {
+		return chatbotapitest.Reply{Tokens: []string{"first", "second", "third"}, TokenDelay: time.Hour}
+	})
+	defer model.Close()
+	client := chatbotapi.New(config.ModelAPI{URL: model.URL, Timeout: time.Hour})
 
-// 	// Print the response
-// 	fmt.Println(string(body))
-// }
+	ctx, cancel := context.WithCancel(context.Background())
+	stream := client.OpenStream(ctx, "Xin chào", "1", "123", false, "", nil)
+	if token := <-stream.Tokens; token != "first\n" {
+		t.Fatalf("first token is %q", token)
+	}
+	cancel()
+
+	var tokens []string
+	timeout := time.After(5 * time.Second)
+	for closed := false; !closed; {
+		select {
+		case token, ok := <-stream.Tokens:
+			if !ok {
+				closed = true
+				break
+			}
+			tokens = append(tokens, token)
+		case <-timeout:
+			t.Fatal("the stream kept going after the cancellation")
+		}
+	}
+	if !errors.Is(stream.Err(), context.Canceled) {
+		t.Errorf("Err() = %v, want the cancellation", stream.Err())
+	}
+	if len(tokens) != 0 {
+		t.Errorf("expected no token after the cancellation, got %q", tokens)
+	}
+}
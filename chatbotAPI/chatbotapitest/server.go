@@ -0,0 +1,136 @@
+// Package chatbotapitest fakes the model API for tests and local development. It speaks the protocol OpenStream reads:
+// a JSON POST answered by the tokens one per line, ended by the topic line on the first question of a conversation.
+package chatbotapitest
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"time"
+
+	chatbotapi "server/chatbotAPI"
+)
+
+// TopicPrefix starts the line carrying the topic of a conversation, GenerateResponseAndWebsocket stops reading there.
+const TopicPrefix = "Chủ đề-123: "
+
+// Request is what the server asked the model API.
+type Request struct {
+	Query          string                      `json:"query"`
+	ConversationID string                      `json:"conversation_id"`
+	IsFirst        string                      `json:"is_first"`
+	Mode           string                      `json:"mode"`
+	Cid            string                      `json:"cid"`
+	History        []chatbotapi.HistoryMessage `json:"history,omitempty"`
+}
+
+// Reply is how the fake answers a request. Topic is only sent when the request is the first of its conversation.
+type Reply struct {
+	Tokens []string
+	Topic  string
+	// A status other than 200 is answered without a body
+	Status int
+	// Wait before the first token, like a model reading the question, and between the tokens
+	FirstTokenDelay time.Duration
+	TokenDelay      time.Duration
+	// When positive, the connection is cut after sending that many tokens (or all of them when there are fewer),
+	// as when the model crashes mid-answer
+	FailAfter int
+}
+
+// Handler answers the requests of the model API with answer and records them.
+type Handler struct {
+	answer func(Request) Reply
+
+	mu       sync.Mutex
+	requests []Request
+}
+
+func NewHandler(answer func(Request) Reply) *Handler {
+	return &Handler{answer: answer}
+}
+
+type Server struct {
+	*httptest.Server
+	*Handler
+}
+
+// NewServer starts a fake model API answering every request with answer. It is closed with Close.
+func NewServer(answer func(Request) Reply) *Server {
+	handler := NewHandler(answer)
+	return &Server{Server: httptest.NewServer(handler), Handler: handler}
+}
+
+// Echo answers with the question itself and "Echo" as topic.
+func Echo(r Request) Reply {
+	return Reply{Tokens: []string{"You asked:", r.Query}, Topic: "Echo"}
+}
+
+// Requests returns the requests received so far, oldest first.
+func (h *Handler) Requests() []Request {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return append([]Request(nil), h.requests...)
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var request Request
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	h.mu.Lock()
+	h.requests = append(h.requests, request)
+	h.mu.Unlock()
+
+	reply := h.answer(request)
+	if reply.Status != 0 && reply.Status != http.StatusOK {
+		w.WriteHeader(reply.Status)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	flusher, _ := w.(http.Flusher)
+	lines := reply.Tokens
+	if reply.Topic != "" && request.IsFirst == "true" {
+		lines = append(lines[:len(lines):len(lines)], TopicPrefix+reply.Topic)
+	}
+	if !sleep(r, reply.FirstTokenDelay) {
+		return
+	}
+	for i, line := range lines {
+		if reply.FailAfter > 0 && i == reply.FailAfter {
+			// Aborting the handler closes the connection without ending the chunked body, the client reads an unexpected EOF
+			panic(http.ErrAbortHandler)
+		}
+		if i > 0 && !sleep(r, reply.TokenDelay) {
+			return
+		}
+		w.Write([]byte(line + "\n"))
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+	if reply.FailAfter > 0 {
+		panic(http.ErrAbortHandler)
+	}
+}
+
+// sleep waits for d unless the client goes away first, and tells whether it is still there.
+func sleep(r *http.Request, d time.Duration) bool {
+	if d <= 0 {
+		return true
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-r.Context().Done():
+		return false
+	}
+}
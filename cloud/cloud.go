@@ -5,7 +5,6 @@ import (
 	"fmt"
 	"io"
 	"net/http"
-	"os"
 	"strings"
 )
 
@@ -15,11 +14,11 @@ type PinataResponse struct {
 	PinataApiSecret string `json:"pinata_api_secret"`
 }
 
-func GetSignedJWT(userId string) (string, error) {
+func GetSignedJWT(pinataJWT, userId string) (string, error) {
 	url := "https://api.pinata.cloud/v3/pinata/keys"
 	payload := strings.NewReader(fmt.Sprintf("{\n  \"keyName\": \"key_%s\",\n  \"permissions\": {\n    \"admin\": false,\n    \"endpoints\": {\n      \"pinning\": {\n        \"pinFileToIPFS\": true\n      }\n    }\n  },\n  \"maxUses\": 1\n}", userId))
 	req, _ := http.NewRequest("POST", url, payload)
-	req.Header.Add("Authorization", "Bearer "+os.Getenv("PINATA_JWT"))
+	req.Header.Add("Authorization", "Bearer "+pinataJWT)
 	req.Header.Add("Content-Type", "application/json")
 	res, err := http.DefaultClient.Do(req)
 	if err != nil {
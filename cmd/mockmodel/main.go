@@ -0,0 +1,47 @@
+// Command mockmodel serves a fake model API for local development, so the server can run without the GPU box
+// behind MODEL_API_URL. It speaks the same protocol: a JSON POST answered by one token per line, then the topic line
+// on the first question of a conversation. A script can make it answer some questions slowly, fail mid-answer or
+// answer with an error status, see script.example.yaml.
+//
+//	go run ./cmd/mockmodel -addr :8000 -script cmd/mockmodel/script.example.yaml
+//	MODEL_API_URL=http://localhost:8000 go run .
+package main
+
+import (
+	"flag"
+	"log"
+	"net/http"
+	"time"
+
+	"server/chatbotAPI/chatbotapitest"
+)
+
+func main() {
+	addr := flag.String("addr", ":8000", "address to listen on")
+	scriptPath := flag.String("script", "", "YAML file of scripted replies, every question is echoed without it")
+	firstTokenDelay := flag.Duration("first-token-delay", 300*time.Millisecond, "wait before the first token")
+	tokenDelay := flag.Duration("token-delay", 50*time.Millisecond, "wait between two tokens")
+	flag.Parse()
+
+	defaults := chatbotapitest.Reply{FirstTokenDelay: *firstTokenDelay, TokenDelay: *tokenDelay}
+	s := &script{}
+	if *scriptPath != "" {
+		var err error
+		if s, err = loadScript(*scriptPath); err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("loaded %d scripted replies from %s", len(s.Replies), *scriptPath)
+	}
+
+	handler := chatbotapitest.NewHandler(func(request chatbotapitest.Request) chatbotapitest.Reply {
+		reply, ok := s.reply(request, defaults)
+		if !ok {
+			reply = echo(request, defaults)
+		}
+		log.Printf("conversation %s (first: %s, mode: %s, cid: %s, history: %d): %q -> status %d, %d tokens",
+			request.ConversationID, request.IsFirst, request.Mode, request.Cid, len(request.History), request.Query, reply.Status, len(reply.Tokens))
+		return reply
+	})
+	log.Printf("mock model API listening on %s", *addr)
+	log.Fatal(http.ListenAndServe(*addr, handler))
+}
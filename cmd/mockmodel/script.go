@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"server/chatbotAPI/chatbotapitest"
+
+	"gopkg.in/yaml.v3"
+)
+
+// rule answers the questions it matches, see script.example.yaml.
+type rule struct {
+	// Found in the query, ignoring case. Empty matches every query
+	Match string `yaml:"match"`
+	// Only questions asked in this mode, empty for any mode
+	Mode string `yaml:"mode"`
+	// Each token is sent on its own line. Text is split into lines instead, {query} is replaced by the question
+	Tokens []string `yaml:"tokens"`
+	Text   string   `yaml:"text"`
+	Topic  string   `yaml:"topic"`
+	Status int      `yaml:"status"`
+	// Empty delays use the ones given on the command line
+	FirstTokenDelay *time.Duration `yaml:"first_token_delay"`
+	TokenDelay      *time.Duration `yaml:"token_delay"`
+	FailAfter       int            `yaml:"fail_after"`
+	// When positive, the rule only answers that many times, then the next rules are tried
+	Times int `yaml:"times"`
+}
+
+type script struct {
+	Replies []rule `yaml:"replies"`
+
+	mu   sync.Mutex
+	used []int
+}
+
+func loadScript(path string) (*script, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	s := &script{}
+	if err := decoder.Decode(s); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	for i, r := range s.Replies {
+		switch {
+		case len(r.Tokens) > 0 && r.Text != "":
+			return nil, fmt.Errorf("%s: reply %d has both tokens and text", path, i+1)
+		case r.Status != 0 && (r.Status < 100 || r.Status > 599):
+			return nil, fmt.Errorf("%s: reply %d has an invalid status %d", path, i+1, r.Status)
+		case r.FailAfter < 0 || r.Times < 0:
+			return nil, fmt.Errorf("%s: reply %d has a negative fail_after or times", path, i+1)
+		}
+	}
+	s.used = make([]int, len(s.Replies))
+	return s, nil
+}
+
+// reply returns the reply of the first rule matching the request, and false when none does.
+func (s *script) reply(request chatbotapitest.Request, defaults chatbotapitest.Reply) (chatbotapitest.Reply, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	query := strings.ToLower(request.Query)
+	for i, r := range s.Replies {
+		if !strings.Contains(query, strings.ToLower(r.Match)) || (r.Mode != "" && r.Mode != request.Mode) {
+			continue
+		}
+		if r.Times > 0 && s.used[i] >= r.Times {
+			continue
+		}
+		s.used[i]++
+		return r.toReply(request, defaults), true
+	}
+	return chatbotapitest.Reply{}, false
+}
+
+func (r rule) toReply(request chatbotapitest.Request, defaults chatbotapitest.Reply) chatbotapitest.Reply {
+	reply := defaults
+	reply.Tokens = r.Tokens
+	if r.Text != "" {
+		reply.Tokens = strings.Split(strings.ReplaceAll(strings.TrimRight(r.Text, "\n"), "{query}", request.Query), "\n")
+	}
+	reply.Topic = r.Topic
+	reply.Status = r.Status
+	reply.FailAfter = r.FailAfter
+	if r.FirstTokenDelay != nil {
+		reply.FirstTokenDelay = *r.FirstTokenDelay
+	}
+	if r.TokenDelay != nil {
+		reply.TokenDelay = *r.TokenDelay
+	}
+	if reply.Status == 0 {
+		reply.Status = http.StatusOK
+	}
+	return reply
+}
+
+// echo is the reply to the questions no rule matches: the question itself, titled with its first words.
+func echo(request chatbotapitest.Request, defaults chatbotapitest.Reply) chatbotapitest.Reply {
+	reply := defaults
+	reply.Tokens = []string{"Mock answer to:", request.Query}
+	words := strings.Fields(request.Query)
+	if len(words) > 5 {
+		words = words[:5]
+	}
+	reply.Topic = strings.Join(words, " ")
+	return reply
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"server/chatbotAPI/chatbotapitest"
+)
+
+func TestExampleScript(t *testing.T) {
+	s, err := loadScript("script.example.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defaults := chatbotapitest.Reply{TokenDelay: time.Millisecond}
+	ask := func(query string) chatbotapitest.Reply {
+		reply, ok := s.reply(chatbotapitest.Request{Query: query, Mode: "1"}, defaults)
+		if !ok {
+			t.Fatalf("no rule matched %q", query)
+		}
+		return reply
+	}
+
+	if reply := ask("Nước bọt giúp tiêu hóa như thế nào?"); len(reply.Tokens) != 3 || reply.Topic == "" || reply.TokenDelay != time.Millisecond {
+		t.Errorf("unexpected reply %+v", reply)
+	}
+	if reply := ask("please be SLOW"); reply.FirstTokenDelay != 20*time.Second || reply.Tokens[0] != "Sorry for the wait, you asked: please be SLOW" {
+		t.Errorf("unexpected slow reply %+v", reply)
+	}
+	if reply := ask("crash now"); reply.FailAfter != 2 {
+		t.Errorf("unexpected crash reply %+v", reply)
+	}
+	if reply := ask("retry"); reply.Status != http.StatusServiceUnavailable {
+		t.Errorf("the first retry answered %d", reply.Status)
+	}
+	if reply := ask("retry"); reply.Status != http.StatusOK || reply.Topic != "Retry" {
+		t.Errorf("the second retry answered %+v", reply)
+	}
+	if _, ok := s.reply(chatbotapitest.Request{Query: "Xin chào"}, defaults); ok {
+		t.Error("a question without rule was not left to echo")
+	}
+}
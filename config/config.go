@@ -0,0 +1,398 @@
+// Package config reads the settings of the server once at startup into a Config, which main hands to the packages
+// needing them. Values come, from lowest to highest priority, from the defaults, a YAML file, the .env file and the
+// environment. See config.example.yaml for every setting with its environment variable.
+package config
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"net/url"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/joho/godotenv"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	Development = "development"
+	Production  = "production"
+)
+
+type Config struct {
+	// development or production, production also requires the settings needed to send emails
+	Env           string        `yaml:"env" env:"APP_ENV"`
+	Server        Server        `yaml:"server"`
+	Mongo         Mongo         `yaml:"mongo"`
+	Redis         Redis         `yaml:"redis"`
+	Auth          Auth          `yaml:"auth"`
+	RateLimit     RateLimit     `yaml:"rate_limit"`
+	Mail          Mail          `yaml:"mail"`
+	ModelAPI      ModelAPI      `yaml:"model_api"`
+	Gemini        Gemini        `yaml:"gemini"`
+	Pinata        Pinata        `yaml:"pinata"`
+	Search        Search        `yaml:"search"`
+	Conversations Conversations `yaml:"conversations"`
+	Metrics       Metrics       `yaml:"metrics"`
+	Tracing       Tracing       `yaml:"tracing"`
+	Log           Log           `yaml:"log"`
+}
+
+type Server struct {
+	Port        int      `yaml:"port" env:"PORT"`
+	CORSOrigins []string `yaml:"cors_origins" env:"CORS_ORIGINS"`
+	// How long a shutdown waits for the answers being generated before leaving them to the next instance
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout" env:"SHUTDOWN_TIMEOUT"`
+	// IPs or CIDRs of the proxies in front of the server, whose X-Forwarded-For is believed. Empty believes none
+	TrustedProxies []string `yaml:"trusted_proxies" env:"TRUSTED_PROXIES"`
+	// How long a token of an answer waits for the websocket of its conversation before it is dropped
+	WebsocketWait time.Duration `yaml:"websocket_wait" env:"WEBSOCKET_WAIT"`
+}
+
+type Mongo struct {
+	URL      string `yaml:"url" env:"DB_URL"`
+	Database string `yaml:"database" env:"DB_NAME"`
+	// Deadline of a single operation, long running ones such as migrations have their own
+	Timeout time.Duration `yaml:"timeout" env:"DB_TIMEOUT"`
+	// Deadline of saving a question before its answer is generated
+	AskTimeout time.Duration `yaml:"ask_timeout" env:"DB_ASK_TIMEOUT"`
+	// Deadline of each attempt at saving an answer, the attempts are retried
+	WriteTimeout time.Duration `yaml:"write_timeout" env:"DB_WRITE_TIMEOUT"`
+}
+
+type Redis struct {
+	Addr     string `yaml:"addr" env:"REDIS_HOST"`
+	Password string `yaml:"password" env:"REDIS_PASS"`
+	DB       int    `yaml:"db" env:"REDIS_DB"`
+}
+
+type Auth struct {
+	JWTSecret string        `yaml:"jwt_secret" env:"JWT_SECRET"`
+	TokenTTL  time.Duration `yaml:"token_ttl" env:"JWT_TTL"`
+	// Salt of the tokens proving an email was verified during registration
+	RegisterKey string `yaml:"register_key" env:"KEY_FOR_REGISTER"`
+}
+
+type RateLimit struct {
+	// Keys clients send in X-API-Key to get a global budget of their own, other keys are ignored
+	APIKeys []string `yaml:"api_keys" env:"RATE_LIMIT_API_KEYS"`
+	// Budgets of the groups of routes, only set in the file. Global counts every request, the others the routes
+	// asking the model, the ones calling Gemini for topics and the ones sending emails
+	Global RateLimitRule `yaml:"global"`
+	Ask    RateLimitRule `yaml:"ask"`
+	Topic  RateLimitRule `yaml:"topic"`
+	Auth   RateLimitRule `yaml:"auth"`
+}
+
+// RateLimitRule allows Limit requests per Window to every principal. Key is what a principal is: user, the user of
+// the session or the IP without one, ip, or api_key, one of the API keys or else as user.
+type RateLimitRule struct {
+	Limit  int           `yaml:"limit"`
+	Window time.Duration `yaml:"window"`
+	Key    string        `yaml:"key"`
+}
+
+type Mail struct {
+	From     string `yaml:"from" env:"APP_EMAIL"`
+	Password string `yaml:"password" env:"APP_PASS"`
+	Host     string `yaml:"host" env:"SMTP_HOST"`
+	Port     int    `yaml:"port" env:"SMTP_PORT"`
+}
+
+type ModelAPI struct {
+	URL     string        `yaml:"url" env:"MODEL_API_URL"`
+	DemoURL string        `yaml:"demo_url" env:"MODEL_API_URL_DEMO"`
+	Timeout time.Duration `yaml:"timeout" env:"MODEL_API_TIMEOUT"`
+}
+
+type Gemini struct {
+	APIKey string `yaml:"api_key" env:"GENAI_API_KEY"`
+}
+
+type Pinata struct {
+	JWT string `yaml:"jwt" env:"PINATA_JWT"`
+}
+
+type Search struct {
+	// gemini, fake or empty, empty uses Gemini when its API key is set and disables semantic search otherwise
+	Embedder string `yaml:"embedder" env:"EMBEDDER"`
+	// mongo or memory
+	VectorIndex string `yaml:"vector_index" env:"VECTOR_INDEX"`
+	// Embed at start the messages missing from the vector index. It reads every message, and with the memory
+	// index it embeds all of them again, so it is only meant to be turned on once after semantic search is enabled
+	Backfill bool `yaml:"backfill" env:"EMBEDDINGS_BACKFILL"`
+}
+
+type Conversations struct {
+	// Conversations per page of the page-numbered list kept for older clients
+	LegacyPageSize     int `yaml:"legacy_page_size" env:"LEGACY_PAGE_SIZE"`
+	TrashRetentionDays int `yaml:"trash_retention_days" env:"TRASH_RETENTION_DAYS"`
+}
+
+type Metrics struct {
+	// Bearer token Prometheus has to send to read /metrics, empty leaves /metrics open
+	Token string `yaml:"token" env:"METRICS_TOKEN"`
+}
+
+type Tracing struct {
+	// OTLP/HTTP URL the spans are sent to, such as http://localhost:4318/v1/traces. Empty disables tracing
+	Endpoint string `yaml:"endpoint" env:"OTEL_EXPORTER_OTLP_TRACES_ENDPOINT"`
+	// Share of the traces started by the server that are kept, the ones continuing a trace of the caller follow its choice
+	SamplePercent int `yaml:"sample_percent" env:"TRACING_SAMPLE_PERCENT"`
+}
+
+type Log struct {
+	// debug, info, warn or error. Lines are JSON in production and text in development
+	Level string `yaml:"level" env:"LOG_LEVEL"`
+}
+
+// Addr is the address the HTTP server listens on.
+func (s Server) Addr() string {
+	return ":" + strconv.Itoa(s.Port)
+}
+
+// TrashRetention is how long deleted conversations stay restorable.
+func (c Conversations) TrashRetention() time.Duration {
+	return time.Duration(c.TrashRetentionDays) * 24 * time.Hour
+}
+
+// Default returns the settings used for everything the file and the environment leave out.
+func Default() *Config {
+	return &Config{
+		Env: Development,
+		Server: Server{
+			Port:            5000,
+			CORSOrigins:     []string{"https://www.newgchatbot.site", "https://newgchatbot.site", "http://localhost:5173"},
+			ShutdownTimeout: 30 * time.Second,
+			WebsocketWait:   50 * time.Second,
+		},
+		Mongo:         Mongo{Database: "chatbot-server", Timeout: 20 * time.Second, AskTimeout: 30 * time.Second, WriteTimeout: 10 * time.Second},
+		Auth:          Auth{TokenTTL: 24 * time.Hour},
+		Mail:          Mail{Host: "smtp.gmail.com", Port: 587},
+		ModelAPI:      ModelAPI{Timeout: 60 * time.Second},
+		Search:        Search{VectorIndex: "mongo"},
+		Conversations: Conversations{LegacyPageSize: 8, TrashRetentionDays: 30},
+		Tracing:       Tracing{SamplePercent: 100},
+		Log:           Log{Level: "info"},
+		RateLimit: RateLimit{
+			Global: RateLimitRule{Limit: 300, Window: time.Minute, Key: "api_key"},
+			Ask:    RateLimitRule{Limit: 20, Window: time.Minute, Key: "user"},
+			Topic:  RateLimitRule{Limit: 10, Window: time.Minute, Key: "ip"},
+			Auth:   RateLimitRule{Limit: 5, Window: 15 * time.Minute, Key: "ip"},
+		},
+	}
+}
+
+// Load reads the configuration and checks it. The YAML file is CONFIG_FILE, or config.yaml when it exists.
+// The variables of .env are added to the environment without replacing the ones already set.
+func Load() (*Config, error) {
+	if err := godotenv.Load(); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("failed to read .env: %w", err)
+	}
+	cfg := Default()
+	path, explicit := os.LookupEnv("CONFIG_FILE")
+	if !explicit {
+		path = "config.yaml"
+	}
+	data, err := os.ReadFile(path)
+	if err == nil {
+		err = cfg.decodeYAML(data)
+	} else if !explicit && errors.Is(err, fs.ErrNotExist) {
+		err = nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	if err := cfg.applyEnv(os.LookupEnv); err != nil {
+		return nil, err
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// decodeYAML overrides the settings present in data. Unknown keys are rejected so that typos do not go unnoticed.
+func (cfg *Config) decodeYAML(data []byte) error {
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(cfg); err != nil && !errors.Is(err, io.EOF) {
+		return err
+	}
+	return nil
+}
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// applyEnv overrides the settings whose variable is set. Lists are comma separated.
+func (cfg *Config) applyEnv(lookup func(string) (string, bool)) error {
+	var problems []string
+	var walk func(v reflect.Value)
+	walk = func(v reflect.Value) {
+		for i := 0; i < v.NumField(); i++ {
+			field, value := v.Type().Field(i), v.Field(i)
+			if field.Type.Kind() == reflect.Struct {
+				walk(value)
+				continue
+			}
+			name := field.Tag.Get("env")
+			if name == "" {
+				continue
+			}
+			raw, ok := lookup(name)
+			if !ok {
+				continue
+			}
+			raw = strings.TrimSpace(raw)
+			switch {
+			case field.Type == durationType:
+				d, err := time.ParseDuration(raw)
+				if err != nil {
+					problems = append(problems, fmt.Sprintf("%s: %q is not a duration such as 30s or 5m", name, raw))
+					continue
+				}
+				value.SetInt(int64(d))
+			case field.Type.Kind() == reflect.Int:
+				n, err := strconv.Atoi(raw)
+				if err != nil {
+					problems = append(problems, fmt.Sprintf("%s: %q is not a number", name, raw))
+					continue
+				}
+				value.SetInt(int64(n))
+			case field.Type.Kind() == reflect.Bool:
+				b, err := strconv.ParseBool(raw)
+				if err != nil {
+					problems = append(problems, fmt.Sprintf("%s: %q is not true or false", name, raw))
+					continue
+				}
+				value.SetBool(b)
+			case field.Type.Kind() == reflect.String:
+				value.SetString(raw)
+			case field.Type.Kind() == reflect.Slice:
+				var items []string
+				for _, item := range strings.Split(raw, ",") {
+					if item = strings.TrimSpace(item); item != "" {
+						items = append(items, item)
+					}
+				}
+				value.Set(reflect.ValueOf(items))
+			}
+		}
+	}
+	walk(reflect.ValueOf(cfg).Elem())
+	return invalid(problems)
+}
+
+// Validate reports every missing or malformed setting at once.
+func (cfg *Config) Validate() error {
+	var problems []string
+	require := func(value, env, key string) {
+		if value == "" {
+			problems = append(problems, fmt.Sprintf("%s (%s) is required", env, key))
+		}
+	}
+	positive := func(value int64, env, key string) {
+		if value <= 0 {
+			problems = append(problems, fmt.Sprintf("%s (%s) must be greater than 0", env, key))
+		}
+	}
+
+	if cfg.Env != Development && cfg.Env != Production {
+		problems = append(problems, fmt.Sprintf("APP_ENV (env) must be %s or %s, got %q", Development, Production, cfg.Env))
+	}
+	if cfg.Server.Port <= 0 || cfg.Server.Port > 65535 {
+		problems = append(problems, fmt.Sprintf("PORT (server.port) must be between 1 and 65535, got %d", cfg.Server.Port))
+	}
+	for _, origin := range cfg.Server.CORSOrigins {
+		// Credentials are allowed, browsers refuse them with a wildcard origin
+		if u, err := url.Parse(origin); err != nil || u.Scheme == "" || u.Host == "" {
+			problems = append(problems, fmt.Sprintf("CORS_ORIGINS (server.cors_origins): %q is not an origin such as https://example.com", origin))
+		}
+	}
+	positive(int64(cfg.Server.ShutdownTimeout), "SHUTDOWN_TIMEOUT", "server.shutdown_timeout")
+	positive(int64(cfg.Server.WebsocketWait), "WEBSOCKET_WAIT", "server.websocket_wait")
+	for _, proxy := range cfg.Server.TrustedProxies {
+		if _, _, err := net.ParseCIDR(proxy); err != nil && net.ParseIP(proxy) == nil {
+			problems = append(problems, fmt.Sprintf("TRUSTED_PROXIES (server.trusted_proxies): %q is not an IP or a CIDR such as 10.0.0.0/8", proxy))
+		}
+	}
+
+	require(cfg.Mongo.URL, "DB_URL", "mongo.url")
+	require(cfg.Mongo.Database, "DB_NAME", "mongo.database")
+	positive(int64(cfg.Mongo.Timeout), "DB_TIMEOUT", "mongo.timeout")
+	positive(int64(cfg.Mongo.AskTimeout), "DB_ASK_TIMEOUT", "mongo.ask_timeout")
+	positive(int64(cfg.Mongo.WriteTimeout), "DB_WRITE_TIMEOUT", "mongo.write_timeout")
+	require(cfg.Redis.Addr, "REDIS_HOST", "redis.addr")
+
+	require(cfg.Auth.JWTSecret, "JWT_SECRET", "auth.jwt_secret")
+	positive(int64(cfg.Auth.TokenTTL), "JWT_TTL", "auth.token_ttl")
+
+	for _, group := range []struct {
+		name string
+		rule RateLimitRule
+	}{{"global", cfg.RateLimit.Global}, {"ask", cfg.RateLimit.Ask}, {"topic", cfg.RateLimit.Topic}, {"auth", cfg.RateLimit.Auth}} {
+		name, rule := group.name, group.rule
+		if rule.Limit <= 0 {
+			problems = append(problems, fmt.Sprintf("rate_limit.%s.limit must be greater than 0, got %d", name, rule.Limit))
+		}
+		if rule.Window <= 0 {
+			problems = append(problems, fmt.Sprintf("rate_limit.%s.window must be greater than 0, got %s", name, rule.Window))
+		}
+		if rule.Key != "user" && rule.Key != "ip" && rule.Key != "api_key" {
+			problems = append(problems, fmt.Sprintf("rate_limit.%s.key must be user, ip or api_key, got %q", name, rule.Key))
+		}
+	}
+
+	require(cfg.ModelAPI.URL, "MODEL_API_URL", "model_api.url")
+	if u, err := url.Parse(cfg.ModelAPI.URL); cfg.ModelAPI.URL != "" && (err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "") {
+		problems = append(problems, fmt.Sprintf("MODEL_API_URL (model_api.url): %q is not an http(s) URL", cfg.ModelAPI.URL))
+	}
+	positive(int64(cfg.ModelAPI.Timeout), "MODEL_API_TIMEOUT", "model_api.timeout")
+
+	switch cfg.Search.Embedder {
+	case "", "fake":
+	case "gemini":
+		require(cfg.Gemini.APIKey, "GENAI_API_KEY", "gemini.api_key")
+	default:
+		problems = append(problems, fmt.Sprintf("EMBEDDER (search.embedder) must be gemini or fake, got %q", cfg.Search.Embedder))
+	}
+	if cfg.Search.VectorIndex != "mongo" && cfg.Search.VectorIndex != "memory" {
+		problems = append(problems, fmt.Sprintf("VECTOR_INDEX (search.vector_index) must be mongo or memory, got %q", cfg.Search.VectorIndex))
+	}
+	positive(int64(cfg.Conversations.LegacyPageSize), "LEGACY_PAGE_SIZE", "conversations.legacy_page_size")
+	positive(int64(cfg.Conversations.TrashRetentionDays), "TRASH_RETENTION_DAYS", "conversations.trash_retention_days")
+
+	if u, err := url.Parse(cfg.Tracing.Endpoint); cfg.Tracing.Endpoint != "" && (err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "") {
+		problems = append(problems, fmt.Sprintf("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT (tracing.endpoint): %q is not an http(s) URL", cfg.Tracing.Endpoint))
+	}
+	if cfg.Tracing.SamplePercent < 0 || cfg.Tracing.SamplePercent > 100 {
+		problems = append(problems, fmt.Sprintf("TRACING_SAMPLE_PERCENT (tracing.sample_percent) must be between 0 and 100, got %d", cfg.Tracing.SamplePercent))
+	}
+	switch cfg.Log.Level {
+	case "debug", "info", "warn", "error":
+	default:
+		problems = append(problems, fmt.Sprintf("LOG_LEVEL (log.level) must be debug, info, warn or error, got %q", cfg.Log.Level))
+	}
+
+	// Registration cannot work without them, a development server may do without
+	if cfg.Env == Production {
+		require(cfg.Auth.RegisterKey, "KEY_FOR_REGISTER", "auth.register_key")
+		require(cfg.Mail.From, "APP_EMAIL", "mail.from")
+		require(cfg.Mail.Password, "APP_PASS", "mail.password")
+	}
+	return invalid(problems)
+}
+
+func invalid(problems []string) error {
+	if len(problems) == 0 {
+		return nil
+	}
+	return errors.New("invalid configuration:\n  " + strings.Join(problems, "\n  "))
+}
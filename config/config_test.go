@@ -0,0 +1,141 @@
+package config
+
+import (
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func env(values map[string]string) func(string) (string, bool) {
+	return func(name string) (string, bool) {
+		value, ok := values[name]
+		return value, ok
+	}
+}
+
+func valid() *Config {
+	cfg := Default()
+	cfg.Mongo.URL = "mongodb://localhost:27017"
+	cfg.Redis.Addr = "localhost:6379"
+	cfg.Auth.JWTSecret = "secret"
+	cfg.ModelAPI.URL = "http://localhost:8000/chat"
+	return cfg
+}
+
+func TestDefaultsNeedOnlyTheRequiredSettings(t *testing.T) {
+	if err := valid().Validate(); err != nil {
+		t.Fatal(err)
+	}
+	err := Default().Validate()
+	if err == nil {
+		t.Fatal("expected the defaults alone to be invalid")
+	}
+	for _, name := range []string{"DB_URL", "REDIS_HOST", "JWT_SECRET", "MODEL_API_URL"} {
+		if !strings.Contains(err.Error(), name+" (") {
+			t.Errorf("error does not mention %s: %v", name, err)
+		}
+	}
+}
+
+func TestPriority(t *testing.T) {
+	cfg := Default()
+	err := cfg.decodeYAML([]byte(`
+server:
+  port: 8080
+  cors_origins: [https://example.com]
+mongo:
+  database: from-file
+  timeout: 5s
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = cfg.applyEnv(env(map[string]string{
+		"DB_NAME":          "from-env",
+		"CORS_ORIGINS":     "https://a.example.com, https://b.example.com,",
+		"SHUTDOWN_TIMEOUT": "1m",
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Server.Port != 8080 || cfg.Mongo.Timeout != 5*time.Second {
+		t.Errorf("file values were not applied: %+v %+v", cfg.Server, cfg.Mongo)
+	}
+	if cfg.Mongo.Database != "from-env" {
+		t.Errorf("environment should override the file, got %q", cfg.Mongo.Database)
+	}
+	if len(cfg.Server.CORSOrigins) != 2 || cfg.Server.CORSOrigins[1] != "https://b.example.com" {
+		t.Errorf("unexpected origins %q", cfg.Server.CORSOrigins)
+	}
+	if cfg.Server.ShutdownTimeout != time.Minute || cfg.Conversations.LegacyPageSize != 8 {
+		t.Errorf("defaults or environment lost: %+v %+v", cfg.Server, cfg.Conversations)
+	}
+	if cfg.Server.Addr() != ":8080" {
+		t.Errorf("Addr() = %q", cfg.Server.Addr())
+	}
+}
+
+func TestUnknownYAMLKey(t *testing.T) {
+	if err := Default().decodeYAML([]byte("mongo:\n  databse: typo\n")); err == nil {
+		t.Fatal("expected an unknown key to be rejected")
+	}
+	if err := Default().decodeYAML(nil); err != nil {
+		t.Fatalf("an empty file should be accepted: %v", err)
+	}
+}
+
+func TestInvalidValues(t *testing.T) {
+	err := Default().applyEnv(env(map[string]string{"PORT": "http", "DB_TIMEOUT": "20", "EMBEDDINGS_BACKFILL": "sometimes"}))
+	if err == nil || !strings.Contains(err.Error(), "PORT") || !strings.Contains(err.Error(), "DB_TIMEOUT") || !strings.Contains(err.Error(), "EMBEDDINGS_BACKFILL") {
+		t.Fatalf("expected every variable to be reported, got %v", err)
+	}
+
+	cfg := valid()
+	cfg.Env = "staging"
+	cfg.Server.CORSOrigins = []string{"*"}
+	cfg.Server.TrustedProxies = []string{"10.0.0.0/8", "proxy.internal"}
+	cfg.ModelAPI.URL = "localhost:8000"
+	cfg.Search.Embedder = "gemini"
+	cfg.Tracing.SamplePercent = 150
+	cfg.Log.Level = "verbose"
+	cfg.RateLimit.Ask.Limit = 0
+	cfg.RateLimit.Topic.Window = -time.Minute
+	cfg.RateLimit.Auth.Key = "email"
+	err = cfg.Validate()
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	for _, name := range []string{"APP_ENV", "CORS_ORIGINS", "TRUSTED_PROXIES", "MODEL_API_URL", "GENAI_API_KEY", "TRACING_SAMPLE_PERCENT", "LOG_LEVEL",
+		"rate_limit.ask.limit", "rate_limit.topic.window", "rate_limit.auth.key"} {
+		if !strings.Contains(err.Error(), name) {
+			t.Errorf("error does not mention %s: %v", name, err)
+		}
+	}
+
+	cfg = valid()
+	cfg.Env = Production
+	if err := cfg.Validate(); err == nil || !strings.Contains(err.Error(), "APP_EMAIL") {
+		t.Errorf("production should require the mail account, got %v", err)
+	}
+}
+
+func TestExampleFile(t *testing.T) {
+	data, err := os.ReadFile("../config.example.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := Default()
+	if err := cfg.decodeYAML(data); err != nil {
+		t.Fatal(err)
+	}
+	// The example documents the defaults, reading it must not change any of them
+	want := Default()
+	if cfg.Server.Port != want.Server.Port || cfg.Server.WebsocketWait != want.Server.WebsocketWait || len(cfg.Server.CORSOrigins) != len(want.Server.CORSOrigins) ||
+		len(cfg.Server.TrustedProxies) != 0 || len(cfg.RateLimit.APIKeys) != 0 || cfg.RateLimit.Global != want.RateLimit.Global ||
+		cfg.RateLimit.Ask != want.RateLimit.Ask || cfg.RateLimit.Topic != want.RateLimit.Topic || cfg.RateLimit.Auth != want.RateLimit.Auth ||
+		cfg.Mongo != want.Mongo || cfg.Auth != want.Auth || cfg.Mail != want.Mail || cfg.ModelAPI != want.ModelAPI ||
+		cfg.Search != want.Search || cfg.Conversations != want.Conversations || cfg.Metrics != want.Metrics || cfg.Tracing != want.Tracing || cfg.Log != want.Log {
+		t.Errorf("config.example.yaml differs from the defaults: %+v", cfg)
+	}
+}
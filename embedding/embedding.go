@@ -0,0 +1,77 @@
+package embedding
+
+import (
+	"context"
+	"math"
+	"sort"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Embedder turns texts into vectors whose dot product measures how close their meanings are.
+type Embedder interface {
+	Embed(ctx context.Context, texts []string) ([][]float32, error)
+}
+
+// Vector is the embedding of one message. UserID restricts searches to the owner's messages.
+type Vector struct {
+	ID             primitive.ObjectID `bson:"_id"`
+	ConversationID primitive.ObjectID `bson:"conversation_id"`
+	UserID         primitive.ObjectID `bson:"user_id"`
+	Values         []float32          `bson:"values"`
+}
+
+type Match struct {
+	ID             primitive.ObjectID
+	ConversationID primitive.ObjectID
+	Score          float64
+}
+
+// Index stores vectors and finds the nearest ones. MemoryIndex keeps them in the process, MongoIndex in a collection.
+type Index interface {
+	Upsert(ctx context.Context, vectors []Vector) error
+	Delete(ctx context.Context, ids []primitive.ObjectID) error
+	Contains(ctx context.Context, ids []primitive.ObjectID) (map[primitive.ObjectID]bool, error)
+	Search(ctx context.Context, userID primitive.ObjectID, query []float32, k int) ([]Match, error)
+}
+
+// Normalize scales v to unit length in place, so cosine similarity is a plain dot product.
+func Normalize(v []float32) []float32 {
+	var sum float64
+	for _, x := range v {
+		sum += float64(x) * float64(x)
+	}
+	if sum == 0 {
+		return v
+	}
+	norm := float32(math.Sqrt(sum))
+	for i := range v {
+		v[i] /= norm
+	}
+	return v
+}
+
+func dot(a, b []float32) float64 {
+	n := len(a)
+	if len(b) < n {
+		n = len(b)
+	}
+	var sum float64
+	for i := 0; i < n; i++ {
+		sum += float64(a[i]) * float64(b[i])
+	}
+	return sum
+}
+
+// rank scores every vector against query and keeps the k best, best first.
+func rank(vectors []Vector, query []float32, k int) []Match {
+	matches := make([]Match, 0, len(vectors))
+	for _, v := range vectors {
+		matches = append(matches, Match{ID: v.ID, ConversationID: v.ConversationID, Score: dot(v.Values, query)})
+	}
+	sort.Slice(matches, func(i, j int) bool { return matches[i].Score > matches[j].Score })
+	if k > 0 && len(matches) > k {
+		matches = matches[:k]
+	}
+	return matches
+}
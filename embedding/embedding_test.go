@@ -0,0 +1,50 @@
+package embedding
+
+import (
+	"context"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestFakeEmbedderIsDeterministic(t *testing.T) {
+	embedder := FakeEmbedder{Dimensions: 64}
+	a, _ := embedder.Embed(context.Background(), []string{"Nước bọt giúp tiêu hóa"})
+	b, _ := embedder.Embed(context.Background(), []string{"nuoc bot giup tieu hoa"})
+	if score := dot(a[0], b[0]); score < 0.999 {
+		t.Fatalf("same words with and without diacritics should embed the same, score %f", score)
+	}
+}
+
+func TestMemoryIndexSearch(t *testing.T) {
+	ctx := context.Background()
+	embedder := FakeEmbedder{}
+	owner, other := primitive.NewObjectID(), primitive.NewObjectID()
+	texts := []string{"cách nấu phở bò", "lịch sử Việt Nam", "nấu phở gà"}
+	values, _ := embedder.Embed(ctx, texts)
+	index := NewMemoryIndex()
+	var ids []primitive.ObjectID
+	for _, v := range values {
+		id := primitive.NewObjectID()
+		ids = append(ids, id)
+		index.Upsert(ctx, []Vector{{ID: id, UserID: owner, Values: v}})
+	}
+	index.Upsert(ctx, []Vector{{ID: primitive.NewObjectID(), UserID: other, Values: values[0]}})
+
+	query, _ := embedder.Embed(ctx, []string{"nấu phở"})
+	matches, _ := index.Search(ctx, owner, query[0], 2)
+	if len(matches) != 2 {
+		t.Fatalf("got %d matches, want 2", len(matches))
+	}
+	for _, m := range matches {
+		if m.ID == ids[1] {
+			t.Fatalf("unrelated message ranked in the top 2: %v", matches)
+		}
+	}
+
+	index.Delete(ctx, ids[:1])
+	found, _ := index.Contains(ctx, ids)
+	if found[ids[0]] || !found[ids[2]] {
+		t.Fatalf("Contains after delete = %v", found)
+	}
+}
@@ -0,0 +1,38 @@
+package embedding
+
+import (
+	"context"
+	"hash/fnv"
+	"server/utils"
+)
+
+// FakeEmbedder is a deterministic embedder for tests and local development: every word is hashed to a dimension,
+// so texts sharing words are close. It knows nothing about meaning, paraphrases are not found.
+type FakeEmbedder struct {
+	Dimensions int
+}
+
+func (f FakeEmbedder) Embed(ctx context.Context, texts []string) ([][]float32, error) {
+	dimensions := f.Dimensions
+	if dimensions <= 0 {
+		dimensions = 256
+	}
+	vectors := make([][]float32, 0, len(texts))
+	for _, text := range texts {
+		v := make([]float32, dimensions)
+		for _, term := range utils.SearchTerms(text) {
+			h := fnv.New32a()
+			h.Write([]byte(term))
+			sum := h.Sum32()
+			// The top bit picks the sign so unrelated words colliding on a dimension tend to cancel out
+			i := int(sum % uint32(dimensions))
+			if sum&(1<<31) != 0 {
+				v[i]--
+			} else {
+				v[i]++
+			}
+		}
+		vectors = append(vectors, Normalize(v))
+	}
+	return vectors, nil
+}
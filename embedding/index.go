@@ -0,0 +1,123 @@
+package embedding
+
+import (
+	"context"
+	"sync"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// MemoryIndex keeps vectors in memory and compares the query with every vector of the user.
+// It is lost on restart, model.BackfillEmbeddings fills it again.
+type MemoryIndex struct {
+	mu      sync.RWMutex
+	vectors map[primitive.ObjectID]Vector
+}
+
+func NewMemoryIndex() *MemoryIndex {
+	return &MemoryIndex{vectors: make(map[primitive.ObjectID]Vector)}
+}
+
+func (m *MemoryIndex) Upsert(ctx context.Context, vectors []Vector) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, v := range vectors {
+		m.vectors[v.ID] = v
+	}
+	return nil
+}
+
+func (m *MemoryIndex) Delete(ctx context.Context, ids []primitive.ObjectID) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, id := range ids {
+		delete(m.vectors, id)
+	}
+	return nil
+}
+
+func (m *MemoryIndex) Contains(ctx context.Context, ids []primitive.ObjectID) (map[primitive.ObjectID]bool, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	found := make(map[primitive.ObjectID]bool)
+	for _, id := range ids {
+		if _, ok := m.vectors[id]; ok {
+			found[id] = true
+		}
+	}
+	return found, nil
+}
+
+func (m *MemoryIndex) Search(ctx context.Context, userID primitive.ObjectID, query []float32, k int) ([]Match, error) {
+	m.mu.RLock()
+	var owned []Vector
+	for _, v := range m.vectors {
+		if v.UserID == userID {
+			owned = append(owned, v)
+		}
+	}
+	m.mu.RUnlock()
+	return rank(owned, query, k), nil
+}
+
+// MongoIndex stores one document per message in a collection and ranks the user's vectors in the server process.
+// That is fine for the size of a personal history, an Atlas $vectorSearch index could replace Search without changing callers.
+type MongoIndex struct {
+	collection *mongo.Collection
+}
+
+func NewMongoIndex(collection *mongo.Collection) *MongoIndex {
+	return &MongoIndex{collection: collection}
+}
+
+func (m *MongoIndex) Upsert(ctx context.Context, vectors []Vector) error {
+	if len(vectors) == 0 {
+		return nil
+	}
+	writes := make([]mongo.WriteModel, 0, len(vectors))
+	for _, v := range vectors {
+		writes = append(writes, mongo.NewReplaceOneModel().SetFilter(bson.M{"_id": v.ID}).SetReplacement(v).SetUpsert(true))
+	}
+	_, err := m.collection.BulkWrite(ctx, writes)
+	return err
+}
+
+func (m *MongoIndex) Delete(ctx context.Context, ids []primitive.ObjectID) error {
+	_, err := m.collection.DeleteMany(ctx, bson.M{"_id": bson.M{"$in": ids}})
+	return err
+}
+
+func (m *MongoIndex) Contains(ctx context.Context, ids []primitive.ObjectID) (map[primitive.ObjectID]bool, error) {
+	cursor, err := m.collection.Find(ctx, bson.M{"_id": bson.M{"$in": ids}}, options.Find().SetProjection(bson.M{"_id": 1}))
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+	found := make(map[primitive.ObjectID]bool)
+	for cursor.Next(ctx) {
+		var v struct {
+			ID primitive.ObjectID `bson:"_id"`
+		}
+		if err := cursor.Decode(&v); err != nil {
+			return nil, err
+		}
+		found[v.ID] = true
+	}
+	return found, cursor.Err()
+}
+
+func (m *MongoIndex) Search(ctx context.Context, userID primitive.ObjectID, query []float32, k int) ([]Match, error) {
+	cursor, err := m.collection.Find(ctx, bson.M{"user_id": userID})
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+	var vectors []Vector
+	if err := cursor.All(ctx, &vectors); err != nil {
+		return nil, err
+	}
+	return rank(vectors, query, k), nil
+}
@@ -0,0 +1,61 @@
+package geminiapi
+
+import (
+	"context"
+	"fmt"
+	"server/tracing"
+
+	"github.com/google/generative-ai-go/genai"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/api/option"
+)
+
+// Embedder embeds texts with a Gemini embedding model. Unlike GetTopic it keeps one client for its whole life.
+type Embedder struct {
+	client *genai.Client
+	model  *genai.EmbeddingModel
+}
+
+func NewEmbedder(ctx context.Context, apiKey string) (*Embedder, error) {
+	client, err := genai.NewClient(ctx, option.WithAPIKey(apiKey))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create client: %v", err)
+	}
+	model := client.EmbeddingModel("text-embedding-004")
+	model.TaskType = genai.TaskTypeSemanticSimilarity
+	return &Embedder{client: client, model: model}, nil
+}
+
+func (e *Embedder) Embed(ctx context.Context, texts []string) (vectors [][]float32, err error) {
+	ctx, span := tracing.Start(ctx, "gemini embed", trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(
+		attribute.String("gen_ai.request.model", "text-embedding-004"),
+		attribute.Int("chatbot.texts", len(texts)),
+	))
+	defer func() {
+		if err != nil {
+			tracing.Fail(span, err)
+		}
+		span.End()
+	}()
+	batch := e.model.NewBatch()
+	for _, text := range texts {
+		batch.AddContent(genai.Text(text))
+	}
+	resp, err := e.model.BatchEmbedContents(ctx, batch)
+	if err != nil {
+		return nil, fmt.Errorf("failed to embed content: %v", err)
+	}
+	if len(resp.Embeddings) != len(texts) {
+		return nil, fmt.Errorf("expected %d embeddings, got %d", len(texts), len(resp.Embeddings))
+	}
+	vectors = make([][]float32, 0, len(texts))
+	for _, embedding := range resp.Embeddings {
+		vectors = append(vectors, embedding.Values)
+	}
+	return vectors, nil
+}
+
+func (e *Embedder) Close() error {
+	return e.client.Close()
+}
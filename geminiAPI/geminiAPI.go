@@ -3,10 +3,12 @@ package geminiapi
 import (
 	"context"
 	"fmt"
-	"log"
-	"os"
+	"log/slog"
+	"server/tracing"
 
 	"github.com/google/generative-ai-go/genai"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"google.golang.org/api/iterator"
 	"google.golang.org/api/option"
 )
@@ -21,20 +23,27 @@ import (
 //		}
 //		fmt.Println("---")
 //	}
-func printResponse(resp *genai.GenerateContentResponse) {
+func printResponse(ctx context.Context, resp *genai.GenerateContentResponse) {
 	for _, cand := range resp.Candidates {
 		if cand.Content != nil {
 			for _, part := range cand.Content.Parts {
-				fmt.Println(part)
+				slog.DebugContext(ctx, "gemini response part", "part", fmt.Sprint(part))
 			}
 		}
 	}
-	fmt.Println("---")
 }
-func GetTopic(userQuestion string, isStream bool) (string, error) {
-	ctx := context.Background()
+// GetTopic asks Gemini for the topic of a question, traced as a child of the span in ctx.
+func GetTopic(ctx context.Context, apiKey, userQuestion string, isStream bool) (topic string, err error) {
+	ctx, span := tracing.Start(ctx, "gemini topic", trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attribute.String("gen_ai.request.model", "gemini-1.5-flash")))
+	defer func() {
+		if err != nil {
+			tracing.Fail(span, err)
+		}
+		span.End()
+	}()
 	// Create the request body
-	client, err := genai.NewClient(ctx, option.WithAPIKey(os.Getenv("GENAI_API_KEY")))
+	client, err := genai.NewClient(ctx, option.WithAPIKey(apiKey))
 	if err != nil {
 		return "", fmt.Errorf("failed to create client: %v", err)
 	}
@@ -48,9 +57,9 @@ func GetTopic(userQuestion string, isStream bool) (string, error) {
 				break
 			}
 			if err != nil {
-				log.Fatal(err)
+				return "", fmt.Errorf("failed to stream content: %v", err)
 			}
-			printResponse(resp)
+			printResponse(ctx, resp)
 		}
 	}
 	text := fmt.Sprintf(`
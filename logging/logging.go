@@ -0,0 +1,128 @@
+// Package logging sets up the structured logger of the server on log/slog. Code logs with the slog functions taking a
+// context, the logger then adds what is known about the request or the job the context belongs to: its request_id,
+// user_id and conversation_id, and the trace_id of its span. Emails, codes and tokens are redacted from every line.
+//
+// Lines are JSON in production and text in development.
+package logging
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+
+	"server/config"
+
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Setup makes the logger of cfg the default one, which the log package writes to as well.
+func Setup(cfg *config.Config) {
+	slog.SetDefault(New(os.Stderr, cfg.Env, cfg.Log.Level))
+	if cfg.Env == config.Production {
+		gin.SetMode(gin.ReleaseMode)
+	}
+	// Gin only prints in debug mode, its route list and warnings become debug lines
+	gin.DebugPrintFunc = func(format string, values ...interface{}) {
+		slog.Debug(strings.TrimSpace(strings.TrimPrefix(fmt.Sprintf(format, values...), "[GIN-debug] ")))
+	}
+}
+
+// New returns a logger writing to w, in JSON for the production env. level is debug, info, warn or error.
+func New(w io.Writer, env, level string) *slog.Logger {
+	var lvl slog.Level
+	if err := lvl.UnmarshalText([]byte(level)); err != nil {
+		lvl = slog.LevelInfo
+	}
+	options := &slog.HandlerOptions{Level: lvl, ReplaceAttr: redactAttr}
+	var h slog.Handler
+	if env == config.Production {
+		h = slog.NewJSONHandler(w, options)
+	} else {
+		h = slog.NewTextHandler(w, options)
+	}
+	return slog.New(handler{h})
+}
+
+// scope holds the attributes of the lines logged with a context. Add appends to it, so what a middleware learns
+// about the request, such as the user, is also on the lines of the middlewares around it.
+type scope struct {
+	mu    sync.Mutex
+	attrs []slog.Attr
+}
+
+type scopeKey struct{}
+
+func scopeOf(ctx context.Context) *scope {
+	s, _ := ctx.Value(scopeKey{}).(*scope)
+	return s
+}
+
+func (s *scope) snapshot() []slog.Attr {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]slog.Attr(nil), s.attrs...)
+}
+
+// With returns a copy of ctx whose lines carry the key-value pairs of args, like the arguments of slog.Info.
+func With(ctx context.Context, args ...interface{}) context.Context {
+	var attrs []slog.Attr
+	if s := scopeOf(ctx); s != nil {
+		attrs = s.snapshot()
+	}
+	attrs = append(attrs, slog.Group("", args...).Value.Group()...)
+	return context.WithValue(ctx, scopeKey{}, &scope{attrs: attrs})
+}
+
+// Add adds the key-value pairs of args to the lines of ctx, including the ones logged by the callers once it returns.
+// It does nothing for a context without With.
+func Add(ctx context.Context, args ...interface{}) {
+	s := scopeOf(ctx)
+	if s == nil {
+		return
+	}
+	attrs := slog.Group("", args...).Value.Group()
+	s.mu.Lock()
+	s.attrs = append(s.attrs, attrs...)
+	s.mu.Unlock()
+}
+
+// RequestID returns the id of the request ctx belongs to, empty outside of a request.
+func RequestID(ctx context.Context) string {
+	if s := scopeOf(ctx); s != nil {
+		for _, a := range s.snapshot() {
+			if a.Key == requestIDKey {
+				return a.Value.String()
+			}
+		}
+	}
+	return ""
+}
+
+// handler adds the attributes of the context and redacts the message before passing the line on.
+type handler struct {
+	slog.Handler
+}
+
+func (h handler) Handle(ctx context.Context, r slog.Record) error {
+	r.Message = redact(r.Message)
+	if s := scopeOf(ctx); s != nil {
+		r.AddAttrs(s.snapshot()...)
+	}
+	if span := trace.SpanContextFromContext(ctx); span.IsValid() {
+		r.AddAttrs(slog.String("trace_id", span.TraceID().String()), slog.String("span_id", span.SpanID().String()))
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h handler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return handler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h handler) WithGroup(name string) slog.Handler {
+	return handler{h.Handler.WithGroup(name)}
+}
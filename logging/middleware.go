@@ -0,0 +1,72 @@
+package logging
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"runtime/debug"
+	"time"
+
+	"server/apierror"
+
+	"github.com/gin-gonic/gin"
+)
+
+// RequestIDHeader carries the id of a request. A client or a proxy may send one, the answer always has it.
+const RequestIDHeader = "X-Request-ID"
+
+const requestIDKey = "request_id"
+
+// Ids sent by clients end up in the logs, anything else than a plain id is replaced
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._\-]{1,64}$`)
+
+func newRequestID() string {
+	id := make([]byte, 16)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// Middleware gives each request an id, makes the lines logged with its context carry it and logs one line per request
+// once it is answered. The line has the route rather than the path, which can hold share tokens.
+func Middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		id := c.GetHeader(RequestIDHeader)
+		if !validRequestID.MatchString(id) {
+			id = newRequestID()
+		}
+		c.Header(RequestIDHeader, id)
+		ctx := With(c.Request.Context(), requestIDKey, id)
+		c.Request = c.Request.WithContext(ctx)
+
+		c.Next()
+
+		status := c.Writer.Status()
+		attrs := []slog.Attr{
+			slog.String("method", c.Request.Method),
+			slog.String("route", c.FullPath()),
+			slog.Int("status", status),
+			slog.Duration("duration", time.Since(start)),
+			slog.Int("bytes", c.Writer.Size()),
+			slog.String("client_ip", c.ClientIP()),
+		}
+		if c.FullPath() == "" {
+			attrs[1] = slog.String("route", "unmatched")
+		}
+		level := slog.LevelInfo
+		if status >= http.StatusInternalServerError {
+			level = slog.LevelError
+		}
+		slog.LogAttrs(ctx, level, "request", attrs...)
+	}
+}
+
+// Recovery answers internal to the requests whose handler panicked and logs the panic with its stack.
+func Recovery() gin.HandlerFunc {
+	return gin.CustomRecoveryWithWriter(nil, func(c *gin.Context, recovered interface{}) {
+		slog.ErrorContext(c.Request.Context(), "handler panicked", "panic", recovered, "stack", string(debug.Stack()))
+		c.AbortWithStatusJSON(apierror.Internal.Status, apierror.Internal)
+	})
+}
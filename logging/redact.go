@@ -0,0 +1,75 @@
+package logging
+
+import (
+	"log/slog"
+	"regexp"
+	"strings"
+)
+
+const redacted = "[REDACTED]"
+
+// Attributes whose value is always a secret, also when they end a longer key such as register_token
+var secretKeys = []string{"password", "otp", "token", "jwt", "secret", "api_key", "authorization", "cookie"}
+
+var (
+	emailPattern = regexp.MustCompile(`[A-Za-z0-9._%+\-]+@[A-Za-z0-9.\-]+\.[A-Za-z]{2,}`)
+	// JWTs, such as the jwt_token and register_token cookies, and bearer tokens
+	tokenPattern = regexp.MustCompile(`eyJ[A-Za-z0-9_\-]+\.[A-Za-z0-9_\-]+\.[A-Za-z0-9_\-]+|(?i:bearer)\s+\S+`)
+	// Codes emailed at registration, only when the text says so
+	otpPattern = regexp.MustCompile(`(?i)(otp|code)(\W{1,3})\d{4,8}\b`)
+)
+
+func isSecret(key string) bool {
+	key = strings.ToLower(key)
+	for _, secret := range secretKeys {
+		if key == secret || strings.HasSuffix(key, "_"+secret) {
+			return true
+		}
+	}
+	return false
+}
+
+func isEmail(key string) bool {
+	key = strings.ToLower(key)
+	return key == "email" || strings.HasSuffix(key, "_email")
+}
+
+// maskEmail keeps the first letter and the domain, enough to tell users apart while reading logs.
+func maskEmail(email string) string {
+	local, domain, ok := strings.Cut(email, "@")
+	if !ok || local == "" {
+		return redacted
+	}
+	return local[:1] + "***@" + domain
+}
+
+// redact masks the emails and removes the tokens and codes found in free text, such as an error message.
+func redact(text string) string {
+	text = emailPattern.ReplaceAllStringFunc(text, maskEmail)
+	text = tokenPattern.ReplaceAllString(text, redacted)
+	return otpPattern.ReplaceAllString(text, "$1$2"+redacted)
+}
+
+func redactAttr(groups []string, a slog.Attr) slog.Attr {
+	if len(groups) == 0 && (a.Key == slog.TimeKey || a.Key == slog.LevelKey) {
+		return a
+	}
+	switch {
+	case isSecret(a.Key):
+		return slog.String(a.Key, redacted)
+	case isEmail(a.Key):
+		return slog.String(a.Key, maskEmail(a.Value.String()))
+	}
+	switch a.Value.Kind() {
+	case slog.KindString:
+		return slog.String(a.Key, redact(a.Value.String()))
+	case slog.KindAny:
+		if err, ok := a.Value.Any().(error); ok {
+			return slog.String(a.Key, redact(err.Error()))
+		}
+		if s, ok := a.Value.Any().(interface{ String() string }); ok {
+			return slog.String(a.Key, redact(s.String()))
+		}
+	}
+	return a
+}
@@ -2,445 +2,182 @@ package main
 
 import (
 	"context"
-	"errors"
-	"fmt"
+	"log/slog"
 	"net/http"
+	"os"
+	"os/signal"
+	"server/api"
+	"server/app"
 	"server/auth"
-	"server/cloud"
+	"server/config"
+	"server/embedding"
 	geminiapi "server/geminiAPI"
+	"server/logging"
 	"server/model"
+	"server/queue"
+	"server/ratelimit"
+	"server/tracing"
 	"server/utils"
 	ws "server/websocket"
-	"strconv"
+	"syscall"
 	"time"
 
-	"github.com/gin-contrib/cors"
-	"github.com/gin-gonic/gin"
-	"github.com/joho/godotenv"
+	"github.com/redis/go-redis/v9"
 	"go.mongodb.org/mongo-driver/bson"
-	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
 )
 
 func main() {
-	// Use the SetServerAPIOptions() method to set the version of the Stable API on the client
-	godotenv.Load()
-	// Send a ping to confirm a successful connection
-	client := utils.ConnectDB()
-	redisClient := utils.ConnectRedis()
-	router := gin.Default()
-	router.Use(cors.New(cors.Config{
-		AllowOrigins: []string{"https://www.newgchatbot.site",
-			"https://newgchatbot.site",
-			"http://localhost:5173"}, // Add your frontend origin
-		AllowMethods:     []string{"GET", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"},
-		AllowHeaders:     []string{"Origin", "Content-Type", "Accept", "Authorization", "X-Requested-With", "ngrok-skip-browser-warning"},
-		ExposeHeaders:    []string{"Content-Length", "Set-Cookie"},
-		AllowCredentials: true,
-		MaxAge:           12 * time.Hour,
-	}))
-	defer redisClient.Close()
-	defer func() {
-		if err := client.Disconnect(context.TODO()); err != nil {
-			panic(err)
-		}
-	}()
-	if err := client.Database("admin").RunCommand(context.TODO(), bson.D{{"ping", 1}}).Err(); err != nil {
+	cfg, err := config.Load()
+	if err != nil {
+		slog.Error("invalid configuration", "error", err)
+		os.Exit(1)
+	}
+	logging.Setup(cfg)
+	flushTraces, err := tracing.Setup(cfg.Tracing)
+	if err != nil {
+		slog.Error("failed to set up tracing", "error", err)
+		os.Exit(1)
+	}
+	client := utils.ConnectDB(cfg.Mongo)
+	db := model.NewDB(client, cfg)
+	redisClient := utils.ConnectRedis(cfg.Redis)
+	if err := client.Database("admin").RunCommand(context.TODO(), bson.D{{Key: "ping", Value: 1}}).Err(); err != nil {
 		panic(err)
 	}
-	fmt.Println("Pinged your deployment. You successfully connected to MongoDB!")
-	// Create a new WebSocket connection
-	router.GET("/ws/:id", func(c *gin.Context) {
-		ws.HandleWebSocket(c, client)
-	})
-	router.GET("/test/:userid", func(c *gin.Context) {
-		id := "670aa7a22065dc72cb99f733"
-		userid := c.Param("userid")
-		objectId1, _ := primitive.ObjectIDFromHex(id)
-		objectId2, _ := primitive.ObjectIDFromHex(userid)
-		if err := model.CheckConversationUser(objectId2, objectId1, client); err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{
-				"error": err.Error(),
-			})
-			return
-		}
-		c.JSON(http.StatusOK, gin.H{"message": "success"})
+	slog.Info("connected to MongoDB", "database", cfg.Mongo.Database)
+	if err := model.EnsureIndexes(db); err != nil {
+		slog.Error("failed to create indexes", "error", err)
+	}
+	if migrated, err := model.MigrateMessages(db); err != nil {
+		slog.Error("failed to move messages to their own collection", "error", err)
+	} else if migrated > 0 {
+		slog.Info("moved messages to their own collection", "conversations", migrated)
+	}
+	if updated, err := model.BackfillSearchText(db); err != nil {
+		slog.Error("failed to index old messages for search", "error", err)
+	} else if updated > 0 {
+		slog.Info("indexed old messages and topics for search", "messages", updated)
+	}
+	setupEmbeddings(db, cfg)
+	go purgeTrash(db, cfg.Conversations.TrashRetention())
+	// Answers are generated by a pool of workers taking jobs from Redis, see model.UseQueue
+	jobs := queue.New(redisClient, "generation", queue.DefaultOptions)
+	model.UseQueue(jobs, db)
+	jobs.Start()
 
-	})
-	router.GET("/ping", func(c *gin.Context) {
-		if token, err := c.Request.Cookie("jwt_token"); err != nil {
-			c.JSON(http.StatusOK, gin.H{"message": "no token"})
-			return
-		} else {
-			if _, er := auth.VerifyJWT(token.Value); er != nil {
-				c.JSON(http.StatusOK, gin.H{"message": "invalid token"})
-				return
-			}
-			c.JSON(http.StatusOK, gin.H{"message": "pong"})
-		}
-	})
-	router.POST("/registerEmail", func(c *gin.Context) {
-		email := c.PostForm("email")
-		if email == "" {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "email is required"})
-			return
-		}
-		if err := model.RegisterNewEmail(email, client, redisClient); err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
-			return
-		}
-		c.JSON(http.StatusOK, gin.H{"message": "success"})
-	})
-	router.POST("/verify_register_OTP", func(c *gin.Context) {
-		if !model.IsTokenNotValid(c, redisClient) {
-			return
-		}
-		email := c.PostForm("email")
-		otp := c.PostForm("otp")
-		if email == "" || otp == "" {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "email and otp are required"})
-			return
-		}
-		if err := model.VerifyOTP(email, otp, redisClient); err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
-			return
-		}
-		cookie := &http.Cookie{
-			Name:     "register_token",
-			Value:    utils.GenerateToken(email, redisClient),
-			Expires:  time.Now().Add(15 * time.Minute),
-			Path:     "/",
-			Domain:   "",
-			MaxAge:   60 * 15,
-			Secure:   true,
-			HttpOnly: true,
-			SameSite: http.SameSiteNoneMode,
-		}
-		http.SetCookie(c.Writer, cookie)
-		c.JSON(http.StatusOK, gin.H{"message": "success"})
-	})
-	router.POST("/register", func(c *gin.Context) {
-		if !model.IsTokenNotValid(c, redisClient) {
-			return
-		}
-		var user model.User
-		c.ShouldBind(&user)
-		if user.Username == "" || user.Email == "" || user.Password == "" {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "username, email, and password are required"})
-			return
-		}
-		if cookie, err := c.Request.Cookie("register_token"); err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "please verify your email first"})
-			return
-		} else {
-			if !utils.VerifyToken(user.Email, cookie.Value, redisClient) {
-				c.JSON(http.StatusBadRequest, gin.H{"error": "please verify your email first"})
-				return
-			}
-		}
-		cookie := &http.Cookie{
-			Name:     "register_token",
-			Value:    "",
-			Expires:  time.Now().Add(-1 * time.Hour),
-			Path:     "/",
-			Domain:   "",
-			MaxAge:   -1,
-			Secure:   true,
-			HttpOnly: true,
-			SameSite: http.SameSiteNoneMode,
-		}
-		http.SetCookie(c.Writer, cookie)
-		if err := model.RegisterNewUser(&user, client, redisClient); err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
-			return
-		}
-		if token, er := auth.GenerateJWT(user.ID.Hex()); er != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": er.Error()})
-			return
-		} else {
-			cookie := &http.Cookie{
-				Name:     "jwt_token",
-				Value:    token,
-				Expires:  time.Now().Add(24 * time.Hour),
-				Path:     "/",
-				Domain:   "",
-				MaxAge:   86400,
-				Secure:   true,
-				HttpOnly: true,
-				SameSite: http.SameSiteNoneMode,
-			}
-			http.SetCookie(c.Writer, cookie)
-		}
-		c.JSON(http.StatusOK, gin.H{"message": "success"})
-	})
-	router.POST("/login", func(c *gin.Context) {
-		if !model.IsTokenNotValid(c, redisClient) {
-			return
+	conversations := model.NewMongoConversations(db)
+	application := &app.App{
+		Config:        cfg,
+		Users:         model.NewMongoUsers(db),
+		Conversations: conversations,
+		Messages:      conversations,
+		Folders:       conversations,
+		Shares:        conversations,
+		Transfers:     conversations,
+		Search:        conversations,
+		Sessions:      model.NewRedisSessions(redisClient, cfg.Auth.RegisterKey),
+		Mailer:        utils.SMTPMailer{Config: cfg.Mail},
+		Tokens:        auth.NewTokens(cfg.Auth),
+		Limiter:       ratelimit.New(redisClient),
+	}
+	server := &http.Server{Addr: cfg.Server.Addr(), Handler: api.NewRouter(application)}
+	go func() {
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			panic(err)
 		}
-		// if model.IsTokenValid(c, redisClient) {
-		// 	c.JSON(http.StatusOK, gin.H{"message": "token is already valid"})
-		// 	return
-		// }
-		var user model.User
-		c.ShouldBind(&user)
+	}()
+	signals, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	<-signals.Done()
+	slog.Info("shutting down")
+	shutdown(server, cfg.Server.ShutdownTimeout, application, jobs, client, redisClient, flushTraces)
+}
 
-		if userId, userName, err := model.Login(user.Email, user.Password, client); err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
-			return
-		} else {
-			if token, er := auth.GenerateJWT(userId); er != nil {
-				c.JSON(http.StatusBadRequest, gin.H{"error": er.Error()})
-				return
-			} else {
-				// setCookie(c,"jwt_token",token)
-				cookie := &http.Cookie{
-					Name:     "jwt_token",
-					Value:    token,
-					Expires:  time.Now().Add(24 * time.Hour),
-					Path:     "/",
-					Domain:   "",
-					MaxAge:   86400,
-					Secure:   true,
-					HttpOnly: true,
-					SameSite: http.SameSiteNoneMode,
-				}
-				http.SetCookie(c.Writer, cookie)
-				// c.SetCookie("jwt_token", token, 60*60*24, "/", "", false, true)
-			}
+// shutdown stops the server without losing the answers being generated. It stops taking questions and connections,
+// closes the idle websockets, waits for the answers in progress to be saved, closes the sockets still streaming and
+// finally disconnects from MongoDB and Redis and sends the last spans. It waits at most timeout: answers still running
+// by then are left in the queue and generated again by the next instance.
+func shutdown(server *http.Server, timeout time.Duration, application *app.App, jobs *queue.Queue, client *mongo.Client, redisClient *redis.Client, flushTraces func(context.Context) error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
 
-			c.JSON(http.StatusOK, gin.H{"message": "success", "userId": userId, "userEmail": user.Email, "userName": userName})
-		}
-	})
-	router.GET("/conversations/:id", func(c *gin.Context) {
-		if !model.IsTokenValid(c, redisClient) {
-			return
-		}
-		var id int64
-		var er error
-		id, er = strconv.ParseInt(c.Param("id"), 10, 64)
-		if er != nil || id <= 0 {
-			c.JSON(http.StatusBadRequest, gin.H{
-				"error": "bad page",
-			})
-			return
-		}
-
-		cookie, _ := c.Request.Cookie("jwt_token")
-		token := cookie.Value
-		payload, _ := auth.DecodeJWT(token)
-		userID, err := primitive.ObjectIDFromHex(payload.UserID)
-		if err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{
-				"error": err,
-			})
-			return
-		}
-		if conversations, err := model.GetUserConversationsPage(userID, client, id); err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{
-				"error": err,
-			})
-			return
-		} else {
-			c.JSON(http.StatusOK, gin.H{
-				"message":       "success",
-				"conversations": conversations,
-			})
-			return
-		}
-	})
-	router.GET("/test/conversations", func(c *gin.Context) {
-		type Test struct {
-			ID          string    `json:"id"`
-			Title       string    `json:"title"`
-			LastMessage string    `json:"lastMessage"`
-			UpdatedAt   time.Time `json:"updatedAt"`
-			Unread      bool      `json:"unread"`
-		}
-		conversation1 := Test{
-			ID:          "1",
-			Title:       "First Conversation",
-			LastMessage: "Last message in the conversation",
-			UpdatedAt:   time.Date(2024, 3, 8, 12, 0, 0, 0, time.UTC),
-			Unread:      false,
-		}
-		conversation2 := Test{
-			ID:          "2",
-			Title:       "Second Conversation",
-			LastMessage: "Last message in the conversation",
-			UpdatedAt:   time.Date(2024, 3, 9, 12, 0, 0, 0, time.UTC),
-			Unread:      true,
-		}
-		conversation3 := Test{
-			ID:          "3",
-			Title:       "Thirsd Conversation",
-			LastMessage: "Last message in the conversation3",
-			UpdatedAt:   time.Date(2024, 3, 9, 18, 0, 0, 0, time.UTC),
-			Unread:      false,
-		}
-		test := []Test{conversation1, conversation2, conversation3}
+	application.Drain()
+	// Websockets are hijacked connections, Shutdown does not wait for them
+	if err := server.Shutdown(ctx); err != nil {
+		slog.Error("failed to finish the requests in progress", "error", err)
+	}
+	jobs.Stop()
+	ws.CloseConnections(true)
+	if err := jobs.Shutdown(ctx); err != nil {
+		slog.Error("stopped before every queued answer was saved", "error", err)
+	}
+	if err := model.WaitForAnswers(ctx); err != nil {
+		slog.Error("stopped before every answer was saved", "error", err)
+	}
+	ws.CloseConnections(false)
 
-		c.JSON(http.StatusOK, gin.H{"list": test})
-	})
-	router.GET("/conversations", func(c *gin.Context) {
-		if !model.IsTokenValid(c, redisClient) {
-			return
-		}
-		cookie, _ := c.Request.Cookie("jwt_token")
-		token := cookie.Value
-		payload, _ := auth.DecodeJWT(token)
-		userID, err := primitive.ObjectIDFromHex(payload.UserID)
-		if err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{
-				"error": err,
-			})
-			return
-		}
-		if conversations, err := model.GetUserConversations(userID, client); err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{
-				"error": err,
-			})
-			return
-		} else {
-			c.JSON(http.StatusOK, gin.H{
-				"message":       "success",
-				"conversations": conversations,
-			})
-			return
-		}
-	})
-	router.GET("/conversation/:id", func(c *gin.Context) {
-		if !model.IsTokenValid(c, redisClient) {
-			return
-		}
-		id := c.Param("id")
-		conversationID, err := primitive.ObjectIDFromHex(id)
-		if err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{
-				"error": errors.New("invalid conversation id"),
-			})
-			return
-		}
-		cookie, _ := c.Request.Cookie("jwt_token")
-		token := cookie.Value
-		payload, _ := auth.DecodeJWT(token)
-		userID, err := primitive.ObjectIDFromHex(payload.UserID)
-		if err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{
-				"error": err,
-			})
-			return
-		}
-		if conversation, err := model.GetOneConversation(conversationID, userID, client); err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{
-				"error": err,
-			})
-			return
-		} else {
-			c.JSON(http.StatusOK, gin.H{
-				"message":      "success",
-				"conversation": conversation,
-			})
-			return
-		}
-	})
-	router.POST("/conversation/new", func(c *gin.Context) {
-		if !model.IsTokenValid(c, redisClient) {
-			return
-		}
-		mode := c.PostForm("mode")
-		if mode != "1" && mode != "2" {
-			mode = "1"
-		}
-		message := c.PostForm("message")
-		cid := c.PostForm("cid")
+	closing, cancelClosing := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelClosing()
+	if err := client.Disconnect(closing); err != nil {
+		slog.Error("failed to disconnect from MongoDB", "error", err)
+	}
+	if err := redisClient.Close(); err != nil {
+		slog.Error("failed to close Redis", "error", err)
+	}
+	if err := flushTraces(closing); err != nil {
+		slog.Error("failed to send the last spans", "error", err)
+	}
+	slog.Info("server stopped")
+}
 
-		cookie, _ := c.Request.Cookie("jwt_token")
-		token := cookie.Value
-		payload, _ := auth.DecodeJWT(token)
-		id, err := primitive.ObjectIDFromHex(payload.UserID)
+// setupEmbeddings enables semantic search. The embedder is "gemini" (the default when the Gemini API key is set) or "fake",
+// the vector index keeps vectors in "mongo" (default) or in "memory". The messages saved before are only embedded
+// when the backfill is turned on.
+func setupEmbeddings(db *model.DB, cfg *config.Config) {
+	var embedder embedding.Embedder
+	switch cfg.Search.Embedder {
+	case "fake":
+		embedder = embedding.FakeEmbedder{}
+	default:
+		// config.Validate already rejected unknown embedders and an explicit gemini without a key
+		if cfg.Gemini.APIKey == "" {
+			slog.Warn("semantic search is disabled, GENAI_API_KEY is not set")
+			return
+		}
+		gemini, err := geminiapi.NewEmbedder(context.Background(), cfg.Gemini.APIKey)
 		if err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{
-				"error": err,
-			})
-			return
-		}
-		if id, er := model.AskNewConversation(id, message, client, mode, cid); er != nil {
-			c.JSON(http.StatusBadRequest, gin.H{
-				"error": err,
-			})
-		} else {
-			c.JSON(http.StatusOK, gin.H{
-				"cid": id.Hex(),
-			})
-		}
-	})
-	router.POST("/conversation/:id", func(c *gin.Context) {
-		if !model.IsTokenValid(c, redisClient) {
-			return
-		}
-		message := c.PostForm("message")
-		id := c.Param("id")
-		objectID, err := primitive.ObjectIDFromHex(id)
-		if err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{
-				"error": err,
-			})
-			return
-		}
-		cid := c.PostForm("cid")
-		if err := model.AskInConversation(objectID, message, client, cid); err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{
-				"error": err,
-			})
-			return
-		}
-		c.JSON(http.StatusOK, gin.H{
-			"message": "success",
-		})
-	})
-	router.GET("/api/get-signed-jwt", func(c *gin.Context) {
-		if !model.IsTokenValid(c, redisClient) {
+			slog.Error("semantic search is disabled", "error", err)
 			return
 		}
-		cookie, _ := c.Request.Cookie("jwt_token")
-		token := cookie.Value
-		payload, _ := auth.DecodeJWT(token)
-		if jwt, err := cloud.GetSignedJWT(payload.UserID); err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
-			return
-		} else {
-			c.JSON(http.StatusOK, gin.H{"jwt": jwt})
+		embedder = gemini
+	}
+	var index embedding.Index = embedding.NewMongoIndex(db.Collection("embedding"))
+	if cfg.Search.VectorIndex == "memory" {
+		index = embedding.NewMemoryIndex()
+	}
+	model.UseEmbeddings(embedder, index)
+	if !cfg.Search.Backfill {
+		return
+	}
+	go func() {
+		if embedded, err := model.BackfillEmbeddings(db); err != nil {
+			slog.Error("failed to embed old messages", "error", err)
+		} else if embedded > 0 {
+			slog.Info("embedded old messages", "messages", embedded)
 		}
-		// In production, you might want to validate the file type/size here
+	}()
+}
 
-	})
-	router.GET("/logout", func(c *gin.Context) {
-		cookie := &http.Cookie{
-			Name:     "jwt_token",
-			Value:    "",
-			Expires:  time.Now().Add(-1 * time.Second),
-			Path:     "/",
-			Domain:   "",
-			MaxAge:   -1,
-			Secure:   true,
-			HttpOnly: true,
-			SameSite: http.SameSiteNoneMode,
+// purgeTrash deletes every hour the conversations that have been in the trash for longer than retention.
+func purgeTrash(db *model.DB, retention time.Duration) {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+	for ; true; <-ticker.C {
+		if purged, err := model.PurgeTrash(retention, db); err != nil {
+			slog.Error("failed to purge the trash", "error", err)
+		} else if purged > 0 {
+			slog.Info("purged the trash", "conversations", purged)
 		}
-		http.SetCookie(c.Writer, cookie)
-		c.JSON(http.StatusOK, gin.H{"message": "success"})
-	})
-	router.POST("/getTopic", func(c *gin.Context) {
-		question := c.PostForm("question")
-		if question == "" {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "question is required"})
-			return
-		}
-		if topic, err := geminiapi.GetTopic(question, false); err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
-			return
-		} else {
-			c.JSON(http.StatusOK, gin.H{"message": "success", "topic": topic})
-		}
-	})
-
-	router.Run(":5000")
+	}
 }
@@ -0,0 +1,158 @@
+// Package metrics collects the Prometheus metrics of the server and serves them at /metrics. The packages being
+// measured update the collectors below, the HTTP, MongoDB and Redis ones are measured from the outside by Middleware,
+// MongoMonitor and RedisHook.
+package metrics
+
+import (
+	"crypto/subtle"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"server/apierror"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "chatbot"
+
+// Registry holds every metric of the server. It is its own rather than the global one of the Prometheus client so that
+// /metrics only shows what is documented here.
+var Registry = prometheus.NewRegistry()
+
+var (
+	httpRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "http_requests_total",
+		Help:      "HTTP requests answered, by route and status.",
+	}, []string{"method", "route", "status"})
+	httpDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "Time to answer an HTTP request, websocket connections excluded.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"method", "route"})
+
+	websocketCount atomic.Pointer[func() int]
+
+	// ModelFirstToken is the time from sending a question to the model API to receiving the first token of the answer.
+	ModelFirstToken = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "model_time_to_first_token_seconds",
+		Help:      "Time from sending a question to the model API to its first token.",
+		Buckets:   prometheus.ExponentialBuckets(0.1, 2, 10),
+	}, []string{"mode"})
+	// ModelGeneration is the time the model API takes to stream a complete answer.
+	ModelGeneration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "model_generation_seconds",
+		Help:      "Time from sending a question to the model API to the end of its answer.",
+		Buckets:   prometheus.ExponentialBuckets(0.5, 2, 10),
+	}, []string{"mode"})
+	ModelTokens = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "model_tokens_streamed_total",
+		Help:      "Tokens received from the model API and streamed to the clients.",
+	})
+	// ModelErrors counts the answers of the model API cut short, by the ModelError types.
+	ModelErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "model_errors_total",
+		Help:      "Requests to the model API that failed, by type.",
+	}, []string{"type"})
+
+	mongoDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "mongo_operation_duration_seconds",
+		Help:      "Time of the MongoDB commands, by command and outcome.",
+		Buckets:   storeBuckets,
+	}, []string{"command", "outcome"})
+	redisDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "redis_operation_duration_seconds",
+		Help:      "Time of the Redis commands, by command and outcome. Pipelines count as one pipeline command.",
+		Buckets:   storeBuckets,
+	}, []string{"command", "outcome"})
+
+	OTPEmailsSent = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "otp_emails_sent_total",
+		Help:      "Emails sent with a registration code.",
+	})
+)
+
+// From half a millisecond to about eight seconds
+var storeBuckets = prometheus.ExponentialBuckets(0.0005, 2, 15)
+
+// Types of ModelErrors
+const (
+	ModelErrorRequest = "request" // the request could not be built
+	ModelErrorTimeout = "timeout"
+	ModelErrorNetwork = "network"
+	ModelErrorStatus  = "status" // the model API answered with another status than 200
+	ModelErrorRead    = "read"   // the answer broke off while being read
+)
+
+func init() {
+	Registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		httpRequests, httpDuration,
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "websocket_connections",
+			Help:      "Websocket connections open.",
+		}, func() float64 {
+			if count := websocketCount.Load(); count != nil {
+				return float64((*count)())
+			}
+			return 0
+		}),
+		ModelFirstToken, ModelGeneration, ModelTokens, ModelErrors,
+		mongoDuration, redisDuration,
+		OTPEmailsSent,
+	)
+	// Show the error types at 0 rather than only once they happened
+	for _, kind := range []string{ModelErrorRequest, ModelErrorTimeout, ModelErrorNetwork, ModelErrorStatus, ModelErrorRead} {
+		ModelErrors.WithLabelValues(kind)
+	}
+}
+
+// CountWebsockets sets how the open websocket connections are counted when the metrics are read.
+func CountWebsockets(count func() int) {
+	websocketCount.Store(&count)
+}
+
+// Middleware measures the requests. They are labelled by their route pattern, such as /v1/conversations/:id, so that
+// the ids do not make a series each. Requests matching no route share the route "unmatched".
+func Middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+		route := c.FullPath()
+		if route == "" {
+			route = "unmatched"
+		}
+		httpRequests.WithLabelValues(c.Request.Method, route, strconv.Itoa(c.Writer.Status())).Inc()
+		// A websocket request lasts as long as the connection, it would drown the latency of the other routes
+		if !c.IsWebsocket() {
+			httpDuration.WithLabelValues(c.Request.Method, route).Observe(time.Since(start).Seconds())
+		}
+	}
+}
+
+// Handler serves the metrics in the Prometheus text format. With a token, scrapers have to send it as a bearer token.
+func Handler(token string) gin.HandlerFunc {
+	serve := promhttp.HandlerFor(Registry, promhttp.HandlerOpts{})
+	expected := []byte("Bearer " + token)
+	return func(c *gin.Context) {
+		if token != "" && subtle.ConstantTimeCompare([]byte(c.GetHeader("Authorization")), expected) != 1 {
+			c.Error(apierror.Unauthenticated.WithMessage("metrics need the bearer token"))
+			return
+		}
+		serve.ServeHTTP(c.Writer, c.Request)
+	}
+}
@@ -0,0 +1,80 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"server/apierror"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/redis/go-redis/v9"
+)
+
+func TestMiddlewareLabelsRoutes(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	engine := gin.New()
+	engine.Use(Middleware())
+	engine.GET("/v1/conversations/:id", func(c *gin.Context) { c.Status(http.StatusNoContent) })
+
+	for _, path := range []string{"/v1/conversations/1", "/v1/conversations/2", "/nothing"} {
+		engine.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, path, nil))
+	}
+	if got := testutil.ToFloat64(httpRequests.WithLabelValues("GET", "/v1/conversations/:id", "204")); got != 2 {
+		t.Errorf("counted %v requests of the route, want 2", got)
+	}
+	if got := testutil.ToFloat64(httpRequests.WithLabelValues("GET", "unmatched", "404")); got != 1 {
+		t.Errorf("counted %v unmatched requests, want 1", got)
+	}
+}
+
+func TestHandler(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	CountWebsockets(func() int { return 3 })
+	engine := gin.New()
+	engine.Use(apierror.Middleware(func(error) *apierror.Error { return nil }))
+	engine.GET("/metrics", Handler("secret"))
+
+	w := httptest.NewRecorder()
+	engine.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("without the token got %d, want 401", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	r.Header.Set("Authorization", "Bearer secret")
+	engine.ServeHTTP(w, r)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "chatbot_websocket_connections 3") {
+		t.Errorf("got %d %s", w.Code, w.Body)
+	}
+}
+
+func TestRedisHook(t *testing.T) {
+	process := RedisHook{}.ProcessHook(func(ctx context.Context, cmd redis.Cmder) error {
+		if cmd.Name() == "get" {
+			return redis.Nil
+		}
+		return errors.New("connection refused")
+	})
+	process(context.Background(), redis.NewStringCmd(context.Background(), "get", "key"))
+	process(context.Background(), redis.NewStatusCmd(context.Background(), "set", "key", "value"))
+	if observations(t, redisDuration, "get", "ok") != 1 || observations(t, redisDuration, "set", "error") != 1 {
+		t.Error("a missing key should be ok and a refused connection an error")
+	}
+}
+
+func observations(t *testing.T, histogram *prometheus.HistogramVec, labels ...string) uint64 {
+	t.Helper()
+	var m dto.Metric
+	if err := histogram.WithLabelValues(labels...).(prometheus.Metric).Write(&m); err != nil {
+		t.Fatal(err)
+	}
+	return m.GetHistogram().GetSampleCount()
+}
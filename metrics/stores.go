@@ -0,0 +1,57 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"net"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"go.mongodb.org/mongo-driver/event"
+)
+
+func outcome(failed bool) string {
+	if failed {
+		return "error"
+	}
+	return "ok"
+}
+
+// MongoMonitor measures the commands sent by a MongoDB client, set it with options.Client().SetMonitor.
+func MongoMonitor() *event.CommandMonitor {
+	return &event.CommandMonitor{
+		Succeeded: func(_ context.Context, e *event.CommandSucceededEvent) {
+			mongoDuration.WithLabelValues(e.CommandName, outcome(false)).Observe(e.Duration.Seconds())
+		},
+		Failed: func(_ context.Context, e *event.CommandFailedEvent) {
+			mongoDuration.WithLabelValues(e.CommandName, outcome(true)).Observe(e.Duration.Seconds())
+		},
+	}
+}
+
+// RedisHook measures the commands sent by a Redis client, add it with client.AddHook. A missing key is not a failure.
+type RedisHook struct{}
+
+func (RedisHook) DialHook(next redis.DialHook) redis.DialHook {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return next(ctx, network, addr)
+	}
+}
+
+func (RedisHook) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		start := time.Now()
+		err := next(ctx, cmd)
+		redisDuration.WithLabelValues(cmd.Name(), outcome(err != nil && !errors.Is(err, redis.Nil))).Observe(time.Since(start).Seconds())
+		return err
+	}
+}
+
+func (RedisHook) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return func(ctx context.Context, cmds []redis.Cmder) error {
+		start := time.Now()
+		err := next(ctx, cmds)
+		redisDuration.WithLabelValues("pipeline", outcome(err != nil && !errors.Is(err, redis.Nil))).Observe(time.Since(start).Seconds())
+		return err
+	}
+}
@@ -0,0 +1,248 @@
+package model
+
+import (
+	"context"
+	chatbotapi "server/chatbotAPI"
+	"server/utils"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Messages of a conversation form a tree: every message points to the one it answers (or follows) through ParentID.
+// Editing a user message adds a sibling of it instead of overwriting it, so the old continuation stays reachable.
+// The branch shown to the user is the path from the root to ActiveLeafID.
+
+// ensureMessageTree gives IDs to messages stored before branching existed and chains them in order.
+// It reports whether the conversation changed so the caller can persist it.
+func (c *Conversation) ensureMessageTree() bool {
+	return c.chainMessages(func(int) primitive.ObjectID { return primitive.NewObjectID() })
+}
+
+// chainMessages is ensureMessageTree with the IDs given by newID, from the index of the message.
+func (c *Conversation) chainMessages(newID func(i int) primitive.ObjectID) bool {
+	changed := false
+	var prev primitive.ObjectID
+	for i := range c.Messages {
+		if c.Messages[i].ID.IsZero() {
+			c.Messages[i].ID = newID(i)
+			c.Messages[i].ParentID = prev
+			changed = true
+		}
+		prev = c.Messages[i].ID
+	}
+	if c.ActiveLeafID.IsZero() && len(c.Messages) > 0 {
+		c.ActiveLeafID = c.Messages[len(c.Messages)-1].ID
+		changed = true
+	}
+	return changed
+}
+
+// FindMessage returns the index of the message id in c.Messages.
+func (c *Conversation) FindMessage(id primitive.ObjectID) (int, bool) {
+	for i := range c.Messages {
+		if c.Messages[i].ID == id {
+			return i, true
+		}
+	}
+	return -1, false
+}
+
+// Children returns the indexes of the direct replies of parentID, oldest first. A zero parentID returns the roots.
+func (c *Conversation) Children(parentID primitive.ObjectID) []int {
+	var result []int
+	for i := range c.Messages {
+		if c.Messages[i].ParentID == parentID && !c.Messages[i].ID.IsZero() {
+			result = append(result, i)
+		}
+	}
+	return result
+}
+
+// PathTo returns the messages from the root down to id, inclusive.
+func (c *Conversation) PathTo(id primitive.ObjectID) []Message {
+	byID := make(map[primitive.ObjectID]int, len(c.Messages))
+	for i := range c.Messages {
+		byID[c.Messages[i].ID] = i
+	}
+	var path []Message
+	// The bound protects against a corrupted document where parents form a cycle
+	for steps := 0; !id.IsZero() && steps <= len(c.Messages); steps++ {
+		i, ok := byID[id]
+		if !ok {
+			break
+		}
+		path = append(path, c.Messages[i])
+		id = c.Messages[i].ParentID
+	}
+	for i, j := 0, len(path)-1; i < j; i, j = i+1, j-1 {
+		path[i], path[j] = path[j], path[i]
+	}
+	return path
+}
+
+// ActivePath returns the messages of the selected branch, each annotated with its position among its siblings.
+func (c *Conversation) ActivePath() []Message {
+	if c.ActiveLeafID.IsZero() {
+		return c.Messages
+	}
+	path := c.PathTo(c.ActiveLeafID)
+	siblings := make(map[primitive.ObjectID][]primitive.ObjectID)
+	for _, m := range c.Messages {
+		if !m.ID.IsZero() {
+			siblings[m.ParentID] = append(siblings[m.ParentID], m.ID)
+		}
+	}
+	for i := range path {
+		ids := siblings[path[i].ParentID]
+		if len(ids) < 2 {
+			continue
+		}
+		path[i].BranchCount = len(ids)
+		for k, id := range ids {
+			if id == path[i].ID {
+				path[i].BranchIndex = k + 1
+			}
+		}
+	}
+	return path
+}
+
+// LatestLeaf follows the most recent reply from id until it reaches a message nobody answered yet.
+func (c *Conversation) LatestLeaf(id primitive.ObjectID) primitive.ObjectID {
+	for steps := 0; steps <= len(c.Messages); steps++ {
+		replies := c.Children(id)
+		if len(replies) == 0 {
+			break
+		}
+		id = c.Messages[replies[len(replies)-1]].ID
+	}
+	return id
+}
+
+// ToHistory turns a branch into the history sent to the model API.
+func ToHistory(messages []Message) []chatbotapi.HistoryMessage {
+	history := make([]chatbotapi.HistoryMessage, 0, len(messages))
+	for _, m := range messages {
+		history = append(history, chatbotapi.HistoryMessage{Role: m.Sender, Content: m.Content})
+	}
+	return history
+}
+
+// loadConversationTree reads a conversation owned by userID together with all of its messages.
+// Without withContent only the tree structure is read (no content nor versions), which stays small for long conversations.
+func loadConversationTree(ctx context.Context, db *DB, conversationID, userID primitive.ObjectID, withContent bool) (*Conversation, error) {
+	conversation, err := loadConversation(ctx, db, conversationID, userID)
+	if err != nil {
+		return nil, err
+	}
+	if conversation.Messages, err = loadMessages(ctx, db, conversationID, withContent); err != nil {
+		return nil, err
+	}
+	if conversation.ActiveLeafID.IsZero() && conversation.ensureMessageTree() {
+		update := bson.M{"$set": bson.M{"active_leaf_id": conversation.ActiveLeafID}}
+		if _, err := db.database().Collection("conversation").UpdateOne(ctx, bson.M{"_id": conversationID}, update); err != nil {
+			return nil, err
+		}
+	}
+	return conversation, nil
+}
+
+func setActiveLeaf(ctx context.Context, db *DB, conversationID, leafID primitive.ObjectID) error {
+	collection := db.database().Collection("conversation")
+	update := bson.M{"$set": bson.M{"active_leaf_id": leafID, "updated_at": time.Now()}}
+	_, err := collection.UpdateOne(ctx, bson.M{"_id": conversationID}, update)
+	return err
+}
+
+// This function replaces an earlier user message with a new version and regenerates the answer from there.
+// The old message and everything after it are kept as a sibling branch that can be switched back to.
+func EditMessage(ctx context.Context, conversationID, userID, messageID primitive.ObjectID, content string, db *DB, cid string) error {
+	content = utils.CleanString(content)
+	if content == "" {
+		return invalid("content is empty")
+	}
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), db.settings.Mongo.Timeout)
+	defer cancel()
+	conversation, err := loadConversationTree(ctx, db, conversationID, userID, false)
+	if err != nil {
+		return err
+	}
+	i, ok := conversation.FindMessage(messageID)
+	if !ok {
+		return ErrMessageNotFound
+	}
+	if conversation.Messages[i].Sender != "user" {
+		return invalid("only user messages can be edited")
+	}
+	parentID := conversation.Messages[i].ParentID
+	edited := Message{
+		ID:             primitive.NewObjectID(),
+		ConversationID: conversationID,
+		ParentID:       parentID,
+		Sender:         "user",
+		Content:        content,
+		Cid:            cid,
+		Timestamp:      time.Now(),
+		Status:         StatusPending,
+		StatusAt:       time.Now(),
+	}
+	if err := insertMessages(ctx, db, edited); err != nil {
+		return err
+	}
+	if err := setActiveLeaf(ctx, db, conversationID, edited.ID); err != nil {
+		return err
+	}
+
+	answerLater(ctx, db, AnswerJob{UserID: userID, ConversationID: conversationID, QuestionID: edited.ID, Mode: conversation.Mode, WithHistory: true})
+	return nil
+}
+
+// This function returns every version of a message (the message and its siblings), oldest first,
+// together with the index of the version that is on the active branch.
+func GetBranches(conversationID, userID, messageID primitive.ObjectID, db *DB) ([]Message, int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), db.settings.Mongo.Timeout)
+	defer cancel()
+	conversation, err := loadConversationTree(ctx, db, conversationID, userID, false)
+	if err != nil {
+		return nil, -1, err
+	}
+	i, ok := conversation.FindMessage(messageID)
+	if !ok {
+		return nil, -1, ErrMessageNotFound
+	}
+	active := make(map[primitive.ObjectID]bool)
+	for _, m := range conversation.PathTo(conversation.ActiveLeafID) {
+		active[m.ID] = true
+	}
+	var branches []Message
+	selected := -1
+	for k, idx := range conversation.Children(conversation.Messages[i].ParentID) {
+		if active[conversation.Messages[idx].ID] {
+			selected = k
+		}
+		branches = append(branches, conversation.Messages[idx])
+	}
+	if branches, err = fillContent(ctx, db, branches); err != nil {
+		return nil, -1, err
+	}
+	return branches, selected, nil
+}
+
+// This function makes the branch going through messageID the active one, continuing down its most recent replies.
+func SwitchBranch(conversationID, userID, messageID primitive.ObjectID, db *DB) error {
+	ctx, cancel := context.WithTimeout(context.Background(), db.settings.Mongo.Timeout)
+	defer cancel()
+	conversation, err := loadConversationTree(ctx, db, conversationID, userID, false)
+	if err != nil {
+		return err
+	}
+	if _, ok := conversation.FindMessage(messageID); !ok {
+		return ErrMessageNotFound
+	}
+	collection := db.database().Collection("conversation")
+	leaf := conversation.LatestLeaf(messageID)
+	_, err = collection.UpdateOne(ctx, bson.M{"_id": conversationID}, bson.M{"$set": bson.M{"active_leaf_id": leaf}})
+	return err
+}
@@ -0,0 +1,109 @@
+package model
+
+import (
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func contents(messages []Message) []string {
+	var result []string
+	for _, m := range messages {
+		result = append(result, m.Content)
+	}
+	return result
+}
+
+func equal(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestMessageTree(t *testing.T) {
+	// A conversation stored before branching existed: no IDs, no active leaf
+	conversation := &Conversation{Messages: []Message{
+		{Sender: "user", Content: "q1"},
+		{Sender: "bot", Content: "a1"},
+		{Sender: "user", Content: "q2"},
+		{Sender: "bot", Content: "a2"},
+	}}
+	if !conversation.ensureMessageTree() {
+		t.Fatal("legacy conversation should be migrated")
+	}
+	if conversation.ensureMessageTree() {
+		t.Fatal("migration should be idempotent")
+	}
+	if got := contents(conversation.ActivePath()); !equal(got, []string{"q1", "a1", "q2", "a2"}) {
+		t.Fatalf("active path = %v", got)
+	}
+
+	// Edit q2: the new version is a sibling answered on its own branch
+	q2 := conversation.Messages[2]
+	edited := Message{ID: primitive.NewObjectID(), ParentID: q2.ParentID, Sender: "user", Content: "q2 edited"}
+	answer := Message{ID: primitive.NewObjectID(), ParentID: edited.ID, Sender: "bot", Content: "a2 edited"}
+	conversation.Messages = append(conversation.Messages, edited, answer)
+	conversation.ActiveLeafID = answer.ID
+
+	path := conversation.ActivePath()
+	if got := contents(path); !equal(got, []string{"q1", "a1", "q2 edited", "a2 edited"}) {
+		t.Fatalf("active path after edit = %v", got)
+	}
+	if path[2].BranchCount != 2 || path[2].BranchIndex != 2 {
+		t.Fatalf("edited message branch = %d/%d, want 2/2", path[2].BranchIndex, path[2].BranchCount)
+	}
+
+	// Switching back to the original question lands on its latest answer
+	conversation.ActiveLeafID = conversation.LatestLeaf(q2.ID)
+	if got := contents(conversation.ActivePath()); !equal(got, []string{"q1", "a1", "q2", "a2"}) {
+		t.Fatalf("active path after switch = %v", got)
+	}
+
+	conversation.AddMessage("user", "q3")
+	if got := contents(conversation.ActivePath()); !equal(got, []string{"q1", "a1", "q2", "a2", "q3"}) {
+		t.Fatalf("active path after add = %v", got)
+	}
+}
+
+func TestLegacyMessageIDs(t *testing.T) {
+	conversationID := primitive.NewObjectID()
+	legacy := func() *Conversation {
+		return &Conversation{ID: conversationID, Messages: []Message{{Content: "q1"}, {Content: "a1"}, {Content: "q2"}}}
+	}
+	first, second := legacy(), legacy()
+	for _, c := range []*Conversation{first, second} {
+		c.chainMessages(func(i int) primitive.ObjectID { return legacyMessageID(c.ID, i) })
+	}
+	for i := range first.Messages {
+		if first.Messages[i].ID != second.Messages[i].ID || first.Messages[i].ParentID != second.Messages[i].ParentID {
+			t.Fatalf("migrating again gave message %d another id", i)
+		}
+		if i > 0 && first.Messages[i].ID.Hex() <= first.Messages[i-1].ID.Hex() {
+			t.Fatalf("message %d sorts before the one it follows", i)
+		}
+	}
+	if other := legacyMessageID(primitive.NewObjectID(), 0); other == first.Messages[0].ID {
+		t.Fatal("two conversations gave their first message the same id")
+	}
+}
+
+func TestRemoveMessageKeepsReplies(t *testing.T) {
+	conversation := &Conversation{}
+	conversation.AddMessage("user", "q1")
+	conversation.AddMessage("bot", "a1")
+	conversation.AddMessage("user", "q2")
+	conversation.RemoveMessage(1)
+	if got := contents(conversation.ActivePath()); !equal(got, []string{"q1", "q2"}) {
+		t.Fatalf("active path after remove = %v", got)
+	}
+	conversation.RemoveMessage(1)
+	if got := contents(conversation.ActivePath()); !equal(got, []string{"q1"}) {
+		t.Fatalf("active path after removing the leaf = %v", got)
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"errors"
 	"fmt"
 	chatbotapi "server/chatbotAPI"
+	"server/config"
 	"server/utils"
 	ws "server/websocket"
 	"strings"
@@ -16,10 +17,32 @@ import (
 	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
+// Messages are stored in their own collection, one document per message, so a conversation has no size limit.
 type Message struct {
-	Sender    string    `bson:"sender" json:"sender"`
+	ID             primitive.ObjectID `bson:"_id,omitempty" json:"id,omitempty"`
+	ConversationID primitive.ObjectID `bson:"conversation_id" json:"conversation_id,omitempty"`
+	ParentID       primitive.ObjectID `bson:"parent_id,omitempty" json:"parent_id,omitempty"`
+	Sender         string             `bson:"sender" json:"sender"`
+	Content        string             `bson:"content" json:"content"`
+	Cid            string             `bson:"cid,omitempty" json:"cid,omitempty"`
+	Timestamp      time.Time          `bson:"timestamp" json:"timestamp"`
+	Pinned         bool               `bson:"pinned,omitempty" json:"pinned,omitempty"`
+	// Where the answer to a user message stands, see StatusPending. Empty on messages saved before it existed, which are complete
+	Status string `bson:"status,omitempty" json:"status,omitempty"`
+	// When Status last changed, a pending or streaming question whose status is older than the answer lease is no longer being answered
+	StatusAt time.Time `bson:"status_at,omitempty" json:"-"`
+	// Content without diacritics, indexed for full-text search
+	SearchText string `bson:"search_text,omitempty" json:"-"`
+	// Answers generated for the same question when a bot message is regenerated, Content holds Versions[Selected]
+	Versions []MessageVersion `bson:"versions,omitempty" json:"versions,omitempty"`
+	Selected int              `bson:"selected,omitempty" json:"selected,omitempty"`
+	// Position of the message among its edited versions, 1-based, only set when there is more than one version
+	BranchIndex int `bson:"-" json:"branch_index,omitempty"`
+	BranchCount int `bson:"-" json:"branch_count,omitempty"`
+}
+
+type MessageVersion struct {
 	Content   string    `bson:"content" json:"content"`
-	Cid       string    `bson:"cid,omitempty" json:"cid,omitempty"`
 	Timestamp time.Time `bson:"timestamp" json:"timestamp"`
 }
 
@@ -34,36 +57,86 @@ type Conversation struct {
 	UserID    primitive.ObjectID   `bson:"user_id" json:"user_id"`
 	StartedAt time.Time            `bson:"started_at" json:"started_at"`
 	UpdatedAt time.Time            `bson:"updated_at" json:"updated_at"`
-	Messages  []Message            `bson:"messages" json:"messages"`
 	Topic     string               `bson:"topic,omitempty" json:"topic,omitempty"`
 	Metadata  ConversationMetadata `bson:"metadata,omitempty" json:"metadata,omitempty"`
 	Mode      string               `bson:"mode,omitempty" json:"mode,omitempty"`
+	Pinned    bool                 `bson:"pinned,omitempty" json:"pinned,omitempty"`
+	Archived  bool                 `bson:"archived,omitempty" json:"archived,omitempty"`
+	// Topic without diacritics, indexed for full-text search
+	TopicSearch string `bson:"topic_search,omitempty" json:"-"`
+	// Set when the conversation is moved to the trash, it is purged after the retention period
+	DeletedAt *time.Time `bson:"deleted_at,omitempty" json:"deleted_at,omitempty"`
+	// Folder of the user the conversation is filed in, none when it is unfiled
+	FolderID primitive.ObjectID `bson:"folder_id,omitempty" json:"folder_id,omitempty"`
+	Tags     []string           `bson:"tags,omitempty" json:"tags,omitempty"`
+	// Share the conversation was forked from. The model API has never seen its first messages, so they are sent as history
+	ForkedFrom primitive.ObjectID `bson:"forked_from,omitempty" json:"forked_from,omitempty"`
+	// Tool the conversation was imported from, the model API has never seen its messages either
+	ImportedFrom string `bson:"imported_from,omitempty" json:"imported_from,omitempty"`
+	// Last message of the branch currently shown to the user
+	ActiveLeafID primitive.ObjectID `bson:"active_leaf_id,omitempty" json:"active_leaf_id,omitempty"`
+	// Messages live in the message collection, they are only loaded here when a function needs them
+	Messages []Message `bson:"-" json:"messages,omitempty"`
+	// Cursor for the messages older than Messages, see GetActiveMessages
+	NextCursor string `bson:"-" json:"next_cursor,omitempty"`
 }
 type ConversationSummary struct {
 	ID        primitive.ObjectID `bson:"_id" json:"id"`
 	Topic     string             `bson:"topic" json:"topic"`
 	UpdatedAt time.Time          `bson:"updated_at" json:"updated_at"`
 	Mode      string             `bson:"mode" json:"mode"`
+	Pinned    bool               `bson:"pinned" json:"pinned"`
+	Archived  bool               `bson:"archived" json:"archived"`
+	DeletedAt *time.Time         `bson:"deleted_at,omitempty" json:"deleted_at,omitempty"`
+	FolderID  primitive.ObjectID `bson:"folder_id,omitempty" json:"folder_id,omitempty"`
+	Tags      []string           `bson:"tags,omitempty" json:"tags,omitempty"`
+}
+
+// summaryProjection reads the fields of ConversationSummary.
+var summaryProjection = bson.M{
+	"_id":        1,
+	"topic":      1,
+	"updated_at": 1,
+	"mode":       1,
+	"pinned":     1,
+	"archived":   1,
+	"deleted_at": 1,
+	"folder_id":  1,
+	"tags":       1,
 }
 
+// notDeleted is the filter value of deleted_at leaving out the conversations in the trash.
+var notDeleted = bson.M{"$exists": false}
+
 func NewConversation(userID primitive.ObjectID, content string, cid string) (*Conversation, error) {
 	content = utils.CleanString(content)
+	conversationID := primitive.NewObjectID()
+	first := Message{
+		ID:             primitive.NewObjectID(),
+		ConversationID: conversationID,
+		Sender:         "user",
+		Content:        content,
+		Timestamp:      time.Now(),
+		Cid:            cid,
+	}
 	return &Conversation{
-		UserID:    userID,
-		StartedAt: time.Now(),
-		UpdatedAt: time.Now(),
-		Topic:     "",
-		Messages: []Message{{
-			Sender:    "user",
-			Content:   content,
-			Timestamp: time.Now(),
-			Cid:       cid,
-		}},
+		ID:           conversationID,
+		UserID:       userID,
+		StartedAt:    time.Now(),
+		UpdatedAt:    time.Now(),
+		Topic:        "",
+		Messages:     []Message{first},
+		ActiveLeafID: first.ID,
 	}, nil
 }
 
-// This function generates a response from the user's message using the model API and sends it to the user via websocket.
-func GenerateResponseAndWebsocket(userID, content, id, mode string, isFirst bool, cid string) (string, string, error) {
+// Sent on the websocket before the answer of a retried job: the answer the failed attempt streamed, up to its
+// "end of response", is to be dropped
+const RestartOfResponse = "restart of response"
+
+// This function generates a response from the user's message using the model API of cfg and sends it to the user via websocket.
+// history is only needed when answering on another branch than the one the model API remembers (see EditMessage).
+func GenerateResponseAndWebsocket(ctx context.Context, cfg *config.Config, userID, content, id, mode string, isFirst bool, cid string, history []chatbotapi.HistoryMessage) (string, string, error) {
 	var completeResponse strings.Builder
 	prefix := "Chủ đề-123: "
 	if userID == "" {
@@ -80,15 +153,22 @@ func GenerateResponseAndWebsocket(userID, content, id, mode string, isFirst bool
 		client.Mu.Lock()
 		client.IsSending = true
 		client.Mu.Unlock()
+		// Released on every return, the topic line ends the response early
+		defer func() {
+			client.Mu.Lock()
+			client.IsSending = false
+			client.Mu.Unlock()
+		}()
 	}
 
-	for token := range chatbotapi.GetStreamingResponseFromModelAPI(content, mode, id, isFirst, cid) {
+	stream := chatbotapi.New(cfg.ModelAPI).OpenStream(ctx, content, mode, id, isFirst, cid, history)
+	for token := range stream.Tokens {
 		// Print each token for debugging/viewing
 		// HANDLE WEBSOCKET HERE
-		ws.BroadcastToken(userID, id, token)
+		ws.BroadcastToken(userID, id, token, cfg.Server.WebsocketWait)
 		if strings.HasPrefix(token, prefix) {
 			topic := token[len(prefix):]
-			ws.BroadcastToken(userID, id, "end of response")
+			ws.BroadcastToken(userID, id, "end of response", cfg.Server.WebsocketWait)
 			if strings.HasSuffix(topic, "\n") {
 				topic = topic[:len(topic)-1]
 			}
@@ -97,22 +177,21 @@ func GenerateResponseAndWebsocket(userID, content, id, mode string, isFirst bool
 		completeResponse.WriteString(token)
 
 	}
-	ws.BroadcastToken(userID, id, "end of response")
-	if client, exists := ws.Clients[clientID]; exists {
-		client.Mu.Lock()
-		client.IsSending = false
-		client.Mu.Unlock()
+	ws.BroadcastToken(userID, id, "end of response", cfg.Server.WebsocketWait)
+	if err := stream.Err(); err != nil {
+		return "", "", err
 	}
 	return completeResponse.String(), "", nil
 }
-func CheckConversationUser(userID, conversationID primitive.ObjectID, client *mongo.Client) error {
-	collection := client.Database("chatbot-server").Collection("conversation")
-	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+func CheckConversationUser(userID, conversationID primitive.ObjectID, db *DB) error {
+	collection := db.database().Collection("conversation")
+	ctx, cancel := context.WithTimeout(context.Background(), db.settings.Mongo.Timeout)
 	defer cancel()
 
 	filter := bson.M{
-		"_id":     conversationID,
-		"user_id": userID,
+		"_id":        conversationID,
+		"user_id":    userID,
+		"deleted_at": notDeleted,
 	}
 
 	var conversation Conversation
@@ -120,7 +199,7 @@ func CheckConversationUser(userID, conversationID primitive.ObjectID, client *mo
 
 	if err != nil {
 		if err == mongo.ErrNoDocuments {
-			return errors.New("conversation not found or does not belong to the user")
+			return ErrConversationNotFound
 		}
 		return err
 	}
@@ -128,158 +207,172 @@ func CheckConversationUser(userID, conversationID primitive.ObjectID, client *mo
 	return nil
 }
 
-// This function first creates a new conversation with the user's message, then generates a response using the model API and sends it to the user via websocket. Finally, it saves the conversation to the database.
-func AskNewConversation(userID primitive.ObjectID, content string, client *mongo.Client, mode string, cid string) (primitive.ObjectID, error) {
+// This function first creates a new conversation with the user's message, then generates a response using the model API and sends it to the user via websocket.
+// The question is saved before the model is called, its status tells the client whether the answer is on its way, saved or failed.
+// Sending the same cid again returns the conversation created the first time, asking again only if it failed.
+func AskNewConversation(ctx context.Context, userID primitive.ObjectID, content string, db *DB, mode string, cid string) (primitive.ObjectID, error) {
 	if content == "" {
-		return primitive.NilObjectID, errors.New("content is empty")
+		return primitive.NilObjectID, invalid("content is empty")
+	}
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), db.settings.Mongo.AskTimeout)
+	defer cancel()
+	if cid != "" {
+		first, existing, err := findFirstQuestion(ctx, db, userID, cid)
+		if err != nil {
+			return primitive.NilObjectID, err
+		}
+		if first != nil {
+			if first.Status == StatusFailed {
+				answerLater(ctx, db, AnswerJob{UserID: userID, ConversationID: existing.ID, QuestionID: first.ID, Mode: existing.Mode, IsFirst: true})
+			}
+			return existing.ID, nil
+		}
 	}
 	conversation, err := NewConversation(userID, content, cid)
 	if err != nil {
 		return primitive.NilObjectID, err
 	}
 	conversation.Mode = mode
-	collection := client.Database("chatbot-server").Collection("conversation")
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
-	result, err := collection.InsertOne(ctx, conversation)
-	if err != nil {
-		return primitive.NilObjectID, errors.New("failed to create conversation")
+	conversation.Messages[0].Status, conversation.Messages[0].StatusAt = StatusPending, time.Now()
+	collection := db.database().Collection("conversation")
+	if _, err := collection.InsertOne(ctx, conversation); err != nil {
+		return primitive.NilObjectID, fmt.Errorf("failed to create conversation: %w", err)
+	}
+	if err := insertMessages(ctx, db, conversation.Messages...); err != nil {
+		return primitive.NilObjectID, fmt.Errorf("failed to create conversation: %w", err)
 	}
 
-	go func() {
-		finalResponse, topic, err := GenerateResponseAndWebsocket(userID.Hex(), conversation.Messages[0].Content, result.InsertedID.(primitive.ObjectID).Hex(), mode, true, cid)
-		if err != nil {
-			fmt.Println(err)
-			return
-		}
-		filter := bson.M{"_id": result.InsertedID.(primitive.ObjectID)}
-		newMessage := Message{
-			Sender:    "bot",
-			Content:   finalResponse,
-			Timestamp: time.Now(),
-		}
-		update := bson.M{
-			"$push": bson.M{"messages": newMessage},
-			"$set":  bson.M{"updated_at": time.Now(), "topic": topic},
-		}
-
-		if _, err := collection.UpdateOne(context.TODO(), filter, update); err != nil {
-			fmt.Println(err)
-		}
-	}()
+	answerLater(ctx, db, AnswerJob{UserID: userID, ConversationID: conversation.ID, QuestionID: conversation.Messages[0].ID, Mode: mode, IsFirst: true})
 
-	return result.InsertedID.(primitive.ObjectID), nil
+	return conversation.ID, nil
 }
+
+// AddMessage appends a message at the end of the active branch.
 func (c *Conversation) AddMessage(sender, content string) {
-	c.Messages = append(c.Messages, Message{
+	c.ensureMessageTree()
+	message := Message{
+		ID:        primitive.NewObjectID(),
+		ParentID:  c.ActiveLeafID,
 		Sender:    sender,
 		Content:   content,
 		Timestamp: time.Now(),
-	})
+	}
+	c.Messages = append(c.Messages, message)
+	c.ActiveLeafID = message.ID
 	c.UpdatedAt = time.Now()
 }
+
+// RemoveMessage deletes the message at index, its replies are attached to its parent so no branch is lost.
 func (c *Conversation) RemoveMessage(index int) {
+	c.ensureMessageTree()
+	removed := c.Messages[index]
 	c.Messages = append(c.Messages[:index], c.Messages[index+1:]...)
+	for i := range c.Messages {
+		if c.Messages[i].ParentID == removed.ID {
+			c.Messages[i].ParentID = removed.ParentID
+		}
+	}
+	if c.ActiveLeafID == removed.ID {
+		c.ActiveLeafID = c.LatestLeaf(removed.ParentID)
+	}
 }
 
-// This function generates a response from the whole conversation using the model API and sends it to the user via websocket. It then saves the question and answer to the database.
-func AskInConversation(conversationID primitive.ObjectID, content string, client *mongo.Client, cid string) error {
+// This function saves the user's message at the end of the active branch, then generates a response using the model API
+// and sends it to the user via websocket. Sending the same cid again does not ask twice, unless the first attempt failed.
+func AskInConversation(ctx context.Context, conversationID primitive.ObjectID, content string, db *DB, cid string) error {
 	if content == "" {
-		return errors.New("content is empty")
+		return invalid("content is empty")
 	}
 	content = utils.CleanString(content)
 
-	collection1 := client.Database("chatbot-server").Collection("conversation")
+	collection1 := db.database().Collection("conversation")
 	// Create a filter for the _id
 	var result struct {
-		UserID primitive.ObjectID `bson:"user_id"`
-		Mode   string             `bson:"mode"`
+		UserID       primitive.ObjectID `bson:"user_id"`
+		Mode         string             `bson:"mode"`
+		ActiveLeafID primitive.ObjectID `bson:"active_leaf_id"`
+		ForkedFrom   primitive.ObjectID `bson:"forked_from"`
+		ImportedFrom string             `bson:"imported_from"`
 	}
-	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), db.settings.Mongo.AskTimeout)
 	defer cancel()
 	err1 := collection1.FindOne(
 		ctx,
-		bson.M{"_id": conversationID},
+		bson.M{"_id": conversationID, "deleted_at": notDeleted},
 	).Decode(&result)
 	if err1 != nil {
 		return err1
 	}
-	go func() {
-		if finalResponse, _, err := GenerateResponseAndWebsocket(result.UserID.Hex(), content, conversationID.Hex(), result.Mode, false, cid); err != nil {
-			fmt.Println(err)
-			return
-		} else {
-			filter := bson.M{"_id": conversationID}
-			newMessages := []Message{
-				{
-					Sender:    "user",
-					Content:   content,
-					Timestamp: time.Now(),
-					Cid:       cid,
-				},
-				{
-					Sender:    "bot",
-					Content:   finalResponse,
-					Timestamp: time.Now(),
-				},
-			}
-			update := bson.M{
-				"$push": bson.M{
-					"messages": bson.M{
-						"$each": newMessages,
-					},
-				},
-				"$set": bson.M{"updated_at": time.Now()},
-			}
-			collection := client.Database("chatbot-server").Collection("conversation")
-			_, err := collection.UpdateOne(context.TODO(), filter, update)
-			if err != nil {
-				fmt.Println(err)
+	// The model API has never seen the first messages of forked and imported conversations, they are sent along
+	task := AnswerJob{
+		UserID:         result.UserID,
+		ConversationID: conversationID,
+		Mode:           result.Mode,
+		WithHistory:    !result.ForkedFrom.IsZero() || result.ImportedFrom != "",
+	}
+	if cid != "" {
+		existing, err := findQuestion(ctx, db, conversationID, cid)
+		if err != nil {
+			return err
+		}
+		if existing != nil {
+			if existing.Status == StatusFailed {
+				task.QuestionID = existing.ID
+				answerLater(ctx, db, task)
 			}
+			return nil
 		}
-	}()
+	}
+	question := Message{
+		ID:             primitive.NewObjectID(),
+		ConversationID: conversationID,
+		ParentID:       result.ActiveLeafID,
+		Sender:         "user",
+		Content:        content,
+		Timestamp:      time.Now(),
+		Cid:            cid,
+		Status:         StatusPending,
+		StatusAt:       time.Now(),
+	}
+	if err := insertMessages(ctx, db, question); err != nil {
+		return fmt.Errorf("failed to save the message: %w", err)
+	}
+	if err := setActiveLeaf(ctx, db, conversationID, question.ID); err != nil {
+		return err
+	}
+	task.QuestionID = question.ID
+	answerLater(ctx, db, task)
 	return nil
 }
 
-// This function retrieves all conversations of a user from the database, it will be sorted based on the last updated_at time. (Warning: pagination is not implemented in this function)
-func GetUserConversations(userID primitive.ObjectID, client *mongo.Client) (*[]ConversationSummary, error) {
-	filter := bson.M{"user_id": userID}
-	projection := bson.M{
-		"_id":        1,
-		"topic":      1,
-		"updated_at": 1,
-		"mode":       1,
-	}
-
-	findOptions := options.Find().SetProjection(projection).SetSort(bson.M{"updated_at": -1})
-	collection := client.Database("chatbot-server").Collection("conversation")
-	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+// This function retrieves one page of the conversations of a user by page number, of LegacyPageSize conversations. It is kept for older clients,
+// ListUserConversations pages with a cursor instead, which does not shift when conversations are updated in between.
+// This function retrieves every conversation of a user matching filter, newest first. It is the list of the clients
+// written before pagination, which expect all of them at once.
+func GetUserConversations(userID primitive.ObjectID, db *DB, conversationFilter ConversationFilter) (*[]ConversationSummary, error) {
+	findOptions := options.Find().SetProjection(summaryProjection).SetSort(bson.D{{Key: "updated_at", Value: -1}, {Key: "_id", Value: -1}})
+	collection := db.database().Collection("conversation")
+	ctx, cancel := context.WithTimeout(context.Background(), db.settings.Mongo.Timeout)
 	defer cancel()
-	cursor, err := collection.Find(ctx, filter, findOptions)
+	cursor, err := collection.Find(ctx, conversationFilter.query(userID), findOptions)
 	if err != nil {
 		return nil, err
 	}
 	defer cursor.Close(ctx)
 
-	var conversations []ConversationSummary
+	conversations := []ConversationSummary{}
 	if err = cursor.All(ctx, &conversations); err != nil {
 		return nil, err
 	}
-
 	return &conversations, nil
 }
-func GetUserConversationsPage(userID primitive.ObjectID, client *mongo.Client, page int64) (*[]ConversationSummary, error) {
-	filter := bson.M{"user_id": userID}
-	projection := bson.M{
-		"_id":        1,
-		"topic":      1,
-		"updated_at": 1,
-		"mode":       1,
-	}
-	skip := (page - 1) * 8
-	findOptions := options.Find().SetProjection(projection).SetSort(bson.M{"updated_at": -1}).SetLimit(8).SetSkip(skip)
-	collection := client.Database("chatbot-server").Collection("conversation")
-	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+
+func GetUserConversationsPage(userID primitive.ObjectID, db *DB, page int64, conversationFilter ConversationFilter) (*[]ConversationSummary, error) {
+	filter := conversationFilter.query(userID)
+	size := int64(db.settings.Conversations.LegacyPageSize)
+	findOptions := options.Find().SetProjection(summaryProjection).SetSort(bson.M{"updated_at": -1}).SetLimit(size).SetSkip((page - 1) * size)
+	collection := db.database().Collection("conversation")
+	ctx, cancel := context.WithTimeout(context.Background(), db.settings.Mongo.Timeout)
 	defer cancel()
 	cursor, err := collection.Find(ctx, filter, findOptions)
 	if err != nil {
@@ -296,25 +389,20 @@ func GetUserConversationsPage(userID primitive.ObjectID, client *mongo.Client, p
 }
 
 // This function retrieves a single conversation of a user from the database. If the conversation does not exist or does not belong to the user, it returns an error.
-func GetOneConversation(conversationID, userID primitive.ObjectID, client *mongo.Client) (*Conversation, error) {
-	collection := client.Database("chatbot-server").Collection("conversation")
-	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+// Only the latest page of the active branch is returned, the older messages are loaded with GetActiveMessages from NextCursor.
+func GetOneConversation(conversationID, userID primitive.ObjectID, db *DB) (*Conversation, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), db.settings.Mongo.Timeout)
 	defer cancel()
 
-	filter := bson.M{
-		"_id":     conversationID,
-		"user_id": userID,
+	conversation, err := loadActiveConversation(ctx, db, conversationID, userID)
+	if err != nil {
+		return nil, err
 	}
-
-	var conversation Conversation
-	err := collection.FindOne(ctx, filter).Decode(&conversation)
-
+	page, err := activePage(ctx, db, conversation, primitive.NilObjectID, primitive.NilObjectID, DefaultMessagePageSize)
 	if err != nil {
-		if err == mongo.ErrNoDocuments {
-			return nil, errors.New("conversation not found or does not belong to the user")
-		}
 		return nil, err
 	}
-
-	return &conversation, nil
+	conversation.Messages = page.Messages
+	conversation.NextCursor = page.NextCursor
+	return conversation, nil
 }
@@ -0,0 +1,28 @@
+package model
+
+import (
+	"server/config"
+
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// DB is the MongoDB of the server with the settings the functions of this package read: the database, the timeouts,
+// the page sizes and the model API the answers come from.
+type DB struct {
+	client   *mongo.Client
+	settings *config.Config
+}
+
+func NewDB(client *mongo.Client, cfg *config.Config) *DB {
+	return &DB{client: client, settings: cfg}
+}
+
+// database is the database holding the collections of the server.
+func (db *DB) database() *mongo.Database {
+	return db.client.Database(db.settings.Mongo.Database)
+}
+
+// Collection returns a collection of the database, for the packages keeping their own data next to the server's.
+func (db *DB) Collection(name string) *mongo.Collection {
+	return db.database().Collection(name)
+}
@@ -0,0 +1,32 @@
+package model
+
+import "errors"
+
+// Errors the handlers tell apart to answer with the right status and code, see app.Translate.
+var (
+	ErrConversationNotFound   = errors.New("conversation not found or does not belong to the user")
+	ErrNotInTrash             = errors.New("conversation not found in the trash")
+	ErrMessageNotFound        = errors.New("message not found")
+	ErrVersionNotFound        = errors.New("version not found")
+	ErrAnswerInProgress       = errors.New("the answer is still being generated")
+	ErrFolderNotFound         = errors.New("folder not found")
+	ErrFolderExists           = errors.New("a folder with this name already exists")
+	ErrShareNotFound          = errors.New("shared conversation not found")
+	ErrInvalidCredentials     = errors.New("email or password is incorrect")
+	ErrOTPIncorrect           = errors.New("otp is incorrect")
+	ErrOTPExpired             = errors.New("otp has been expired")
+	ErrSemanticSearchDisabled = errors.New("semantic search is not enabled")
+)
+
+// InvalidInput is the error of a request refused because of what the user sent, the message tells what to change.
+type InvalidInput struct {
+	Message string
+}
+
+func (e *InvalidInput) Error() string {
+	return e.Message
+}
+
+func invalid(message string) error {
+	return &InvalidInput{Message: message}
+}
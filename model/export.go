@@ -0,0 +1,255 @@
+package model
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"html"
+	"regexp"
+	"server/utils"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// MaxBulkExport is the number of conversations one ZIP export can hold.
+const MaxBulkExport = 100
+
+// Export is a rendered conversation ready to be downloaded.
+type Export struct {
+	Filename    string
+	ContentType string
+	Data        []byte
+}
+
+var exportFormats = map[string]struct {
+	extension   string
+	contentType string
+	render      func(*Conversation, []Message) ([]byte, error)
+}{
+	"md":   {"md", "text/markdown; charset=utf-8", renderMarkdown},
+	"html": {"html", "text/html; charset=utf-8", renderHTML},
+	"json": {"json", "application/json; charset=utf-8", renderJSON},
+	"txt":  {"txt", "text/plain; charset=utf-8", renderText},
+}
+
+func senderName(sender string) string {
+	if sender == "bot" {
+		return "Assistant"
+	}
+	return "User"
+}
+
+func exportTitle(conversation *Conversation) string {
+	if conversation.Topic == "" {
+		return "Untitled conversation"
+	}
+	return conversation.Topic
+}
+
+// Message contents are markdown already, so they are written as they are: code blocks and math keep their delimiters.
+func renderMarkdown(conversation *Conversation, messages []Message) ([]byte, error) {
+	var b strings.Builder
+	fmt.Fprintf(&b, "# %s\n\n", exportTitle(conversation))
+	fmt.Fprintf(&b, "- Started: %s\n- Updated: %s\n", conversation.StartedAt.Format(time.RFC3339), conversation.UpdatedAt.Format(time.RFC3339))
+	if conversation.Mode != "" {
+		fmt.Fprintf(&b, "- Mode: %s\n", conversation.Mode)
+	}
+	for _, m := range messages {
+		fmt.Fprintf(&b, "\n## %s · %s\n\n%s\n", senderName(m.Sender), m.Timestamp.Format(time.RFC3339), m.Content)
+	}
+	return []byte(b.String()), nil
+}
+
+func renderText(conversation *Conversation, messages []Message) ([]byte, error) {
+	var b strings.Builder
+	title := exportTitle(conversation)
+	fmt.Fprintf(&b, "%s\n%s\n", title, strings.Repeat("=", len([]rune(title))))
+	for _, m := range messages {
+		fmt.Fprintf(&b, "\n[%s] %s:\n%s\n", m.Timestamp.Format(time.DateTime), senderName(m.Sender), m.Content)
+	}
+	return []byte(b.String()), nil
+}
+
+func renderJSON(conversation *Conversation, messages []Message) ([]byte, error) {
+	type exportedMessage struct {
+		ID        primitive.ObjectID `json:"id"`
+		Sender    string             `json:"sender"`
+		Content   string             `json:"content"`
+		Timestamp time.Time          `json:"timestamp"`
+	}
+	exported := struct {
+		ID        primitive.ObjectID `json:"id"`
+		Topic     string             `json:"topic"`
+		Mode      string             `json:"mode,omitempty"`
+		StartedAt time.Time          `json:"started_at"`
+		UpdatedAt time.Time          `json:"updated_at"`
+		Tags      []string           `json:"tags,omitempty"`
+		Messages  []exportedMessage  `json:"messages"`
+	}{
+		ID:        conversation.ID,
+		Topic:     conversation.Topic,
+		Mode:      conversation.Mode,
+		StartedAt: conversation.StartedAt,
+		UpdatedAt: conversation.UpdatedAt,
+		Tags:      conversation.Tags,
+		Messages:  make([]exportedMessage, 0, len(messages)),
+	}
+	for _, m := range messages {
+		exported.Messages = append(exported.Messages, exportedMessage{ID: m.ID, Sender: m.Sender, Content: m.Content, Timestamp: m.Timestamp})
+	}
+	return json.MarshalIndent(exported, "", "  ")
+}
+
+const exportStyle = `body{font-family:system-ui,-apple-system,"Segoe UI",Roboto,sans-serif;max-width:800px;margin:2em auto;padding:0 1em;line-height:1.5;color:#111}
+header{border-bottom:1px solid #ddd;margin-bottom:1em}header p{color:#666;margin:.2em 0}
+.message{margin:1em 0;page-break-inside:avoid}.sender{font-weight:600}.time{color:#888;font-size:.85em;margin-left:.5em}
+.bot{background:#f6f6f6;border-radius:6px;padding:.5em 1em}
+pre{background:#272822;color:#f8f8f2;padding:.8em;border-radius:4px;overflow-x:auto;white-space:pre-wrap;word-wrap:break-word}
+code{font-family:ui-monospace,Consolas,monospace;font-size:.9em}
+@media print{body{margin:0;max-width:none}.bot{background:none;border-left:3px solid #ccc;border-radius:0}pre{background:#f4f4f4;color:#111;border:1px solid #ddd}}`
+
+var (
+	openingFence = regexp.MustCompile("(?m)^```[ \t]*([\\w+#.-]*)[ \t]*\n")
+	closingFence = regexp.MustCompile("(?m)^```[ \t]*$")
+)
+
+// contentHTML escapes a message and keeps its fenced code blocks as <pre><code>, the rest is split into paragraphs.
+// Math is left as written between its $ delimiters so it can still be read or rendered by KaTeX after printing.
+func contentHTML(content string) string {
+	var b strings.Builder
+	paragraphs := func(text string) {
+		for _, p := range strings.Split(text, "\n\n") {
+			if p = strings.TrimSpace(p); p != "" {
+				b.WriteString("<p>" + strings.ReplaceAll(html.EscapeString(p), "\n", "<br>") + "</p>\n")
+			}
+		}
+	}
+	rest := content
+	for {
+		open := openingFence.FindStringSubmatchIndex(rest)
+		if open == nil {
+			break
+		}
+		paragraphs(rest[:open[0]])
+		class := ""
+		if language := rest[open[2]:open[3]]; language != "" {
+			class = ` class="language-` + html.EscapeString(language) + `"`
+		}
+		// An unclosed block runs to the end of the message, like markdown renderers do
+		code, after := rest[open[1]:], ""
+		if end := closingFence.FindStringIndex(code); end != nil {
+			code, after = code[:end[0]], code[end[1]:]
+		}
+		b.WriteString("<pre><code" + class + ">" + html.EscapeString(strings.TrimSuffix(code, "\n")) + "</code></pre>\n")
+		rest = after
+	}
+	paragraphs(rest)
+	return b.String()
+}
+
+func renderHTML(conversation *Conversation, messages []Message) ([]byte, error) {
+	var b strings.Builder
+	title := html.EscapeString(exportTitle(conversation))
+	b.WriteString("<!DOCTYPE html>\n<html>\n<head>\n<meta charset=\"utf-8\">\n<title>" + title + "</title>\n<style>\n" + exportStyle + "\n</style>\n</head>\n<body>\n")
+	b.WriteString("<header>\n<h1>" + title + "</h1>\n")
+	fmt.Fprintf(&b, "<p>Started %s · Updated %s</p>\n</header>\n", conversation.StartedAt.Format(time.DateTime), conversation.UpdatedAt.Format(time.DateTime))
+	for _, m := range messages {
+		fmt.Fprintf(&b, "<section class=\"message %s\">\n<div><span class=\"sender\">%s</span><span class=\"time\">%s</span></div>\n%s</section>\n",
+			html.EscapeString(m.Sender), senderName(m.Sender), m.Timestamp.Format(time.DateTime), contentHTML(m.Content))
+	}
+	b.WriteString("</body>\n</html>\n")
+	return []byte(b.String()), nil
+}
+
+var unsafeFilename = regexp.MustCompile(`[^a-z0-9]+`)
+
+// exportFilename turns the topic into an ASCII file name, the id keeps names of conversations with the same topic apart.
+func exportFilename(conversation *Conversation, extension string) string {
+	name := strings.Trim(unsafeFilename.ReplaceAllString(utils.NormalizeVietnamese(conversation.Topic), "-"), "-")
+	if runes := []rune(name); len(runes) > 50 {
+		name = strings.TrimRight(string(runes[:50]), "-")
+	}
+	if name == "" {
+		name = "conversation"
+	}
+	return name + "-" + conversation.ID.Hex() + "." + extension
+}
+
+var errExportFormat = invalid("format must be md, html, json or txt")
+
+// RenderExport renders the active branch of a conversation loaded with its content.
+func RenderExport(conversation *Conversation, format string) (*Export, error) {
+	exporter, ok := exportFormats[format]
+	if !ok {
+		return nil, errExportFormat
+	}
+	data, err := exporter.render(conversation, conversation.ActivePath())
+	if err != nil {
+		return nil, err
+	}
+	return &Export{Filename: exportFilename(conversation, exporter.extension), ContentType: exporter.contentType, Data: data}, nil
+}
+
+func exportConversation(ctx context.Context, db *DB, conversationID, userID primitive.ObjectID, format string) (*Export, error) {
+	if _, ok := exportFormats[format]; !ok {
+		return nil, errExportFormat
+	}
+	conversation, err := loadConversationTree(ctx, db, conversationID, userID, true)
+	if err != nil {
+		return nil, err
+	}
+	return RenderExport(conversation, format)
+}
+
+// This function renders the active branch of a conversation of the user as md, html, json or txt.
+func ExportConversation(conversationID, userID primitive.ObjectID, format string, db *DB) (*Export, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), db.settings.Mongo.Timeout)
+	defer cancel()
+	return exportConversation(ctx, db, conversationID, userID, format)
+}
+
+// This function renders several conversations of the user in the same format and packs them in a ZIP archive.
+func ExportConversations(conversationIDs []primitive.ObjectID, userID primitive.ObjectID, format string, db *DB) (*Export, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+	defer cancel()
+	return ZipExports(conversationIDs, func(id primitive.ObjectID) (*Export, error) {
+		return exportConversation(ctx, db, id, userID, format)
+	})
+}
+
+// ZipExports packs the export of each conversation in a ZIP archive, failing on the first conversation that can not be exported.
+func ZipExports(conversationIDs []primitive.ObjectID, export func(primitive.ObjectID) (*Export, error)) (*Export, error) {
+	if len(conversationIDs) == 0 {
+		return nil, invalid("no conversation to export")
+	}
+	if len(conversationIDs) > MaxBulkExport {
+		return nil, invalid(fmt.Sprintf("at most %d conversations can be exported at once", MaxBulkExport))
+	}
+	var buffer bytes.Buffer
+	archive := zip.NewWriter(&buffer)
+	for _, id := range conversationIDs {
+		export, err := export(id)
+		if err != nil {
+			return nil, fmt.Errorf("conversation %s: %w", id.Hex(), err)
+		}
+		file, err := archive.Create(export.Filename)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := file.Write(export.Data); err != nil {
+			return nil, err
+		}
+	}
+	if err := archive.Close(); err != nil {
+		return nil, err
+	}
+	return &Export{
+		Filename:    "conversations-" + time.Now().Format("20060102-150405") + ".zip",
+		ContentType: "application/zip",
+		Data:        buffer.Bytes(),
+	}, nil
+}
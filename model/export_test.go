@@ -0,0 +1,89 @@
+package model
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func exportFixture() (*Conversation, []Message) {
+	at := time.Date(2024, 10, 1, 9, 30, 0, 0, time.UTC)
+	conversation := &Conversation{ID: primitive.NewObjectID(), Topic: "Tích phân <cơ bản>", StartedAt: at, UpdatedAt: at, Mode: "1"}
+	messages := []Message{
+		{ID: primitive.NewObjectID(), Sender: "user", Content: "Tính $\\int_0^1 x^2 dx$ & giải thích", Timestamp: at},
+		{ID: primitive.NewObjectID(), Sender: "bot", Content: "Kết quả là $\\frac{1}{3}$.\n\n```python\nprint(1 < 3)\n```\nXong.", Timestamp: at},
+	}
+	return conversation, messages
+}
+
+func TestRenderMarkdownKeepsContent(t *testing.T) {
+	conversation, messages := exportFixture()
+	data, _ := renderMarkdown(conversation, messages)
+	out := string(data)
+	for _, want := range []string{"# Tích phân <cơ bản>", "## User · 2024-10-01T09:30:00Z", "$\\int_0^1 x^2 dx$", "```python\nprint(1 < 3)\n```"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("markdown is missing %q:\n%s", want, out)
+		}
+	}
+}
+
+func TestRenderHTML(t *testing.T) {
+	conversation, messages := exportFixture()
+	data, _ := renderHTML(conversation, messages)
+	out := string(data)
+	for _, want := range []string{
+		"<title>Tích phân &lt;cơ bản&gt;</title>",
+		"$\\int_0^1 x^2 dx$ &amp; giải thích",
+		"<pre><code class=\"language-python\">print(1 &lt; 3)</code></pre>",
+		"<p>Xong.</p>",
+		"@media print",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("html is missing %q:\n%s", want, out)
+		}
+	}
+	if strings.Contains(out, "```") {
+		t.Error("code fences should be turned into <pre>")
+	}
+}
+
+func TestContentHTMLUnclosedFence(t *testing.T) {
+	if got := contentHTML("a\n```\nx <y>"); got != "<p>a</p>\n<pre><code>x &lt;y&gt;</code></pre>\n" {
+		t.Fatalf("got %q", got)
+	}
+}
+
+func TestRenderJSONAndText(t *testing.T) {
+	conversation, messages := exportFixture()
+	data, err := renderJSON(conversation, messages)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded struct {
+		Topic    string `json:"topic"`
+		Messages []struct {
+			Sender string `json:"sender"`
+		} `json:"messages"`
+	}
+	if err := json.Unmarshal(data, &decoded); err != nil || decoded.Topic != conversation.Topic || len(decoded.Messages) != 2 {
+		t.Fatalf("json = %s, %v", data, err)
+	}
+	data, _ = renderText(conversation, messages)
+	if !strings.Contains(string(data), "[2024-10-01 09:30:00] Assistant:\nKết quả là") {
+		t.Errorf("text = %s", data)
+	}
+}
+
+func TestExportFilename(t *testing.T) {
+	conversation, _ := exportFixture()
+	if got, want := exportFilename(conversation, "md"), "tich-phan-co-ban-"+conversation.ID.Hex()+".md"; got != want {
+		t.Fatalf("filename = %q, want %q", got, want)
+	}
+	conversation.Topic = ""
+	if got := exportFilename(conversation, "md"); !strings.HasPrefix(got, "conversation-") {
+		t.Fatalf("filename = %q", got)
+	}
+}
@@ -0,0 +1,258 @@
+package model
+
+import (
+	"context"
+	"server/utils"
+	"sort"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	maxTagsPerConversation = 20
+	maxTagLength           = 40
+	maxFolderNameLength    = 100
+)
+
+type Folder struct {
+	ID        primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	UserID    primitive.ObjectID `bson:"user_id" json:"-"`
+	Name      string             `bson:"name" json:"name"`
+	CreatedAt time.Time          `bson:"created_at" json:"created_at"`
+	// Number of conversations in the folder, archived and deleted ones are not counted
+	Count int64 `bson:"-" json:"count"`
+}
+
+// FolderList is what the sidebar shows: the folders of the user and how many conversations are in no folder.
+type FolderList struct {
+	Folders []Folder `json:"folders"`
+	Unfiled int64    `json:"unfiled"`
+}
+
+type TagCount struct {
+	Tag   string `bson:"_id" json:"tag"`
+	Count int64  `bson:"count" json:"count"`
+}
+
+// NormalizeTags trims and lowercases tags and drops empty and repeated ones, so "Work" and " work" are the same tag.
+func NormalizeTags(tags []string) []string {
+	normalized := make([]string, 0, len(tags))
+	seen := make(map[string]bool, len(tags))
+	for _, tag := range tags {
+		tag = strings.ToLower(utils.CleanString(tag))
+		if tag == "" || seen[tag] {
+			continue
+		}
+		seen[tag] = true
+		normalized = append(normalized, tag)
+	}
+	return normalized
+}
+
+// CheckTags normalizes the tags of a conversation and refuses too many or too long ones.
+func CheckTags(tags []string) ([]string, error) {
+	tags = NormalizeTags(tags)
+	if len(tags) > maxTagsPerConversation {
+		return nil, invalid("too many tags")
+	}
+	for _, tag := range tags {
+		if len([]rune(tag)) > maxTagLength {
+			return nil, invalid("tag is too long")
+		}
+	}
+	return tags, nil
+}
+
+// FolderName cleans the name of a folder and refuses an empty or too long one.
+func FolderName(name string) (string, error) {
+	name = utils.CleanString(name)
+	if name == "" {
+		return "", invalid("folder name is empty")
+	}
+	if len([]rune(name)) > maxFolderNameLength {
+		return "", invalid("folder name is too long")
+	}
+	return name, nil
+}
+
+func CreateFolder(userID primitive.ObjectID, name string, db *DB) (*Folder, error) {
+	name, err := FolderName(name)
+	if err != nil {
+		return nil, err
+	}
+	folder := Folder{ID: primitive.NewObjectID(), UserID: userID, Name: name, CreatedAt: time.Now()}
+	collection := db.database().Collection("folder")
+	ctx, cancel := context.WithTimeout(context.Background(), db.settings.Mongo.Timeout)
+	defer cancel()
+	if _, err := collection.InsertOne(ctx, folder); err != nil {
+		if mongo.IsDuplicateKeyError(err) {
+			return nil, ErrFolderExists
+		}
+		return nil, err
+	}
+	return &folder, nil
+}
+
+func RenameFolder(folderID, userID primitive.ObjectID, name string, db *DB) error {
+	name, err := FolderName(name)
+	if err != nil {
+		return err
+	}
+	collection := db.database().Collection("folder")
+	ctx, cancel := context.WithTimeout(context.Background(), db.settings.Mongo.Timeout)
+	defer cancel()
+	result, err := collection.UpdateOne(ctx, bson.M{"_id": folderID, "user_id": userID}, bson.M{"$set": bson.M{"name": name}})
+	if err != nil {
+		if mongo.IsDuplicateKeyError(err) {
+			return ErrFolderExists
+		}
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return ErrFolderNotFound
+	}
+	return nil
+}
+
+// This function deletes a folder of the user. Its conversations are not deleted, they become unfiled.
+func DeleteFolder(folderID, userID primitive.ObjectID, db *DB) error {
+	ctx, cancel := context.WithTimeout(context.Background(), db.settings.Mongo.Timeout)
+	defer cancel()
+	result, err := db.database().Collection("folder").DeleteOne(ctx, bson.M{"_id": folderID, "user_id": userID})
+	if err != nil {
+		return err
+	}
+	if result.DeletedCount == 0 {
+		return ErrFolderNotFound
+	}
+	_, err = db.database().Collection("conversation").UpdateMany(ctx,
+		bson.M{"user_id": userID, "folder_id": folderID},
+		bson.M{"$unset": bson.M{"folder_id": ""}})
+	return err
+}
+
+// This function lists the folders of the user by name, each with the number of conversations it holds.
+func GetFolders(userID primitive.ObjectID, db *DB) (*FolderList, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), db.settings.Mongo.Timeout)
+	defer cancel()
+	cursor, err := db.database().Collection("folder").Find(ctx, bson.M{"user_id": userID},
+		options.Find().SetSort(bson.M{"name": 1}))
+	if err != nil {
+		return nil, err
+	}
+	folders := []Folder{}
+	if err = cursor.All(ctx, &folders); err != nil {
+		return nil, err
+	}
+
+	// Counted the same way as the default conversation list: archived and deleted conversations are left out
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: ConversationFilter{}.query(userID)}},
+		{{Key: "$group", Value: bson.M{"_id": "$folder_id", "count": bson.M{"$sum": 1}}}},
+	}
+	cursor, err = db.database().Collection("conversation").Aggregate(ctx, pipeline)
+	if err != nil {
+		return nil, err
+	}
+	var counts []struct {
+		FolderID primitive.ObjectID `bson:"_id"`
+		Count    int64              `bson:"count"`
+	}
+	if err = cursor.All(ctx, &counts); err != nil {
+		return nil, err
+	}
+	list := &FolderList{Folders: folders}
+	byFolder := make(map[primitive.ObjectID]int64, len(counts))
+	for _, c := range counts {
+		// Conversations without folder_id are grouped under null, which decodes to the zero ID
+		if c.FolderID.IsZero() {
+			list.Unfiled = c.Count
+		} else {
+			byFolder[c.FolderID] = c.Count
+		}
+	}
+	for i := range list.Folders {
+		list.Folders[i].Count = byFolder[list.Folders[i].ID]
+	}
+	return list, nil
+}
+
+// This function files a conversation of the user in one of their folders, a zero folderID takes it out of its folder.
+func MoveConversation(conversationID, userID, folderID primitive.ObjectID, db *DB) error {
+	ctx, cancel := context.WithTimeout(context.Background(), db.settings.Mongo.Timeout)
+	defer cancel()
+	update := bson.M{"$unset": bson.M{"folder_id": ""}}
+	if !folderID.IsZero() {
+		count, err := db.database().Collection("folder").CountDocuments(ctx, bson.M{"_id": folderID, "user_id": userID})
+		if err != nil {
+			return err
+		}
+		if count == 0 {
+			return ErrFolderNotFound
+		}
+		update = bson.M{"$set": bson.M{"folder_id": folderID}}
+	}
+	filter := bson.M{"_id": conversationID, "user_id": userID, "deleted_at": notDeleted}
+	result, err := db.database().Collection("conversation").UpdateOne(ctx, filter, update)
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return ErrConversationNotFound
+	}
+	return nil
+}
+
+// This function replaces the tags of a conversation of the user and returns them as they were saved.
+func SetConversationTags(conversationID, userID primitive.ObjectID, tags []string, db *DB) ([]string, error) {
+	tags, err := CheckTags(tags)
+	if err != nil {
+		return nil, err
+	}
+	update := bson.M{"$set": bson.M{"tags": tags}}
+	if len(tags) == 0 {
+		update = bson.M{"$unset": bson.M{"tags": ""}}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), db.settings.Mongo.Timeout)
+	defer cancel()
+	filter := bson.M{"_id": conversationID, "user_id": userID, "deleted_at": notDeleted}
+	result, err := db.database().Collection("conversation").UpdateOne(ctx, filter, update)
+	if err != nil {
+		return nil, err
+	}
+	if result.MatchedCount == 0 {
+		return nil, ErrConversationNotFound
+	}
+	return tags, nil
+}
+
+// This function lists the tags the user has put on their conversations, most used first.
+func GetTags(userID primitive.ObjectID, db *DB) ([]TagCount, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), db.settings.Mongo.Timeout)
+	defer cancel()
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{"user_id": userID, "deleted_at": notDeleted, "tags": bson.M{"$exists": true}}}},
+		{{Key: "$unwind", Value: "$tags"}},
+		{{Key: "$group", Value: bson.M{"_id": "$tags", "count": bson.M{"$sum": 1}}}},
+	}
+	cursor, err := db.database().Collection("conversation").Aggregate(ctx, pipeline)
+	if err != nil {
+		return nil, err
+	}
+	tags := []TagCount{}
+	if err = cursor.All(ctx, &tags); err != nil {
+		return nil, err
+	}
+	sort.Slice(tags, func(i, j int) bool {
+		if tags[i].Count != tags[j].Count {
+			return tags[i].Count > tags[j].Count
+		}
+		return tags[i].Tag < tags[j].Tag
+	})
+	return tags, nil
+}
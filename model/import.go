@@ -0,0 +1,367 @@
+package model
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"server/utils"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// ImportResult tells what happened to one conversation of an imported file.
+type ImportResult struct {
+	// Position of the conversation in the file, from 0
+	Index          int                `json:"index"`
+	Title          string             `json:"title"`
+	ConversationID primitive.ObjectID `json:"conversation_id,omitempty"`
+	Messages       int                `json:"messages"`
+	Error          string             `json:"error,omitempty"`
+}
+
+// importedMessage is a message read from a file. Parent is the key of its parent in the same file, empty for the first one.
+type importedMessage struct {
+	Key       string
+	Parent    string
+	Sender    string
+	Content   string
+	Timestamp time.Time
+}
+
+// ImportedConversation is a conversation read from a file by ParseImport, Err tells why it can not be imported.
+type ImportedConversation struct {
+	Title     string
+	StartedAt time.Time
+	UpdatedAt time.Time
+	Messages  []importedMessage
+	// Key of the last message of the branch to show, the latest message when empty
+	ActiveKey string
+	Err       error
+}
+
+// importSender maps the roles used by other tools to ours. System prompts and tool calls are not kept.
+func importSender(role string) string {
+	switch strings.ToLower(role) {
+	case "user", "human":
+		return "user"
+	case "assistant", "bot", "model", "ai":
+		return "bot"
+	}
+	return ""
+}
+
+// unixTime reads the float seconds of ChatGPT exports.
+func unixTime(seconds float64) time.Time {
+	if seconds <= 0 {
+		return time.Time{}
+	}
+	whole, fraction := math.Modf(seconds)
+	return time.Unix(int64(whole), int64(fraction*1e9))
+}
+
+// parseChatGPT reads the conversations.json of a ChatGPT data export. Each conversation is a tree of nodes,
+// the nodes that are not user or assistant messages are skipped and their children attached to the nearest kept ancestor.
+func parseChatGPT(data []byte) ([]ImportedConversation, error) {
+	type node struct {
+		Parent  string `json:"parent"`
+		Message *struct {
+			Author struct {
+				Role string `json:"role"`
+			} `json:"author"`
+			CreateTime float64 `json:"create_time"`
+			Content    struct {
+				Parts []interface{} `json:"parts"`
+				Text  string        `json:"text"`
+			} `json:"content"`
+		} `json:"message"`
+	}
+	var raw []struct {
+		Title       string          `json:"title"`
+		CreateTime  float64         `json:"create_time"`
+		UpdateTime  float64         `json:"update_time"`
+		Mapping     map[string]node `json:"mapping"`
+		CurrentNode string          `json:"current_node"`
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, invalid("invalid ChatGPT export: " + err.Error())
+	}
+	conversations := make([]ImportedConversation, 0, len(raw))
+	for _, r := range raw {
+		conversation := ImportedConversation{Title: r.Title, StartedAt: unixTime(r.CreateTime), UpdatedAt: unixTime(r.UpdateTime)}
+		kept := make(map[string]bool)
+		keys := make([]string, 0, len(r.Mapping))
+		for key := range r.Mapping {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			n := r.Mapping[key]
+			if n.Message == nil || importSender(n.Message.Author.Role) == "" {
+				continue
+			}
+			var parts []string
+			for _, part := range n.Message.Content.Parts {
+				// Images and other attachments are objects, only the text parts are kept
+				if text, ok := part.(string); ok && text != "" {
+					parts = append(parts, text)
+				}
+			}
+			content := strings.Join(parts, "\n")
+			if content == "" {
+				content = n.Message.Content.Text
+			}
+			if strings.TrimSpace(content) == "" {
+				continue
+			}
+			kept[key] = true
+			conversation.Messages = append(conversation.Messages, importedMessage{
+				Key:       key,
+				Parent:    n.Parent,
+				Sender:    importSender(n.Message.Author.Role),
+				Content:   content,
+				Timestamp: unixTime(n.Message.CreateTime),
+			})
+		}
+		// Skipped nodes are replaced by their nearest kept ancestor, the bound protects against cycles
+		nearestKept := func(key string) string {
+			for steps := 0; key != "" && !kept[key] && steps <= len(r.Mapping); steps++ {
+				key = r.Mapping[key].Parent
+			}
+			if !kept[key] {
+				return ""
+			}
+			return key
+		}
+		for i := range conversation.Messages {
+			conversation.Messages[i].Parent = nearestKept(conversation.Messages[i].Parent)
+		}
+		conversation.ActiveKey = nearestKept(r.CurrentNode)
+		if len(conversation.Messages) == 0 {
+			conversation.Err = errors.New("conversation has no message")
+		}
+		conversations = append(conversations, conversation)
+	}
+	return conversations, nil
+}
+
+// parseJSONL reads one message per line: {"role": "user", "content": "...", "timestamp": "..."}. Lines with the same
+// "conversation" field form one conversation, in the order they first appear; without that field the file is one conversation.
+// "title" names the conversation and "timestamp" is either RFC 3339 or Unix seconds.
+func parseJSONL(data []byte) ([]ImportedConversation, error) {
+	var conversations []ImportedConversation
+	byKey := make(map[string]int)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+		var r struct {
+			Conversation interface{}     `json:"conversation"`
+			Title        string          `json:"title"`
+			Role         string          `json:"role"`
+			Content      string          `json:"content"`
+			Timestamp    json.RawMessage `json:"timestamp"`
+		}
+		err := json.Unmarshal([]byte(text), &r)
+		key := ""
+		if r.Conversation != nil {
+			key = fmt.Sprint(r.Conversation)
+		}
+		i, ok := byKey[key]
+		if !ok {
+			i = len(conversations)
+			byKey[key] = i
+			conversations = append(conversations, ImportedConversation{})
+		}
+		conversation := &conversations[i]
+		if conversation.Err != nil {
+			continue
+		}
+		if err != nil {
+			conversation.Err = fmt.Errorf("line %d: %v", line, err)
+			continue
+		}
+		if conversation.Title == "" {
+			conversation.Title = r.Title
+		}
+		sender := importSender(r.Role)
+		if sender == "" || strings.TrimSpace(r.Content) == "" {
+			continue
+		}
+		timestamp, err := parseImportTime(r.Timestamp)
+		if err != nil {
+			conversation.Err = fmt.Errorf("line %d: %v", line, err)
+			continue
+		}
+		message := importedMessage{Key: strconv.Itoa(line), Sender: sender, Content: r.Content, Timestamp: timestamp}
+		if n := len(conversation.Messages); n > 0 {
+			message.Parent = conversation.Messages[n-1].Key
+		}
+		conversation.Messages = append(conversation.Messages, message)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	for i := range conversations {
+		if conversations[i].Err == nil && len(conversations[i].Messages) == 0 {
+			conversations[i].Err = errors.New("conversation has no message")
+		}
+	}
+	return conversations, nil
+}
+
+func parseImportTime(raw json.RawMessage) (time.Time, error) {
+	if len(raw) == 0 || string(raw) == "null" {
+		return time.Time{}, nil
+	}
+	var seconds float64
+	if err := json.Unmarshal(raw, &seconds); err == nil {
+		return unixTime(seconds), nil
+	}
+	var value string
+	if err := json.Unmarshal(raw, &value); err != nil {
+		return time.Time{}, errors.New("invalid timestamp")
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, errors.New("invalid timestamp " + value)
+	}
+	return t, nil
+}
+
+// ToConversation builds the conversation and its message tree. Message ids are given in chronological order,
+// since the tree functions rely on _id order to sort replies.
+func (imported *ImportedConversation) ToConversation(userID primitive.ObjectID, source string) *Conversation {
+	now := time.Now()
+	messages := append([]importedMessage(nil), imported.Messages...)
+	sort.SliceStable(messages, func(i, j int) bool { return messages[i].Timestamp.Before(messages[j].Timestamp) })
+	// Missing times are filled from the previous message, or the start of the conversation
+	last := imported.StartedAt
+	for i := range messages {
+		if messages[i].Timestamp.IsZero() {
+			messages[i].Timestamp = last
+		}
+		if messages[i].Timestamp.IsZero() {
+			messages[i].Timestamp = now
+		}
+		last = messages[i].Timestamp
+	}
+	conversation := &Conversation{
+		ID:           primitive.NewObjectID(),
+		UserID:       userID,
+		StartedAt:    imported.StartedAt,
+		UpdatedAt:    imported.UpdatedAt,
+		Mode:         "1",
+		ImportedFrom: source,
+	}
+	if conversation.StartedAt.IsZero() {
+		conversation.StartedAt = messages[0].Timestamp
+	}
+	if conversation.UpdatedAt.IsZero() {
+		conversation.UpdatedAt = messages[len(messages)-1].Timestamp
+	}
+	ids := make(map[string]primitive.ObjectID, len(messages))
+	for _, m := range messages {
+		ids[m.Key] = primitive.NewObjectID()
+	}
+	for _, m := range messages {
+		conversation.Messages = append(conversation.Messages, Message{
+			ID:             ids[m.Key],
+			ConversationID: conversation.ID,
+			ParentID:       ids[m.Parent],
+			Sender:         m.Sender,
+			Content:        m.Content,
+			Timestamp:      m.Timestamp,
+		})
+	}
+	conversation.ActiveLeafID = ids[imported.ActiveKey]
+	if conversation.ActiveLeafID.IsZero() {
+		conversation.ActiveLeafID = conversation.Messages[len(conversation.Messages)-1].ID
+	}
+	conversation.Topic = utils.CleanString(imported.Title)
+	if conversation.Topic == "" {
+		// Titled like the first question, Gemini is not asked for a topic on import
+		runes := []rune(utils.CleanString(conversation.Messages[0].Content))
+		if len(runes) > 50 {
+			runes = runes[:50]
+		}
+		conversation.Topic = string(runes)
+	}
+	conversation.TopicSearch = utils.NormalizeVietnamese(conversation.Topic)
+	return conversation
+}
+
+// ParseImport reads the conversations of an exported file, guessing its format when it is empty. It returns the format it read.
+func ParseImport(format string, data []byte) ([]ImportedConversation, string, error) {
+	if format == "" {
+		format = "jsonl"
+		if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '[' {
+			format = "chatgpt"
+		}
+	}
+	var conversations []ImportedConversation
+	var err error
+	switch format {
+	case "chatgpt":
+		conversations, err = parseChatGPT(data)
+	case "jsonl":
+		conversations, err = parseJSONL(data)
+	default:
+		return nil, "", invalid("format must be chatgpt or jsonl")
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	if len(conversations) == 0 {
+		return nil, "", invalid("the file has no conversation")
+	}
+	return conversations, format, nil
+}
+
+// This function creates conversations of the user from the export of another chat tool. format is "chatgpt" for
+// the conversations.json of a ChatGPT export, "jsonl" for one role/content message per line, or empty to guess it.
+// A conversation that can not be imported does not stop the others, its error is in its result.
+func ImportConversations(userID primitive.ObjectID, format string, data []byte, db *DB) ([]ImportResult, error) {
+	conversations, format, err := ParseImport(format, data)
+	if err != nil {
+		return nil, err
+	}
+
+	collection := db.database().Collection("conversation")
+	results := make([]ImportResult, 0, len(conversations))
+	for i := range conversations {
+		imported := &conversations[i]
+		result := ImportResult{Index: i, Title: imported.Title, Messages: len(imported.Messages)}
+		if imported.Err != nil {
+			result.Error = imported.Err.Error()
+			results = append(results, result)
+			continue
+		}
+		conversation := imported.ToConversation(userID, format)
+		result.Title = conversation.Topic
+		ctx, cancel := context.WithTimeout(context.Background(), db.settings.Mongo.Timeout)
+		if _, err := collection.InsertOne(ctx, conversation); err != nil {
+			result.Error = "failed to create conversation"
+		} else if err := insertMessages(ctx, db, conversation.Messages...); err != nil {
+			// Without its messages the conversation is useless, it is removed so the import can be retried
+			collection.DeleteOne(ctx, bson.M{"_id": conversation.ID})
+			result.Error = "failed to save messages"
+		} else {
+			result.ConversationID = conversation.ID
+		}
+		cancel()
+		results = append(results, result)
+	}
+	return results, nil
+}
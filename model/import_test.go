@@ -0,0 +1,74 @@
+package model
+
+import (
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const chatGPTExport = `[{
+	"title": "Ôn tập",
+	"create_time": 1700000000.5,
+	"update_time": 1700000100,
+	"current_node": "a2",
+	"mapping": {
+		"root": {"parent": null, "message": null},
+		"sys": {"parent": "root", "message": {"author": {"role": "system"}, "content": {"content_type": "text", "parts": [""]}}},
+		"u1": {"parent": "sys", "message": {"author": {"role": "user"}, "create_time": 1700000001, "content": {"parts": ["Câu hỏi"]}}},
+		"a1": {"parent": "u1", "message": {"author": {"role": "assistant"}, "create_time": 1700000002, "content": {"parts": ["Trả lời 1"]}}},
+		"a2": {"parent": "u1", "message": {"author": {"role": "assistant"}, "create_time": 1700000003, "content": {"parts": ["Trả lời 2", {"image": true}]}}}
+	}
+}, {"title": "Empty", "mapping": {}}]`
+
+func TestParseChatGPT(t *testing.T) {
+	conversations, err := parseChatGPT([]byte(chatGPTExport))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(conversations) != 2 || conversations[1].Err == nil {
+		t.Fatalf("conversations = %+v", conversations)
+	}
+	imported := conversations[0]
+	if len(imported.Messages) != 3 || imported.ActiveKey != "a2" {
+		t.Fatalf("imported = %+v", imported)
+	}
+	conversation := imported.ToConversation(primitive.NewObjectID(), "chatgpt")
+	if conversation.Topic != "Ôn tập" || !conversation.StartedAt.Equal(time.Unix(1700000000, 5e8)) {
+		t.Fatalf("conversation = %+v", conversation)
+	}
+	// The system prompt is dropped, both answers stay as branches and the current one is shown
+	if got := contents(conversation.ActivePath()); !equal(got, []string{"Câu hỏi", "Trả lời 2"}) {
+		t.Fatalf("active path = %v", got)
+	}
+	if !conversation.Messages[0].ParentID.IsZero() || len(conversation.Children(conversation.Messages[0].ID)) != 2 {
+		t.Fatal("the answers should both be replies to the question")
+	}
+}
+
+func TestParseJSONL(t *testing.T) {
+	data := `{"conversation": 1, "title": "First", "role": "user", "content": "hi", "timestamp": "2024-10-01T09:00:00Z"}
+{"conversation": 1, "role": "assistant", "content": "hello", "timestamp": 1727773300}
+{"conversation": 2, "role": "system", "content": "be nice"}
+{"conversation": 2, "role": "user", "content": "Một câu hỏi khá dài để đặt làm tiêu đề cho cuộc hội thoại được nhập"}
+
+{"conversation": 3, "role": "user", "content": "x", "timestamp": "yesterday"}
+not json`
+	conversations, err := parseJSONL([]byte(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(conversations) != 4 {
+		t.Fatalf("got %d conversations", len(conversations))
+	}
+	first := conversations[0].ToConversation(primitive.NewObjectID(), "jsonl")
+	if first.Topic != "First" || !equal(contents(first.ActivePath()), []string{"hi", "hello"}) {
+		t.Fatalf("first = %+v", first)
+	}
+	if second := conversations[1].ToConversation(primitive.NewObjectID(), "jsonl"); len([]rune(second.Topic)) != 50 || len(second.Messages) != 1 {
+		t.Fatalf("second = %+v", second)
+	}
+	if conversations[2].Err == nil || conversations[3].Err == nil {
+		t.Fatal("a bad timestamp and a bad line should fail their conversation")
+	}
+}
@@ -0,0 +1,201 @@
+package model
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"server/logging"
+	"server/queue"
+	"server/tracing"
+	"sync"
+	"time"
+
+	chatbotapi "server/chatbotAPI"
+	ws "server/websocket"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const answerJobType = "answer"
+
+var jobs *queue.Queue
+
+// answering counts the answers generated outside the queue, so a shutdown can wait for them to be saved.
+var answering sync.WaitGroup
+
+// AnswerJob asks the model for the answer to a saved question.
+type AnswerJob struct {
+	UserID         primitive.ObjectID `json:"user_id"`
+	ConversationID primitive.ObjectID `json:"conversation_id"`
+	QuestionID     primitive.ObjectID `json:"question_id"`
+	Mode           string             `json:"mode"`
+	IsFirst        bool               `json:"is_first,omitempty"`
+	// The branch leading to the question is sent to the model API, which only remembers the branch it answered last
+	WithHistory bool `json:"with_history,omitempty"`
+	// Set when regenerating, the new answer becomes another version of this message
+	AnswerID primitive.ObjectID `json:"answer_id,omitempty"`
+	// Trace context of the request asking the question, the trace of the answer links to it
+	Trace tracing.Carrier `json:"trace,omitempty"`
+	// Request asking the question, its id is on the log lines of the answer
+	RequestID string `json:"request_id,omitempty"`
+	// Runs of the job that failed before this one, their tokens already reached the websocket
+	Attempt int `json:"-"`
+}
+
+// logContext returns ctx with the ids of the task on its log lines.
+func (task AnswerJob) logContext(ctx context.Context) context.Context {
+	return logging.With(ctx,
+		"request_id", task.RequestID,
+		"user_id", task.UserID.Hex(),
+		"conversation_id", task.ConversationID.Hex(),
+		"question_id", task.QuestionID.Hex(),
+	)
+}
+
+// UseQueue makes the model answer questions through q, with its retries and concurrency limits, instead of
+// in a goroutine per question. It registers the handlers, q is started by the caller.
+// Tokens go out through the websockets of the process running the job, so every process sharing q must serve websockets.
+func UseQueue(q *queue.Queue, db *DB) {
+	q.Handle(answerJobType, func(ctx context.Context, job queue.Job) error {
+		var task AnswerJob
+		if err := json.Unmarshal(job.Payload, &task); err != nil {
+			return queue.Permanent(err)
+		}
+		task.Attempt = job.Attempt
+		err := runAnswerJob(ctx, db, task)
+		if err != nil && !queue.IsPermanent(err) {
+			// The job context is cancelled when the server shuts down, the status is saved all the same
+			ctx, cancel := context.WithTimeout(context.WithoutCancel(task.logContext(ctx)), db.settings.Mongo.Timeout)
+			defer cancel()
+			slog.WarnContext(ctx, "failed to answer, the job will be retried", "attempt", job.Attempt+1, "error", err)
+			// Back to pending while the job waits for its next attempt
+			if statusErr := setStatus(ctx, db, task.QuestionID, StatusPending); statusErr != nil {
+				slog.ErrorContext(ctx, "failed to set the question back to pending", "error", statusErr)
+			}
+		}
+		return err
+	})
+	q.OnDead(func(job queue.Job, err error) {
+		var task AnswerJob
+		if json.Unmarshal(job.Payload, &task) == nil {
+			failQuestion(task.logContext(context.Background()), db, task.QuestionID, err)
+		}
+	})
+	jobs = q
+}
+
+// answerLater answers a saved question in the background. Without a queue, or when Redis can not take the job,
+// it runs in its own goroutine and is not retried. ctx is the request asking the question, only its trace is kept.
+func answerLater(ctx context.Context, db *DB, task AnswerJob) {
+	task.Trace = tracing.Inject(ctx)
+	task.RequestID = logging.RequestID(ctx)
+	if jobs != nil {
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 5*time.Second)
+		defer cancel()
+		_, err := jobs.Enqueue(ctx, answerJobType, task.UserID.Hex(), task)
+		if err == nil {
+			return
+		}
+		slog.WarnContext(ctx, "failed to enqueue the answer, answering right away", "error", err)
+	}
+	answering.Add(1)
+	go func() {
+		defer answering.Done()
+		if err := runAnswerJob(context.Background(), db, task); err != nil {
+			failQuestion(task.logContext(context.Background()), db, task.QuestionID, err)
+		}
+	}()
+}
+
+// AnswerInBackground runs answer in its own goroutine, in the span and with the log ids of task, and counts it for
+// WaitForAnswers. It is for the stores that keep the conversations elsewhere than in MongoDB, such as the fakes of
+// modeltest, and logs the error answer returns.
+func AnswerInBackground(ctx context.Context, task AnswerJob, answer func(context.Context) error) {
+	task.Trace = tracing.Inject(ctx)
+	task.RequestID = logging.RequestID(ctx)
+	answering.Add(1)
+	go func() {
+		defer answering.Done()
+		ctx, span := startAnswer(context.Background(), task)
+		defer span.End()
+		if err := answer(ctx); err != nil {
+			tracing.Fail(span, err)
+			slog.ErrorContext(ctx, "failed to answer the question", "error", err)
+		}
+	}()
+}
+
+// startAnswer starts the span of generating an answer, linked to the request that asked for it, and logs with the ids of task.
+func startAnswer(ctx context.Context, task AnswerJob) (context.Context, trace.Span) {
+	return tracing.StartLinked(task.logContext(ctx), task.Trace, "generate answer",
+		attribute.String("chatbot.conversation_id", task.ConversationID.Hex()),
+		attribute.String("chatbot.question_id", task.QuestionID.Hex()),
+		attribute.String("chatbot.mode", task.Mode),
+		attribute.Bool("chatbot.regenerate", !task.AnswerID.IsZero()),
+	)
+}
+
+func runAnswerJob(ctx context.Context, db *DB, task AnswerJob) (err error) {
+	ctx, span := startAnswer(ctx, task)
+	defer func() {
+		if err != nil {
+			tracing.Fail(span, err)
+		}
+		span.End()
+	}()
+	// The lookups have a deadline, the answer itself takes as long as the model does
+	lookup, cancel := context.WithTimeout(ctx, db.settings.Mongo.Timeout)
+	defer cancel()
+	messages := db.database().Collection("message")
+	var question Message
+	if err := messages.FindOne(lookup, bson.M{"_id": task.QuestionID}).Decode(&question); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return queue.Permanent(errors.New("question not found"))
+		}
+		return err
+	}
+	var history []chatbotapi.HistoryMessage
+	if task.WithHistory {
+		conversation, err := loadConversationTree(lookup, db, task.ConversationID, task.UserID, true)
+		if err != nil {
+			return err
+		}
+		history = ToHistory(conversation.PathTo(question.ParentID))
+	}
+	if task.Attempt > 0 {
+		// The client drops what the failed attempt streamed, apology included, before the new answer comes
+		ws.BroadcastToken(task.UserID.Hex(), task.ConversationID.Hex(), RestartOfResponse, db.settings.Server.WebsocketWait)
+	}
+	if task.AnswerID.IsZero() {
+		return answerQuestion(ctx, db, task, question, history)
+	}
+	var answer Message
+	if err := messages.FindOne(lookup, bson.M{"_id": task.AnswerID}).Decode(&answer); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return queue.Permanent(errors.New("answer not found"))
+		}
+		return err
+	}
+	return regenerateAnswer(ctx, db, task, question, answer, history)
+}
+
+// This function waits until the answers being generated are saved, or until ctx is done. New questions must have
+// stopped coming, the queue is drained by its own Shutdown.
+func WaitForAnswers(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		answering.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,200 @@
+package model
+
+import (
+	"context"
+	"encoding/base64"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	DefaultConversationPageSize = 20
+	MaxConversationPageSize     = 100
+)
+
+// ConversationFilter narrows the conversations listed by ListUserConversations, zero values do not filter.
+type ConversationFilter struct {
+	Mode string
+	// Range of updated_at, both bounds inclusive
+	From time.Time
+	To   time.Time
+	// Archived conversations are left out unless Archived is set
+	Pinned   *bool
+	Archived *bool
+	// Only the conversations of this folder, or the ones in no folder when Unfiled is set
+	FolderID primitive.ObjectID
+	Unfiled  bool
+	// Only the conversations carrying every one of these tags
+	Tags []string
+}
+
+type ConversationPage struct {
+	Conversations []ConversationSummary `json:"conversations"`
+	// Pass it as cursor to get the next page, empty on the last page
+	NextCursor string `json:"next_cursor,omitempty"`
+	// Number of conversations matching the filter, across all pages
+	Total int64 `json:"total"`
+}
+
+// The cursor is the position of the last conversation of a page in the (updated_at, _id) order.
+// _id breaks ties between conversations updated in the same millisecond.
+func EncodeConversationCursor(updatedAt time.Time, id primitive.ObjectID) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(strconv.FormatInt(updatedAt.UnixMilli(), 10) + "_" + id.Hex()))
+}
+
+func DecodeConversationCursor(cursor string) (time.Time, primitive.ObjectID, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return time.Time{}, primitive.NilObjectID, invalid("invalid cursor")
+	}
+	millis, hex, ok := strings.Cut(string(raw), "_")
+	if !ok {
+		return time.Time{}, primitive.NilObjectID, invalid("invalid cursor")
+	}
+	ms, err := strconv.ParseInt(millis, 10, 64)
+	if err != nil {
+		return time.Time{}, primitive.NilObjectID, invalid("invalid cursor")
+	}
+	id, err := primitive.ObjectIDFromHex(hex)
+	if err != nil {
+		return time.Time{}, primitive.NilObjectID, invalid("invalid cursor")
+	}
+	return time.UnixMilli(ms), id, nil
+}
+
+func (f ConversationFilter) query(userID primitive.ObjectID) bson.M {
+	query := bson.M{"user_id": userID, "deleted_at": notDeleted}
+	if f.Mode != "" {
+		query["mode"] = f.Mode
+	}
+	if !f.From.IsZero() || !f.To.IsZero() {
+		updatedAt := bson.M{}
+		if !f.From.IsZero() {
+			updatedAt["$gte"] = f.From
+		}
+		if !f.To.IsZero() {
+			updatedAt["$lte"] = f.To
+		}
+		query["updated_at"] = updatedAt
+	}
+	// The flags are omitted from documents when false, so false has to match a missing field too
+	if f.Pinned != nil {
+		query["pinned"] = flagQuery(*f.Pinned)
+	}
+	if f.Archived != nil {
+		query["archived"] = flagQuery(*f.Archived)
+	} else {
+		query["archived"] = flagQuery(false)
+	}
+	if !f.FolderID.IsZero() {
+		query["folder_id"] = f.FolderID
+	} else if f.Unfiled {
+		query["folder_id"] = bson.M{"$exists": false}
+	}
+	if tags := NormalizeTags(f.Tags); len(tags) > 0 {
+		query["tags"] = bson.M{"$all": tags}
+	}
+	return query
+}
+
+// Matches is the query of f applied to a conversation held in memory, for the stores that do not keep the
+// conversations in MongoDB. The two change together, TestConversationFilters runs the same cases through both.
+func (f ConversationFilter) Matches(c *Conversation, userID primitive.ObjectID) bool {
+	if c.UserID != userID || c.DeletedAt != nil {
+		return false
+	}
+	if f.Mode != "" && c.Mode != f.Mode {
+		return false
+	}
+	if (!f.From.IsZero() && c.UpdatedAt.Before(f.From)) || (!f.To.IsZero() && c.UpdatedAt.After(f.To)) {
+		return false
+	}
+	if f.Pinned != nil && c.Pinned != *f.Pinned {
+		return false
+	}
+	archived := false
+	if f.Archived != nil {
+		archived = *f.Archived
+	}
+	if c.Archived != archived {
+		return false
+	}
+	if !f.FolderID.IsZero() && c.FolderID != f.FolderID {
+		return false
+	}
+	if f.FolderID.IsZero() && f.Unfiled && !c.FolderID.IsZero() {
+		return false
+	}
+	for _, tag := range NormalizeTags(f.Tags) {
+		found := false
+		for _, t := range c.Tags {
+			found = found || t == tag
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+func flagQuery(value bool) interface{} {
+	if value {
+		return true
+	}
+	return bson.M{"$ne": true}
+}
+
+// This function retrieves one page of the conversations of a user, most recently updated first.
+// The cursor is the NextCursor of the previous page, empty for the first one.
+func ListUserConversations(userID primitive.ObjectID, filter ConversationFilter, cursor string, limit int, db *DB) (*ConversationPage, error) {
+	if limit <= 0 {
+		limit = DefaultConversationPageSize
+	}
+	if limit > MaxConversationPageSize {
+		limit = MaxConversationPageSize
+	}
+	query := filter.query(userID)
+	collection := db.database().Collection("conversation")
+	ctx, cancel := context.WithTimeout(context.Background(), db.settings.Mongo.Timeout)
+	defer cancel()
+	total, err := collection.CountDocuments(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	if cursor != "" {
+		updatedAt, id, err := DecodeConversationCursor(cursor)
+		if err != nil {
+			return nil, err
+		}
+		query["$or"] = bson.A{
+			bson.M{"updated_at": bson.M{"$lt": updatedAt}},
+			bson.M{"updated_at": updatedAt, "_id": bson.M{"$lt": id}},
+		}
+	}
+	// One more than asked for tells whether there is a next page
+	findOptions := options.Find().
+		SetProjection(summaryProjection).
+		SetSort(bson.D{{Key: "updated_at", Value: -1}, {Key: "_id", Value: -1}}).
+		SetLimit(int64(limit + 1))
+	result, err := collection.Find(ctx, query, findOptions)
+	if err != nil {
+		return nil, err
+	}
+	defer result.Close(ctx)
+	conversations := []ConversationSummary{}
+	if err = result.All(ctx, &conversations); err != nil {
+		return nil, err
+	}
+	page := &ConversationPage{Conversations: conversations, Total: total}
+	if len(conversations) > limit {
+		page.Conversations = conversations[:limit]
+		last := page.Conversations[limit-1]
+		page.NextCursor = EncodeConversationCursor(last.UpdatedAt, last.ID)
+	}
+	return page, nil
+}
@@ -0,0 +1,55 @@
+package model
+
+import (
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestConversationCursor(t *testing.T) {
+	updatedAt := time.UnixMilli(1729000000123)
+	id := primitive.NewObjectID()
+	gotTime, gotID, err := DecodeConversationCursor(EncodeConversationCursor(updatedAt, id))
+	if err != nil || !gotTime.Equal(updatedAt) || gotID != id {
+		t.Fatalf("round trip = %v, %v, %v", gotTime, gotID, err)
+	}
+	for _, cursor := range []string{"", "!!!", "MTIz", "YWJjX2RlZg"} {
+		if _, _, err := DecodeConversationCursor(cursor); err == nil {
+			t.Errorf("cursor %q should be invalid", cursor)
+		}
+	}
+}
+
+func TestConversationFilterQuery(t *testing.T) {
+	userID := primitive.NewObjectID()
+	query := ConversationFilter{}.query(userID)
+	if _, ok := query["archived"]; !ok {
+		t.Fatal("archived conversations should be left out by default")
+	}
+	archived := true
+	query = ConversationFilter{Mode: "2", Archived: &archived, From: time.Now()}.query(userID)
+	if query["mode"] != "2" || query["archived"] != true || query["updated_at"] == nil {
+		t.Fatalf("query = %v", query)
+	}
+}
+
+func TestConversationFilterFolderAndTags(t *testing.T) {
+	userID, folderID := primitive.NewObjectID(), primitive.NewObjectID()
+	query := ConversationFilter{FolderID: folderID, Tags: []string{" Work ", "work", "", "urgent"}}.query(userID)
+	if query["folder_id"] != folderID {
+		t.Fatalf("folder_id = %v", query["folder_id"])
+	}
+	tags := query["tags"].(bson.M)["$all"].([]string)
+	if len(tags) != 2 || tags[0] != "work" || tags[1] != "urgent" {
+		t.Fatalf("tags = %v", tags)
+	}
+	query = ConversationFilter{Unfiled: true}.query(userID)
+	if _, ok := query["folder_id"].(bson.M)["$exists"]; !ok {
+		t.Fatalf("unfiled query = %v", query)
+	}
+	if _, ok := query["tags"]; ok {
+		t.Fatal("no tags should not filter")
+	}
+}
@@ -0,0 +1,159 @@
+package model
+
+import (
+	"context"
+	"server/utils"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// ConversationUpdate holds the fields of a conversation the user can change, nil fields are left as they are.
+type ConversationUpdate struct {
+	Title    *string
+	Pinned   *bool
+	Archived *bool
+	Mode     *string
+}
+
+// This function renames, pins, archives or changes the mode of a conversation of the user.
+func UpdateConversation(conversationID, userID primitive.ObjectID, changes ConversationUpdate, db *DB) (*Conversation, error) {
+	set := bson.M{}
+	if changes.Title != nil {
+		title := utils.CleanString(*changes.Title)
+		if title == "" {
+			return nil, invalid("title is empty")
+		}
+		set["topic"] = title
+		set["topic_search"] = utils.NormalizeVietnamese(title)
+	}
+	if changes.Pinned != nil {
+		set["pinned"] = *changes.Pinned
+	}
+	if changes.Archived != nil {
+		set["archived"] = *changes.Archived
+	}
+	if changes.Mode != nil {
+		if *changes.Mode != "1" && *changes.Mode != "2" {
+			return nil, invalid("mode must be 1 or 2")
+		}
+		set["mode"] = *changes.Mode
+	}
+	if len(set) == 0 {
+		return nil, invalid("nothing to update")
+	}
+	collection := db.database().Collection("conversation")
+	ctx, cancel := context.WithTimeout(context.Background(), db.settings.Mongo.Timeout)
+	defer cancel()
+	filter := bson.M{"_id": conversationID, "user_id": userID, "deleted_at": notDeleted}
+	var conversation Conversation
+	err := collection.FindOneAndUpdate(ctx, filter, bson.M{"$set": set}, options.FindOneAndUpdate().SetReturnDocument(options.After)).Decode(&conversation)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, ErrConversationNotFound
+		}
+		return nil, err
+	}
+	return &conversation, nil
+}
+
+// This function moves a conversation to the trash. It disappears from every list and search
+// but can be restored until PurgeTrash deletes it for good.
+func DeleteConversation(conversationID, userID primitive.ObjectID, db *DB) error {
+	collection := db.database().Collection("conversation")
+	ctx, cancel := context.WithTimeout(context.Background(), db.settings.Mongo.Timeout)
+	defer cancel()
+	filter := bson.M{"_id": conversationID, "user_id": userID, "deleted_at": notDeleted}
+	result, err := collection.UpdateOne(ctx, filter, bson.M{"$set": bson.M{"deleted_at": time.Now()}})
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return ErrConversationNotFound
+	}
+	return nil
+}
+
+func RestoreConversation(conversationID, userID primitive.ObjectID, db *DB) error {
+	collection := db.database().Collection("conversation")
+	ctx, cancel := context.WithTimeout(context.Background(), db.settings.Mongo.Timeout)
+	defer cancel()
+	filter := bson.M{"_id": conversationID, "user_id": userID, "deleted_at": bson.M{"$exists": true}}
+	result, err := collection.UpdateOne(ctx, filter, bson.M{"$unset": bson.M{"deleted_at": ""}})
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return ErrNotInTrash
+	}
+	return nil
+}
+
+// This function lists the conversations of the user in the trash, most recently deleted first.
+func GetTrash(userID primitive.ObjectID, db *DB) ([]ConversationSummary, error) {
+	collection := db.database().Collection("conversation")
+	ctx, cancel := context.WithTimeout(context.Background(), db.settings.Mongo.Timeout)
+	defer cancel()
+	filter := bson.M{"user_id": userID, "deleted_at": bson.M{"$exists": true}}
+	findOptions := options.Find().SetProjection(summaryProjection).SetSort(bson.M{"deleted_at": -1})
+	cursor, err := collection.Find(ctx, filter, findOptions)
+	if err != nil {
+		return nil, err
+	}
+	conversations := []ConversationSummary{}
+	if err = cursor.All(ctx, &conversations); err != nil {
+		return nil, err
+	}
+	return conversations, nil
+}
+
+// This function deletes for good the conversations that have been in the trash for longer than retention,
+// together with their messages, vectors and share links. It returns how many conversations were deleted.
+func PurgeTrash(retention time.Duration, db *DB) (int, error) {
+	conversations := db.database().Collection("conversation")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
+	defer cancel()
+	filter := bson.M{"deleted_at": bson.M{"$lt": time.Now().Add(-retention)}}
+	cursor, err := conversations.Find(ctx, filter, options.Find().SetProjection(bson.M{"_id": 1}))
+	if err != nil {
+		return 0, err
+	}
+	var expired []struct {
+		ID primitive.ObjectID `bson:"_id"`
+	}
+	if err = cursor.All(ctx, &expired); err != nil {
+		return 0, err
+	}
+	purged := 0
+	messages := db.database().Collection("message")
+	shares := db.database().Collection("share")
+	for _, c := range expired {
+		if vectorIndex != nil {
+			var ids []primitive.ObjectID
+			if all, err := loadMessages(ctx, db, c.ID, false); err == nil {
+				for _, m := range all {
+					ids = append(ids, m.ID)
+				}
+			}
+			if len(ids) > 0 {
+				if err := vectorIndex.Delete(ctx, ids); err != nil {
+					return purged, err
+				}
+			}
+		}
+		if _, err := messages.DeleteMany(ctx, bson.M{"conversation_id": c.ID}); err != nil {
+			return purged, err
+		}
+		if _, err := shares.DeleteMany(ctx, bson.M{"conversation_id": c.ID}); err != nil {
+			return purged, err
+		}
+		if _, err := conversations.DeleteOne(ctx, bson.M{"_id": c.ID}); err != nil {
+			return purged, err
+		}
+		purged++
+	}
+	return purged, nil
+}
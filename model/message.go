@@ -0,0 +1,404 @@
+package model
+
+import (
+	"context"
+	"fmt"
+	"server/utils"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	DefaultMessagePageSize = 50
+	MaxMessagePageSize     = 200
+)
+
+// MessagePage is one page of the active branch of a conversation, oldest message first.
+type MessagePage struct {
+	Messages []Message `json:"messages"`
+	// Pass it as cursor to get the messages before this page, empty when the page starts the conversation
+	NextCursor string `json:"next_cursor,omitempty"`
+	// Only set when paging forward with after, tells whether newer messages follow the page
+	HasNewer bool `json:"has_newer,omitempty"`
+}
+
+// loadConversation reads the metadata of a conversation owned by userID.
+func loadConversation(ctx context.Context, db *DB, conversationID, userID primitive.ObjectID) (*Conversation, error) {
+	collection := db.database().Collection("conversation")
+	var conversation Conversation
+	err := collection.FindOne(ctx, bson.M{"_id": conversationID, "user_id": userID, "deleted_at": notDeleted}).Decode(&conversation)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, ErrConversationNotFound
+		}
+		return nil, err
+	}
+	return &conversation, nil
+}
+
+// loadMessages reads every message of a conversation in the order they were created.
+func loadMessages(ctx context.Context, db *DB, conversationID primitive.ObjectID, withContent bool) ([]Message, error) {
+	collection := db.database().Collection("message")
+	findOptions := options.Find().SetSort(bson.M{"_id": 1})
+	if !withContent {
+		findOptions.SetProjection(bson.M{"content": 0, "versions": 0, "search_text": 0})
+	}
+	cursor, err := collection.Find(ctx, bson.M{"conversation_id": conversationID}, findOptions)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+	var messages []Message
+	if err = cursor.All(ctx, &messages); err != nil {
+		return nil, err
+	}
+	return messages, nil
+}
+
+// fillContent replaces messages loaded without content by their full documents, keeping their order and branch position.
+func fillContent(ctx context.Context, db *DB, messages []Message) ([]Message, error) {
+	if len(messages) == 0 {
+		return messages, nil
+	}
+	ids := make([]primitive.ObjectID, 0, len(messages))
+	for _, m := range messages {
+		ids = append(ids, m.ID)
+	}
+	collection := db.database().Collection("message")
+	cursor, err := collection.Find(ctx, bson.M{"_id": bson.M{"$in": ids}})
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+	var full []Message
+	if err = cursor.All(ctx, &full); err != nil {
+		return nil, err
+	}
+	byID := make(map[primitive.ObjectID]Message, len(full))
+	for _, m := range full {
+		byID[m.ID] = m
+	}
+	result := make([]Message, 0, len(messages))
+	for _, m := range messages {
+		if f, ok := byID[m.ID]; ok {
+			f.BranchIndex, f.BranchCount = m.BranchIndex, m.BranchCount
+			result = append(result, f)
+		}
+	}
+	return result, nil
+}
+
+func insertMessages(ctx context.Context, db *DB, messages ...Message) error {
+	documents := make([]interface{}, 0, len(messages))
+	for _, m := range messages {
+		m.SearchText = utils.NormalizeVietnamese(m.Content)
+		documents = append(documents, m)
+	}
+	if _, err := db.database().Collection("message").InsertMany(ctx, documents); err != nil {
+		return err
+	}
+	embedInBackground(db, messages...)
+	return nil
+}
+
+// This function retrieves one message of a conversation owned by the user.
+func GetMessage(conversationID, userID, messageID primitive.ObjectID, db *DB) (*Message, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), db.settings.Mongo.Timeout)
+	defer cancel()
+	if _, err := loadConversation(ctx, db, conversationID, userID); err != nil {
+		return nil, err
+	}
+	collection := db.database().Collection("message")
+	var message Message
+	if err := collection.FindOne(ctx, bson.M{"_id": messageID, "conversation_id": conversationID}).Decode(&message); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, ErrMessageNotFound
+		}
+		return nil, err
+	}
+	return &message, nil
+}
+
+// This function returns a page of the active branch. Pages go backwards from the latest message: pass the NextCursor
+// of a page as before to get the previous one. With after it returns the messages following that message instead,
+// which lets a client that already has part of the conversation sync the rest.
+func GetActiveMessages(conversationID, userID, after, before primitive.ObjectID, limit int, db *DB) (*MessagePage, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), db.settings.Mongo.Timeout)
+	defer cancel()
+	conversation, err := loadActiveConversation(ctx, db, conversationID, userID)
+	if err != nil {
+		return nil, err
+	}
+	return activePage(ctx, db, conversation, after, before, limit)
+}
+
+// loadActiveConversation reads the metadata of a conversation like loadConversation. Conversations stored before
+// branching existed have no ActiveLeafID until their messages are chained, those are loaded whole once to chain them.
+func loadActiveConversation(ctx context.Context, db *DB, conversationID, userID primitive.ObjectID) (*Conversation, error) {
+	conversation, err := loadConversation(ctx, db, conversationID, userID)
+	if err != nil || !conversation.ActiveLeafID.IsZero() {
+		return conversation, err
+	}
+	return loadConversationTree(ctx, db, conversationID, userID, false)
+}
+
+// activePage reads a page of the active branch by walking up the parent chain from the active leaf or the cursor, so
+// it only reads the messages of the page however long the conversation is. Paging forward with after walks up to
+// after without the content of the messages, then loads the content of the page only.
+func activePage(ctx context.Context, db *DB, conversation *Conversation, after, before primitive.ObjectID, limit int) (*MessagePage, error) {
+	if limit <= 0 {
+		limit = DefaultMessagePageSize
+	}
+	if limit > MaxMessagePageSize {
+		limit = MaxMessagePageSize
+	}
+	page := &MessagePage{Messages: []Message{}, HasNewer: !before.IsZero()}
+	top := conversation.ActiveLeafID
+	if !before.IsZero() {
+		top = before
+	}
+	if top.IsZero() || top == after {
+		return page, nil
+	}
+
+	var messages []Message
+	if after.IsZero() {
+		// The leaf is part of the page, the message before is not
+		max := limit
+		if before.IsZero() {
+			max--
+		}
+		start, ancestors, err := walkUp(ctx, db, conversation.ID, top, primitive.NilObjectID, max, true)
+		if err != nil {
+			return nil, err
+		}
+		messages = oldestFirst(ancestors)
+		if before.IsZero() {
+			messages = append(messages, *start)
+		}
+	} else {
+		start, ancestors, err := walkUp(ctx, db, conversation.ID, top, after, 0, false)
+		if err != nil {
+			return nil, err
+		}
+		path := oldestFirst(ancestors)
+		if before.IsZero() {
+			path = append(path, *start)
+		}
+		// The walk stops below after, it reached the root instead when after is not on the branch
+		first := *start
+		if len(path) > 0 {
+			first = path[0]
+		}
+		if first.ParentID != after {
+			return nil, ErrMessageNotFound
+		}
+		if len(path) > limit {
+			path = path[:limit]
+			page.HasNewer = true
+		}
+		if messages, err = fillContent(ctx, db, path); err != nil {
+			return nil, err
+		}
+	}
+	if err := annotateBranches(ctx, db, conversation.ID, messages); err != nil {
+		return nil, err
+	}
+	page.Messages = messages
+	if len(messages) > 0 && !messages[0].ParentID.IsZero() {
+		page.NextCursor = messages[0].ID.Hex()
+	}
+	return page, nil
+}
+
+// walkUp reads the message id of a conversation and its ancestors, nearest first. The walk stops below stop, and
+// after max ancestors unless max is 0. MongoDB follows parent_id through the _id index, reading only the messages returned.
+func walkUp(ctx context.Context, db *DB, conversationID, id, stop primitive.ObjectID, max int, withContent bool) (*Message, []Message, error) {
+	lookup := bson.M{
+		"from":                    "message",
+		"startWith":               "$parent_id",
+		"connectFromField":        "parent_id",
+		"connectToField":          "_id",
+		"as":                      "ancestors",
+		"depthField":              "depth",
+		"restrictSearchWithMatch": bson.M{"conversation_id": conversationID, "_id": bson.M{"$ne": stop}},
+	}
+	if max > 0 {
+		lookup["maxDepth"] = max - 1
+	}
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{"_id": id, "conversation_id": conversationID}}},
+		{{Key: "$graphLookup", Value: lookup}},
+	}
+	if !withContent {
+		pipeline = append(pipeline, bson.D{{Key: "$project", Value: bson.M{
+			"content": 0, "versions": 0, "search_text": 0,
+			"ancestors.content": 0, "ancestors.versions": 0, "ancestors.search_text": 0,
+		}}})
+	}
+	cursor, err := db.database().Collection("message").Aggregate(ctx, pipeline)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer cursor.Close(ctx)
+	var found []struct {
+		Message   `bson:",inline"`
+		Ancestors []struct {
+			Message `bson:",inline"`
+			Depth   int `bson:"depth"`
+		} `bson:"ancestors"`
+	}
+	if err := cursor.All(ctx, &found); err != nil {
+		return nil, nil, err
+	}
+	if len(found) == 0 {
+		return nil, nil, ErrMessageNotFound
+	}
+	// $graphLookup returns the ancestors in no particular order
+	ancestors := make([]Message, len(found[0].Ancestors))
+	for _, a := range found[0].Ancestors {
+		if a.Depth >= len(ancestors) {
+			return nil, nil, fmt.Errorf("message %s has two parents at depth %d", id.Hex(), a.Depth)
+		}
+		ancestors[a.Depth] = a.Message
+	}
+	return &found[0].Message, ancestors, nil
+}
+
+// oldestFirst reverses the ancestors returned by walkUp into the order of the conversation.
+func oldestFirst(ancestors []Message) []Message {
+	path := make([]Message, len(ancestors))
+	for i, m := range ancestors {
+		path[len(ancestors)-1-i] = m
+	}
+	return path
+}
+
+// annotateBranches sets the position of each message among its siblings, reading only the ids of the siblings.
+func annotateBranches(ctx context.Context, db *DB, conversationID primitive.ObjectID, messages []Message) error {
+	if len(messages) == 0 {
+		return nil
+	}
+	parents := bson.A{}
+	for _, m := range messages {
+		if m.ParentID.IsZero() {
+			parents = append(parents, nil)
+		} else {
+			parents = append(parents, m.ParentID)
+		}
+	}
+	collection := db.database().Collection("message")
+	findOptions := options.Find().SetSort(bson.M{"_id": 1}).SetProjection(bson.M{"_id": 1, "parent_id": 1})
+	// parent_id: null also matches the roots, which have no parent_id
+	cursor, err := collection.Find(ctx, bson.M{"conversation_id": conversationID, "parent_id": bson.M{"$in": parents}}, findOptions)
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+	var siblings []Message
+	if err := cursor.All(ctx, &siblings); err != nil {
+		return err
+	}
+	byParent := make(map[primitive.ObjectID][]primitive.ObjectID)
+	for _, s := range siblings {
+		byParent[s.ParentID] = append(byParent[s.ParentID], s.ID)
+	}
+	for i := range messages {
+		ids := byParent[messages[i].ParentID]
+		if len(ids) < 2 {
+			continue
+		}
+		messages[i].BranchCount = len(ids)
+		for k, id := range ids {
+			if id == messages[i].ID {
+				messages[i].BranchIndex = k + 1
+			}
+		}
+	}
+	return nil
+}
+
+// This function deletes one message. Replies to it are attached to its parent, so the rest of the branch stays visible.
+func DeleteMessage(conversationID, userID, messageID primitive.ObjectID, db *DB) error {
+	ctx, cancel := context.WithTimeout(context.Background(), db.settings.Mongo.Timeout)
+	defer cancel()
+	conversation, err := loadConversationTree(ctx, db, conversationID, userID, false)
+	if err != nil {
+		return err
+	}
+	i, ok := conversation.FindMessage(messageID)
+	if !ok {
+		return ErrMessageNotFound
+	}
+	parentID := conversation.Messages[i].ParentID
+	conversation.RemoveMessage(i)
+
+	messages := db.database().Collection("message")
+	if _, err := messages.DeleteOne(ctx, bson.M{"_id": messageID}); err != nil {
+		return err
+	}
+	reparent := bson.M{"$set": bson.M{"parent_id": parentID}}
+	if parentID.IsZero() {
+		reparent = bson.M{"$unset": bson.M{"parent_id": ""}}
+	}
+	if _, err := messages.UpdateMany(ctx, bson.M{"conversation_id": conversationID, "parent_id": messageID}, reparent); err != nil {
+		return err
+	}
+	if vectorIndex != nil {
+		if err := vectorIndex.Delete(ctx, []primitive.ObjectID{messageID}); err != nil {
+			return err
+		}
+	}
+	return setActiveLeaf(ctx, db, conversationID, conversation.ActiveLeafID)
+}
+
+func PinMessage(conversationID, userID, messageID primitive.ObjectID, pinned bool, db *DB) error {
+	ctx, cancel := context.WithTimeout(context.Background(), db.settings.Mongo.Timeout)
+	defer cancel()
+	if _, err := loadConversation(ctx, db, conversationID, userID); err != nil {
+		return err
+	}
+	collection := db.database().Collection("message")
+	filter := bson.M{"_id": messageID, "conversation_id": conversationID}
+	result, err := collection.UpdateOne(ctx, filter, bson.M{"$set": bson.M{"pinned": pinned}})
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return ErrMessageNotFound
+	}
+	return nil
+}
+
+// This function copies a message to the end of the active branch of another conversation of the same user.
+func CopyMessage(conversationID, userID, messageID, targetID primitive.ObjectID, db *DB) (*Message, error) {
+	message, err := GetMessage(conversationID, userID, messageID, db)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), db.settings.Mongo.Timeout)
+	defer cancel()
+	target, err := loadConversation(ctx, db, targetID, userID)
+	if err != nil {
+		return nil, err
+	}
+	copied := Message{
+		ID:             primitive.NewObjectID(),
+		ConversationID: targetID,
+		ParentID:       target.ActiveLeafID,
+		Sender:         message.Sender,
+		Content:        message.Content,
+		Timestamp:      time.Now(),
+	}
+	if err := insertMessages(ctx, db, copied); err != nil {
+		return nil, err
+	}
+	if err := setActiveLeaf(ctx, db, targetID, copied.ID); err != nil {
+		return nil, err
+	}
+	return &copied, nil
+}
@@ -0,0 +1,206 @@
+package model
+
+import (
+	"context"
+	"crypto/sha256"
+	"server/utils"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// embeddedMessage is a message as it was stored inside the messages array of a conversation,
+// where the message ID (if any) was under "id" instead of "_id".
+type embeddedMessage struct {
+	Message  `bson:",inline"`
+	LegacyID primitive.ObjectID `bson:"id,omitempty"`
+}
+
+// This function creates the indexes the queries of this package rely on. It is safe to call on every start.
+func EnsureIndexes(db *DB) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	messages := db.database().Collection("message")
+	if _, err := messages.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "conversation_id", Value: 1}, {Key: "_id", Value: 1}},
+	}); err != nil {
+		return err
+	}
+	// Finds the replies of a message, to count the branches of a page of messages and to reattach them on delete
+	if _, err := messages.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "conversation_id", Value: 1}, {Key: "parent_id", Value: 1}},
+	}); err != nil {
+		return err
+	}
+	// Finds the question and answer of a cid when a request is retried
+	if _, err := messages.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "cid", Value: 1}, {Key: "conversation_id", Value: 1}},
+		Options: options.Index().SetPartialFilterExpression(bson.M{"cid": bson.M{"$exists": true}}),
+	}); err != nil {
+		return err
+	}
+	// Backs the (updated_at, _id) cursor of ListUserConversations
+	conversations := db.database().Collection("conversation")
+	if _, err := conversations.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "user_id", Value: 1}, {Key: "updated_at", Value: -1}, {Key: "_id", Value: -1}},
+	}); err != nil {
+		return err
+	}
+	// Folder names are unique per user, and the sidebar counts conversations by folder
+	if _, err := db.database().Collection("folder").Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "user_id", Value: 1}, {Key: "name", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	}); err != nil {
+		return err
+	}
+	if _, err := conversations.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "user_id", Value: 1}, {Key: "folder_id", Value: 1}, {Key: "updated_at", Value: -1}},
+	}); err != nil {
+		return err
+	}
+	// Share links are looked up by token, and expired ones are removed by MongoDB
+	shares := db.database().Collection("share")
+	if _, err := shares.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "token", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	}); err != nil {
+		return err
+	}
+	if _, err := shares.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "expires_at", Value: 1}},
+		Options: options.Index().SetExpireAfterSeconds(0),
+	}); err != nil {
+		return err
+	}
+	// Text indexes for Search. The fields are already folded by utils.NormalizeVietnamese and MongoDB has no
+	// Vietnamese stemmer, so the language is "none": words are only split, never stemmed nor dropped as stop words.
+	if _, err := messages.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "search_text", Value: "text"}},
+		Options: options.Index().SetDefaultLanguage("none").SetName("search_text"),
+	}); err != nil {
+		return err
+	}
+	if _, err := conversations.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "topic_search", Value: "text"}},
+		Options: options.Index().SetDefaultLanguage("none").SetName("topic_search"),
+	}); err != nil {
+		return err
+	}
+	// embedding.MongoIndex searches the vectors of one user
+	_, err := db.database().Collection("embedding").Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "user_id", Value: 1}},
+	})
+	return err
+}
+
+// This function fills the search fields of the messages and topics stored before search existed.
+func BackfillSearchText(db *DB) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Minute)
+	defer cancel()
+	updated := 0
+	for _, target := range []struct{ collection, source, field string }{
+		{"message", "content", "search_text"},
+		{"conversation", "topic", "topic_search"},
+	} {
+		collection := db.database().Collection(target.collection)
+		filter := bson.M{target.field: bson.M{"$exists": false}, target.source: bson.M{"$exists": true}}
+		cursor, err := collection.Find(ctx, filter, options.Find().SetProjection(bson.M{target.source: 1}))
+		if err != nil {
+			return updated, err
+		}
+		var writes []mongo.WriteModel
+		for cursor.Next(ctx) {
+			var document bson.M
+			if err := cursor.Decode(&document); err != nil {
+				cursor.Close(ctx)
+				return updated, err
+			}
+			text, _ := document[target.source].(string)
+			update := bson.M{"$set": bson.M{target.field: utils.NormalizeVietnamese(text)}}
+			writes = append(writes, mongo.NewUpdateOneModel().SetFilter(bson.M{"_id": document["_id"]}).SetUpdate(update))
+			if len(writes) == 500 {
+				if _, err := collection.BulkWrite(ctx, writes); err != nil {
+					cursor.Close(ctx)
+					return updated, err
+				}
+				updated += len(writes)
+				writes = nil
+			}
+		}
+		cursor.Close(ctx)
+		if len(writes) > 0 {
+			if _, err := collection.BulkWrite(ctx, writes); err != nil {
+				return updated, err
+			}
+			updated += len(writes)
+		}
+	}
+	return updated, nil
+}
+
+// legacyMessageID is the ID migrating gives the message at index of a conversation that stored it without one. It is
+// derived from the conversation ID, so migrating again gives the same IDs: the timestamp of the conversation, a hash of
+// its ID and the index, which keeps the messages of the conversation in order.
+func legacyMessageID(conversationID primitive.ObjectID, index int) primitive.ObjectID {
+	sum := sha256.Sum256(conversationID[:])
+	var id primitive.ObjectID
+	copy(id[:4], conversationID[:4])
+	copy(id[4:9], sum[:5])
+	id[9], id[10], id[11] = byte(index>>16), byte(index>>8), byte(index)
+	return id
+}
+
+// This function moves the messages still embedded in conversation documents to the message collection.
+// Messages are upserted by ID before the array is removed, and the ones stored without an ID get one derived from
+// their position (see legacyMessageID), so an interrupted run can simply be started again.
+func MigrateMessages(db *DB) (int, error) {
+	conversations := db.database().Collection("conversation")
+	messages := db.database().Collection("message")
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Minute)
+	defer cancel()
+	filter := bson.M{"messages": bson.M{"$exists": true}}
+	cursor, err := conversations.Find(ctx, filter, options.Find().SetProjection(bson.M{"_id": 1, "active_leaf_id": 1, "messages": 1}))
+	if err != nil {
+		return 0, err
+	}
+	defer cursor.Close(ctx)
+	migrated := 0
+	for cursor.Next(ctx) {
+		var legacy struct {
+			ID           primitive.ObjectID `bson:"_id"`
+			ActiveLeafID primitive.ObjectID `bson:"active_leaf_id,omitempty"`
+			Messages     []embeddedMessage  `bson:"messages"`
+		}
+		if err := cursor.Decode(&legacy); err != nil {
+			return migrated, err
+		}
+		conversation := Conversation{ID: legacy.ID, ActiveLeafID: legacy.ActiveLeafID}
+		for _, m := range legacy.Messages {
+			m.Message.ID = m.LegacyID
+			conversation.Messages = append(conversation.Messages, m.Message)
+		}
+		conversation.chainMessages(func(i int) primitive.ObjectID { return legacyMessageID(conversation.ID, i) })
+		var writes []mongo.WriteModel
+		for _, m := range conversation.Messages {
+			m.ConversationID = conversation.ID
+			writes = append(writes, mongo.NewReplaceOneModel().SetFilter(bson.M{"_id": m.ID}).SetReplacement(m).SetUpsert(true))
+		}
+		if len(writes) > 0 {
+			if _, err := messages.BulkWrite(ctx, writes); err != nil {
+				return migrated, err
+			}
+		}
+		update := bson.M{"$unset": bson.M{"messages": ""}}
+		if !conversation.ActiveLeafID.IsZero() {
+			update["$set"] = bson.M{"active_leaf_id": conversation.ActiveLeafID}
+		}
+		if _, err := conversations.UpdateOne(ctx, bson.M{"_id": conversation.ID}, update); err != nil {
+			return migrated, err
+		}
+		migrated++
+	}
+	return migrated, cursor.Err()
+}
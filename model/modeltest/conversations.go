@@ -0,0 +1,445 @@
+// Package modeltest keeps users, sessions and conversations in memory instead of MongoDB and Redis, for tests and
+// for running the server locally. Nothing survives a restart. The stores behave like the ones of package model and
+// share its rules: validation, pages, branches, versions, exports and imports are the functions of model, only the
+// storage is faked.
+package modeltest
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"server/config"
+	"server/embedding"
+	"server/model"
+	"server/utils"
+	"sort"
+	"sync"
+	"time"
+
+	chatbotapi "server/chatbotAPI"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// invalid is the error of model for a request refused because of what the user sent.
+func invalid(message string) error {
+	return &model.InvalidInput{Message: message}
+}
+
+// Conversations keeps the conversations with all their messages, the folders and the shares in memory. It implements
+// every conversation store of package app. Answers are generated like with MongoDB: in the background through
+// model.GenerateResponseAndWebsocket, and model.WaitForAnswers waits for them.
+type Conversations struct {
+	// Turns semantic search on, like model.UseEmbeddings does for MongoDB
+	Embedder embedding.Embedder
+
+	mu            sync.Mutex
+	conversations map[primitive.ObjectID]*model.Conversation
+	folders       map[primitive.ObjectID]*model.Folder
+	shares        []*model.Share
+	settings      *config.Config
+}
+
+// NewConversations returns an empty store reading its page sizes, timeouts and model API from cfg.
+func NewConversations(cfg *config.Config) *Conversations {
+	return &Conversations{
+		conversations: make(map[primitive.ObjectID]*model.Conversation),
+		folders:       make(map[primitive.ObjectID]*model.Folder),
+		settings:      cfg,
+	}
+}
+
+// copyConversation returns a copy the caller can use after the lock is released, answers keep changing the stored one.
+func copyConversation(c *model.Conversation) *model.Conversation {
+	copied := *c
+	copied.Messages = make([]model.Message, len(c.Messages))
+	for i, m := range c.Messages {
+		m.Versions = append([]model.MessageVersion(nil), m.Versions...)
+		copied.Messages[i] = m
+	}
+	copied.Tags = append([]string(nil), c.Tags...)
+	return &copied
+}
+
+func summary(c *model.Conversation) model.ConversationSummary {
+	return model.ConversationSummary{
+		ID:        c.ID,
+		Topic:     c.Topic,
+		UpdatedAt: c.UpdatedAt,
+		Mode:      c.Mode,
+		Pinned:    c.Pinned,
+		Archived:  c.Archived,
+		DeletedAt: c.DeletedAt,
+		FolderID:  c.FolderID,
+		Tags:      append([]string(nil), c.Tags...),
+	}
+}
+
+// newestFirst sorts conversations in the (updated_at, _id) order of model.ListUserConversations, at the millisecond MongoDB keeps.
+func newestFirst(conversations []*model.Conversation) {
+	sort.Slice(conversations, func(i, j int) bool {
+		a, b := conversations[i].UpdatedAt.UnixMilli(), conversations[j].UpdatedAt.UnixMilli()
+		if a != b {
+			return a > b
+		}
+		return bytes.Compare(conversations[i].ID[:], conversations[j].ID[:]) > 0
+	})
+}
+
+func (s *Conversations) matching(userID primitive.ObjectID, filter model.ConversationFilter) []*model.Conversation {
+	var result []*model.Conversation
+	for _, c := range s.conversations {
+		if filter.Matches(c, userID) {
+			result = append(result, c)
+		}
+	}
+	newestFirst(result)
+	return result
+}
+
+// owned returns the stored conversation, the lock must be held.
+func (s *Conversations) owned(conversationID, userID primitive.ObjectID) (*model.Conversation, error) {
+	c, ok := s.conversations[conversationID]
+	if !ok || c.UserID != userID || c.DeletedAt != nil {
+		return nil, model.ErrConversationNotFound
+	}
+	return c, nil
+}
+
+func (s *Conversations) ownedMessage(conversationID, userID, messageID primitive.ObjectID) (*model.Conversation, int, error) {
+	c, err := s.owned(conversationID, userID)
+	if err != nil {
+		return nil, -1, err
+	}
+	i, ok := c.FindMessage(messageID)
+	if !ok {
+		return nil, -1, model.ErrMessageNotFound
+	}
+	return c, i, nil
+}
+
+func (s *Conversations) CheckOwner(conversationID, userID primitive.ObjectID) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err := s.owned(conversationID, userID)
+	return err
+}
+
+func (s *Conversations) List(userID primitive.ObjectID, filter model.ConversationFilter, cursor string, limit int) (*model.ConversationPage, error) {
+	if limit <= 0 {
+		limit = model.DefaultConversationPageSize
+	}
+	if limit > model.MaxConversationPageSize {
+		limit = model.MaxConversationPageSize
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	matching := s.matching(userID, filter)
+	page := &model.ConversationPage{Conversations: []model.ConversationSummary{}, Total: int64(len(matching))}
+	if cursor != "" {
+		updatedAt, id, err := model.DecodeConversationCursor(cursor)
+		if err != nil {
+			return nil, err
+		}
+		for len(matching) > 0 {
+			c := matching[0]
+			if ms := c.UpdatedAt.UnixMilli(); ms < updatedAt.UnixMilli() || (ms == updatedAt.UnixMilli() && bytes.Compare(c.ID[:], id[:]) < 0) {
+				break
+			}
+			matching = matching[1:]
+		}
+	}
+	for i, c := range matching {
+		if i == limit {
+			last := page.Conversations[limit-1]
+			page.NextCursor = model.EncodeConversationCursor(last.UpdatedAt, last.ID)
+			break
+		}
+		page.Conversations = append(page.Conversations, summary(c))
+	}
+	return page, nil
+}
+
+func (s *Conversations) ListAll(userID primitive.ObjectID, filter model.ConversationFilter) (*[]model.ConversationSummary, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	conversations := []model.ConversationSummary{}
+	for _, c := range s.matching(userID, filter) {
+		conversations = append(conversations, summary(c))
+	}
+	return &conversations, nil
+}
+
+func (s *Conversations) ListPage(userID primitive.ObjectID, page int64, filter model.ConversationFilter) (*[]model.ConversationSummary, error) {
+	size := int64(s.settings.Conversations.LegacyPageSize)
+	if page < 1 {
+		page = 1
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	conversations := []model.ConversationSummary{}
+	for i, c := range s.matching(userID, filter) {
+		if int64(i) >= (page-1)*size && int64(i) < page*size {
+			conversations = append(conversations, summary(c))
+		}
+	}
+	return &conversations, nil
+}
+
+func (s *Conversations) Get(conversationID, userID primitive.ObjectID) (*model.Conversation, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c, err := s.owned(conversationID, userID)
+	if err != nil {
+		return nil, err
+	}
+	conversation := copyConversation(c)
+	page, err := messagePage(conversation, primitive.NilObjectID, primitive.NilObjectID, model.DefaultMessagePageSize)
+	if err != nil {
+		return nil, err
+	}
+	conversation.Messages = page.Messages
+	conversation.NextCursor = page.NextCursor
+	return conversation, nil
+}
+
+func (s *Conversations) AskNew(ctx context.Context, userID primitive.ObjectID, content, mode, cid string) (primitive.ObjectID, error) {
+	if content == "" {
+		return primitive.NilObjectID, invalid("content is empty")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if cid != "" {
+		for _, c := range s.conversations {
+			if c.UserID != userID || c.DeletedAt != nil {
+				continue
+			}
+			for _, m := range c.Messages {
+				if m.Cid == cid && m.Sender == "user" && m.ParentID.IsZero() {
+					if m.Status == model.StatusFailed {
+						s.answerLater(ctx, model.AnswerJob{UserID: userID, ConversationID: c.ID, QuestionID: m.ID, Mode: c.Mode, IsFirst: true})
+					}
+					return c.ID, nil
+				}
+			}
+		}
+	}
+	conversation, err := model.NewConversation(userID, content, cid)
+	if err != nil {
+		return primitive.NilObjectID, err
+	}
+	conversation.Mode = mode
+	conversation.Messages[0].Status, conversation.Messages[0].StatusAt = model.StatusPending, time.Now()
+	s.conversations[conversation.ID] = conversation
+	s.answerLater(ctx, model.AnswerJob{UserID: userID, ConversationID: conversation.ID, QuestionID: conversation.Messages[0].ID, Mode: mode, IsFirst: true})
+	return conversation.ID, nil
+}
+
+func (s *Conversations) Ask(ctx context.Context, conversationID, userID primitive.ObjectID, content, cid string) error {
+	if content == "" {
+		return invalid("content is empty")
+	}
+	content = utils.CleanString(content)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c, err := s.owned(conversationID, userID)
+	if err != nil {
+		return err
+	}
+	task := model.AnswerJob{
+		UserID:         userID,
+		ConversationID: conversationID,
+		Mode:           c.Mode,
+		WithHistory:    !c.ForkedFrom.IsZero() || c.ImportedFrom != "",
+	}
+	if cid != "" {
+		for _, m := range c.Messages {
+			if m.Cid == cid && m.Sender == "user" {
+				if m.Status == model.StatusFailed {
+					task.QuestionID = m.ID
+					s.answerLater(ctx, task)
+				}
+				return nil
+			}
+		}
+	}
+	question := model.Message{
+		ID:             primitive.NewObjectID(),
+		ConversationID: conversationID,
+		ParentID:       c.ActiveLeafID,
+		Sender:         "user",
+		Content:        content,
+		Timestamp:      time.Now(),
+		Cid:            cid,
+		Status:         model.StatusPending,
+		StatusAt:       time.Now(),
+	}
+	c.Messages = append(c.Messages, question)
+	c.ActiveLeafID = question.ID
+	c.UpdatedAt = time.Now()
+	task.QuestionID = question.ID
+	s.answerLater(ctx, task)
+	return nil
+}
+
+// answerLater answers a stored question in its own goroutine, see model.AnswerInBackground. The lock must be held.
+func (s *Conversations) answerLater(ctx context.Context, task model.AnswerJob) {
+	model.AnswerInBackground(ctx, task, func(ctx context.Context) error {
+		err := s.answer(ctx, task)
+		if err != nil {
+			s.setStatus(task.ConversationID, task.QuestionID, model.StatusFailed)
+		}
+		return err
+	})
+}
+
+func (s *Conversations) setStatus(conversationID, messageID primitive.ObjectID, status string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if c, ok := s.conversations[conversationID]; ok {
+		if i, ok := c.FindMessage(messageID); ok {
+			c.Messages[i].Status = status
+		}
+	}
+}
+
+// answer is what the answer jobs of package model do, in memory. The lock is only held around the reads and writes,
+// not while the model answers.
+func (s *Conversations) answer(ctx context.Context, task model.AnswerJob) error {
+	s.mu.Lock()
+	c, ok := s.conversations[task.ConversationID]
+	if !ok {
+		s.mu.Unlock()
+		return errors.New("conversation not found")
+	}
+	i, ok := c.FindMessage(task.QuestionID)
+	if !ok {
+		s.mu.Unlock()
+		return errors.New("question not found")
+	}
+	question := c.Messages[i]
+	c.Messages[i].Status, c.Messages[i].StatusAt = model.StatusStreaming, time.Now()
+	var history []chatbotapi.HistoryMessage
+	if task.WithHistory {
+		history = model.ToHistory(c.PathTo(question.ParentID))
+	}
+	s.mu.Unlock()
+
+	response, topic, err := model.GenerateResponseAndWebsocket(ctx, s.settings, task.UserID.Hex(), question.Content, task.ConversationID.Hex(), task.Mode, task.IsFirst, question.Cid, history)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// Like saveAnswer, a retried job keeps the answer a first run already saved
+	answered := false
+	for _, k := range c.Children(question.ID) {
+		answered = answered || c.Messages[k].Sender == "bot"
+	}
+	if task.AnswerID.IsZero() && !answered {
+		answer := model.Message{
+			ID:             primitive.NewObjectID(),
+			ConversationID: task.ConversationID,
+			ParentID:       question.ID,
+			Sender:         "bot",
+			Content:        response,
+			Cid:            question.Cid,
+			Timestamp:      time.Now(),
+		}
+		c.Messages = append(c.Messages, answer)
+		c.ActiveLeafID = answer.ID
+		c.UpdatedAt = time.Now()
+		if task.IsFirst && topic != "" {
+			c.Topic = topic
+			c.TopicSearch = utils.NormalizeVietnamese(topic)
+		}
+	} else if !task.AnswerID.IsZero() {
+		k, ok := c.FindMessage(task.AnswerID)
+		if !ok {
+			return errors.New("answer not found")
+		}
+		c.Messages[k].AddVersion(response)
+	}
+	if i, ok := c.FindMessage(question.ID); ok {
+		c.Messages[i].Status = model.StatusComplete
+	}
+	return nil
+}
+
+func (s *Conversations) Update(conversationID, userID primitive.ObjectID, changes model.ConversationUpdate) (*model.Conversation, error) {
+	var title string
+	if changes.Title != nil {
+		if title = utils.CleanString(*changes.Title); title == "" {
+			return nil, invalid("title is empty")
+		}
+	}
+	if changes.Mode != nil && *changes.Mode != "1" && *changes.Mode != "2" {
+		return nil, invalid("mode must be 1 or 2")
+	}
+	if changes.Title == nil && changes.Pinned == nil && changes.Archived == nil && changes.Mode == nil {
+		return nil, invalid("nothing to update")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c, err := s.owned(conversationID, userID)
+	if err != nil {
+		return nil, err
+	}
+	if changes.Title != nil {
+		c.Topic = title
+		c.TopicSearch = utils.NormalizeVietnamese(title)
+	}
+	if changes.Pinned != nil {
+		c.Pinned = *changes.Pinned
+	}
+	if changes.Archived != nil {
+		c.Archived = *changes.Archived
+	}
+	if changes.Mode != nil {
+		c.Mode = *changes.Mode
+	}
+	conversation := copyConversation(c)
+	conversation.Messages = nil
+	return conversation, nil
+}
+
+func (s *Conversations) Delete(conversationID, userID primitive.ObjectID) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c, err := s.owned(conversationID, userID)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	c.DeletedAt = &now
+	return nil
+}
+
+func (s *Conversations) Restore(conversationID, userID primitive.ObjectID) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c, ok := s.conversations[conversationID]
+	if !ok || c.UserID != userID || c.DeletedAt == nil {
+		return model.ErrNotInTrash
+	}
+	c.DeletedAt = nil
+	return nil
+}
+
+func (s *Conversations) Trash(userID primitive.ObjectID) ([]model.ConversationSummary, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var deleted []*model.Conversation
+	for _, c := range s.conversations {
+		if c.UserID == userID && c.DeletedAt != nil {
+			deleted = append(deleted, c)
+		}
+	}
+	sort.Slice(deleted, func(i, j int) bool { return deleted[i].DeletedAt.After(*deleted[j].DeletedAt) })
+	conversations := []model.ConversationSummary{}
+	for _, c := range deleted {
+		conversations = append(conversations, summary(c))
+	}
+	return conversations, nil
+}
@@ -0,0 +1,149 @@
+package modeltest
+
+import (
+	"server/model"
+	"sort"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func (s *Conversations) Folders(userID primitive.ObjectID) (*model.FolderList, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list := &model.FolderList{Folders: []model.Folder{}}
+	counts := make(map[primitive.ObjectID]int64)
+	for _, c := range s.matching(userID, model.ConversationFilter{}) {
+		if c.FolderID.IsZero() {
+			list.Unfiled++
+		} else {
+			counts[c.FolderID]++
+		}
+	}
+	for _, folder := range s.folders {
+		if folder.UserID == userID {
+			f := *folder
+			f.Count = counts[f.ID]
+			list.Folders = append(list.Folders, f)
+		}
+	}
+	sort.Slice(list.Folders, func(i, j int) bool { return list.Folders[i].Name < list.Folders[j].Name })
+	return list, nil
+}
+
+// folderNamed tells whether another folder of the user has the name, the unique index of the folder collection.
+func (s *Conversations) folderNamed(userID primitive.ObjectID, name string, except primitive.ObjectID) bool {
+	for _, folder := range s.folders {
+		if folder.UserID == userID && folder.Name == name && folder.ID != except {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Conversations) CreateFolder(userID primitive.ObjectID, name string) (*model.Folder, error) {
+	name, err := model.FolderName(name)
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.folderNamed(userID, name, primitive.NilObjectID) {
+		return nil, model.ErrFolderExists
+	}
+	folder := model.Folder{ID: primitive.NewObjectID(), UserID: userID, Name: name, CreatedAt: time.Now()}
+	s.folders[folder.ID] = &folder
+	return &folder, nil
+}
+
+func (s *Conversations) RenameFolder(folderID, userID primitive.ObjectID, name string) error {
+	name, err := model.FolderName(name)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	folder, ok := s.folders[folderID]
+	if !ok || folder.UserID != userID {
+		return model.ErrFolderNotFound
+	}
+	if s.folderNamed(userID, name, folderID) {
+		return model.ErrFolderExists
+	}
+	folder.Name = name
+	return nil
+}
+
+func (s *Conversations) DeleteFolder(folderID, userID primitive.ObjectID) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	folder, ok := s.folders[folderID]
+	if !ok || folder.UserID != userID {
+		return model.ErrFolderNotFound
+	}
+	delete(s.folders, folderID)
+	for _, c := range s.conversations {
+		if c.UserID == userID && c.FolderID == folderID {
+			c.FolderID = primitive.NilObjectID
+		}
+	}
+	return nil
+}
+
+func (s *Conversations) Move(conversationID, userID, folderID primitive.ObjectID) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !folderID.IsZero() {
+		if folder, ok := s.folders[folderID]; !ok || folder.UserID != userID {
+			return model.ErrFolderNotFound
+		}
+	}
+	c, err := s.owned(conversationID, userID)
+	if err != nil {
+		return err
+	}
+	c.FolderID = folderID
+	return nil
+}
+
+func (s *Conversations) SetTags(conversationID, userID primitive.ObjectID, tags []string) ([]string, error) {
+	tags, err := model.CheckTags(tags)
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c, err := s.owned(conversationID, userID)
+	if err != nil {
+		return nil, err
+	}
+	c.Tags = nil
+	if len(tags) > 0 {
+		c.Tags = append([]string(nil), tags...)
+	}
+	return tags, nil
+}
+
+func (s *Conversations) Tags(userID primitive.ObjectID) ([]model.TagCount, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	counts := make(map[string]int64)
+	for _, c := range s.conversations {
+		if c.UserID == userID && c.DeletedAt == nil {
+			for _, tag := range c.Tags {
+				counts[tag]++
+			}
+		}
+	}
+	tags := []model.TagCount{}
+	for tag, count := range counts {
+		tags = append(tags, model.TagCount{Tag: tag, Count: count})
+	}
+	sort.Slice(tags, func(i, j int) bool {
+		if tags[i].Count != tags[j].Count {
+			return tags[i].Count > tags[j].Count
+		}
+		return tags[i].Tag < tags[j].Tag
+	})
+	return tags, nil
+}
@@ -0,0 +1,246 @@
+package modeltest
+
+import (
+	"context"
+	"server/model"
+	"server/utils"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// sliceMessages keeps the messages of path strictly between after and before, at most limit of them:
+// the first ones when after is set, the last ones otherwise. It also reports whether path goes on before and after the result.
+func sliceMessages(path []model.Message, after, before primitive.ObjectID, limit int) ([]model.Message, bool, bool, error) {
+	indexOf := func(id primitive.ObjectID) int {
+		for i := range path {
+			if path[i].ID == id {
+				return i
+			}
+		}
+		return -1
+	}
+	start, end := 0, len(path)
+	if !after.IsZero() {
+		if start = indexOf(after) + 1; start == 0 {
+			return nil, false, false, model.ErrMessageNotFound
+		}
+	}
+	if !before.IsZero() {
+		if end = indexOf(before); end < 0 {
+			return nil, false, false, model.ErrMessageNotFound
+		}
+	}
+	if start > end {
+		start = end
+	}
+	if limit > 0 && end-start > limit {
+		if !after.IsZero() {
+			end = start + limit
+		} else {
+			start = end - limit
+		}
+	}
+	return path[start:end], start > 0, end < len(path), nil
+}
+
+// messagePage is a page of the active branch of a conversation held in memory, which has the content of its messages already.
+func messagePage(conversation *model.Conversation, after, before primitive.ObjectID, limit int) (*model.MessagePage, error) {
+	if limit <= 0 {
+		limit = model.DefaultMessagePageSize
+	}
+	if limit > model.MaxMessagePageSize {
+		limit = model.MaxMessagePageSize
+	}
+	messages, hasOlder, hasNewer, err := sliceMessages(conversation.ActivePath(), after, before, limit)
+	if err != nil {
+		return nil, err
+	}
+	page := &model.MessagePage{Messages: messages, HasNewer: hasNewer}
+	if hasOlder && len(messages) > 0 {
+		page.NextCursor = messages[0].ID.Hex()
+	}
+	return page, nil
+}
+
+func (s *Conversations) Messages(conversationID, userID, after, before primitive.ObjectID, limit int) (*model.MessagePage, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c, err := s.owned(conversationID, userID)
+	if err != nil {
+		return nil, err
+	}
+	return messagePage(copyConversation(c), after, before, limit)
+}
+
+func (s *Conversations) Message(conversationID, userID, messageID primitive.ObjectID) (*model.Message, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c, i, err := s.ownedMessage(conversationID, userID, messageID)
+	if err != nil {
+		return nil, err
+	}
+	message := copyConversation(c).Messages[i]
+	return &message, nil
+}
+
+func (s *Conversations) DeleteMessage(conversationID, userID, messageID primitive.ObjectID) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c, i, err := s.ownedMessage(conversationID, userID, messageID)
+	if err != nil {
+		return err
+	}
+	c.RemoveMessage(i)
+	c.UpdatedAt = time.Now()
+	return nil
+}
+
+func (s *Conversations) PinMessage(conversationID, userID, messageID primitive.ObjectID, pinned bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c, i, err := s.ownedMessage(conversationID, userID, messageID)
+	if err != nil {
+		return err
+	}
+	c.Messages[i].Pinned = pinned
+	return nil
+}
+
+func (s *Conversations) CopyMessage(conversationID, userID, messageID, targetID primitive.ObjectID) (*model.Message, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c, i, err := s.ownedMessage(conversationID, userID, messageID)
+	if err != nil {
+		return nil, err
+	}
+	target, err := s.owned(targetID, userID)
+	if err != nil {
+		return nil, err
+	}
+	copied := model.Message{
+		ID:             primitive.NewObjectID(),
+		ConversationID: targetID,
+		ParentID:       target.ActiveLeafID,
+		Sender:         c.Messages[i].Sender,
+		Content:        c.Messages[i].Content,
+		Timestamp:      time.Now(),
+	}
+	target.Messages = append(target.Messages, copied)
+	target.ActiveLeafID = copied.ID
+	target.UpdatedAt = time.Now()
+	return &copied, nil
+}
+
+func (s *Conversations) EditMessage(ctx context.Context, conversationID, userID, messageID primitive.ObjectID, content, cid string) error {
+	content = utils.CleanString(content)
+	if content == "" {
+		return invalid("content is empty")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c, i, err := s.ownedMessage(conversationID, userID, messageID)
+	if err != nil {
+		return err
+	}
+	if c.Messages[i].Sender != "user" {
+		return invalid("only user messages can be edited")
+	}
+	edited := model.Message{
+		ID:             primitive.NewObjectID(),
+		ConversationID: conversationID,
+		ParentID:       c.Messages[i].ParentID,
+		Sender:         "user",
+		Content:        content,
+		Cid:            cid,
+		Timestamp:      time.Now(),
+		Status:         model.StatusPending,
+		StatusAt:       time.Now(),
+	}
+	c.Messages = append(c.Messages, edited)
+	c.ActiveLeafID = edited.ID
+	c.UpdatedAt = time.Now()
+	s.answerLater(ctx, model.AnswerJob{UserID: userID, ConversationID: conversationID, QuestionID: edited.ID, Mode: c.Mode, WithHistory: true})
+	return nil
+}
+
+func (s *Conversations) Branches(conversationID, userID, messageID primitive.ObjectID) ([]model.Message, int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c, i, err := s.ownedMessage(conversationID, userID, messageID)
+	if err != nil {
+		return nil, -1, err
+	}
+	c = copyConversation(c)
+	active := make(map[primitive.ObjectID]bool)
+	for _, m := range c.PathTo(c.ActiveLeafID) {
+		active[m.ID] = true
+	}
+	var branches []model.Message
+	selected := -1
+	for k, idx := range c.Children(c.Messages[i].ParentID) {
+		if active[c.Messages[idx].ID] {
+			selected = k
+		}
+		branches = append(branches, c.Messages[idx])
+	}
+	return branches, selected, nil
+}
+
+func (s *Conversations) SwitchBranch(conversationID, userID, messageID primitive.ObjectID) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c, _, err := s.ownedMessage(conversationID, userID, messageID)
+	if err != nil {
+		return err
+	}
+	c.ActiveLeafID = c.LatestLeaf(messageID)
+	return nil
+}
+
+func (s *Conversations) Regenerate(ctx context.Context, conversationID, userID primitive.ObjectID) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c, err := s.owned(conversationID, userID)
+	if err != nil {
+		return err
+	}
+	path := c.PathTo(c.ActiveLeafID)
+	if len(path) == 0 {
+		return invalid("conversation is empty")
+	}
+	var answer *model.Message
+	last := len(path) - 1
+	if path[last].Sender == "bot" {
+		answer = &path[last]
+		last--
+	}
+	if last < 0 || path[last].Sender != "user" {
+		return invalid("no question to answer")
+	}
+	i, _ := c.FindMessage(path[last].ID)
+	if c.Messages[i].Answering(time.Now(), model.AnswerLease(s.settings)) {
+		return model.ErrAnswerInProgress
+	}
+	c.Messages[i].Status, c.Messages[i].StatusAt = model.StatusPending, time.Now()
+	task := model.AnswerJob{UserID: userID, ConversationID: conversationID, QuestionID: path[last].ID, Mode: c.Mode, WithHistory: true}
+	if answer != nil {
+		task.AnswerID = answer.ID
+	}
+	s.answerLater(ctx, task)
+	return nil
+}
+
+func (s *Conversations) SelectVersion(conversationID, userID, messageID primitive.ObjectID, index int) (*model.Message, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c, i, err := s.ownedMessage(conversationID, userID, messageID)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.Messages[i].SelectVersion(index); err != nil {
+		return nil, err
+	}
+	message := copyConversation(c).Messages[i]
+	return &message, nil
+}
@@ -0,0 +1,65 @@
+package modeltest
+
+import (
+	"context"
+	"server/config"
+	"server/model"
+	"strings"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func contents(messages []model.Message) []string {
+	var result []string
+	for _, m := range messages {
+		result = append(result, m.Content)
+	}
+	return result
+}
+
+func TestSliceMessages(t *testing.T) {
+	conversation := &model.Conversation{}
+	for _, content := range []string{"q1", "a1", "q2", "a2", "q3"} {
+		conversation.AddMessage("user", content)
+	}
+	path := conversation.ActivePath()
+	cases := []struct {
+		after, before      primitive.ObjectID
+		limit              int
+		want               []string
+		hasOlder, hasNewer bool
+	}{
+		{limit: 2, want: []string{"a2", "q3"}, hasOlder: true},
+		{limit: 10, want: []string{"q1", "a1", "q2", "a2", "q3"}},
+		{after: path[1].ID, limit: 2, want: []string{"q2", "a2"}, hasOlder: true, hasNewer: true},
+		{before: path[3].ID, limit: 2, want: []string{"a1", "q2"}, hasOlder: true, hasNewer: true},
+		{after: path[0].ID, before: path[3].ID, want: []string{"a1", "q2"}, hasOlder: true, hasNewer: true},
+	}
+	for _, tc := range cases {
+		got, hasOlder, hasNewer, err := sliceMessages(path, tc.after, tc.before, tc.limit)
+		if err != nil || strings.Join(contents(got), " ") != strings.Join(tc.want, " ") || hasOlder != tc.hasOlder || hasNewer != tc.hasNewer {
+			t.Errorf("sliceMessages = %v, %v, %v, %v, want %v, %v, %v", contents(got), hasOlder, hasNewer, err, tc.want, tc.hasOlder, tc.hasNewer)
+		}
+	}
+	if _, _, _, err := sliceMessages(path, primitive.NewObjectID(), primitive.NilObjectID, 0); err == nil {
+		t.Error("unknown message should fail")
+	}
+}
+
+func TestRegenerateWhileAnswering(t *testing.T) {
+	store := NewConversations(config.Default())
+	userID := primitive.NewObjectID()
+	results, err := store.Import(userID, "jsonl", []byte(`{"role":"user","content":"Xin chào"}`+"\n"+`{"role":"assistant","content":"Chào bạn"}`))
+	if err != nil || len(results) != 1 {
+		t.Fatalf("import failed: %v %+v", err, results)
+	}
+	c := store.conversations[results[0].ConversationID]
+	question, _ := c.FindMessage(c.PathTo(c.ActiveLeafID)[0].ID)
+	c.Messages[question].Status, c.Messages[question].StatusAt = model.StatusStreaming, time.Now()
+
+	if err := store.Regenerate(context.Background(), c.ID, userID); err != model.ErrAnswerInProgress {
+		t.Errorf("regenerating a question being answered gave %v", err)
+	}
+}
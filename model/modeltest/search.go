@@ -0,0 +1,142 @@
+package modeltest
+
+import (
+	"context"
+	"server/embedding"
+	"server/model"
+	"server/utils"
+	"sort"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// matchScore counts the terms found in text, MongoDB scores $text matches by their terms as well.
+func matchScore(text string, terms []string) float64 {
+	text = utils.NormalizeVietnamese(text)
+	score := 0.0
+	for _, term := range terms {
+		if strings.Contains(text, term) {
+			score++
+		}
+	}
+	return score
+}
+
+func (s *Conversations) Search(userID primitive.ObjectID, query string, limit int) ([]model.SearchResult, error) {
+	terms := utils.SearchTerms(query)
+	if len(terms) == 0 {
+		return nil, invalid("query is empty")
+	}
+	if limit <= 0 || limit > 100 {
+		limit = 20
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ranked := []model.SearchResult{}
+	for _, c := range s.conversations {
+		if c.UserID != userID || c.DeletedAt != nil {
+			continue
+		}
+		result := model.SearchResult{ConversationID: c.ID, Topic: c.Topic, UpdatedAt: c.UpdatedAt, MessageIDs: []primitive.ObjectID{}, Hits: []model.SearchHit{}}
+		if score := matchScore(c.Topic, terms); score > 0 {
+			result.TopicSnippet = utils.Highlight(c.Topic, terms, model.SnippetWidth)
+			result.Score = score
+		}
+		for _, m := range c.Messages {
+			score := matchScore(m.Content, terms)
+			if score == 0 {
+				continue
+			}
+			result.MessageIDs = append(result.MessageIDs, m.ID)
+			result.Hits = append(result.Hits, model.SearchHit{
+				MessageID: m.ID,
+				Sender:    m.Sender,
+				Timestamp: m.Timestamp,
+				Snippet:   utils.Highlight(m.Content, terms, model.SnippetWidth),
+				Score:     score,
+			})
+			if score > result.Score {
+				result.Score = score
+			}
+		}
+		if result.Score > 0 {
+			ranked = append(ranked, result)
+		}
+	}
+	sort.Slice(ranked, func(i, j int) bool {
+		if ranked[i].Score != ranked[j].Score {
+			return ranked[i].Score > ranked[j].Score
+		}
+		return ranked[i].UpdatedAt.After(ranked[j].UpdatedAt)
+	})
+	if len(ranked) > limit {
+		ranked = ranked[:limit]
+	}
+	return ranked, nil
+}
+
+// SemanticSearch embeds the messages of the user on every call, which is fine for the few messages a test holds.
+func (s *Conversations) SemanticSearch(userID primitive.ObjectID, query string, limit int) ([]model.SemanticResult, error) {
+	if s.Embedder == nil {
+		return nil, model.ErrSemanticSearchDisabled
+	}
+	query = utils.CleanString(query)
+	if query == "" {
+		return nil, invalid("query is empty")
+	}
+	if limit <= 0 || limit > 50 {
+		limit = 10
+	}
+	s.mu.Lock()
+	messages := make(map[primitive.ObjectID]model.Message)
+	topics := make(map[primitive.ObjectID]string)
+	texts := []string{model.EmbeddedText(query)}
+	var ids []primitive.ObjectID
+	for _, c := range s.conversations {
+		if c.UserID != userID || c.DeletedAt != nil {
+			continue
+		}
+		topics[c.ID] = c.Topic
+		for _, m := range c.Messages {
+			messages[m.ID] = m
+			ids = append(ids, m.ID)
+			texts = append(texts, model.EmbeddedText(m.Content))
+		}
+	}
+	s.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	values, err := s.Embedder.Embed(ctx, texts)
+	if err != nil {
+		return nil, err
+	}
+	index := embedding.NewMemoryIndex()
+	vectors := make([]embedding.Vector, 0, len(ids))
+	for i, id := range ids {
+		vectors = append(vectors, embedding.Vector{ID: id, ConversationID: messages[id].ConversationID, UserID: userID, Values: embedding.Normalize(values[i+1])})
+	}
+	if err := index.Upsert(ctx, vectors); err != nil {
+		return nil, err
+	}
+	matches, err := index.Search(ctx, userID, embedding.Normalize(values[0]), limit)
+	if err != nil {
+		return nil, err
+	}
+	results := make([]model.SemanticResult, 0, len(matches))
+	for _, match := range matches {
+		m := messages[match.ID]
+		results = append(results, model.SemanticResult{
+			MessageID:      m.ID,
+			ConversationID: m.ConversationID,
+			Topic:          topics[m.ConversationID],
+			Sender:         m.Sender,
+			Content:        m.Content,
+			Timestamp:      m.Timestamp,
+			Score:          match.Score,
+		})
+	}
+	return results, nil
+}
@@ -0,0 +1,96 @@
+package modeltest
+
+import (
+	"server/model"
+	"server/utils"
+	"sync"
+	"time"
+)
+
+// expiringValue is a key of Sessions, like a Redis key with a TTL.
+type expiringValue struct {
+	value     string
+	expiresAt time.Time
+}
+
+// Sessions keeps the registration codes and tokens and the blacklisted users in memory.
+type Sessions struct {
+	mu sync.Mutex
+	// Salt of the registration tokens, see utils.RegisterToken
+	registerKey string
+	otps        map[string]expiringValue
+	tokens      map[string]expiringValue
+	blacklist   map[string]bool
+}
+
+func NewSessions(registerKey string) *Sessions {
+	return &Sessions{
+		registerKey: registerKey,
+		otps:        make(map[string]expiringValue),
+		tokens:      make(map[string]expiringValue),
+		blacklist:   make(map[string]bool),
+	}
+}
+
+// take removes the value of key when it matches value and has not expired, and tells whether it did.
+// found is false when the key is unknown or expired, the way a Redis key disappears after its TTL.
+func take(values map[string]expiringValue, key, value string) (matched, found bool) {
+	stored, ok := values[key]
+	if !ok || time.Now().After(stored.expiresAt) {
+		delete(values, key)
+		return false, false
+	}
+	if stored.value != value {
+		return false, true
+	}
+	delete(values, key)
+	return true, true
+}
+
+func (s *Sessions) SaveOTP(email, otp string, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.otps[email] = expiringValue{value: otp, expiresAt: time.Now().Add(ttl)}
+	return nil
+}
+
+func (s *Sessions) VerifyOTP(email, otp string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	matched, found := take(s.otps, email, otp)
+	if !found {
+		return model.ErrOTPExpired
+	}
+	if !matched {
+		return model.ErrOTPIncorrect
+	}
+	return nil
+}
+
+func (s *Sessions) IssueRegisterToken(email string) (string, error) {
+	token := utils.RegisterToken(email, s.registerKey)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tokens[email] = expiringValue{value: token, expiresAt: time.Now().Add(15 * time.Minute)}
+	return token, nil
+}
+
+func (s *Sessions) ConsumeRegisterToken(email, token string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	matched, _ := take(s.tokens, email, token)
+	return matched
+}
+
+// Blacklist makes the tokens of the user refused, what the blacklist_ keys do in Redis.
+func (s *Sessions) Blacklist(userID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.blacklist[userID] = true
+}
+
+func (s *Sessions) IsBlacklisted(userID string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.blacklist[userID]
+}
@@ -0,0 +1,79 @@
+package modeltest
+
+import (
+	"server/model"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func (s *Conversations) Share(conversationID, userID primitive.ObjectID, expiresIn time.Duration) (*model.Share, error) {
+	if expiresIn < 0 {
+		return nil, invalid("expiry must be in the future")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c, err := s.owned(conversationID, userID)
+	if err != nil {
+		return nil, err
+	}
+	share, err := model.NewShare(c, userID, expiresIn)
+	if err != nil {
+		return nil, err
+	}
+	s.shares = append(s.shares, share)
+	copied := *share
+	return &copied, nil
+}
+
+func (s *Conversations) Shares(conversationID, userID primitive.ObjectID) ([]model.Share, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	shares := []model.Share{}
+	// Shares are appended as they are created, so the newest come last
+	for i := len(s.shares) - 1; i >= 0; i-- {
+		if s.shares[i].ConversationID == conversationID && s.shares[i].UserID == userID {
+			share := *s.shares[i]
+			share.Messages = nil
+			shares = append(shares, share)
+		}
+	}
+	return shares, nil
+}
+
+func (s *Conversations) GetShare(token string) (*model.Share, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, share := range s.shares {
+		if share.Token == token && share.Active() {
+			copied := *share
+			return &copied, nil
+		}
+	}
+	return nil, model.ErrShareNotFound
+}
+
+func (s *Conversations) RevokeShare(token string, userID primitive.ObjectID) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, share := range s.shares {
+		if share.Token == token && share.UserID == userID && share.RevokedAt == nil {
+			now := time.Now()
+			share.RevokedAt = &now
+			return nil
+		}
+	}
+	return model.ErrShareNotFound
+}
+
+func (s *Conversations) ForkShare(token string, userID primitive.ObjectID) (*model.Conversation, error) {
+	share, err := s.GetShare(token)
+	if err != nil {
+		return nil, err
+	}
+	conversation := share.Fork(userID)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.conversations[conversation.ID] = conversation
+	return copyConversation(conversation), nil
+}
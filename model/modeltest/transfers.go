@@ -0,0 +1,50 @@
+package modeltest
+
+import (
+	"server/model"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func (s *Conversations) Export(conversationID, userID primitive.ObjectID, format string) (*model.Export, error) {
+	s.mu.Lock()
+	c, err := s.owned(conversationID, userID)
+	if err == nil {
+		c = copyConversation(c)
+	}
+	s.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	return model.RenderExport(c, format)
+}
+
+func (s *Conversations) ExportMany(conversationIDs []primitive.ObjectID, userID primitive.ObjectID, format string) (*model.Export, error) {
+	return model.ZipExports(conversationIDs, func(id primitive.ObjectID) (*model.Export, error) {
+		return s.Export(id, userID, format)
+	})
+}
+
+func (s *Conversations) Import(userID primitive.ObjectID, format string, data []byte) ([]model.ImportResult, error) {
+	conversations, format, err := model.ParseImport(format, data)
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	results := make([]model.ImportResult, 0, len(conversations))
+	for i := range conversations {
+		imported := &conversations[i]
+		result := model.ImportResult{Index: i, Title: imported.Title, Messages: len(imported.Messages)}
+		if imported.Err != nil {
+			result.Error = imported.Err.Error()
+		} else {
+			conversation := imported.ToConversation(userID, format)
+			s.conversations[conversation.ID] = conversation
+			result.Title = conversation.Topic
+			result.ConversationID = conversation.ID
+		}
+		results = append(results, result)
+	}
+	return results, nil
+}
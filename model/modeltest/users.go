@@ -0,0 +1,58 @@
+package modeltest
+
+import (
+	"server/model"
+	"sync"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Users keeps the accounts in memory.
+type Users struct {
+	mu    sync.Mutex
+	users []model.User
+}
+
+func NewUsers() *Users {
+	return &Users{}
+}
+
+func (s *Users) EmailTaken(email string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, user := range s.users {
+		if user.Email == email {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (s *Users) CreateUser(user *model.User) error {
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(user.Password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+	user.Password = string(hashedPassword)
+	user.ID = primitive.NewObjectID()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.users = append(s.users, *user)
+	return nil
+}
+
+func (s *Users) Login(email, password string) (string, string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, user := range s.users {
+		if user.Email != email {
+			continue
+		}
+		if err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(password)); err != nil {
+			break
+		}
+		return user.ID.Hex(), user.Username, nil
+	}
+	return "", "", model.ErrInvalidCredentials
+}
@@ -0,0 +1,213 @@
+package model
+
+import (
+	"context"
+	"log/slog"
+	"server/config"
+	"server/utils"
+	"time"
+
+	chatbotapi "server/chatbotAPI"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Status of a user message. It is saved as pending as soon as the question is received, becomes streaming while
+// the model answers, then complete once the answer is saved or failed when the answer could not be generated or saved.
+// A failed question is asked again by sending it with the same cid, or by regenerating the answer.
+const (
+	StatusPending   = "pending"
+	StatusStreaming = "streaming"
+	StatusComplete  = "complete"
+	StatusFailed    = "failed"
+)
+
+const saveAttempts = 4
+
+// retryDelay is the wait before the second attempt, it doubles after each failure.
+var retryDelay = time.Second
+
+// withRetry runs a write until it succeeds, giving each attempt timeout. Writes run after the model answered,
+// failing them would lose an answer that took long to generate. It stops waiting when ctx is cancelled.
+func withRetry(ctx context.Context, timeout time.Duration, write func(ctx context.Context) error) error {
+	var err error
+	delay := retryDelay
+	for attempt := 0; attempt < saveAttempts; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(delay):
+			}
+			delay *= 2
+		}
+		attemptCtx, cancel := context.WithTimeout(ctx, timeout)
+		err = write(attemptCtx)
+		cancel()
+		if err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+// AnswerLease is how long a question stays claimed by the job answering it: the model API timeout, plus time to save
+// the answer. A question pending or streaming for longer was left by a job that crashed, and can be claimed again.
+func AnswerLease(cfg *config.Config) time.Duration {
+	return cfg.ModelAPI.Timeout + cfg.Mongo.Timeout
+}
+
+// Answering tells whether the answer to the question m is being generated, by a job that claimed it less than lease ago.
+func (m *Message) Answering(now time.Time, lease time.Duration) bool {
+	return (m.Status == StatusPending || m.Status == StatusStreaming) && now.Sub(m.StatusAt) < lease
+}
+
+func setStatus(ctx context.Context, db *DB, messageID primitive.ObjectID, status string) error {
+	collection := db.database().Collection("message")
+	return withRetry(ctx, db.settings.Mongo.WriteTimeout, func(ctx context.Context) error {
+		set := bson.M{"status": status, "status_at": time.Now()}
+		_, err := collection.UpdateOne(ctx, bson.M{"_id": messageID}, bson.M{"$set": set})
+		return err
+	})
+}
+
+// findQuestion returns the user message sent with cid in a conversation, nil when there is none.
+func findQuestion(ctx context.Context, db *DB, conversationID primitive.ObjectID, cid string) (*Message, error) {
+	var message Message
+	filter := bson.M{"conversation_id": conversationID, "cid": cid, "sender": "user"}
+	err := db.database().Collection("message").FindOne(ctx, filter).Decode(&message)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &message, nil
+}
+
+// findFirstQuestion returns the question sent with cid that started a conversation of the user, with that conversation.
+// Both are nil when there is none. Another user may have sent the same cid, so the questions are matched against the
+// conversations of the user, deleted ones excluded.
+func findFirstQuestion(ctx context.Context, db *DB, userID primitive.ObjectID, cid string) (*Message, *Conversation, error) {
+	filter := bson.M{"cid": cid, "sender": "user", "parent_id": bson.M{"$exists": false}}
+	cursor, err := db.database().Collection("message").Find(ctx, filter)
+	if err != nil {
+		return nil, nil, err
+	}
+	var questions []Message
+	if err := cursor.All(ctx, &questions); err != nil {
+		return nil, nil, err
+	}
+	if len(questions) == 0 {
+		return nil, nil, nil
+	}
+	ids := make([]primitive.ObjectID, 0, len(questions))
+	for _, q := range questions {
+		ids = append(ids, q.ConversationID)
+	}
+	var conversation Conversation
+	err = db.database().Collection("conversation").
+		FindOne(ctx, bson.M{"_id": bson.M{"$in": ids}, "user_id": userID, "deleted_at": notDeleted}).
+		Decode(&conversation)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	for i := range questions {
+		if questions[i].ConversationID == conversation.ID {
+			return &questions[i], &conversation, nil
+		}
+	}
+	return nil, nil, nil
+}
+
+// saveAnswer stores the answer to a question. A retried write may have succeeded the first time without the server
+// knowing, and a retried job builds a new answer for the same question, so the answer is upserted on its question:
+// whatever happens a question gets one answer.
+func saveAnswer(ctx context.Context, db *DB, answer *Message) error {
+	filter := bson.M{"conversation_id": answer.ConversationID, "parent_id": answer.ParentID, "sender": "bot"}
+	answer.SearchText = utils.NormalizeVietnamese(answer.Content)
+	collection := db.database().Collection("message")
+	err := withRetry(ctx, db.settings.Mongo.WriteTimeout, func(ctx context.Context) error {
+		var stored Message
+		upsert := options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)
+		if err := collection.FindOneAndUpdate(ctx, filter, bson.M{"$setOnInsert": answer}, upsert).Decode(&stored); err != nil {
+			return err
+		}
+		*answer = stored
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	embedInBackground(db, *answer)
+	return nil
+}
+
+// failQuestion marks a question as failed. It is called when something already went wrong, so its own error is only logged.
+func failQuestion(ctx context.Context, db *DB, questionID primitive.ObjectID, cause error) {
+	slog.ErrorContext(ctx, "failed to answer the question", "error", cause)
+	if err := setStatus(ctx, db, questionID, StatusFailed); err != nil {
+		slog.ErrorContext(ctx, "failed to mark the question as failed, it stays pending", "error", err)
+	}
+}
+
+// answerQuestion generates the answer to a saved question while streaming it to the user, saves it at the end of the
+// branch of the question and moves the status of the question along. For the first question the topic is saved too.
+// On error the question is left for the caller to retry or fail.
+func answerQuestion(ctx context.Context, db *DB, task AnswerJob, question Message, history []chatbotapi.HistoryMessage) error {
+	if err := setStatus(ctx, db, question.ID, StatusStreaming); err != nil {
+		return err
+	}
+	response, topic, err := GenerateResponseAndWebsocket(ctx, db.settings, task.UserID.Hex(), question.Content, task.ConversationID.Hex(), task.Mode, task.IsFirst, question.Cid, history)
+	if err != nil {
+		return err
+	}
+	answer := &Message{
+		ID:             primitive.NewObjectID(),
+		ConversationID: task.ConversationID,
+		ParentID:       question.ID,
+		Sender:         "bot",
+		Content:        response,
+		Cid:            question.Cid,
+		Timestamp:      time.Now(),
+	}
+	if err := saveAnswer(ctx, db, answer); err != nil {
+		return err
+	}
+	set := bson.M{"updated_at": time.Now(), "active_leaf_id": answer.ID}
+	if task.IsFirst && topic != "" {
+		set["topic"] = topic
+		set["topic_search"] = utils.NormalizeVietnamese(topic)
+	}
+	collection := db.database().Collection("conversation")
+	if err := withRetry(ctx, db.settings.Mongo.WriteTimeout, func(ctx context.Context) error {
+		_, err := collection.UpdateOne(ctx, bson.M{"_id": task.ConversationID}, bson.M{"$set": set})
+		return err
+	}); err != nil {
+		return err
+	}
+	return setStatus(ctx, db, question.ID, StatusComplete)
+}
+
+// regenerateAnswer asks the model again for a question that already has an answer and adds the new answer as a version of it.
+func regenerateAnswer(ctx context.Context, db *DB, task AnswerJob, question, answer Message, history []chatbotapi.HistoryMessage) error {
+	if err := setStatus(ctx, db, question.ID, StatusStreaming); err != nil {
+		return err
+	}
+	response, _, err := GenerateResponseAndWebsocket(ctx, db.settings, task.UserID.Hex(), question.Content, task.ConversationID.Hex(), task.Mode, false, question.Cid, history)
+	if err != nil {
+		return err
+	}
+	updated, err := appendVersion(ctx, db, answer, response)
+	if err != nil {
+		return err
+	}
+	embedInBackground(db, *updated)
+	return setStatus(ctx, db, question.ID, StatusComplete)
+}
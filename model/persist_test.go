@@ -0,0 +1,151 @@
+package model
+
+import (
+	"context"
+	"errors"
+	"os"
+	"server/config"
+	"server/utils"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestWithRetry(t *testing.T) {
+	defer func(delay time.Duration) { retryDelay = delay }(retryDelay)
+	retryDelay = time.Millisecond
+
+	calls := 0
+	err := withRetry(context.Background(), time.Second, func(ctx context.Context) error {
+		calls++
+		if calls < 3 {
+			return errors.New("timeout")
+		}
+		return nil
+	})
+	if err != nil || calls != 3 {
+		t.Fatalf("err = %v after %d calls", err, calls)
+	}
+
+	calls = 0
+	err = withRetry(context.Background(), time.Second, func(ctx context.Context) error {
+		calls++
+		return errors.New("down")
+	})
+	if err == nil || calls != saveAttempts {
+		t.Fatalf("err = %v after %d calls, want %d", err, calls, saveAttempts)
+	}
+}
+
+func TestWithRetryStopsWhenCancelled(t *testing.T) {
+	defer func(delay time.Duration) { retryDelay = delay }(retryDelay)
+	retryDelay = time.Hour
+
+	ctx, cancel := context.WithCancel(context.Background())
+	calls := 0
+	done := make(chan error)
+	go func() {
+		done <- withRetry(ctx, time.Second, func(ctx context.Context) error {
+			calls++
+			return errors.New("down")
+		})
+	}()
+	cancel()
+	select {
+	case err := <-done:
+		if !errors.Is(err, context.Canceled) || calls != 1 {
+			t.Fatalf("err = %v after %d calls", err, calls)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("withRetry kept waiting after the cancellation")
+	}
+}
+
+// testDB connects to the MongoDB of DB_URL and skips the test when it is not set. The tests write to the
+// chatbot-test database.
+func testDB(t *testing.T) *DB {
+	url := os.Getenv("DB_URL")
+	if url == "" {
+		t.Skip("DB_URL is not set")
+	}
+	cfg := config.Default()
+	cfg.Mongo.URL, cfg.Mongo.Database = url, "chatbot-test"
+	client := utils.ConnectDB(cfg.Mongo)
+	t.Cleanup(func() { client.Disconnect(context.Background()) })
+	return NewDB(client, cfg)
+}
+
+// TestSaveAnswerTwice saves the answer to a question without cid twice, as a retried job does.
+func TestSaveAnswerTwice(t *testing.T) {
+	db := testDB(t)
+	ctx := context.Background()
+	conversationID, questionID := primitive.NewObjectID(), primitive.NewObjectID()
+	var ids []primitive.ObjectID
+	for _, content := range []string{"first try", "second try"} {
+		answer := &Message{ID: primitive.NewObjectID(), ConversationID: conversationID, ParentID: questionID, Sender: "bot", Content: content}
+		if err := saveAnswer(ctx, db, answer); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, answer.ID)
+	}
+	if ids[0] != ids[1] {
+		t.Errorf("the retry saved answer %s next to %s", ids[1].Hex(), ids[0].Hex())
+	}
+	count, err := db.database().Collection("message").CountDocuments(ctx, bson.M{"parent_id": questionID})
+	if err != nil || count != 1 {
+		t.Fatalf("the question has %d answers: %v", count, err)
+	}
+}
+
+func TestAnswering(t *testing.T) {
+	now := time.Now()
+	lease := time.Minute
+	for _, c := range []struct {
+		status   string
+		statusAt time.Time
+		want     bool
+	}{
+		{StatusPending, now.Add(-time.Second), true},
+		{StatusStreaming, now.Add(-time.Second), true},
+		{StatusStreaming, now.Add(-2 * time.Minute), false},
+		// Questions saved before the status time was, stuck for good
+		{StatusPending, time.Time{}, false},
+		{StatusComplete, now, false},
+		{StatusFailed, now, false},
+		{"", time.Time{}, false},
+	} {
+		m := Message{Status: c.status, StatusAt: c.statusAt}
+		if got := m.Answering(now, lease); got != c.want {
+			t.Errorf("Answering of a question %q since %v = %v, want %v", c.status, now.Sub(c.statusAt), got, c.want)
+		}
+	}
+}
+
+// TestClaimQuestion claims questions as a regeneration does: one still being answered is refused, one left by a
+// crashed job is taken over.
+func TestClaimQuestion(t *testing.T) {
+	db := testDB(t)
+	ctx := context.Background()
+	messages := db.database().Collection("message")
+	answering := Message{ID: primitive.NewObjectID(), Sender: "user", Status: StatusStreaming, StatusAt: time.Now()}
+	stuck := Message{ID: primitive.NewObjectID(), Sender: "user", Status: StatusStreaming, StatusAt: time.Now().Add(-2 * AnswerLease(db.settings))}
+	legacy := Message{ID: primitive.NewObjectID(), Sender: "user", Status: StatusPending}
+	for _, m := range []Message{answering, stuck, legacy} {
+		if _, err := messages.InsertOne(ctx, m); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := claimQuestion(ctx, db, answering.ID); !errors.Is(err, ErrAnswerInProgress) {
+		t.Errorf("claiming a question being answered: %v", err)
+	}
+	for _, m := range []Message{stuck, legacy} {
+		if err := claimQuestion(ctx, db, m.ID); err != nil {
+			t.Errorf("claiming a question left by a crashed job: %v", err)
+		}
+		if err := claimQuestion(ctx, db, m.ID); !errors.Is(err, ErrAnswerInProgress) {
+			t.Errorf("claiming a question just claimed: %v", err)
+		}
+	}
+}
@@ -0,0 +1,139 @@
+package model
+
+import (
+	"context"
+	"server/utils"
+	"sort"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Runes of text kept around the matched terms in the snippets of the results
+const SnippetWidth = 160
+
+type SearchHit struct {
+	MessageID primitive.ObjectID `json:"message_id"`
+	Sender    string             `json:"sender"`
+	Timestamp time.Time          `json:"timestamp"`
+	// Excerpt of the message, HTML-escaped, with the matching words wrapped in <mark></mark>
+	Snippet string  `json:"snippet"`
+	Score   float64 `json:"score"`
+}
+
+// SearchResult groups the hits of one conversation, conversations are ranked by their best hit.
+type SearchResult struct {
+	ConversationID primitive.ObjectID   `json:"conversation_id"`
+	Topic          string               `json:"topic"`
+	TopicSnippet   string               `json:"topic_snippet,omitempty"`
+	UpdatedAt      time.Time            `json:"updated_at"`
+	MessageIDs     []primitive.ObjectID `json:"message_ids"`
+	Hits           []SearchHit          `json:"hits"`
+	Score          float64              `json:"score"`
+}
+
+// This function searches the topics and messages of all the conversations of a user.
+// Both the query and the stored text are folded with utils.NormalizeVietnamese, so "tieu hoa" finds "tiêu hóa".
+func Search(userID primitive.ObjectID, query string, limit int, db *DB) ([]SearchResult, error) {
+	terms := utils.SearchTerms(query)
+	if len(terms) == 0 {
+		return nil, invalid("query is empty")
+	}
+	if limit <= 0 || limit > 100 {
+		limit = 20
+	}
+	search := strings.Join(terms, " ")
+	ctx, cancel := context.WithTimeout(context.Background(), db.settings.Mongo.Timeout)
+	defer cancel()
+
+	conversations := db.database().Collection("conversation")
+	cursor, err := conversations.Find(ctx, bson.M{"user_id": userID, "deleted_at": notDeleted}, options.Find().SetProjection(bson.M{"_id": 1, "topic": 1, "updated_at": 1}))
+	if err != nil {
+		return nil, err
+	}
+	var owned []Conversation
+	if err = cursor.All(ctx, &owned); err != nil {
+		return nil, err
+	}
+	results := make(map[primitive.ObjectID]*SearchResult, len(owned))
+	ids := make([]primitive.ObjectID, 0, len(owned))
+	for _, c := range owned {
+		results[c.ID] = &SearchResult{ConversationID: c.ID, Topic: c.Topic, UpdatedAt: c.UpdatedAt, MessageIDs: []primitive.ObjectID{}, Hits: []SearchHit{}}
+		ids = append(ids, c.ID)
+	}
+	if len(ids) == 0 {
+		return []SearchResult{}, nil
+	}
+
+	scored := options.Find().
+		SetProjection(bson.M{"score": bson.M{"$meta": "textScore"}, "topic": 1}).
+		SetSort(bson.M{"score": bson.M{"$meta": "textScore"}}).
+		SetLimit(int64(limit))
+	cursor, err = conversations.Find(ctx, bson.M{"user_id": userID, "deleted_at": notDeleted, "$text": bson.M{"$search": search}}, scored)
+	if err != nil {
+		return nil, err
+	}
+	var topics []struct {
+		ID    primitive.ObjectID `bson:"_id"`
+		Topic string             `bson:"topic"`
+		Score float64            `bson:"score"`
+	}
+	if err = cursor.All(ctx, &topics); err != nil {
+		return nil, err
+	}
+	for _, t := range topics {
+		results[t.ID].TopicSnippet = utils.Highlight(t.Topic, terms, SnippetWidth)
+		results[t.ID].Score = t.Score
+	}
+
+	messages := db.database().Collection("message")
+	scored = options.Find().
+		SetProjection(bson.M{"score": bson.M{"$meta": "textScore"}, "conversation_id": 1, "sender": 1, "content": 1, "timestamp": 1}).
+		SetSort(bson.M{"score": bson.M{"$meta": "textScore"}}).
+		SetLimit(int64(limit * 5))
+	cursor, err = messages.Find(ctx, bson.M{"conversation_id": bson.M{"$in": ids}, "$text": bson.M{"$search": search}}, scored)
+	if err != nil {
+		return nil, err
+	}
+	var hits []struct {
+		Message `bson:",inline"`
+		Score   float64 `bson:"score"`
+	}
+	if err = cursor.All(ctx, &hits); err != nil {
+		return nil, err
+	}
+	for _, h := range hits {
+		result := results[h.ConversationID]
+		result.MessageIDs = append(result.MessageIDs, h.ID)
+		result.Hits = append(result.Hits, SearchHit{
+			MessageID: h.ID,
+			Sender:    h.Sender,
+			Timestamp: h.Timestamp,
+			Snippet:   utils.Highlight(h.Content, terms, SnippetWidth),
+			Score:     h.Score,
+		})
+		if h.Score > result.Score {
+			result.Score = h.Score
+		}
+	}
+
+	ranked := []SearchResult{}
+	for _, result := range results {
+		if result.Score > 0 {
+			ranked = append(ranked, *result)
+		}
+	}
+	sort.Slice(ranked, func(i, j int) bool {
+		if ranked[i].Score != ranked[j].Score {
+			return ranked[i].Score > ranked[j].Score
+		}
+		return ranked[i].UpdatedAt.After(ranked[j].UpdatedAt)
+	})
+	if len(ranked) > limit {
+		ranked = ranked[:limit]
+	}
+	return ranked, nil
+}
@@ -0,0 +1,231 @@
+package model
+
+import (
+	"context"
+	"log/slog"
+	"server/embedding"
+	"server/utils"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Only the beginning of long answers is embedded, embedding models truncate their input anyway
+const maxEmbeddedRunes = 2000
+
+var (
+	embedder    embedding.Embedder
+	vectorIndex embedding.Index
+)
+
+// UseEmbeddings turns on semantic search: every message saved afterwards is embedded in the background.
+func UseEmbeddings(e embedding.Embedder, index embedding.Index) {
+	embedder = e
+	vectorIndex = index
+}
+
+type SemanticResult struct {
+	MessageID      primitive.ObjectID `json:"message_id"`
+	ConversationID primitive.ObjectID `json:"conversation_id"`
+	Topic          string             `json:"topic"`
+	Sender         string             `json:"sender"`
+	Content        string             `json:"content"`
+	Timestamp      time.Time          `json:"timestamp"`
+	Score          float64            `json:"score"`
+}
+
+// EmbeddedText is the part of content that is embedded.
+func EmbeddedText(content string) string {
+	runes := []rune(content)
+	if len(runes) > maxEmbeddedRunes {
+		runes = runes[:maxEmbeddedRunes]
+	}
+	return string(runes)
+}
+
+// embedMessages stores the vectors of messages of one conversation. It is called after the messages are saved.
+func embedMessages(ctx context.Context, db *DB, messages []Message) error {
+	if embedder == nil || len(messages) == 0 {
+		return nil
+	}
+	var owner struct {
+		UserID primitive.ObjectID `bson:"user_id"`
+	}
+	collection := db.database().Collection("conversation")
+	if err := collection.FindOne(ctx, bson.M{"_id": messages[0].ConversationID}, options.FindOne().SetProjection(bson.M{"user_id": 1})).Decode(&owner); err != nil {
+		return err
+	}
+	texts := make([]string, 0, len(messages))
+	for _, m := range messages {
+		texts = append(texts, EmbeddedText(m.Content))
+	}
+	values, err := embedder.Embed(ctx, texts)
+	if err != nil {
+		return err
+	}
+	vectors := make([]embedding.Vector, 0, len(messages))
+	for i, m := range messages {
+		vectors = append(vectors, embedding.Vector{
+			ID:             m.ID,
+			ConversationID: m.ConversationID,
+			UserID:         owner.UserID,
+			Values:         embedding.Normalize(values[i]),
+		})
+	}
+	return vectorIndex.Upsert(ctx, vectors)
+}
+
+// embedInBackground embeds messages without making the caller wait for the embedding API.
+func embedInBackground(db *DB, messages ...Message) {
+	if embedder == nil {
+		return
+	}
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		defer cancel()
+		if err := embedMessages(ctx, db, messages); err != nil {
+			slog.Error("failed to embed messages", "messages", len(messages), "error", err)
+		}
+	}()
+}
+
+// This function ranks the messages of a user by how close their meaning is to the query.
+func SemanticSearch(userID primitive.ObjectID, query string, limit int, db *DB) ([]SemanticResult, error) {
+	if embedder == nil {
+		return nil, ErrSemanticSearchDisabled
+	}
+	query = utils.CleanString(query)
+	if query == "" {
+		return nil, invalid("query is empty")
+	}
+	if limit <= 0 || limit > 50 {
+		limit = 10
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), db.settings.Mongo.Timeout)
+	defer cancel()
+	values, err := embedder.Embed(ctx, []string{query})
+	if err != nil {
+		return nil, err
+	}
+	matches, err := vectorIndex.Search(ctx, userID, embedding.Normalize(values[0]), limit)
+	if err != nil {
+		return nil, err
+	}
+	if len(matches) == 0 {
+		return []SemanticResult{}, nil
+	}
+
+	// Vectors of deleted messages may linger, only messages that still exist are returned
+	ids := make([]primitive.ObjectID, 0, len(matches))
+	conversationIDs := make([]primitive.ObjectID, 0, len(matches))
+	for _, m := range matches {
+		ids = append(ids, m.ID)
+		conversationIDs = append(conversationIDs, m.ConversationID)
+	}
+	cursor, err := db.database().Collection("message").Find(ctx, bson.M{"_id": bson.M{"$in": ids}})
+	if err != nil {
+		return nil, err
+	}
+	var messages []Message
+	if err = cursor.All(ctx, &messages); err != nil {
+		return nil, err
+	}
+	byID := make(map[primitive.ObjectID]Message, len(messages))
+	for _, m := range messages {
+		byID[m.ID] = m
+	}
+	cursor, err = db.database().Collection("conversation").Find(ctx,
+		bson.M{"_id": bson.M{"$in": conversationIDs}, "user_id": userID, "deleted_at": notDeleted},
+		options.Find().SetProjection(bson.M{"_id": 1, "topic": 1}))
+	if err != nil {
+		return nil, err
+	}
+	var conversations []Conversation
+	if err = cursor.All(ctx, &conversations); err != nil {
+		return nil, err
+	}
+	topics := make(map[primitive.ObjectID]string, len(conversations))
+	for _, c := range conversations {
+		topics[c.ID] = c.Topic
+	}
+
+	results := make([]SemanticResult, 0, len(matches))
+	for _, match := range matches {
+		m, ok := byID[match.ID]
+		if _, owned := topics[m.ConversationID]; !ok || !owned {
+			continue
+		}
+		results = append(results, SemanticResult{
+			MessageID:      m.ID,
+			ConversationID: m.ConversationID,
+			Topic:          topics[m.ConversationID],
+			Sender:         m.Sender,
+			Content:        m.Content,
+			Timestamp:      m.Timestamp,
+			Score:          match.Score,
+		})
+	}
+	return results, nil
+}
+
+// This function embeds the messages that are not in the vector index yet, such as the ones saved before
+// semantic search existed or all of them when the index lives in memory.
+func BackfillEmbeddings(db *DB) (int, error) {
+	if embedder == nil {
+		return 0, nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Hour)
+	defer cancel()
+	collection := db.database().Collection("message")
+	cursor, err := collection.Find(ctx, bson.M{}, options.Find().SetSort(bson.D{{Key: "conversation_id", Value: 1}, {Key: "_id", Value: 1}}))
+	if err != nil {
+		return 0, err
+	}
+	defer cursor.Close(ctx)
+	embedded := 0
+	var batch []Message
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		ids := make([]primitive.ObjectID, 0, len(batch))
+		for _, m := range batch {
+			ids = append(ids, m.ID)
+		}
+		found, err := vectorIndex.Contains(ctx, ids)
+		if err != nil {
+			return err
+		}
+		var missing []Message
+		for _, m := range batch {
+			if !found[m.ID] {
+				missing = append(missing, m)
+			}
+		}
+		batch = nil
+		if err := embedMessages(ctx, db, missing); err != nil {
+			return err
+		}
+		embedded += len(missing)
+		return nil
+	}
+	for cursor.Next(ctx) {
+		var m Message
+		if err := cursor.Decode(&m); err != nil {
+			return embedded, err
+		}
+		// embedMessages expects the messages of a single conversation
+		if len(batch) == 50 || (len(batch) > 0 && batch[0].ConversationID != m.ConversationID) {
+			if err := flush(); err != nil {
+				return embedded, err
+			}
+		}
+		batch = append(batch, m)
+	}
+	if err := flush(); err != nil {
+		return embedded, err
+	}
+	return embedded, cursor.Err()
+}
@@ -0,0 +1,196 @@
+package model
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"server/utils"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Share is a read-only copy of the active branch of a conversation, taken when the link is created.
+// Later messages, edits and deletions do not change what the link shows.
+type Share struct {
+	ID             primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	Token          string             `bson:"token" json:"token"`
+	UserID         primitive.ObjectID `bson:"user_id" json:"-"`
+	ConversationID primitive.ObjectID `bson:"conversation_id" json:"conversation_id"`
+	Topic          string             `bson:"topic,omitempty" json:"topic,omitempty"`
+	Mode           string             `bson:"mode,omitempty" json:"mode,omitempty"`
+	Messages       []SharedMessage    `bson:"messages" json:"messages,omitempty"`
+	CreatedAt      time.Time          `bson:"created_at" json:"created_at"`
+	// Expired shares are removed by a TTL index, revoked ones are kept so the owner sees they were revoked
+	ExpiresAt *time.Time `bson:"expires_at,omitempty" json:"expires_at,omitempty"`
+	RevokedAt *time.Time `bson:"revoked_at,omitempty" json:"revoked_at,omitempty"`
+}
+
+// SharedMessage leaves out everything about a message that is private to the owner, such as cid and message ids.
+type SharedMessage struct {
+	Sender    string    `bson:"sender" json:"sender"`
+	Content   string    `bson:"content" json:"content"`
+	Timestamp time.Time `bson:"timestamp" json:"timestamp"`
+}
+
+// shareToken returns 32 random bytes, so links can not be guessed nor enumerated.
+func shareToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// NewShare copies the active branch of a conversation loaded with its content into a share with a new token.
+func NewShare(conversation *Conversation, userID primitive.ObjectID, expiresIn time.Duration) (*Share, error) {
+	path := conversation.ActivePath()
+	if len(path) == 0 {
+		return nil, invalid("conversation has no message")
+	}
+	token, err := shareToken()
+	if err != nil {
+		return nil, err
+	}
+	share := &Share{
+		ID:             primitive.NewObjectID(),
+		Token:          token,
+		UserID:         userID,
+		ConversationID: conversation.ID,
+		Topic:          conversation.Topic,
+		Mode:           conversation.Mode,
+		Messages:       make([]SharedMessage, 0, len(path)),
+		CreatedAt:      time.Now(),
+	}
+	for _, m := range path {
+		share.Messages = append(share.Messages, SharedMessage{Sender: m.Sender, Content: m.Content, Timestamp: m.Timestamp})
+	}
+	if expiresIn > 0 {
+		expiresAt := share.CreatedAt.Add(expiresIn)
+		share.ExpiresAt = &expiresAt
+	}
+	return share, nil
+}
+
+// This function creates a public link to the active branch of a conversation of the user.
+// A zero expiresIn makes a link that works until it is revoked.
+func ShareConversation(conversationID, userID primitive.ObjectID, expiresIn time.Duration, db *DB) (*Share, error) {
+	if expiresIn < 0 {
+		return nil, invalid("expiry must be in the future")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), db.settings.Mongo.Timeout)
+	defer cancel()
+	conversation, err := loadConversationTree(ctx, db, conversationID, userID, true)
+	if err != nil {
+		return nil, err
+	}
+	share, err := NewShare(conversation, userID, expiresIn)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := db.database().Collection("share").InsertOne(ctx, share); err != nil {
+		return nil, err
+	}
+	return share, nil
+}
+
+// Active tells whether the link still opens the share, it does until it is revoked or expires.
+func (share *Share) Active() bool {
+	return share.RevokedAt == nil && (share.ExpiresAt == nil || share.ExpiresAt.After(time.Now()))
+}
+
+// This function lists the links the user created for a conversation, without their messages.
+func GetShares(conversationID, userID primitive.ObjectID, db *DB) ([]Share, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), db.settings.Mongo.Timeout)
+	defer cancel()
+	findOptions := options.Find().SetProjection(bson.M{"messages": 0}).SetSort(bson.M{"created_at": -1})
+	cursor, err := db.database().Collection("share").Find(ctx, bson.M{"conversation_id": conversationID, "user_id": userID}, findOptions)
+	if err != nil {
+		return nil, err
+	}
+	shares := []Share{}
+	if err = cursor.All(ctx, &shares); err != nil {
+		return nil, err
+	}
+	return shares, nil
+}
+
+// This function reads a shared conversation by the token of its link. It needs no user: anyone with the link can read it.
+func GetShare(token string, db *DB) (*Share, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), db.settings.Mongo.Timeout)
+	defer cancel()
+	var share Share
+	if err := db.database().Collection("share").FindOne(ctx, bson.M{"token": token}).Decode(&share); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, ErrShareNotFound
+		}
+		return nil, err
+	}
+	// The TTL monitor only runs every minute, the expiry is checked here as well
+	if !share.Active() {
+		return nil, ErrShareNotFound
+	}
+	return &share, nil
+}
+
+func RevokeShare(token string, userID primitive.ObjectID, db *DB) error {
+	ctx, cancel := context.WithTimeout(context.Background(), db.settings.Mongo.Timeout)
+	defer cancel()
+	filter := bson.M{"token": token, "user_id": userID, "revoked_at": bson.M{"$exists": false}}
+	result, err := db.database().Collection("share").UpdateOne(ctx, filter, bson.M{"$set": bson.M{"revoked_at": time.Now()}})
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return ErrShareNotFound
+	}
+	return nil
+}
+
+// Fork copies the messages of the share into a new conversation of userID, chained one after the other.
+func (share *Share) Fork(userID primitive.ObjectID) *Conversation {
+	conversation := &Conversation{
+		ID:          primitive.NewObjectID(),
+		UserID:      userID,
+		StartedAt:   time.Now(),
+		UpdatedAt:   time.Now(),
+		Topic:       share.Topic,
+		TopicSearch: utils.NormalizeVietnamese(share.Topic),
+		Mode:        share.Mode,
+		ForkedFrom:  share.ID,
+	}
+	for _, m := range share.Messages {
+		message := Message{
+			ID:             primitive.NewObjectID(),
+			ConversationID: conversation.ID,
+			ParentID:       conversation.ActiveLeafID,
+			Sender:         m.Sender,
+			Content:        m.Content,
+			Timestamp:      m.Timestamp,
+		}
+		conversation.Messages = append(conversation.Messages, message)
+		conversation.ActiveLeafID = message.ID
+	}
+	return conversation
+}
+
+// This function copies a shared conversation into a new conversation of the user, who can then go on with it.
+func ForkShare(token string, userID primitive.ObjectID, db *DB) (*Conversation, error) {
+	share, err := GetShare(token, db)
+	if err != nil {
+		return nil, err
+	}
+	conversation := share.Fork(userID)
+	ctx, cancel := context.WithTimeout(context.Background(), db.settings.Mongo.Timeout)
+	defer cancel()
+	if _, err := db.database().Collection("conversation").InsertOne(ctx, conversation); err != nil {
+		return nil, err
+	}
+	if err := insertMessages(ctx, db, conversation.Messages...); err != nil {
+		return nil, err
+	}
+	return conversation, nil
+}
@@ -0,0 +1,17 @@
+package model
+
+import "testing"
+
+func TestShareToken(t *testing.T) {
+	seen := make(map[string]bool)
+	for i := 0; i < 100; i++ {
+		token, err := shareToken()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(token) != 43 || seen[token] {
+			t.Fatalf("token %q is too short or repeated", token)
+		}
+		seen[token] = true
+	}
+}
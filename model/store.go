@@ -0,0 +1,207 @@
+package model
+
+import (
+	"context"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// MongoUsers keeps the accounts in the user collection.
+type MongoUsers struct {
+	db *DB
+}
+
+func NewMongoUsers(db *DB) *MongoUsers {
+	return &MongoUsers{db: db}
+}
+
+func (s *MongoUsers) EmailTaken(email string) (bool, error) {
+	return EmailTaken(email, s.db)
+}
+
+func (s *MongoUsers) CreateUser(user *User) error {
+	return RegisterNewUser(user, s.db)
+}
+
+func (s *MongoUsers) Login(email, password string) (string, string, error) {
+	return Login(email, password, s.db)
+}
+
+// MongoConversations keeps the conversations, their messages, folders and shares in MongoDB.
+// Its methods are the functions of this package bound to a DB.
+type MongoConversations struct {
+	db *DB
+}
+
+func NewMongoConversations(db *DB) *MongoConversations {
+	return &MongoConversations{db: db}
+}
+
+func (s *MongoConversations) CheckOwner(conversationID, userID primitive.ObjectID) error {
+	return CheckConversationUser(userID, conversationID, s.db)
+}
+
+func (s *MongoConversations) List(userID primitive.ObjectID, filter ConversationFilter, cursor string, limit int) (*ConversationPage, error) {
+	return ListUserConversations(userID, filter, cursor, limit, s.db)
+}
+
+func (s *MongoConversations) ListPage(userID primitive.ObjectID, page int64, filter ConversationFilter) (*[]ConversationSummary, error) {
+	return GetUserConversationsPage(userID, s.db, page, filter)
+}
+
+func (s *MongoConversations) ListAll(userID primitive.ObjectID, filter ConversationFilter) (*[]ConversationSummary, error) {
+	return GetUserConversations(userID, s.db, filter)
+}
+
+func (s *MongoConversations) Get(conversationID, userID primitive.ObjectID) (*Conversation, error) {
+	return GetOneConversation(conversationID, userID, s.db)
+}
+
+func (s *MongoConversations) AskNew(ctx context.Context, userID primitive.ObjectID, content, mode, cid string) (primitive.ObjectID, error) {
+	return AskNewConversation(ctx, userID, content, s.db, mode, cid)
+}
+
+// Ask checks the conversation belongs to the user before asking in it, AskInConversation trusts the caller.
+func (s *MongoConversations) Ask(ctx context.Context, conversationID, userID primitive.ObjectID, content, cid string) error {
+	if err := CheckConversationUser(userID, conversationID, s.db); err != nil {
+		return err
+	}
+	return AskInConversation(ctx, conversationID, content, s.db, cid)
+}
+
+func (s *MongoConversations) Update(conversationID, userID primitive.ObjectID, changes ConversationUpdate) (*Conversation, error) {
+	return UpdateConversation(conversationID, userID, changes, s.db)
+}
+
+func (s *MongoConversations) Delete(conversationID, userID primitive.ObjectID) error {
+	return DeleteConversation(conversationID, userID, s.db)
+}
+
+func (s *MongoConversations) Restore(conversationID, userID primitive.ObjectID) error {
+	return RestoreConversation(conversationID, userID, s.db)
+}
+
+func (s *MongoConversations) Trash(userID primitive.ObjectID) ([]ConversationSummary, error) {
+	return GetTrash(userID, s.db)
+}
+
+func (s *MongoConversations) Messages(conversationID, userID, after, before primitive.ObjectID, limit int) (*MessagePage, error) {
+	return GetActiveMessages(conversationID, userID, after, before, limit, s.db)
+}
+
+func (s *MongoConversations) Message(conversationID, userID, messageID primitive.ObjectID) (*Message, error) {
+	return GetMessage(conversationID, userID, messageID, s.db)
+}
+
+func (s *MongoConversations) DeleteMessage(conversationID, userID, messageID primitive.ObjectID) error {
+	return DeleteMessage(conversationID, userID, messageID, s.db)
+}
+
+func (s *MongoConversations) PinMessage(conversationID, userID, messageID primitive.ObjectID, pinned bool) error {
+	return PinMessage(conversationID, userID, messageID, pinned, s.db)
+}
+
+func (s *MongoConversations) CopyMessage(conversationID, userID, messageID, targetID primitive.ObjectID) (*Message, error) {
+	return CopyMessage(conversationID, userID, messageID, targetID, s.db)
+}
+
+func (s *MongoConversations) EditMessage(ctx context.Context, conversationID, userID, messageID primitive.ObjectID, content, cid string) error {
+	return EditMessage(ctx, conversationID, userID, messageID, content, s.db, cid)
+}
+
+func (s *MongoConversations) Branches(conversationID, userID, messageID primitive.ObjectID) ([]Message, int, error) {
+	return GetBranches(conversationID, userID, messageID, s.db)
+}
+
+func (s *MongoConversations) SwitchBranch(conversationID, userID, messageID primitive.ObjectID) error {
+	return SwitchBranch(conversationID, userID, messageID, s.db)
+}
+
+func (s *MongoConversations) Regenerate(ctx context.Context, conversationID, userID primitive.ObjectID) error {
+	return RegenerateAnswer(ctx, conversationID, userID, s.db)
+}
+
+func (s *MongoConversations) SelectVersion(conversationID, userID, messageID primitive.ObjectID, index int) (*Message, error) {
+	return SelectVersion(conversationID, userID, messageID, index, s.db)
+}
+
+func (s *MongoConversations) Folders(userID primitive.ObjectID) (*FolderList, error) {
+	return GetFolders(userID, s.db)
+}
+
+func (s *MongoConversations) CreateFolder(userID primitive.ObjectID, name string) (*Folder, error) {
+	return CreateFolder(userID, name, s.db)
+}
+
+func (s *MongoConversations) RenameFolder(folderID, userID primitive.ObjectID, name string) error {
+	return RenameFolder(folderID, userID, name, s.db)
+}
+
+func (s *MongoConversations) DeleteFolder(folderID, userID primitive.ObjectID) error {
+	return DeleteFolder(folderID, userID, s.db)
+}
+
+func (s *MongoConversations) Move(conversationID, userID, folderID primitive.ObjectID) error {
+	return MoveConversation(conversationID, userID, folderID, s.db)
+}
+
+func (s *MongoConversations) SetTags(conversationID, userID primitive.ObjectID, tags []string) ([]string, error) {
+	return SetConversationTags(conversationID, userID, tags, s.db)
+}
+
+func (s *MongoConversations) Tags(userID primitive.ObjectID) ([]TagCount, error) {
+	return GetTags(userID, s.db)
+}
+
+func (s *MongoConversations) Share(conversationID, userID primitive.ObjectID, expiresIn time.Duration) (*Share, error) {
+	return ShareConversation(conversationID, userID, expiresIn, s.db)
+}
+
+func (s *MongoConversations) Shares(conversationID, userID primitive.ObjectID) ([]Share, error) {
+	return GetShares(conversationID, userID, s.db)
+}
+
+func (s *MongoConversations) GetShare(token string) (*Share, error) {
+	return GetShare(token, s.db)
+}
+
+func (s *MongoConversations) RevokeShare(token string, userID primitive.ObjectID) error {
+	return RevokeShare(token, userID, s.db)
+}
+
+func (s *MongoConversations) ForkShare(token string, userID primitive.ObjectID) (*Conversation, error) {
+	return ForkShare(token, userID, s.db)
+}
+
+func (s *MongoConversations) Export(conversationID, userID primitive.ObjectID, format string) (*Export, error) {
+	return ExportConversation(conversationID, userID, format, s.db)
+}
+
+func (s *MongoConversations) ExportMany(conversationIDs []primitive.ObjectID, userID primitive.ObjectID, format string) (*Export, error) {
+	return ExportConversations(conversationIDs, userID, format, s.db)
+}
+
+func (s *MongoConversations) Import(userID primitive.ObjectID, format string, data []byte) ([]ImportResult, error) {
+	return ImportConversations(userID, format, data, s.db)
+}
+
+func (s *MongoConversations) Search(userID primitive.ObjectID, query string, limit int) ([]SearchResult, error) {
+	return Search(userID, query, limit, s.db)
+}
+
+func (s *MongoConversations) SemanticSearch(userID primitive.ObjectID, query string, limit int) ([]SemanticResult, error) {
+	return SemanticSearch(userID, query, limit, s.db)
+}
+
+// RedisSessions keeps the short-lived registration state and the blacklisted users in Redis.
+type RedisSessions struct {
+	redisClient *redis.Client
+	// Salt of the registration tokens, see utils.GenerateToken
+	registerKey string
+}
+
+func NewRedisSessions(redisClient *redis.Client, registerKey string) *RedisSessions {
+	return &RedisSessions{redisClient: redisClient, registerKey: registerKey}
+}
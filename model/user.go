@@ -3,57 +3,31 @@ package model
 import (
 	"context"
 	"errors"
-	"net/http"
-	"server/auth"
 	"server/utils"
 	"time"
 
-	"github.com/gin-gonic/gin"
-	"github.com/redis/go-redis/v9"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
-	"go.mongodb.org/mongo-driver/mongo"
 	"golang.org/x/crypto/bcrypt"
 )
 
 type User struct {
-	ID             primitive.ObjectID `json:"id" bson:"_id,omitempty"`
-	Username       string             `json:"username" bson:"username"`
-	Email          string             `json:"email" bson:"email"`
+	ID       primitive.ObjectID `json:"id" bson:"_id,omitempty"`
+	Username string             `json:"username" bson:"username"`
+	Email    string             `json:"email" bson:"email"`
 	Password string             `json:"password" bson:"password"`
 }
 
-func RegisterNewEmail(email string, client *mongo.Client, redisClient *redis.Client) error {
-	count, err := client.Database("chatbot-server").Collection("user").CountDocuments(context.TODO(), bson.M{"email": email})
+// This function tells whether an account already uses the email.
+func EmailTaken(email string, db *DB) (bool, error) {
+	count, err := db.database().Collection("user").CountDocuments(context.TODO(), bson.M{"email": email})
 	if err != nil {
-		return errors.New("something is wrong please try again")
+		return false, errors.New("something is wrong please try again")
 	}
-	if count > 0 {
-		return errors.New("email has been registered")
-	}
-	otp := utils.GenerateOTP()
-	if err := utils.SendMail(email, otp); err != nil {
-		return err
-	}
-	if err := redisClient.Set(context.TODO(), "otp_"+email, otp, 15*time.Minute).Err(); err != nil {
-		return err
-	}
-	return nil
+	return count > 0, nil
 }
-func VerifyOTP(email string, otp string, redisClient *redis.Client) error {
-	value, err := redisClient.Get(context.TODO(), "otp_"+email).Result()
-	if err != nil {
-		return errors.New("otp has been expired")
-	}
-	if value != otp {
-		return errors.New("otp is incorrect")
-	}
-	redisClient.Del(context.TODO(), "otp_"+email)
-	return nil
-}
-func RegisterNewUser(user *User, client *mongo.Client, redisClient *redis.Client) error {
-	db := client.Database("chatbot-server")
-	collection := db.Collection("user")
+func RegisterNewUser(user *User, db *DB) error {
+	collection := db.database().Collection("user")
 	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(user.Password), bcrypt.DefaultCost)
 	if err != nil {
 		return err
@@ -66,58 +40,45 @@ func RegisterNewUser(user *User, client *mongo.Client, redisClient *redis.Client
 	user.ID = result.InsertedID.(primitive.ObjectID)
 	return nil
 }
-func Login(email, password string, client *mongo.Client) (string,string, error) {
-	db := client.Database("chatbot-server")
-	collection := db.Collection("user")
+func Login(email, password string, db *DB) (string, string, error) {
+	collection := db.database().Collection("user")
 	var user User
 	if err := collection.FindOne(context.TODO(), bson.M{"email": email}).Decode(&user); err != nil {
-		return "","", errors.New("email or password is incorrect")
+		return "", "", ErrInvalidCredentials
 	}
 	if err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(password)); err != nil {
-		return "","", errors.New("email or password is incorrect")
+		return "", "", ErrInvalidCredentials
 	}
-	return user.ID.Hex(),user.Username, nil
+	return user.ID.Hex(), user.Username, nil
 }
-func IsTokenValid(c *gin.Context, redisClient *redis.Client) bool{
-	cookie, err := c.Request.Cookie("jwt_token")
-	if err != nil {
-		c.JSON(http.StatusUnauthorized, gin.H{
-			"error": errors.New("not authenticate"),
-		})
-		return false
-	}
-	token := cookie.Value
-	claims, err := auth.VerifyJWT(token)
-	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{
-			"error": errors.New("token expired"),
-		})
-		return	false
-	}
-	if _, err := redisClient.Get(context.TODO(), "blacklist_"+claims.UserID).Result(); err == nil {
-		c.JSON(http.StatusBadRequest, gin.H{
-			"error": errors.New("token has been blacklisted"),
-		})
-		return 		false
-	}
-	return	true
+
+func (s *RedisSessions) SaveOTP(email, otp string, ttl time.Duration) error {
+	return s.redisClient.Set(context.TODO(), "otp_"+email, otp, ttl).Err()
 }
-func IsTokenNotValid(c *gin.Context, redisClient *redis.Client) bool {
-	cookie, err := c.Request.Cookie("jwt_token")
-	if err != nil {
-		return	true
-	}
-	token := cookie.Value
-	claims, err := auth.VerifyJWT(token)
+
+// VerifyOTP checks the code sent to email, a code can only be used once.
+func (s *RedisSessions) VerifyOTP(email, otp string) error {
+	value, err := s.redisClient.Get(context.TODO(), "otp_"+email).Result()
 	if err != nil {
-		return true
+		return ErrOTPExpired
 	}
-	if _, err := redisClient.Get(context.TODO(), "blacklist_"+claims.UserID).Result(); err == nil {
-		return true
+	if value != otp {
+		return ErrOTPIncorrect
 	}
+	s.redisClient.Del(context.TODO(), "otp_"+email)
+	return nil
+}
+
+// IssueRegisterToken returns the token proving email was verified, it is valid for 15 minutes.
+func (s *RedisSessions) IssueRegisterToken(email string) (string, error) {
+	return utils.GenerateToken(email, s.registerKey, s.redisClient), nil
+}
 
-	c.JSON(200,gin.H{
-		"message":"already login",
-	})
-	return false
-}
\ No newline at end of file
+func (s *RedisSessions) ConsumeRegisterToken(email, token string) bool {
+	return utils.VerifyToken(email, token, s.redisClient)
+}
+
+func (s *RedisSessions) IsBlacklisted(userID string) bool {
+	_, err := s.redisClient.Get(context.TODO(), "blacklist_"+userID).Result()
+	return err == nil
+}
@@ -0,0 +1,159 @@
+package model
+
+import (
+	"context"
+	"server/utils"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// AddVersion records content as a new answer of the bot message and selects it.
+// The answer the message had before regenerating becomes the first version.
+func (m *Message) AddVersion(content string) {
+	if len(m.Versions) == 0 {
+		m.Versions = []MessageVersion{{Content: m.Content, Timestamp: m.Timestamp}}
+	}
+	m.Versions = append(m.Versions, MessageVersion{Content: content, Timestamp: time.Now()})
+	m.Selected = len(m.Versions) - 1
+	m.Content = content
+}
+
+// SelectVersion shows the answer at index instead of the current one.
+func (m *Message) SelectVersion(index int) error {
+	if index < 0 || index >= len(m.Versions) {
+		return ErrVersionNotFound
+	}
+	m.Selected = index
+	m.Content = m.Versions[index].Content
+	return nil
+}
+
+// This function asks the model again for the last question of the active branch and streams the new answer via websocket.
+// The new answer is stored as another version of the existing bot message, the previous answers stay selectable.
+func RegenerateAnswer(ctx context.Context, conversationID, userID primitive.ObjectID, db *DB) error {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), db.settings.Mongo.Timeout)
+	defer cancel()
+	conversation, err := loadConversationTree(ctx, db, conversationID, userID, false)
+	if err != nil {
+		return err
+	}
+	path := conversation.PathTo(conversation.ActiveLeafID)
+	if len(path) == 0 {
+		return invalid("conversation is empty")
+	}
+	// The last question may have no answer yet if generating it failed, in that case the answer is created
+	var answer *Message
+	last := len(path) - 1
+	if path[last].Sender == "bot" {
+		answer = &path[last]
+		last--
+	}
+	if last < 0 || path[last].Sender != "user" {
+		return invalid("no question to answer")
+	}
+	if err := claimQuestion(ctx, db, path[last].ID); err != nil {
+		return err
+	}
+	task := AnswerJob{UserID: userID, ConversationID: conversationID, QuestionID: path[last].ID, Mode: conversation.Mode, WithHistory: true}
+	if answer != nil {
+		task.AnswerID = answer.ID
+	}
+	answerLater(ctx, db, task)
+	return nil
+}
+
+// claimQuestion sets a question back to pending for answering it again, unless it is still being answered, see
+// Message.Answering. The check and the update are one write, so two regenerations of the same question cannot both start.
+func claimQuestion(ctx context.Context, db *DB, questionID primitive.ObjectID) error {
+	collection := db.database().Collection("message")
+	now := time.Now()
+	answering := bson.M{"status": bson.M{"$in": bson.A{StatusPending, StatusStreaming}}, "status_at": bson.M{"$gt": now.Add(-AnswerLease(db.settings))}}
+	filter := bson.M{"_id": questionID, "$nor": bson.A{answering}}
+	result, err := collection.UpdateOne(ctx, filter, bson.M{"$set": bson.M{"status": StatusPending, "status_at": now}})
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return ErrAnswerInProgress
+	}
+	return nil
+}
+
+// appendVersion adds content as the selected version of answer. The versions are appended with $push rather than
+// written back whole, so a regeneration never drops a version another one added meanwhile, and the version is
+// recognized by its timestamp so that retrying the write does not add it twice.
+func appendVersion(ctx context.Context, db *DB, answer Message, content string) (*Message, error) {
+	collection := db.database().Collection("message")
+	if len(answer.Versions) == 0 {
+		// The answer shown until now becomes the first version, unless another regeneration already did it
+		first := bson.A{MessageVersion{Content: answer.Content, Timestamp: answer.Timestamp}}
+		if err := withRetry(ctx, db.settings.Mongo.WriteTimeout, func(ctx context.Context) error {
+			_, err := collection.UpdateOne(ctx, bson.M{"_id": answer.ID, "versions.0": bson.M{"$exists": false}}, bson.M{"$set": bson.M{"versions": first}})
+			return err
+		}); err != nil {
+			return nil, err
+		}
+	}
+	// MongoDB keeps milliseconds, the timestamp is compared as stored
+	version := MessageVersion{Content: content, Timestamp: time.Now().Truncate(time.Millisecond)}
+	filter := bson.M{"_id": answer.ID, "versions.timestamp": bson.M{"$ne": version.Timestamp}}
+	if err := withRetry(ctx, db.settings.Mongo.WriteTimeout, func(ctx context.Context) error {
+		_, err := collection.UpdateOne(ctx, filter, bson.M{"$push": bson.M{"versions": version}})
+		return err
+	}); err != nil {
+		return nil, err
+	}
+	var updated Message
+	if err := withRetry(ctx, db.settings.Mongo.WriteTimeout, func(ctx context.Context) error {
+		return collection.FindOne(ctx, bson.M{"_id": answer.ID}).Decode(&updated)
+	}); err != nil {
+		return nil, err
+	}
+	selected := len(updated.Versions) - 1
+	for i, v := range updated.Versions {
+		if v.Timestamp.Equal(version.Timestamp) && v.Content == content {
+			selected = i
+		}
+	}
+	if err := updated.SelectVersion(selected); err != nil {
+		return nil, err
+	}
+	update := bson.M{"$set": bson.M{
+		"content":     updated.Content,
+		"search_text": utils.NormalizeVietnamese(updated.Content),
+		"selected":    updated.Selected,
+	}}
+	if err := withRetry(ctx, db.settings.Mongo.WriteTimeout, func(ctx context.Context) error {
+		_, err := collection.UpdateOne(ctx, bson.M{"_id": answer.ID}, update)
+		return err
+	}); err != nil {
+		return nil, err
+	}
+	return &updated, nil
+}
+
+// This function changes which of the regenerated answers of a bot message is shown.
+func SelectVersion(conversationID, userID, messageID primitive.ObjectID, index int, db *DB) (*Message, error) {
+	message, err := GetMessage(conversationID, userID, messageID, db)
+	if err != nil {
+		return nil, err
+	}
+	if err := message.SelectVersion(index); err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), db.settings.Mongo.Timeout)
+	defer cancel()
+	collection := db.database().Collection("message")
+	update := bson.M{"$set": bson.M{
+		"content":     message.Content,
+		"search_text": utils.NormalizeVietnamese(message.Content),
+		"selected":    message.Selected,
+	}}
+	if _, err := collection.UpdateOne(ctx, bson.M{"_id": messageID}, update); err != nil {
+		return nil, err
+	}
+	embedInBackground(db, *message)
+	return message, nil
+}
@@ -0,0 +1,18 @@
+package model
+
+import "testing"
+
+func TestMessageVersions(t *testing.T) {
+	message := Message{Sender: "bot", Content: "first"}
+	message.AddVersion("second")
+	message.AddVersion("third")
+	if len(message.Versions) != 3 || message.Selected != 2 || message.Content != "third" {
+		t.Fatalf("after regenerating: %d versions, selected %d, content %q", len(message.Versions), message.Selected, message.Content)
+	}
+	if err := message.SelectVersion(0); err != nil || message.Content != "first" {
+		t.Fatalf("select 0: err %v, content %q", err, message.Content)
+	}
+	if err := message.SelectVersion(3); err == nil {
+		t.Fatal("selecting a missing version should fail")
+	}
+}
@@ -0,0 +1,227 @@
+// Package openapi generates the OpenAPI 3 document of the routes registered through a Router. The request and the
+// response of an operation are Go values: their schemas come from the json, form and binding tags of their fields, so
+// the document follows the code instead of being written next to it.
+package openapi
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"server/apierror"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Operation documents a route.
+type Operation struct {
+	Summary     string
+	Description string
+	// Struct whose form tags are the query parameters
+	Query interface{}
+	// Struct read from the JSON body, or from a multipart form when Multipart is set
+	Body      interface{}
+	Multipart bool
+	// Value written on success, Fields for the usual {"message": "success", ...} objects. Nil means no body.
+	Response interface{}
+	// Status of the success, 200 by default
+	Status int
+	// Content type of a response that is a file instead of JSON
+	Download string
+	// Catalog errors the route can answer with, besides the ones every route of its kind can
+	Errors []*apierror.Error
+}
+
+// Fields is the response {"message": "success"} with the fields added.
+type Fields map[string]interface{}
+
+type route struct {
+	method, path string
+	tag          string
+	user         bool
+	operation    Operation
+}
+
+// Spec collects the operations of the routes and renders them as an OpenAPI document.
+type Spec struct {
+	title, version string
+
+	mu         sync.Mutex
+	routes     []route
+	components map[string]Schema
+}
+
+func New(title, version string) *Spec {
+	return &Spec{title: title, version: version}
+}
+
+// Paths returns the method and the path of every documented route, in the gin syntax.
+func (s *Spec) Paths() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	paths := make([]string, len(s.routes))
+	for i, r := range s.routes {
+		paths[i] = r.method + " " + r.path
+	}
+	return paths
+}
+
+var pathParam = regexp.MustCompile(`[:*](\w+)`)
+
+// Document returns the OpenAPI document of the operations added so far.
+func (s *Spec) Document() map[string]interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.components = map[string]Schema{}
+	paths := map[string]Schema{}
+	for _, r := range s.routes {
+		path := pathParam.ReplaceAllString(r.path, "{$1}")
+		if paths[path] == nil {
+			paths[path] = Schema{}
+		}
+		paths[path][strings.ToLower(r.method)] = s.operation(r)
+	}
+	s.components["Error"] = Schema{
+		"type":     "object",
+		"required": []string{"code", "error"},
+		"properties": Schema{
+			"code":    Schema{"type": "string", "description": "Stable code clients branch on, see the error catalog"},
+			"error":   Schema{"type": "string", "description": "English message for people and logs"},
+			"details": Schema{"type": "object", "additionalProperties": Schema{}},
+		},
+	}
+	return map[string]interface{}{
+		"openapi": "3.0.3",
+		"info":    Schema{"title": s.title, "version": s.version},
+		"paths":   paths,
+		"components": Schema{
+			"schemas": s.components,
+			"securitySchemes": Schema{
+				"cookie": Schema{"type": "apiKey", "in": "cookie", "name": "jwt_token"},
+			},
+		},
+	}
+}
+
+// Handler serves the document as JSON. It is rendered on the first request, once every route has been added.
+func (s *Spec) Handler() gin.HandlerFunc {
+	var once sync.Once
+	var document []byte
+	var err error
+	return func(c *gin.Context) {
+		once.Do(func() {
+			document, err = json.Marshal(s.Document())
+		})
+		if err != nil {
+			c.Error(err)
+			return
+		}
+		c.Data(http.StatusOK, "application/json; charset=utf-8", document)
+	}
+}
+
+func (s *Spec) operation(r route) Schema {
+	op := r.operation
+	operation := Schema{"summary": op.Summary, "tags": []string{r.tag}}
+	if op.Description != "" {
+		operation["description"] = op.Description
+	}
+	var parameters []Schema
+	for _, match := range pathParam.FindAllStringSubmatch(r.path, -1) {
+		parameters = append(parameters, Schema{"name": match[1], "in": "path", "required": true, "schema": Schema{"type": "string"}})
+	}
+	if op.Query != nil {
+		s.walkFields(reflect.TypeOf(op.Query), "form", func(name string, field reflect.StructField) {
+			parameter := Schema{"name": name, "in": "query", "schema": s.fieldSchema(field)}
+			if isRequired(field) {
+				parameter["required"] = true
+			}
+			if field.Type.Kind() == reflect.Slice {
+				parameter["explode"] = true
+			}
+			parameters = append(parameters, parameter)
+		})
+	}
+	if len(parameters) > 0 {
+		operation["parameters"] = parameters
+	}
+	if op.Body != nil {
+		contentType, key := "application/json", "json"
+		if op.Multipart {
+			contentType, key = "multipart/form-data", "form"
+		}
+		operation["requestBody"] = Schema{
+			"required": true,
+			"content":  Schema{contentType: Schema{"schema": s.structSchema(reflect.TypeOf(op.Body), key)}},
+		}
+	}
+	if r.user {
+		operation["security"] = []Schema{{"cookie": []string{}}}
+	}
+	operation["responses"] = s.responses(r)
+	return operation
+}
+
+func (s *Spec) responses(r route) Schema {
+	op := r.operation
+	status := op.Status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	success := Schema{"description": http.StatusText(status)}
+	switch response := op.Response.(type) {
+	case nil:
+		if op.Download != "" {
+			success["content"] = Schema{op.Download: Schema{"schema": Schema{"type": "string", "format": "binary"}}}
+		}
+	case Fields:
+		properties := Schema{"message": Schema{"type": "string", "enum": []string{"success"}}}
+		for name, value := range response {
+			properties[name] = s.schemaOf(reflect.TypeOf(value))
+		}
+		success["content"] = Schema{"application/json": Schema{"schema": Schema{"type": "object", "properties": properties}}}
+	default:
+		success["content"] = Schema{"application/json": Schema{"schema": s.schemaOf(reflect.TypeOf(response))}}
+	}
+	responses := Schema{strconv.Itoa(status): success}
+
+	errs := append([]*apierror.Error{}, op.Errors...)
+	if op.Body != nil || op.Query != nil || strings.Contains(r.path, ":") {
+		errs = append(errs, apierror.InvalidRequest)
+	}
+	if r.user {
+		errs = append(errs, apierror.Unauthenticated, apierror.TokenExpired, apierror.InvalidToken, apierror.TokenRevoked)
+	}
+	errs = append(errs, apierror.Internal)
+	codes := map[int][]string{}
+	for _, e := range errs {
+		codes[e.Status] = appendUnique(codes[e.Status], e.Code)
+	}
+	for status, list := range codes {
+		sort.Strings(list)
+		responses[strconv.Itoa(status)] = Schema{
+			"description": http.StatusText(status) + ": " + strings.Join(list, ", "),
+			"content": Schema{"application/json": Schema{"schema": Schema{
+				"allOf": []Schema{
+					{"$ref": "#/components/schemas/Error"},
+					{"properties": Schema{"code": Schema{"enum": list}}},
+				},
+			}}},
+		}
+	}
+	return responses
+}
+
+func appendUnique(list []string, value string) []string {
+	for _, v := range list {
+		if v == value {
+			return list
+		}
+	}
+	return append(list, value)
+}
@@ -0,0 +1,92 @@
+package openapi
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"server/apierror"
+
+	"github.com/gin-gonic/gin"
+)
+
+type Node struct {
+	Name     string    `json:"name"`
+	Children []Node    `json:"children,omitempty"`
+	Created  time.Time `json:"created"`
+	Secret   string    `json:"-"`
+}
+
+type createRequest struct {
+	Name  string   `json:"name" binding:"required,max=50"`
+	Mode  string   `json:"mode" binding:"omitempty,oneof=1 2"`
+	Email string   `json:"email" binding:"required,email" doc:"Where to write"`
+	Tags  []string `json:"tags" binding:"max=3"`
+}
+
+type listQuery struct {
+	Tags  []string `form:"tag"`
+	Limit int      `form:"limit" binding:"min=1"`
+}
+
+func TestDocument(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	engine := gin.New()
+	spec := New("Test", "1")
+	v1 := NewRouter(engine.Group("/v1"), spec).Tag("nodes")
+	v1.GET("/nodes", Operation{Summary: "List", Query: listQuery{}, Response: Fields{"nodes": []Node{}}}, func(*gin.Context) {})
+	v1.User(func(c *gin.Context) { c.Next() }).POST("/nodes/:id", Operation{
+		Summary:  "Create",
+		Body:     createRequest{},
+		Response: Node{},
+		Errors:   []*apierror.Error{apierror.NotFound},
+	}, func(*gin.Context) {})
+	engine.GET("/openapi.json", spec.Handler())
+
+	w := httptest.NewRecorder()
+	engine.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/openapi.json", nil))
+	var document map[string]interface{}
+	if err := json.NewDecoder(w.Body).Decode(&document); err != nil {
+		t.Fatal(err)
+	}
+	get := func(path ...string) interface{} {
+		var value interface{} = document
+		for _, key := range path {
+			object, ok := value.(map[string]interface{})
+			if !ok {
+				t.Fatalf("%v is not an object at %q", value, key)
+			}
+			value = object[key]
+		}
+		return value
+	}
+	eq := func(got interface{}, want string, path ...string) {
+		t.Helper()
+		raw, _ := json.Marshal(got)
+		if string(raw) != want {
+			t.Errorf("%v is %s, want %s", path, raw, want)
+		}
+	}
+
+	create := []string{"paths", "/v1/nodes/{id}", "post"}
+	body := append(append([]string{}, create...), "requestBody", "content", "application/json", "schema")
+	eq(get(append(body, "required")...), `["name","email"]`, "required")
+	eq(get(append(body, "properties", "name", "maxLength")...), `50`, "maxLength")
+	eq(get(append(body, "properties", "mode", "enum")...), `["1","2"]`, "enum")
+	eq(get(append(body, "properties", "email")...), `{"description":"Where to write","format":"email","type":"string"}`, "email")
+	eq(get(append(body, "properties", "tags", "maxItems")...), `3`, "maxItems")
+	eq(get(append(create, "security")...), `[{"cookie":[]}]`, "security")
+	eq(get(append(create, "responses", "200", "content", "application/json", "schema")...), `{"$ref":"#/components/schemas/Node"}`, "response")
+	eq(get(append(create, "responses", "401", "description")...), `"Unauthorized: invalid_token, token_expired, token_revoked, unauthenticated"`, "401")
+	eq(get(append(create, "responses", "404", "description")...), `"Not Found: not_found"`, "404")
+
+	eq(get("components", "schemas", "Node", "properties"),
+		`{"children":{"items":{"$ref":"#/components/schemas/Node"},"type":"array"},"created":{"format":"date-time","type":"string"},"name":{"type":"string"}}`, "Node")
+	eq(get("paths", "/v1/nodes", "get", "parameters"),
+		`[{"explode":true,"in":"query","name":"tag","schema":{"items":{"type":"string"},"type":"array"}},{"in":"query","name":"limit","schema":{"minimum":1,"type":"integer"}}]`, "parameters")
+	if get("paths", "/v1/nodes", "get", "security") != nil {
+		t.Error("a public route needs the cookie")
+	}
+}
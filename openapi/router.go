@@ -0,0 +1,65 @@
+package openapi
+
+import (
+	"net/http"
+	"path"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Router registers routes on a gin group and adds their operations to a Spec.
+type Router struct {
+	group *gin.RouterGroup
+	spec  *Spec
+	tag   string
+	user  bool
+}
+
+// NewRouter documents the routes registered on group in spec.
+func NewRouter(group *gin.RouterGroup, spec *Spec) *Router {
+	return &Router{group: group, spec: spec}
+}
+
+// Tag returns a router grouping its operations under tag in the document.
+func (r *Router) Tag(tag string) *Router {
+	copied := *r
+	copied.tag = tag
+	return &copied
+}
+
+// User returns a router whose routes run requireUser first and are documented as needing the jwt_token cookie.
+func (r *Router) User(requireUser gin.HandlerFunc) *Router {
+	copied := *r
+	copied.group = r.group.Group("", requireUser)
+	copied.user = true
+	return &copied
+}
+
+// Handle registers the handlers on the relative path and documents them with op.
+func (r *Router) Handle(method, relativePath string, op Operation, handlers ...gin.HandlerFunc) {
+	r.group.Handle(method, relativePath, handlers...)
+	full := path.Join(r.group.BasePath(), relativePath)
+	r.spec.mu.Lock()
+	r.spec.routes = append(r.spec.routes, route{method: method, path: full, tag: r.tag, user: r.user, operation: op})
+	r.spec.mu.Unlock()
+}
+
+func (r *Router) GET(relativePath string, op Operation, handlers ...gin.HandlerFunc) {
+	r.Handle(http.MethodGet, relativePath, op, handlers...)
+}
+
+func (r *Router) POST(relativePath string, op Operation, handlers ...gin.HandlerFunc) {
+	r.Handle(http.MethodPost, relativePath, op, handlers...)
+}
+
+func (r *Router) PUT(relativePath string, op Operation, handlers ...gin.HandlerFunc) {
+	r.Handle(http.MethodPut, relativePath, op, handlers...)
+}
+
+func (r *Router) PATCH(relativePath string, op Operation, handlers ...gin.HandlerFunc) {
+	r.Handle(http.MethodPatch, relativePath, op, handlers...)
+}
+
+func (r *Router) DELETE(relativePath string, op Operation, handlers ...gin.HandlerFunc) {
+	r.Handle(http.MethodDelete, relativePath, op, handlers...)
+}
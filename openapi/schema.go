@@ -0,0 +1,168 @@
+package openapi
+
+import (
+	"encoding"
+	"mime/multipart"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Schema is an OpenAPI schema object, only the keywords the server needs are set.
+type Schema map[string]interface{}
+
+var (
+	timeType       = reflect.TypeOf(time.Time{})
+	fileType       = reflect.TypeOf(multipart.FileHeader{})
+	textMarshaler  = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+	emptyInterface = reflect.TypeOf((*interface{})(nil)).Elem()
+)
+
+// schemaOf returns the schema of t as encoding/json writes it. Exported struct types are added to the components and
+// referenced, the others are inlined.
+func (s *Spec) schemaOf(t reflect.Type) Schema {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	switch {
+	case t == timeType:
+		return Schema{"type": "string", "format": "date-time"}
+	case t == fileType:
+		return Schema{"type": "string", "format": "binary"}
+	case t.Implements(textMarshaler) || reflect.PointerTo(t).Implements(textMarshaler):
+		return Schema{"type": "string"}
+	case t == emptyInterface:
+		return Schema{}
+	}
+	switch t.Kind() {
+	case reflect.String:
+		return Schema{"type": "string"}
+	case reflect.Bool:
+		return Schema{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return Schema{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return Schema{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return Schema{"type": "string", "format": "byte"}
+		}
+		return Schema{"type": "array", "items": s.schemaOf(t.Elem())}
+	case reflect.Map:
+		return Schema{"type": "object", "additionalProperties": s.schemaOf(t.Elem())}
+	case reflect.Struct:
+		if t.Name() == "" || !isExported(t.Name()) {
+			return s.structSchema(t, "json")
+		}
+		name := t.Name()
+		if _, ok := s.components[name]; !ok {
+			// Registered before the fields are walked so recursive types end on the reference
+			s.components[name] = Schema{}
+			s.components[name] = s.structSchema(t, "json")
+		}
+		return Schema{"$ref": "#/components/schemas/" + name}
+	}
+	return Schema{}
+}
+
+// structSchema is the object schema of the fields of t, named by their tag key, json for bodies and form for forms.
+func (s *Spec) structSchema(t reflect.Type, key string) Schema {
+	properties := Schema{}
+	var required []string
+	s.walkFields(t, key, func(name string, field reflect.StructField) {
+		properties[name] = s.fieldSchema(field)
+		if isRequired(field) {
+			required = append(required, name)
+		}
+	})
+	schema := Schema{"type": "object", "properties": properties}
+	if len(required) > 0 {
+		schema["required"] = required
+	}
+	return schema
+}
+
+// walkFields calls fn with the name and the field of every field of t encoded under tag key, embedded structs
+// included.
+func (s *Spec) walkFields(t reflect.Type, key string, fn func(name string, field reflect.StructField)) {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		name := tagName(field, key)
+		if name == "-" {
+			continue
+		}
+		if field.Anonymous && name == "" {
+			s.walkFields(field.Type, key, fn)
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		fn(name, field)
+	}
+}
+
+// fieldSchema is the schema of the type of field, with the constraints of its binding tag.
+func (s *Spec) fieldSchema(field reflect.StructField) Schema {
+	schema := s.schemaOf(field.Type)
+	if _, ok := schema["$ref"]; ok {
+		return schema
+	}
+	if doc := field.Tag.Get("doc"); doc != "" {
+		schema["description"] = doc
+	}
+	kind := "string"
+	if t, ok := schema["type"].(string); ok {
+		kind = t
+	}
+	for _, rule := range strings.Split(field.Tag.Get("binding"), ",") {
+		name, param, _ := strings.Cut(rule, "=")
+		switch name {
+		case "email":
+			schema["format"] = "email"
+		case "oneof":
+			schema["enum"] = strings.Fields(param)
+		case "min", "max", "gte", "lte":
+			n, err := strconv.Atoi(param)
+			if err != nil {
+				continue
+			}
+			bound := map[string]string{"min": "min", "gte": "min", "max": "max", "lte": "max"}[name]
+			switch kind {
+			case "string":
+				schema[bound+"Length"] = n
+			case "array":
+				schema[bound+"Items"] = n
+			default:
+				schema[map[string]string{"min": "minimum", "max": "maximum"}[bound]] = n
+			}
+		}
+	}
+	return schema
+}
+
+func tagName(field reflect.StructField, key string) string {
+	name, _, _ := strings.Cut(field.Tag.Get(key), ",")
+	return name
+}
+
+func isRequired(field reflect.StructField) bool {
+	for _, rule := range strings.Split(field.Tag.Get("binding"), ",") {
+		if rule == "required" {
+			return true
+		}
+	}
+	return false
+}
+
+func isExported(name string) bool {
+	return name != "" && strings.ToUpper(name[:1]) == name[:1]
+}
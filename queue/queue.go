@@ -0,0 +1,436 @@
+package queue
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Job is one unit of background work. It is kept in Redis as JSON, so jobs survive a restart of the server.
+type Job struct {
+	ID         string          `json:"id"`
+	Type       string          `json:"type"`
+	UserID     string          `json:"user_id,omitempty"`
+	Payload    json.RawMessage `json:"payload"`
+	Attempt    int             `json:"attempt"`
+	EnqueuedAt time.Time       `json:"enqueued_at"`
+	LastError  string          `json:"last_error,omitempty"`
+}
+
+// Handler runs a job. A returned error retries the job later, unless it is wrapped with Permanent.
+type Handler func(ctx context.Context, job Job) error
+
+type Options struct {
+	// Jobs run at the same time by this process
+	Workers int
+	// Jobs run at the same time by every process sharing the queue, 0 for no limit
+	GlobalLimit int
+	// Jobs of one user run at the same time, 0 for no limit. The others wait in the queue
+	PerUser int
+	// Runs of a job before it goes to the dead-letter list
+	MaxAttempts int
+	// Wait before the first retry, doubled for each following one up to MaxBackoff
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+	// A job whose worker stopped renewing its lease for that long, because the process died, is run again
+	Lease time.Duration
+	// How often an idle worker looks for jobs
+	PollInterval time.Duration
+}
+
+var DefaultOptions = Options{
+	Workers:      8,
+	PerUser:      2,
+	MaxAttempts:  3,
+	Backoff:      2 * time.Second,
+	MaxBackoff:   time.Minute,
+	Lease:        2 * time.Minute,
+	PollInterval: 200 * time.Millisecond,
+}
+
+// Queue keeps jobs in Redis under queue_<name>_*: a pending list, a delayed sorted set for retries and throttled jobs,
+// a processing sorted set scored by lease expiry and a dead list for the jobs that failed every attempt.
+type Queue struct {
+	redisClient *redis.Client
+	name        string
+	prefix      string
+	options     Options
+	handlers    map[string]Handler
+	onDead      func(Job, error)
+	stop        chan struct{}
+	stopOnce    sync.Once
+	workers     sync.WaitGroup
+	// Context of the running handlers, cancelled when Shutdown stops waiting for them
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+type Stats struct {
+	Pending    int64 `json:"pending"`
+	Delayed    int64 `json:"delayed"`
+	Processing int64 `json:"processing"`
+	Dead       int64 `json:"dead"`
+}
+
+type permanentError struct {
+	err error
+}
+
+func (e permanentError) Error() string { return e.err.Error() }
+func (e permanentError) Unwrap() error { return e.err }
+
+// Permanent marks an error that retrying will not fix, such as a job about a deleted conversation.
+func Permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return permanentError{err}
+}
+
+func IsPermanent(err error) bool {
+	var permanent permanentError
+	return errors.As(err, &permanent)
+}
+
+// Moves one pending job to the processing set, with its lease expiry as score.
+var takeScript = redis.NewScript(`
+local job = redis.call('RPOP', KEYS[1])
+if job then
+	redis.call('ZADD', KEYS[2], ARGV[1], job)
+end
+return job
+`)
+
+// Moves the delayed jobs that are due and the processing jobs whose lease expired back to the pending list.
+var promoteScript = redis.NewScript(`
+local moved = 0
+for _, key in ipairs({KEYS[1], KEYS[2]}) do
+	local due = redis.call('ZRANGEBYSCORE', key, '-inf', ARGV[1], 'LIMIT', 0, 100)
+	for _, job in ipairs(due) do
+		redis.call('ZREM', key, job)
+		redis.call('LPUSH', KEYS[3], job)
+		moved = moved + 1
+	end
+end
+return moved
+`)
+
+// Counts a running job against every counter in KEYS, unless one of them already reached its limit in ARGV.
+// The counters expire so that jobs of a crashed process do not hold their slot forever.
+var acquireScript = redis.NewScript(`
+for i, key in ipairs(KEYS) do
+	local limit = tonumber(ARGV[i])
+	if limit > 0 and tonumber(redis.call('GET', key) or '0') >= limit then
+		return 0
+	end
+end
+for _, key in ipairs(KEYS) do
+	redis.call('INCR', key)
+	redis.call('PEXPIRE', key, ARGV[#KEYS + 1])
+end
+return 1
+`)
+
+var releaseScript = redis.NewScript(`
+for _, key in ipairs(KEYS) do
+	if redis.call('DECR', key) <= 0 then
+		redis.call('DEL', key)
+	end
+end
+return 0
+`)
+
+// New returns a queue named name, zero options take their value from DefaultOptions.
+func New(redisClient *redis.Client, name string, options Options) *Queue {
+	if options.Workers <= 0 {
+		options.Workers = DefaultOptions.Workers
+	}
+	if options.MaxAttempts <= 0 {
+		options.MaxAttempts = DefaultOptions.MaxAttempts
+	}
+	if options.Backoff <= 0 {
+		options.Backoff = DefaultOptions.Backoff
+	}
+	if options.MaxBackoff <= 0 {
+		options.MaxBackoff = DefaultOptions.MaxBackoff
+	}
+	if options.Lease <= 0 {
+		options.Lease = DefaultOptions.Lease
+	}
+	if options.PollInterval <= 0 {
+		options.PollInterval = DefaultOptions.PollInterval
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Queue{
+		redisClient: redisClient,
+		name:        name,
+		prefix:      "queue_" + name + "_",
+		options:     options,
+		handlers:    make(map[string]Handler),
+		stop:        make(chan struct{}),
+		ctx:         ctx,
+		cancel:      cancel,
+	}
+}
+
+func (q *Queue) key(name string) string {
+	return q.prefix + name
+}
+
+// Handle registers the handler of a job type. Handlers are registered before Start.
+func (q *Queue) Handle(jobType string, handler Handler) {
+	q.handlers[jobType] = handler
+}
+
+// OnDead is called when a job goes to the dead-letter list, with the error of its last attempt.
+func (q *Queue) OnDead(f func(Job, error)) {
+	q.onDead = f
+}
+
+// Enqueue adds a job for userID, who may be empty for jobs that belong to nobody.
+func (q *Queue) Enqueue(ctx context.Context, jobType, userID string, payload interface{}) (*Job, error) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+	job := &Job{ID: primitive.NewObjectID().Hex(), Type: jobType, UserID: userID, Payload: data, EnqueuedAt: time.Now()}
+	raw, err := json.Marshal(job)
+	if err != nil {
+		return nil, err
+	}
+	if err := q.redisClient.LPush(ctx, q.key("pending"), raw).Err(); err != nil {
+		return nil, err
+	}
+	return job, nil
+}
+
+// Start runs the workers until Shutdown.
+func (q *Queue) Start() {
+	q.workers.Add(1)
+	go q.promote()
+	for i := 0; i < q.options.Workers; i++ {
+		q.workers.Add(1)
+		go q.work()
+	}
+}
+
+// Stop makes the workers take no more jobs, the running ones go on.
+func (q *Queue) Stop() {
+	q.stopOnce.Do(func() { close(q.stop) })
+}
+
+// Shutdown stops taking jobs and waits for the running ones until ctx is done. The context of the jobs still running
+// is then cancelled, they keep their place in the processing set and are run again once their lease expires.
+func (q *Queue) Shutdown(ctx context.Context) error {
+	q.Stop()
+	done := make(chan struct{})
+	go func() {
+		q.workers.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		q.cancel()
+		return ctx.Err()
+	}
+}
+
+func (q *Queue) Stats(ctx context.Context) (Stats, error) {
+	var stats Stats
+	pipe := q.redisClient.Pipeline()
+	pending := pipe.LLen(ctx, q.key("pending"))
+	delayed := pipe.ZCard(ctx, q.key("delayed"))
+	processing := pipe.ZCard(ctx, q.key("processing"))
+	dead := pipe.LLen(ctx, q.key("dead"))
+	if _, err := pipe.Exec(ctx); err != nil {
+		return stats, err
+	}
+	stats.Pending, stats.Delayed, stats.Processing, stats.Dead = pending.Val(), delayed.Val(), processing.Val(), dead.Val()
+	return stats, nil
+}
+
+// backoff is the wait before the next run of a job that failed attempt times.
+func (q *Queue) backoff(attempt int) time.Duration {
+	delay := q.options.Backoff
+	for i := 1; i < attempt && delay < q.options.MaxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > q.options.MaxBackoff {
+		delay = q.options.MaxBackoff
+	}
+	return delay
+}
+
+// sleep waits for d and tells whether the queue is still running.
+func (q *Queue) sleep(d time.Duration) bool {
+	select {
+	case <-q.stop:
+		return false
+	case <-time.After(d):
+		return true
+	}
+}
+
+func (q *Queue) promote() {
+	defer q.workers.Done()
+	for q.sleep(q.options.PollInterval) {
+		now := strconv.FormatInt(time.Now().UnixMilli(), 10)
+		keys := []string{q.key("delayed"), q.key("processing"), q.key("pending")}
+		if err := promoteScript.Run(context.Background(), q.redisClient, keys, now).Err(); err != nil {
+			slog.Error("queue: failed to promote jobs", "queue", q.name, "error", err)
+		}
+	}
+}
+
+func (q *Queue) work() {
+	defer q.workers.Done()
+	for {
+		select {
+		case <-q.stop:
+			return
+		default:
+		}
+		lease := strconv.FormatInt(time.Now().Add(q.options.Lease).UnixMilli(), 10)
+		raw, err := takeScript.Run(context.Background(), q.redisClient, []string{q.key("pending"), q.key("processing")}, lease).Text()
+		if err != nil {
+			if err != redis.Nil {
+				slog.Error("queue: failed to take a job", "queue", q.name, "error", err)
+			}
+			if !q.sleep(q.options.PollInterval) {
+				return
+			}
+			continue
+		}
+		q.process(raw)
+	}
+}
+
+// limits returns the counters a job is counted against and their limits.
+func (q *Queue) limits(job Job) ([]string, []interface{}) {
+	var keys []string
+	var limits []interface{}
+	if q.options.GlobalLimit > 0 {
+		keys = append(keys, q.key("running"))
+		limits = append(limits, q.options.GlobalLimit)
+	}
+	if q.options.PerUser > 0 && job.UserID != "" {
+		keys = append(keys, q.key("running_"+job.UserID))
+		limits = append(limits, q.options.PerUser)
+	}
+	return keys, limits
+}
+
+func (q *Queue) process(raw string) {
+	ctx := context.Background()
+	var job Job
+	if err := json.Unmarshal([]byte(raw), &job); err != nil {
+		q.finish(raw, nil, fmt.Errorf("invalid job: %w", err))
+		return
+	}
+	keys, limits := q.limits(job)
+	if len(keys) > 0 {
+		args := append(limits, q.options.Lease.Milliseconds())
+		acquired, err := acquireScript.Run(ctx, q.redisClient, keys, args...).Int()
+		if err != nil || acquired == 0 {
+			// Over a limit: the job waits a little without losing an attempt
+			q.redisClient.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+				pipe.ZRem(ctx, q.key("processing"), raw)
+				pipe.ZAdd(ctx, q.key("delayed"), redis.Z{Score: float64(time.Now().Add(q.options.PollInterval * 5).UnixMilli()), Member: raw})
+				return nil
+			})
+			return
+		}
+		defer releaseScript.Run(ctx, q.redisClient, keys)
+	}
+
+	// Renews the lease and the counters while the job runs
+	running := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(q.options.Lease / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-running:
+				return
+			case <-ticker.C:
+				q.redisClient.ZAddXX(ctx, q.key("processing"), redis.Z{Score: float64(time.Now().Add(q.options.Lease).UnixMilli()), Member: raw})
+				for _, key := range keys {
+					q.redisClient.PExpire(ctx, key, q.options.Lease)
+				}
+			}
+		}
+	}()
+	err := q.run(q.ctx, job)
+	close(running)
+	if q.ctx.Err() != nil {
+		// Cancelled by Shutdown: the attempt does not count, the lease brings the job back
+		return
+	}
+	q.finish(raw, &job, err)
+}
+
+// run calls the handler of a job, a panic fails the job instead of the server.
+func (q *Queue) run(ctx context.Context, job Job) (err error) {
+	handler, ok := q.handlers[job.Type]
+	if !ok {
+		return Permanent(errors.New("no handler for job type " + job.Type))
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("job panicked: %v", r)
+		}
+	}()
+	return handler(ctx, job)
+}
+
+// finish removes a job from the processing set and, if it failed, schedules its retry or moves it to the dead list.
+func (q *Queue) finish(raw string, job *Job, err error) {
+	ctx := context.Background()
+	if err == nil {
+		q.redisClient.ZRem(ctx, q.key("processing"), raw)
+		return
+	}
+	dead := job == nil || IsPermanent(err)
+	next := raw
+	if job != nil {
+		job.Attempt++
+		job.LastError = err.Error()
+		dead = dead || job.Attempt >= q.options.MaxAttempts
+		if data, marshalErr := json.Marshal(job); marshalErr == nil {
+			next = string(data)
+		}
+	}
+	_, pipeErr := q.redisClient.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.ZRem(ctx, q.key("processing"), raw)
+		if dead {
+			pipe.LPush(ctx, q.key("dead"), next)
+		} else {
+			runAt := time.Now().Add(q.backoff(job.Attempt))
+			pipe.ZAdd(ctx, q.key("delayed"), redis.Z{Score: float64(runAt.UnixMilli()), Member: next})
+		}
+		return nil
+	})
+	logger := slog.With("queue", q.name)
+	if job != nil {
+		logger = logger.With("job_id", job.ID, "job_type", job.Type, "attempt", job.Attempt, "user_id", job.UserID)
+	}
+	if pipeErr != nil {
+		logger.Error("queue: failed to reschedule a job", "error", pipeErr)
+	}
+	if dead {
+		logger.Error("queue: job failed for good", "error", err)
+		if job != nil && q.onDead != nil {
+			q.onDead(*job, err)
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package queue
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestBackoff(t *testing.T) {
+	q := New(nil, "test", Options{Backoff: time.Second, MaxBackoff: 5 * time.Second})
+	for attempt, want := range map[int]time.Duration{1: time.Second, 2: 2 * time.Second, 3: 4 * time.Second, 4: 5 * time.Second, 30: 5 * time.Second} {
+		if got := q.backoff(attempt); got != want {
+			t.Errorf("backoff(%d) = %v, want %v", attempt, got, want)
+		}
+	}
+}
+
+func TestPermanent(t *testing.T) {
+	err := fmt.Errorf("answer: %w", Permanent(errors.New("question not found")))
+	if !IsPermanent(err) || IsPermanent(errors.New("timeout")) || Permanent(nil) != nil {
+		t.Fatal("permanent errors are not told apart")
+	}
+	if err.Error() != "answer: question not found" {
+		t.Fatalf("message = %q", err.Error())
+	}
+}
+
+func TestLimits(t *testing.T) {
+	q := New(nil, "generation", Options{GlobalLimit: 10, PerUser: 2})
+	keys, limits := q.limits(Job{UserID: "u1"})
+	if len(keys) != 2 || keys[0] != "queue_generation_running" || keys[1] != "queue_generation_running_u1" || limits[1] != 2 {
+		t.Fatalf("keys = %v, limits = %v", keys, limits)
+	}
+	if keys, _ := New(nil, "generation", Options{PerUser: 2}).limits(Job{}); len(keys) != 0 {
+		t.Fatalf("a job without user should not be limited per user: %v", keys)
+	}
+	if q.options.Workers != DefaultOptions.Workers || q.options.Lease != DefaultOptions.Lease {
+		t.Fatal("zero options should take the defaults")
+	}
+}
+
+func TestShutdownCancelsRunningJobs(t *testing.T) {
+	q := New(nil, "test", Options{})
+	q.Handle("wait", func(ctx context.Context, job Job) error {
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	result := make(chan error, 1)
+	q.workers.Add(1)
+	go func() {
+		defer q.workers.Done()
+		result <- q.run(q.ctx, Job{Type: "wait"})
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := q.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("Shutdown = %v, want the deadline", err)
+	}
+	select {
+	case err := <-result:
+		if err != context.Canceled {
+			t.Fatalf("the job returned %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the job was not cancelled")
+	}
+}
@@ -0,0 +1,173 @@
+package ratelimit
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"net/http"
+	"server/apierror"
+	"server/auth"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+)
+
+// KeyFunc returns the principal a request is counted against, e.g. "ip:1.2.3.4".
+type KeyFunc func(c *gin.Context) string
+
+// Rule describes one limit: at most Limit requests per Window for every principal returned by Key.
+// Name separates the counters of different route groups, so the same principal has its own budget per rule.
+type Rule struct {
+	Name   string
+	Limit  int
+	Window time.Duration
+	Key    KeyFunc
+}
+
+// Result is the state of a principal's window after a request has been counted.
+type Result struct {
+	Allowed   bool
+	Limit     int
+	Remaining int
+	Reset     time.Duration
+}
+
+type Limiter struct {
+	redisClient *redis.Client
+	prefix      string
+}
+
+// Sliding window log: every accepted request is a member of a sorted set scored by its time in ms.
+// Members older than the window are dropped before counting, so the window slides with each request.
+var slidingWindow = redis.NewScript(`
+local key = KEYS[1]
+local now = tonumber(ARGV[1])
+local window = tonumber(ARGV[2])
+local limit = tonumber(ARGV[3])
+redis.call('ZREMRANGEBYSCORE', key, 0, now - window)
+local count = redis.call('ZCARD', key)
+local allowed = 0
+if count < limit then
+	redis.call('ZADD', key, now, ARGV[4])
+	count = count + 1
+	allowed = 1
+end
+redis.call('PEXPIRE', key, window)
+local reset = window
+local oldest = redis.call('ZRANGE', key, 0, 0, 'WITHSCORES')
+if oldest[2] then
+	reset = tonumber(oldest[2]) + window - now
+end
+return {allowed, limit - count, reset}
+`)
+
+func New(redisClient *redis.Client) *Limiter {
+	return &Limiter{redisClient: redisClient, prefix: "ratelimit_"}
+}
+
+// Take counts one request for key under rule and reports whether it is allowed.
+func (l *Limiter) Take(ctx context.Context, rule Rule, key string) (Result, error) {
+	now := time.Now().UnixMilli()
+	member := fmt.Sprintf("%d-%d", now, rand.Int63())
+	values, err := slidingWindow.Run(ctx, l.redisClient, []string{l.prefix + rule.Name + ":" + key},
+		now, rule.Window.Milliseconds(), rule.Limit, member).Int64Slice()
+	if err != nil {
+		return Result{}, err
+	}
+	if len(values) != 3 {
+		return Result{}, fmt.Errorf("unexpected rate limit reply: %v", values)
+	}
+	remaining := int(values[1])
+	if remaining < 0 {
+		remaining = 0
+	}
+	return Result{
+		Allowed:   values[0] == 1,
+		Limit:     rule.Limit,
+		Remaining: remaining,
+		Reset:     time.Duration(values[2]) * time.Millisecond,
+	}, nil
+}
+
+// Limit returns a middleware enforcing rule. It sets the RateLimit-* headers on every response
+// and Retry-After when the request is rejected. If Redis is unreachable the request is let through.
+func (l *Limiter) Limit(rule Rule) gin.HandlerFunc {
+	if rule.Key == nil {
+		rule.Key = ByIP
+	}
+	return func(c *gin.Context) {
+		ctx, cancel := context.WithTimeout(c.Request.Context(), 2*time.Second)
+		defer cancel()
+		result, err := l.Take(ctx, rule, rule.Key(c))
+		if err != nil {
+			slog.WarnContext(c.Request.Context(), "rate limit unavailable, letting the request through", "rule", rule.Name, "error", err)
+			c.Next()
+			return
+		}
+		SetHeaders(c.Writer.Header(), rule, result)
+		if !result.Allowed {
+			retryAfter := seconds(result.Reset)
+			c.Header("Retry-After", strconv.Itoa(retryAfter))
+			c.AbortWithStatusJSON(http.StatusTooManyRequests, apierror.RateLimited.WithDetail("rule", rule.Name).WithDetail("retry_after", retryAfter))
+			return
+		}
+		c.Next()
+	}
+}
+
+// SetHeaders writes the RateLimit-* headers from the IETF draft "RateLimit header fields for HTTP".
+func SetHeaders(h http.Header, rule Rule, result Result) {
+	h.Set("RateLimit-Limit", strconv.Itoa(result.Limit))
+	h.Set("RateLimit-Remaining", strconv.Itoa(result.Remaining))
+	h.Set("RateLimit-Reset", strconv.Itoa(seconds(result.Reset)))
+	h.Set("RateLimit-Policy", fmt.Sprintf("%d;w=%d", rule.Limit, seconds(rule.Window)))
+}
+
+// seconds rounds d up so clients never retry before the window has actually moved.
+func seconds(d time.Duration) int {
+	s := int((d + time.Second - 1) / time.Second)
+	if s < 1 {
+		return 1
+	}
+	return s
+}
+
+// ByIP keys on the client IP, which comes from X-Forwarded-For only when the request went through a trusted proxy.
+func ByIP(c *gin.Context) string {
+	return "ip:" + c.ClientIP()
+}
+
+// ByUser keys on the user of a jwt_token cookie tokens verify and falls back to the IP for anonymous requests.
+func ByUser(tokens *auth.Tokens) KeyFunc {
+	return func(c *gin.Context) string {
+		if cookie, err := c.Request.Cookie("jwt_token"); err == nil {
+			if claims, err := tokens.VerifyJWT(cookie.Value); err == nil && claims.UserID != "" {
+				return "user:" + claims.UserID
+			}
+		}
+		return ByIP(c)
+	}
+}
+
+// ByAPIKey keys on the X-API-Key header when it is one of keys and falls back to ByUser otherwise, so that a client
+// cannot get a fresh budget by sending a new key. Keys are hashed, they never end up in Redis.
+func ByAPIKey(keys []string, tokens *auth.Tokens) KeyFunc {
+	byUser := ByUser(tokens)
+	known := make(map[[sha256.Size]byte]bool, len(keys))
+	for _, key := range keys {
+		known[sha256.Sum256([]byte(key))] = true
+	}
+	return func(c *gin.Context) string {
+		if key := c.GetHeader("X-API-Key"); key != "" {
+			if sum := sha256.Sum256([]byte(key)); known[sum] {
+				return "key:" + hex.EncodeToString(sum[:8])
+			}
+		}
+		return byUser(c)
+	}
+}
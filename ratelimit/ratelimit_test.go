@@ -0,0 +1,64 @@
+package ratelimit
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"server/auth"
+	"server/config"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func newContext(header http.Header) *gin.Context {
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest(http.MethodGet, "/", nil)
+	c.Request.RemoteAddr = "10.0.0.1:1234"
+	for k, v := range header {
+		c.Request.Header[k] = v
+	}
+	return c
+}
+
+func TestKeyFuncs(t *testing.T) {
+	tokens := auth.NewTokens(config.Auth{JWTSecret: "test secret", TokenTTL: time.Minute})
+	c := newContext(nil)
+	if got := ByIP(c); got != "ip:10.0.0.1" {
+		t.Fatalf("ByIP = %q", got)
+	}
+	if got := ByUser(tokens)(c); got != "ip:10.0.0.1" {
+		t.Fatalf("ByUser without cookie = %q, want IP fallback", got)
+	}
+	c = newContext(http.Header{"Cookie": {"jwt_token=garbage"}})
+	if got := ByUser(tokens)(c); got != "ip:10.0.0.1" {
+		t.Fatalf("ByUser with invalid token = %q, want IP fallback", got)
+	}
+	c = newContext(http.Header{"X-Api-Key": {"secret-key"}})
+	got := ByAPIKey([]string{"secret-key"}, tokens)(c)
+	if !strings.HasPrefix(got, "key:") || strings.Contains(got, "secret-key") {
+		t.Fatalf("ByAPIKey = %q, want hashed key", got)
+	}
+	c = newContext(http.Header{"X-Api-Key": {"made-up-key"}})
+	if got := ByAPIKey([]string{"secret-key"}, tokens)(c); got != "ip:10.0.0.1" {
+		t.Fatalf("ByAPIKey with an unknown key = %q, want IP fallback", got)
+	}
+}
+
+func TestSetHeaders(t *testing.T) {
+	h := http.Header{}
+	rule := Rule{Name: "test", Limit: 10, Window: time.Minute}
+	SetHeaders(h, rule, Result{Limit: 10, Remaining: 3, Reset: 1500 * time.Millisecond})
+	want := map[string]string{
+		"RateLimit-Limit":     "10",
+		"RateLimit-Remaining": "3",
+		"RateLimit-Reset":     "2",
+		"RateLimit-Policy":    "10;w=60",
+	}
+	for k, v := range want {
+		if h.Get(k) != v {
+			t.Errorf("%s = %q, want %q", k, h.Get(k), v)
+		}
+	}
+}
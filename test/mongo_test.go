@@ -0,0 +1,269 @@
+package test
+
+import (
+	"context"
+	"os"
+	"server/app"
+	"server/config"
+	"server/model"
+	"server/model/modeltest"
+	"server/utils"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// conversationStore is what the tests of this file use of the conversation stores.
+type conversationStore interface {
+	app.ConversationStore
+	app.MessageStore
+	app.FolderStore
+	app.TransferStore
+}
+
+// mongoDB connects to the MongoDB of DB_URL, a server the tests may write to, and returns nil when it is not set.
+// The tests write to the chatbot-test database.
+func mongoDB(t *testing.T) *model.DB {
+	url := os.Getenv("DB_URL")
+	if url == "" {
+		return nil
+	}
+	cfg := config.Default()
+	cfg.Mongo.URL, cfg.Mongo.Database = url, "chatbot-test"
+	client := utils.ConnectDB(cfg.Mongo)
+	t.Cleanup(func() { client.Disconnect(context.Background()) })
+	db := model.NewDB(client, cfg)
+	if err := model.EnsureIndexes(db); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+// conversationStores returns the stores the conversation tests run against: always the memory one,
+// and the MongoDB one when DB_URL is set, see mongoDB.
+func conversationStores(t *testing.T) map[string]conversationStore {
+	stores := map[string]conversationStore{"memory": modeltest.NewConversations(config.Default())}
+	if db := mongoDB(t); db != nil {
+		stores["mongo"] = model.NewMongoConversations(db)
+	}
+	return stores
+}
+
+func contents(page *model.MessagePage) []string {
+	var result []string
+	for _, m := range page.Messages {
+		result = append(result, m.Content)
+	}
+	return result
+}
+
+func TestCheckOwner(t *testing.T) {
+	for name, store := range conversationStores(t) {
+		t.Run(name, func(t *testing.T) {
+			owner, other := primitive.NewObjectID(), primitive.NewObjectID()
+			results, err := store.Import(owner, "jsonl", []byte(`{"role":"user","content":"Xin chào"}`+"\n"+`{"role":"assistant","content":"Chào bạn"}`))
+			if err != nil || len(results) != 1 || results[0].Error != "" {
+				t.Fatalf("import failed: %v %+v", err, results)
+			}
+			id := results[0].ConversationID
+
+			if err := store.CheckOwner(id, owner); err != nil {
+				t.Errorf("the owner was refused: %v", err)
+			}
+			if err := store.CheckOwner(id, other); err == nil {
+				t.Error("another user was let in")
+			}
+			if err := store.Delete(id, owner); err != nil {
+				t.Fatal(err)
+			}
+			if err := store.CheckOwner(id, owner); err == nil {
+				t.Error("a conversation in the trash was let in")
+			}
+		})
+	}
+}
+
+func TestMessagePages(t *testing.T) {
+	for name, store := range conversationStores(t) {
+		t.Run(name, func(t *testing.T) {
+			userID := primitive.NewObjectID()
+			var jsonl string
+			for i, content := range []string{"q1", "a1", "q2", "a2", "q3"} {
+				role := "user"
+				if i%2 == 1 {
+					role = "assistant"
+				}
+				jsonl += `{"role":"` + role + `","content":"` + content + `"}` + "\n"
+			}
+			results, err := store.Import(userID, "jsonl", []byte(jsonl))
+			if err != nil || len(results) != 1 || results[0].Error != "" {
+				t.Fatalf("import failed: %v %+v", err, results)
+			}
+			id := results[0].ConversationID
+
+			var pages [][]string
+			cursor := primitive.NilObjectID
+			for {
+				page, err := store.Messages(id, userID, primitive.NilObjectID, cursor, 2)
+				if err != nil {
+					t.Fatal(err)
+				}
+				pages = append(pages, contents(page))
+				if page.NextCursor == "" {
+					break
+				}
+				if cursor, err = primitive.ObjectIDFromHex(page.NextCursor); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if len(pages) != 3 || pages[0][0] != "a2" || pages[1][0] != "a1" || len(pages[2]) != 1 || pages[2][0] != "q1" {
+				t.Fatalf("paging backwards gave %v", pages)
+			}
+
+			first, err := store.Messages(id, userID, primitive.NilObjectID, primitive.NilObjectID, 5)
+			if err != nil || len(first.Messages) != 5 {
+				t.Fatalf("whole conversation: %v %v", first, err)
+			}
+			after, err := store.Messages(id, userID, first.Messages[0].ID, primitive.NilObjectID, 2)
+			if err != nil || len(after.Messages) != 2 || after.Messages[0].Content != "a1" || !after.HasNewer {
+				t.Fatalf("paging forwards gave %v, has newer %v: %v", contents(after), after.HasNewer, err)
+			}
+			if _, err := store.Messages(id, userID, primitive.NewObjectID(), primitive.NilObjectID, 2); err != model.ErrMessageNotFound {
+				t.Errorf("paging after an unknown message gave %v", err)
+			}
+		})
+	}
+}
+
+func TestRetriedNewConversation(t *testing.T) {
+	for name, store := range conversationStores(t) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			cid := primitive.NewObjectID().Hex()
+			ada, bob := primitive.NewObjectID(), primitive.NewObjectID()
+			first, err := store.AskNew(ctx, ada, "hello", "", cid)
+			if err != nil {
+				t.Fatal(err)
+			}
+			again, err := store.AskNew(ctx, ada, "hello", "", cid)
+			if err != nil || again != first {
+				t.Fatalf("retrying should return conversation %s, got %s: %v", first.Hex(), again.Hex(), err)
+			}
+			other, err := store.AskNew(ctx, bob, "hello", "", cid)
+			if err != nil || other == first {
+				t.Fatalf("the same cid from another user should start its own conversation, got %s: %v", other.Hex(), err)
+			}
+		})
+	}
+}
+
+func TestMigrateMessagesTwice(t *testing.T) {
+	db := mongoDB(t)
+	if db == nil {
+		t.Skip("DB_URL is not set")
+	}
+	ctx := context.Background()
+	conversations := db.Collection("conversation")
+	messages := db.Collection("message")
+	id := primitive.NewObjectID()
+	legacy := bson.A{
+		bson.M{"sender": "user", "content": "Xin chào", "timestamp": time.Now()},
+		bson.M{"sender": "bot", "content": "Chào bạn", "timestamp": time.Now()},
+	}
+	if _, err := conversations.InsertOne(ctx, bson.M{"_id": id, "user_id": primitive.NewObjectID(), "messages": legacy}); err != nil {
+		t.Fatal(err)
+	}
+	for run := 0; run < 2; run++ {
+		if _, err := model.MigrateMessages(db); err != nil {
+			t.Fatal(err)
+		}
+		// The array is back as if the first run stopped before removing it
+		if _, err := conversations.UpdateOne(ctx, bson.M{"_id": id}, bson.M{"$set": bson.M{"messages": legacy}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if count, err := messages.CountDocuments(ctx, bson.M{"conversation_id": id}); err != nil || count != 2 {
+		t.Fatalf("migrating twice left %d messages: %v", count, err)
+	}
+}
+
+// TestConversationFilters runs the same filters through the MongoDB query of model.ConversationFilter and its
+// Matches, which the memory store uses.
+func TestConversationFilters(t *testing.T) {
+	for name, store := range conversationStores(t) {
+		t.Run(name, func(t *testing.T) {
+			userID := primitive.NewObjectID()
+			ids := make(map[string]primitive.ObjectID)
+			for _, topic := range []string{"plain", "pinned", "archived", "filed", "other user's"} {
+				owner := userID
+				if topic == "other user's" {
+					owner = primitive.NewObjectID()
+				}
+				results, err := store.Import(owner, "jsonl", []byte(`{"role":"user","content":"`+topic+`"}`))
+				if err != nil || len(results) != 1 || results[0].Error != "" {
+					t.Fatalf("import failed: %v %+v", err, results)
+				}
+				ids[topic] = results[0].ConversationID
+			}
+			yes, two := true, "2"
+			if _, err := store.Update(ids["pinned"], userID, model.ConversationUpdate{Pinned: &yes, Mode: &two}); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := store.Update(ids["archived"], userID, model.ConversationUpdate{Archived: &yes}); err != nil {
+				t.Fatal(err)
+			}
+			folder, err := store.CreateFolder(userID, "Work")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := store.Move(ids["filed"], userID, folder.ID); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := store.SetTags(ids["filed"], userID, []string{"project"}); err != nil {
+				t.Fatal(err)
+			}
+
+			no := false
+			for _, tc := range []struct {
+				name   string
+				filter model.ConversationFilter
+				want   []string
+			}{
+				{"none", model.ConversationFilter{}, []string{"plain", "pinned", "filed"}},
+				{"mode", model.ConversationFilter{Mode: "2"}, []string{"pinned"}},
+				{"pinned", model.ConversationFilter{Pinned: &yes}, []string{"pinned"}},
+				{"not pinned", model.ConversationFilter{Pinned: &no}, []string{"plain", "filed"}},
+				{"archived", model.ConversationFilter{Archived: &yes}, []string{"archived"}},
+				{"folder", model.ConversationFilter{FolderID: folder.ID}, []string{"filed"}},
+				{"unfiled", model.ConversationFilter{Unfiled: true}, []string{"plain", "pinned"}},
+				{"tag", model.ConversationFilter{Tags: []string{" Project "}}, []string{"filed"}},
+				{"missing tag", model.ConversationFilter{Tags: []string{"project", "home"}}, nil},
+				{"from", model.ConversationFilter{From: time.Now().Add(time.Hour)}, nil},
+				{"to", model.ConversationFilter{To: time.Now().Add(-time.Hour)}, nil},
+			} {
+				page, err := store.List(userID, tc.filter, "", 50)
+				if err != nil {
+					t.Fatal(err)
+				}
+				var got []string
+				for _, c := range page.Conversations {
+					for topic, id := range ids {
+						if c.ID == id {
+							got = append(got, topic)
+						}
+					}
+				}
+				sort.Strings(got)
+				want := append([]string(nil), tc.want...)
+				sort.Strings(want)
+				if strings.Join(got, ", ") != strings.Join(want, ", ") || page.Total != int64(len(want)) {
+					t.Errorf("filter %s listed %q (total %d), want %q", tc.name, got, page.Total, want)
+				}
+			}
+		})
+	}
+}
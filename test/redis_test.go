@@ -1,38 +1,58 @@
 package test
 
 import (
-	"context"
-	"fmt"
+	"os"
+	"server/app"
+	"server/config"
+	"server/model"
+	"server/model/modeltest"
+	"server/utils"
 	"testing"
-
-	"github.com/redis/go-redis/v9"
+	"time"
 )
 
-func TestRedis(t *testing.T) {
-	rdb := redis.NewClient(&redis.Options{
-		Addr:     "redis-12878.c1.ap-southeast-1-1.ec2.redns.redis-cloud.com:12878", // Redis server address
-		Password: "qKl6znBvULaveJhkjIjMr7RCwluJjjbH",                                // No password set
-		DB:       0,                                                                 // Use default DB
-	})
-	ctx := context.Background()
-	pong, err := rdb.Ping(ctx).Result()
-	if err != nil {
-		fmt.Println("Error connecting to Redis:", err)
-		return
-	}
-	fmt.Println("Connected to Redis:", pong)
-	err = rdb.Set(ctx, "mykey", "Hello Redis", 0).Err()
-	if err != nil {
-		fmt.Println("Error setting key:", err)
-		return
+// sessionStores returns the stores the session tests run against: always the memory one,
+// and the Redis one when REDIS_HOST points to a server the tests may write to.
+func sessionStores(t *testing.T) map[string]app.SessionStore {
+	stores := map[string]app.SessionStore{"memory": modeltest.NewSessions("test key")}
+	if addr := os.Getenv("REDIS_HOST"); addr != "" {
+		redisClient := utils.ConnectRedis(config.Redis{Addr: addr, Password: os.Getenv("REDIS_PASS")})
+		t.Cleanup(func() { redisClient.Close() })
+		stores["redis"] = model.NewRedisSessions(redisClient, "test key")
 	}
-	fmt.Println("Key set successfully")
+	return stores
+}
+
+func TestRedis(t *testing.T) {
+	for name, sessions := range sessionStores(t) {
+		t.Run(name, func(t *testing.T) {
+			email := "otp-" + time.Now().Format("150405.000000") + "@example.com"
+			if err := sessions.SaveOTP(email, "123456", time.Minute); err != nil {
+				t.Fatal(err)
+			}
+			if err := sessions.VerifyOTP(email, "654321"); err == nil || err.Error() != "otp is incorrect" {
+				t.Errorf("a wrong code gave %v", err)
+			}
+			if err := sessions.VerifyOTP(email, "123456"); err != nil {
+				t.Errorf("the right code gave %v", err)
+			}
+			if err := sessions.VerifyOTP(email, "123456"); err == nil || err.Error() != "otp has been expired" {
+				t.Errorf("a used code gave %v", err)
+			}
 
-	// GET operation
-	val, err := rdb.Get(ctx, "mykey").Result()
-	if err != nil {
-		fmt.Println("Error getting key:", err)
-		return
+			token, err := sessions.IssueRegisterToken(email)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if sessions.ConsumeRegisterToken(email, "forged") {
+				t.Error("a forged token was accepted")
+			}
+			if !sessions.ConsumeRegisterToken(email, token) {
+				t.Error("the issued token was refused")
+			}
+			if sessions.ConsumeRegisterToken(email, token) {
+				t.Error("the token was accepted twice")
+			}
+		})
 	}
-	fmt.Println("Value of 'mykey':", val)
 }
@@ -0,0 +1,86 @@
+// Package tracing sends OpenTelemetry traces of the server to an OTLP collector. Gin requests, MongoDB and Redis are
+// traced by their OpenTelemetry instrumentations, the packages calling the model API and Gemini start their own spans
+// with Start. Without an endpoint the spans are dropped, but the trace context of the callers is still passed on.
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"server/config"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// ServiceName names the server in the traces.
+const ServiceName = "chatbot-server"
+
+func init() {
+	// The model API and the callers of the server send and receive the W3C traceparent header
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+}
+
+// Setup exports the spans to cfg.Endpoint. The returned function flushes the spans not sent yet, it is called on shutdown.
+func Setup(cfg config.Tracing) (func(context.Context) error, error) {
+	if cfg.Endpoint == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+	exporter, err := otlptracehttp.New(context.Background(), otlptracehttp.WithEndpointURL(cfg.Endpoint))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create the trace exporter: %w", err)
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(semconv.ServiceName(ServiceName))),
+		// A trace started by a caller is kept when the caller keeps it
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(float64(cfg.SamplePercent)/100))),
+	)
+	otel.SetTracerProvider(provider)
+	return provider.Shutdown, nil
+}
+
+// Start starts a span of the server as a child of the span in ctx.
+func Start(ctx context.Context, name string, opts ...trace.SpanStartOption) (context.Context, trace.Span) {
+	return otel.Tracer(ServiceName).Start(ctx, name, opts...)
+}
+
+// Fail marks span as failed because of err.
+func Fail(span trace.Span, err error) {
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+}
+
+// Carrier holds the trace context of a span across a queue or a goroutine, it is stored as JSON with the job.
+type Carrier map[string]string
+
+// Inject returns the trace context of the span in ctx.
+func Inject(ctx context.Context) Carrier {
+	carrier := propagation.MapCarrier{}
+	otel.GetTextMapPropagator().Inject(ctx, carrier)
+	return Carrier(carrier)
+}
+
+// StartLinked starts a span for work done in the background on behalf of the span carried by from. The work outlives
+// the request that asked for it, so the span starts a trace of its own and links to the request instead of being its child.
+func StartLinked(ctx context.Context, from Carrier, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	opts := []trace.SpanStartOption{trace.WithNewRoot(), trace.WithAttributes(attrs...)}
+	origin := trace.SpanContextFromContext(otel.GetTextMapPropagator().Extract(context.Background(), propagation.MapCarrier(from)))
+	if origin.IsValid() {
+		opts = append(opts, trace.WithLinks(trace.Link{SpanContext: origin}))
+	}
+	return Start(ctx, name, opts...)
+}
+
+// InjectHeaders adds the trace context of the span in ctx to the headers of an outgoing request.
+func InjectHeaders(ctx context.Context, header http.Header) {
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(header))
+}
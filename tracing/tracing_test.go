@@ -0,0 +1,47 @@
+package tracing
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+func TestStartLinked(t *testing.T) {
+	spans := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(spans))
+	otel.SetTracerProvider(provider)
+	defer otel.SetTracerProvider(noop.NewTracerProvider())
+
+	ctx, request := Start(context.Background(), "request")
+	// The carrier goes through the queue as JSON
+	raw, err := json.Marshal(Inject(ctx))
+	if err != nil {
+		t.Fatal(err)
+	}
+	request.End()
+	var carrier Carrier
+	if err := json.Unmarshal(raw, &carrier); err != nil {
+		t.Fatal(err)
+	}
+
+	_, answer := StartLinked(context.Background(), carrier, "answer")
+	answer.End()
+	ended := spans.Ended()[1]
+	if ended.Parent().IsValid() || ended.SpanContext().TraceID() == request.SpanContext().TraceID() {
+		t.Error("the background span should start its own trace")
+	}
+	if links := ended.Links(); len(links) != 1 || links[0].SpanContext.SpanID() != request.SpanContext().SpanID() {
+		t.Errorf("the background span should link to the request, got %v", links)
+	}
+
+	_, orphan := StartLinked(context.Background(), nil, "answer")
+	orphan.End()
+	if links := spans.Ended()[2].Links(); len(links) != 0 {
+		t.Errorf("a job without trace context should have no link, got %v", links)
+	}
+}
@@ -2,15 +2,19 @@ package utils
 
 import (
 	"context"
-	"os"
+	"server/config"
+	"server/metrics"
 
+	"go.opentelemetry.io/contrib/instrumentation/go.mongodb.org/mongo-driver/mongo/otelmongo"
+	"go.mongodb.org/mongo-driver/event"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
-func ConnectDB() *mongo.Client {
+func ConnectDB(cfg config.Mongo) *mongo.Client {
 	serverAPI := options.ServerAPI(options.ServerAPIVersion1)
-	opts := options.Client().ApplyURI(os.Getenv("DB_URL")).SetServerAPIOptions(serverAPI)
+	monitor := bothMonitors(otelmongo.NewMonitor(), metrics.MongoMonitor())
+	opts := options.Client().ApplyURI(cfg.URL).SetServerAPIOptions(serverAPI).SetMonitor(monitor)
 	// Create a new client and connect to the server
 	client, err := mongo.Connect(context.TODO(), opts)
 	if err != nil {
@@ -18,3 +22,20 @@ func ConnectDB() *mongo.Client {
 	}
 	return client
 }
+
+// bothMonitors passes the events to tracing then to metrics, a client only takes one monitor.
+func bothMonitors(tracing, metrics *event.CommandMonitor) *event.CommandMonitor {
+	return &event.CommandMonitor{
+		Started: func(ctx context.Context, e *event.CommandStartedEvent) {
+			tracing.Started(ctx, e)
+		},
+		Succeeded: func(ctx context.Context, e *event.CommandSucceededEvent) {
+			tracing.Succeeded(ctx, e)
+			metrics.Succeeded(ctx, e)
+		},
+		Failed: func(ctx context.Context, e *event.CommandFailedEvent) {
+			tracing.Failed(ctx, e)
+			metrics.Failed(ctx, e)
+		},
+	}
+}
@@ -2,22 +2,27 @@ package utils
 
 import (
 	"context"
-	"fmt"
-	"os"
+	"log/slog"
+	"server/config"
+	"server/metrics"
 
+	"github.com/redis/go-redis/extra/redisotel/v9"
 	"github.com/redis/go-redis/v9"
 )
 
-func ConnectRedis() *redis.Client {
+func ConnectRedis(cfg config.Redis) *redis.Client {
 	client := redis.NewClient(&redis.Options{
-		Addr:     os.Getenv("REDIS_HOST"), // Address of your Redis server
-		Password: os.Getenv("REDIS_PASS"),                                   // If your Redis server requires a password
-		DB:       0,                                                                    // Select the database (default is 0)
+		Addr:     cfg.Addr,
+		Password: cfg.Password,
+		DB:       cfg.DB,
 	})
-	pong, err := client.Ping(context.TODO()).Result()
-	if err != nil {
+	if err := redisotel.InstrumentTracing(client); err != nil {
 		panic(err)
 	}
-	fmt.Println(pong," redis") // Output: PONG
+	client.AddHook(metrics.RedisHook{})
+	if err := client.Ping(context.TODO()).Err(); err != nil {
+		panic(err)
+	}
+	slog.Info("connected to Redis", "addr", cfg.Addr)
 	return client
 }
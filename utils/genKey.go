@@ -3,16 +3,19 @@ package utils
 import (
 	"context"
 	"crypto/sha256"
-	"os"
 	"time"
 	"github.com/redis/go-redis/v9"
 	"encoding/hex"
 )
 
-func GenerateToken(email string, redisClient *redis.Client) string {
+// RegisterToken is the token proving email was verified, salted with key.
+func RegisterToken(email, key string) string {
 	hash := sha256.New()
-	hash.Write([]byte(email + os.Getenv("KEY_FOR_REGISTER")))
-	hashString := hex.EncodeToString(hash.Sum(nil))
+	hash.Write([]byte(email + key))
+	return hex.EncodeToString(hash.Sum(nil))
+}
+func GenerateToken(email, key string, redisClient *redis.Client) string {
+	hashString := RegisterToken(email, key)
 	redisClient.Set(context.TODO(), "token_"+email, hashString, 15*time.Minute)
 	return hashString
 }
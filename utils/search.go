@@ -0,0 +1,115 @@
+package utils
+
+import (
+	"html"
+	"strings"
+	"unicode"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// foldRune lowercases r and strips its tone and vowel marks, so "Ệ" and "e" compare equal.
+// Each rune maps to exactly one rune, which keeps positions in the folded text aligned with the original.
+func foldRune(r rune) rune {
+	if r == 'đ' || r == 'Đ' {
+		return 'd'
+	}
+	if r < unicode.MaxASCII {
+		return unicode.ToLower(r)
+	}
+	decomposed := []rune(norm.NFD.String(string(r)))
+	return unicode.ToLower(decomposed[0])
+}
+
+func foldRunes(s string) ([]rune, []rune) {
+	original := []rune(norm.NFC.String(s))
+	folded := make([]rune, len(original))
+	for i, r := range original {
+		folded[i] = foldRune(r)
+	}
+	return original, folded
+}
+
+// NormalizeVietnamese returns s lowercased and without diacritics, most users search Vietnamese text without typing the marks.
+func NormalizeVietnamese(s string) string {
+	_, folded := foldRunes(s)
+	return CleanString(string(folded))
+}
+
+// SearchTerms splits a query into normalized words, dropping duplicates.
+func SearchTerms(query string) []string {
+	var terms []string
+	seen := make(map[string]bool)
+	for _, term := range strings.FieldsFunc(NormalizeVietnamese(query), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	}) {
+		if !seen[term] {
+			seen[term] = true
+			terms = append(terms, term)
+		}
+	}
+	return terms
+}
+
+func isBoundary(runes []rune, i int) bool {
+	return i < 0 || i >= len(runes) || !(unicode.IsLetter(runes[i]) || unicode.IsNumber(runes[i]))
+}
+
+// Highlight returns an HTML-escaped excerpt of about width characters of s around the first match of terms,
+// with every match wrapped in <mark></mark>. It returns an empty string when nothing matches.
+func Highlight(s string, terms []string, width int) string {
+	original, folded := foldRunes(s)
+	marked := make([]bool, len(original))
+	first := -1
+	for _, term := range terms {
+		t := []rune(term)
+		if len(t) == 0 {
+			continue
+		}
+		for i := 0; i+len(t) <= len(folded); i++ {
+			if string(folded[i:i+len(t)]) != term || !isBoundary(folded, i-1) || !isBoundary(folded, i+len(t)) {
+				continue
+			}
+			for k := i; k < i+len(t); k++ {
+				marked[k] = true
+			}
+			if first < 0 || i < first {
+				first = i
+			}
+		}
+	}
+	if first < 0 {
+		return ""
+	}
+	start := first - width/4
+	if start < 0 {
+		start = 0
+	}
+	end := start + width
+	if end > len(original) {
+		end = len(original)
+	}
+	var b strings.Builder
+	if start > 0 {
+		b.WriteString("…")
+	}
+	inMark := false
+	for i := start; i < end; i++ {
+		if marked[i] != inMark {
+			if marked[i] {
+				b.WriteString("<mark>")
+			} else {
+				b.WriteString("</mark>")
+			}
+			inMark = marked[i]
+		}
+		b.WriteString(html.EscapeString(string(original[i])))
+	}
+	if inMark {
+		b.WriteString("</mark>")
+	}
+	if end < len(original) {
+		b.WriteString("…")
+	}
+	return b.String()
+}
@@ -0,0 +1,34 @@
+package utils
+
+import "testing"
+
+func TestNormalizeVietnamese(t *testing.T) {
+	cases := map[string]string{
+		"Nước bọt giúp tiêu hóa như thế nào?": "nuoc bot giup tieu hoa nhu the nao?",
+		"  ĐẠI   Học  ":                       "dai hoc",
+		"plain ASCII":                         "plain ascii",
+	}
+	for input, want := range cases {
+		if got := NormalizeVietnamese(input); got != want {
+			t.Errorf("NormalizeVietnamese(%q) = %q, want %q", input, got, want)
+		}
+	}
+}
+
+func TestHighlight(t *testing.T) {
+	terms := SearchTerms("tieu HÓA")
+	if len(terms) != 2 {
+		t.Fatalf("SearchTerms = %v", terms)
+	}
+	got := Highlight("Nước bọt giúp <b>tiêu hóa</b>", terms, 100)
+	want := "Nước bọt giúp &lt;b&gt;<mark>tiêu</mark> <mark>hóa</mark>&lt;/b&gt;"
+	if got != want {
+		t.Errorf("Highlight = %q, want %q", got, want)
+	}
+	if got := Highlight("khoa học", terms, 100); got != "" {
+		t.Errorf("Highlight without match = %q", got)
+	}
+	if got := Highlight("aaaaaaaaaa hoa bbbbbbbbbb", terms, 8); got != "…a <mark>hoa</mark> bb…" {
+		t.Errorf("Highlight excerpt = %q", got)
+	}
+}
@@ -3,7 +3,7 @@ package utils
 import (
 	"fmt"
 	"math/rand"
-	"os"
+	"server/config"
 
 	"gopkg.in/gomail.v2"
 )
@@ -11,9 +11,9 @@ import (
 func GenerateOTP() string {
 	return fmt.Sprintf("%06d", rand.Intn(1000000))
 }
-func SendMail(to, otp string) error {
+func SendMail(cfg config.Mail, to, otp string) error {
 	m := gomail.NewMessage()
-	from := os.Getenv("APP_EMAIL")
+	from := cfg.From
 	subject := "OTP code"
 	m.SetHeader("From", from)
 	m.SetHeader("To", to)
@@ -32,9 +32,18 @@ func SendMail(to, otp string) error {
 	
 	m.SetBody("text/html", body)
 	
-	d := gomail.NewDialer("smtp.gmail.com", 587, from, os.Getenv("APP_PASS"))
+	d := gomail.NewDialer(cfg.Host, cfg.Port, from, cfg.Password)
 	if err := d.DialAndSend(m); err != nil {
 		return err
 	}
 	return nil
 }
+
+// SMTPMailer sends the OTP emails through the SMTP account of cfg.
+type SMTPMailer struct {
+	Config config.Mail
+}
+
+func (m SMTPMailer) SendOTP(to, otp string) error {
+	return SendMail(m.Config, to, otp)
+}
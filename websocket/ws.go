@@ -1,18 +1,17 @@
 package websocket
 
 import (
-	"context"
-	"log"
+	"log/slog"
 	"net/http"
+	"server/apierror"
 	"server/auth"
+	"server/logging"
 	"sync"
 	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/gorilla/websocket"
-	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
-	"go.mongodb.org/mongo-driver/mongo"
 )
 
 var upgrader = websocket.Upgrader{
@@ -31,73 +30,71 @@ type Client struct {
 var Clients = make(map[string]*Client)
 var clientsMutex sync.Mutex
 
+// Count returns the number of open connections.
+func Count() int {
+	clientsMutex.Lock()
+	defer clientsMutex.Unlock()
+	return len(Clients)
+}
+
 func TestWebSocket() {
 	// This is a test function that does nothing.
 }
-func HandleWebSocket(c *gin.Context,clientMongo *mongo.Client) {
+// HandleWebSocket streams the answers of a conversation to its owner, tokens verify the session and checkOwner tells
+// whether the conversation belongs to the user.
+func HandleWebSocket(c *gin.Context, tokens *auth.Tokens, checkOwner func(conversationID, userID primitive.ObjectID) error) {
 	var token string
 	var userID string
 	chatID := c.Param("id")
 	if chatID == "" {
-		c.JSON(http.StatusBadRequest, gin.H{
-			"error": "No chat id found",
-		})
+		c.Error(apierror.Invalid("no conversation id"))
 		return // Added return statement here
 	}
 
 	// Cookie validation
 	cookie, err := c.Request.Cookie("jwt_token")
 	if err != nil {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "No cookie found"})
+		c.Error(apierror.Unauthenticated)
 		return
 	}
 	token = cookie.Value
 
 	// JWT validation
-	if _, err := auth.VerifyJWT(token); err != nil {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid token"})
+	if _, err := tokens.VerifyJWT(token); auth.IsExpired(err) {
+		c.Error(apierror.TokenExpired)
+		return
+	} else if err != nil {
+		c.Error(apierror.InvalidToken)
 		return
 	}
 	
 	
 	payload, err := auth.DecodeJWT(token)
 	if err != nil {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": err})
+		c.Error(apierror.InvalidToken)
 		return
 	}
 	userID = payload.UserID
-	collection := clientMongo.Database("chatbot-server").Collection("conversation")
-	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
-	defer cancel()
+	ctx := c.Request.Context()
+	logging.Add(ctx, "user_id", userID, "conversation_id", chatID)
 	chatIDObject, err := primitive.ObjectIDFromHex(chatID)
 	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid chat id"})
+		c.Error(apierror.Invalid("invalid conversation id"))
 		return
 	}
 	userIDObject, err := primitive.ObjectIDFromHex(userID)
 	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user id"})
+		c.Error(apierror.InvalidToken)
 		return
 	}
-
-	filter := bson.M{
-		"_id":     chatIDObject,
-		"user_id": userIDObject,
-	}
-	type ChatUser struct{
-		ID        primitive.ObjectID   `bson:"_id,omitempty" json:"id,omitempty"`
-		UserID    primitive.ObjectID   `bson:"user_id" json:"user_id"`
-	}
-	var chat ChatUser
-	err1 := collection.FindOne(ctx, filter).Decode(&chat)
-	if err1 != nil {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": err1.Error()})
+	if err := checkOwner(chatIDObject, userIDObject); err != nil {
+		c.Error(err)
 		return
 	}
 	// Upgrade connection
 	conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
 	if err != nil {
-		log.Println("Error upgrading to WebSocket:", err)
+		slog.WarnContext(ctx, "failed to upgrade to a websocket", "error", err)
 		return
 	}
 
@@ -151,26 +148,27 @@ func HandleWebSocket(c *gin.Context,clientMongo *mongo.Client) {
 		_, _, err := conn.ReadMessage()
 		if err != nil {
 			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
-				log.Printf("Unexpected close error: %v", err)
+				slog.WarnContext(ctx, "websocket closed unexpectedly", "error", err)
 			}
 			break
 		}
 	}
 }
-func BroadcastToken(userID, chatID, token string) {
+// BroadcastToken sends token to the websocket of the conversation, waiting up to wait for it to connect.
+func BroadcastToken(userID, chatID, token string, wait time.Duration) {
 	if userID == "" {
-		log.Println("No user ID provided")
+		slog.Warn("no user id to send the token to", "conversation_id", chatID)
 		return
 	}
 	if chatID == "" {
-		log.Println("No chat ID provided")
+		slog.Warn("no conversation id to send the token to", "user_id", userID)
 		return
 	}
 
 	clientID := userID + ":" + chatID
 
 	// Create a timeout channel
-	timeout := time.After(50 * time.Second) // Adjust timeout duration as needed
+	timeout := time.After(wait)
 
 	// Create a ticker for polling
 	ticker := time.NewTicker(100 * time.Millisecond) // Poll every 100ms
@@ -179,7 +177,7 @@ func BroadcastToken(userID, chatID, token string) {
 	for {
 		select {
 		case <-timeout:
-			log.Printf("Timeout waiting for client connection: %s\n", clientID)
+			slog.Warn("timed out waiting for the websocket of the conversation", "user_id", userID, "conversation_id", chatID)
 			return
 
 		case <-ticker.C:
@@ -191,7 +189,7 @@ func BroadcastToken(userID, chatID, token string) {
 			if exists {
 				err := client.conn.WriteMessage(websocket.TextMessage, []byte(token))
 				if err != nil {
-					log.Printf("Error sending message to user %s: %v\n", clientID, err)
+					slog.Warn("failed to send a token on the websocket", "user_id", userID, "conversation_id", chatID, "error", err)
 					clientsMutex.Lock()
 					delete(Clients, clientID)
 					clientsMutex.Unlock()
@@ -201,3 +199,26 @@ func BroadcastToken(userID, chatID, token string) {
 		}
 	}
 }
+
+// CloseConnections tells the clients the server is going away and closes their sockets, they are expected to reconnect.
+// With idleOnly the sockets receiving an answer are left open, so a shutdown can let their answers finish first.
+func CloseConnections(idleOnly bool) int {
+	clientsMutex.Lock()
+	var closing []*Client
+	for _, client := range Clients {
+		client.Mu.Lock()
+		sending := client.IsSending
+		client.Mu.Unlock()
+		if !idleOnly || !sending {
+			closing = append(closing, client)
+		}
+	}
+	clientsMutex.Unlock()
+	message := websocket.FormatCloseMessage(websocket.CloseGoingAway, "server is restarting")
+	for _, client := range closing {
+		// WriteControl is safe next to BroadcastToken, the read loop of HandleWebSocket then removes the client
+		client.conn.WriteControl(websocket.CloseMessage, message, time.Now().Add(time.Second))
+		client.conn.Close()
+	}
+	return len(closing)
+}